@@ -2,16 +2,49 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
+	"container/list"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"html/template"
 	"io"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode"
 )
 
 const (
@@ -22,188 +55,14910 @@ const (
 	Reset  = "\033[0m"
 )
 
+type ASN struct {
+	Number      int    `json:"asn"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	CountryCode string `json:"country_code,omitempty"`
+	// MatchedBy lists the search terms that returned this ASN when several
+	// were searched at once.
+	MatchedBy []string `json:"-"`
+	// PeeringDBOrg names the PeeringDB organization the ASN is registered
+	// under with -peeringdb; PeeringDBOnly marks ASNs bgpview did not return.
+	PeeringDBOrg  string `json:"-"`
+	PeeringDBOnly bool   `json:"-"`
+	// Whois names the WHOIS evidence an ASN was found from when the search
+	// came back empty.
+	Whois string `json:"-"`
+	// ScopePath is the chain of ASNs, from a selected one down to this one,
+	// that brought a downstream ASN into scope (-include-downstreams).
+	ScopePath  []int `json:"-"`
+	Provenance `json:"-"`
+}
+
+// scopeLabel renders ScopePath as "AS64500 > AS64510".
+func (a ASN) scopeLabel() string {
+	hops := make([]string, len(a.ScopePath))
+	for i, n := range a.ScopePath {
+		hops[i] = "AS" + strconv.Itoa(n)
+	}
+	return strings.Join(hops, " > ")
+}
+
+type Prefix struct {
+	CIDR        string `json:"prefix"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	CountryCode string `json:"country_code,omitempty"`
+	Provenance  `json:"-"`
+}
+
+// About describes the prefix by its description, or its name when it has
+// none, followed by the country code.
+func (p Prefix) About() string {
+	about := cmp.Or(strings.TrimSpace(p.Description), p.Name)
+	if p.CountryCode != "" {
+		about = strings.TrimSpace(about + " [" + p.CountryCode + "]")
+	}
+	return about
+}
+
+// Sources recorded in Provenance. Data answered from -cache-dir (or, for
+// PTRs, from the in-memory result cache) is attributed to sourceCache.
+const (
+	sourceBGPView   = "bgpview"
+	sourceRIPEstat  = "ripestat"
+	sourcePeeringDB = "peeringdb"
+	sourceWhois     = "whois"
+	sourceIRR       = "irr"
+	sourceDNS       = "dns"
+	sourceCache     = "cache"
+)
+
+// Provenance says where an ASN, prefix or finding came from and how old it
+// is. RetrievedAt is when this run got it; FetchedAt, only set for data
+// served from a cache, is when the cached copy was originally fetched.
+type Provenance struct {
+	RetrievedAt *time.Time `json:"retrieved_at,omitempty"`
+	Source      string     `json:"source,omitempty"`
+	FetchedAt   *time.Time `json:"fetched_at,omitempty"`
+}
+
+func retrievedFrom(source string) Provenance {
+	now := time.Now()
+	return Provenance{RetrievedAt: &now, Source: source}
+}
+
+// asOf is when the data was fetched from its source, nil if unknown.
+func (p Provenance) asOf() *time.Time {
+	if p.FetchedAt != nil {
+		return p.FetchedAt
+	}
+	return p.RetrievedAt
+}
+
+// fresher compares when a and b were fetched, unknown being oldest.
+func (p Provenance) fresher(o Provenance) int {
+	a, b := p.asOf(), o.asOf()
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	return a.Compare(*b)
+}
+
+// apiEnvelope is the status wrapper bgpview puts around every response. Some
+// failures (bad query, maintenance) come back as HTTP 200 with status "error".
+type apiEnvelope struct {
+	Status        string `json:"status"`
+	StatusMessage string `json:"status_message,omitempty"`
+}
+
+func (e apiEnvelope) envelopeErr() error {
+	if e.Status == "" || strings.EqualFold(e.Status, "ok") {
+		return nil
+	}
+	if e.StatusMessage != "" {
+		return fmt.Errorf("API error: %s", e.StatusMessage)
+	}
+	return fmt.Errorf("API error: status %q", e.Status)
+}
+
 type SearchResponse struct {
+	apiEnvelope
 	Data struct {
-		ASNs []struct {
-			ASN  int    `json:"asn"`
-			Name string `json:"name"`
-		} `json:"asns"`
+		ASNs []ASN `json:"asns"`
 	} `json:"data"`
 }
 
 type PrefixResponse struct {
+	apiEnvelope
+	Data struct {
+		IPv4Prefixes []Prefix `json:"ipv4_prefixes"`
+		IPv6Prefixes []Prefix `json:"ipv6_prefixes"`
+	} `json:"data"`
+}
+
+type IPResponse struct {
+	apiEnvelope
 	Data struct {
-		IPv4Prefixes []struct {
+		Prefixes []struct {
 			Prefix string `json:"prefix"`
-		} `json:"ipv4_prefixes"`
+			ASN    ASN    `json:"asn"`
+		} `json:"prefixes"`
 	} `json:"data"`
 }
 
-func getJSON(url string, target interface{}) error {
-	resp, err := http.Get(url)
+// cacheEntry is one API response kept on disk together with the validators
+// needed to revalidate it.
+type cacheEntry struct {
+	URL          string          `json:"url"`
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"last_modified,omitempty"`
+	FetchedAt    time.Time       `json:"fetched_at"`
+	Body         json.RawMessage `json:"body"`
+}
+
+// apiCache stores API responses under dir, one file per URL. Entries younger
+// than ttl are used as-is; older ones are revalidated with a conditional
+// request, so a 304 costs almost nothing against the API's rate limit. An
+// offline cache serves every entry regardless of age and never lets a
+// request through.
+type apiCache struct {
+	dir     string
+	ttl     time.Duration
+	offline bool
+}
+
+// errNotCached answers an offline request the cache has no response for.
+var errNotCached = errors.New("not in cache, run online first")
+
+func (c *apiCache) path(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *apiCache) load(url string) *cacheEntry {
+	data, err := os.ReadFile(c.path(url))
 	if err != nil {
+		return nil
+	}
+	var e cacheEntry
+	if json.Unmarshal(data, &e) != nil || e.URL != url {
+		return nil
+	}
+	return &e
+}
+
+func (c *apiCache) store(e *cacheEntry) error {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
 	}
+	return writeFileAtomic(c.path(e.URL), data)
+}
 
-	return json.NewDecoder(resp.Body).Decode(target)
+// tokenBucket paces calls to rate per second, shared by every goroutine
+// drawing from it, while allowing bursts of up to burst calls.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
 }
 
-func getASNs(orgName string) ([]map[string]interface{}, error) {
-	url := fmt.Sprintf("https://api.bgpview.io/search?query_term=%s", orgName)
-	var result SearchResponse
-	if err := getJSON(url, &result); err != nil {
-		return nil, err
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if burst < 1 {
+		burst = 1
 	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
 
-	asns := make([]map[string]interface{}, len(result.Data.ASNs))
-	for i, a := range result.Data.ASNs {
-		asns[i] = map[string]interface{}{
-			"asn":  a.ASN,
-			"name": a.Name,
-		}
+// Wait takes one token, sleeping until it is available. The token is
+// reserved up front, so concurrent callers queue up instead of all waking
+// for the same refill.
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if wait == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return asns, nil
 }
 
-func getIPRanges(asn int) ([]string, error) {
-	url := fmt.Sprintf("https://api.bgpview.io/asn/%d/prefixes", asn)
-	var result PrefixResponse
-	if err := getJSON(url, &result); err != nil {
-		return nil, err
+const defaultAPIBaseURL = "https://api.bgpview.io"
+
+// Client talks to the bgpview API. All HTTP behaviour hangs off it: the
+// http.Client (timeouts, proxy), the optional response cache and the rate
+// limiter every request passes through, however many goroutines share it.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Cache      *apiCache
+
+	limiter   *tokenBucket
+	apiKey    string
+	metrics   *metrics
+	providers []bgpProvider
+	logServed bool
+}
+
+const (
+	apiKeyEnv = "BGPVIEW_API_KEY"
+	// apiURLEnv points every command at a bgpview-compatible mirror.
+	apiURLEnv = "BGPVIEW_API_URL"
+	// keyedAPIRate is the request budget per second of a client with an API
+	// key, against 4 for anonymous ones.
+	keyedAPIRate = 20
+)
+
+// addAPIURLFlag defines -api-url and its synonym -api-base-url on fs.
+func addAPIURLFlag(fs *flag.FlagSet) *string {
+	u := fs.String("api-url", cmp.Or(os.Getenv(apiURLEnv), defaultAPIBaseURL), "base URL of the bgpview-compatible API, e.g. a mirror such as https://bgp-mirror.internal/api ($"+apiURLEnv+" sets the default)")
+	fs.StringVar(u, "api-base-url", *u, "same as -api-url")
+	return u
+}
+
+// checkAPIURL rejects a base URL that endpoints cannot be appended to.
+func checkAPIURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+		return fmt.Errorf("-api-url must be an http(s) URL without a query, got %q", raw)
 	}
+	return nil
+}
 
-	ranges := []string{}
-	for _, p := range result.Data.IPv4Prefixes {
-		ranges = append(ranges, p.Prefix)
+func NewClient() *Client {
+	return &Client{
+		BaseURL:    defaultAPIBaseURL,
+		HTTPClient: newHTTPClient(30 * time.Second),
+		limiter:    newTokenBucket(4, 1),
 	}
-	return ranges, nil
 }
 
-func reverseLookup(ip string) []string {
-	names, err := net.LookupAddr(ip)
-	if err != nil {
-		return []string{}
+// httpTransport carries every HTTP request recon makes: the data APIs,
+// webhooks and the agent's controller calls. tlsFlags.apply replaces it.
+var httpTransport http.RoundTripper = http.DefaultTransport
+
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: httpTransport}
+}
+
+// tlsFlags are the HTTPS trust and client certificate flags of every command
+// that makes HTTP requests.
+type tlsFlags struct {
+	caCert     *string
+	clientCert *string
+	clientKey  *string
+}
+
+func addTLSFlags(fs *flag.FlagSet) tlsFlags {
+	return tlsFlags{
+		caCert:     fs.String("ca-cert", "", "PEM file of CA certificates to trust for HTTPS on top of the system ones (e.g. a TLS-intercepting proxy's)"),
+		clientCert: fs.String("client-cert", "", "PEM client certificate for HTTPS connections and proxies requiring mutual TLS (with -client-key)"),
+		clientKey:  fs.String("client-key", "", "PEM private key of -client-cert"),
 	}
-	return names
 }
 
-func ipsInCIDR(cidr string) ([]string, error) {
-	ip, ipnet, err := net.ParseCIDR(cidr)
-	if err != nil {
-		return nil, err
+// apply builds httpTransport from the flags. It has to run before the first
+// client is created.
+func (f tlsFlags) apply() error {
+	if *f.caCert == "" && *f.clientCert == "" && *f.clientKey == "" {
+		return nil
+	}
+	if (*f.clientCert == "") != (*f.clientKey == "") {
+		return errors.New("-client-cert and -client-key must be given together")
+	}
+	cfg := &tls.Config{}
+	if *f.caCert != "" {
+		pem, err := os.ReadFile(*f.caCert)
+		if err != nil {
+			return err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no PEM certificate in %s", *f.caCert)
+		}
+		cfg.RootCAs = pool
 	}
+	if *f.clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(*f.clientCert, *f.clientKey)
+		if err != nil {
+			return err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	httpTransport = t
+	return nil
+}
 
-	var ips []string
-	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); incIP(ip) {
-		ipCopy := make(net.IP, len(ip))
-		copy(ipCopy, ip)
-		ips = append(ips, ipCopy.String())
+// SetAPIKey sends key with every request and raises the rate limit to the
+// keyed budget. An empty key leaves the client anonymous.
+func (c *Client) SetAPIKey(key string) {
+	if key == "" {
+		return
 	}
+	c.apiKey = key
+	c.limiter = newTokenBucket(keyedAPIRate, keyedAPIRate/4)
+}
 
-	if len(ips) > 2 {
-		ips = ips[1 : len(ips)-1]
+// redact masks the API key in err, in case the server or transport echoes it.
+// The original error stays reachable with errors.As, so a redacted HTTP 503
+// still counts as a hard failure.
+func (c *Client) redact(err error) error {
+	if err == nil || c.apiKey == "" || !strings.Contains(err.Error(), c.apiKey) {
+		return err
 	}
-	return ips, nil
+	return &redactedError{err: err, secret: c.apiKey}
 }
 
-func incIP(ip net.IP) {
-	ipv4 := ip.To4()
-	if ipv4 == nil {
-		return
+// redactedError is an error whose message had a secret in it.
+type redactedError struct {
+	err    error
+	secret string
+}
+
+func (e *redactedError) Error() string {
+	return strings.ReplaceAll(e.err.Error(), e.secret, "[redacted]")
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+func (c *Client) endpoint(format string, args ...interface{}) string {
+	base := c.BaseURL
+	if base == "" {
+		base = defaultAPIBaseURL
 	}
-	binary.BigEndian.PutUint32(ipv4, binary.BigEndian.Uint32(ipv4)+1)
+	return strings.TrimRight(base, "/") + fmt.Sprintf(format, args...)
 }
 
-func printBanner() {
-	fmt.Println(Purple + `   ______________   _
-                   / )
-    \______       (_/ \
-         \_ ) __      /        
-             (___\ \  
-            (____/  \
-             (___/   \
-s-v            ( ____/` + Reset)
-	fmt.Println()
-	fmt.Println(Green + "[+] github.com/unvalidor")
-	fmt.Println("[+] linkedin.com/in/unvalidor")
-	fmt.Println("[+] Usage : go run asn-lookup.go" + Reset)
-	fmt.Println()
+// apiEndpoint labels url by its endpoint below the base URL, so a mirror's
+// path prefix does not show up in the metrics.
+func (c *Client) apiEndpoint(url string) string {
+	return apiEndpoint(strings.TrimPrefix(url, strings.TrimRight(cmp.Or(c.BaseURL, defaultAPIBaseURL), "/")))
 }
 
-func main() {
-	printBanner()
+// fetch GETs url, sending prev's validators when there is a cached copy. A
+// 304 is reported as a nil body with notModified set.
+func (c *Client) fetch(ctx context.Context, url string, prev *cacheEntry) (body []byte, header http.Header, notModified bool, err error) {
+	defer func() { err = c.redact(err) }()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	if prev != nil {
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
+	if c.limiter != nil {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		c.metrics.APIRequest(c.apiEndpoint(url), "error")
+		return nil, nil, false, err
+	}
+	defer resp.Body.Close()
+	c.metrics.APIRequest(c.apiEndpoint(url), strconv.Itoa(resp.StatusCode))
+	
+	if resp.StatusCode == http.StatusNotModified && prev != nil {
+		return nil, resp.Header, true, nil
+	}
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, resp.Header, false, &statusError{code: resp.StatusCode, body: string(body)}
+	}
 
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Print(Blue + "Enter domain or company name: " + Reset)
-	orgName, _ := reader.ReadString('\n')
-	orgName = strings.TrimSpace(orgName)
+	body, err = io.ReadAll(resp.Body)
+	return body, resp.Header, false, err
+}
 
-	if orgName == "" {
-		fmt.Println(Red + "Error: Please enter a valid organization name." + Reset)
-		os.Exit(1)
+// statusError is a response other than 200 or a revalidated 304.
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.code, e.body)
+}
+
+// decodeBody unmarshals body into target and, for responses wrapped in an
+// apiEnvelope, turns an error status into an error. The status is checked
+// first: error responses often carry a data field of another shape.
+func decodeBody(body []byte, target interface{}) error {
+	if _, ok := target.(interface{ envelopeErr() error }); ok {
+		var env apiEnvelope
+		if err := json.Unmarshal(body, &env); err != nil {
+			return err
+		}
+		if err := env.envelopeErr(); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(body, target)
+}
+
+// getJSON fetches url into target. Error envelopes are never cached.
+func (c *Client) getJSON(ctx context.Context, url string, target interface{}) error {
+	_, err := c.getJSONFrom(ctx, "", url, target)
+	return err
+}
+
+// getJSONFrom is getJSON for data whose provenance is kept: the answer is
+// attributed to source, or to the cache when it was served without asking
+// source. A copy source revalidated with a 304 counts as just retrieved.
+func (c *Client) getJSONFrom(ctx context.Context, source, url string, target interface{}) (Provenance, error) {
+	var prev *cacheEntry
+	if c.Cache != nil {
+		if prev = c.Cache.load(url); prev != nil && (c.Cache.offline || time.Since(prev.FetchedAt) < c.Cache.ttl) {
+			fetched, prov := prev.FetchedAt, retrievedFrom(sourceCache)
+			prov.FetchedAt = &fetched
+			return prov, decodeBody(prev.Body, target)
+		}
+		if c.Cache.offline {
+			return Provenance{}, fmt.Errorf("%s: %w", url, errNotCached)
+		}
 	}
 
-	asns, err := getASNs(orgName)
+	body, header, notModified, err := c.fetch(ctx, url, prev)
 	if err != nil {
-		fmt.Println(Red+"Error fetching ASNs:", err, Reset)
-		os.Exit(1)
+		return Provenance{}, err
+	}
+	if notModified {
+		// Still current: keep the body, refresh freshness and any new validators.
+		body = prev.Body
+		if etag := header.Get("ETag"); etag != "" {
+			prev.ETag = etag
+		}
+		if lm := header.Get("Last-Modified"); lm != "" {
+			prev.LastModified = lm
+		}
+	}
+	if err := decodeBody(body, target); err != nil {
+		return Provenance{}, err
 	}
 
-	if len(asns) == 0 {
-		fmt.Printf(Red+"No ASN found for %s\n"+Reset, orgName)
-		os.Exit(0)
+	prov := retrievedFrom(source)
+	if c.Cache != nil {
+		entry := &cacheEntry{URL: url, ETag: header.Get("ETag"), LastModified: header.Get("Last-Modified"), Body: body}
+		if notModified {
+			entry = prev
+		}
+		entry.FetchedAt = *prov.RetrievedAt
+		if err := c.Cache.store(entry); err != nil {
+			fmt.Println(Red+"[!] Failed to update API cache:", err, Reset)
+		}
 	}
+	return prov, nil
+}
 
-	fmt.Printf(Green+"\n[+] Found ASNs for %s\n"+Reset, orgName)
-	for i, asn := range asns {
-		fmt.Printf(Blue+"%d."+Reset+" AS%d - %s\n", i+1, int(asn["asn"].(int)), asn["name"].(string))
+// bgpProvider answers the routing questions recon asks bgpview (searching
+// organizations, listing an ASN's prefixes, finding an address's origin)
+// from one service, in bgpview's shapes: data a service does not have is
+// left empty, never filled in differently.
+type bgpProvider struct {
+	name     string
+	search   func(ctx context.Context, query string) ([]ASN, error)
+	prefixes func(ctx context.Context, asn int) ([]Prefix, error)
+	origin   func(ctx context.Context, ip string) (*ASN, string, error)
+}
+
+func (c *Client) bgpviewProvider() bgpProvider {
+	return bgpProvider{name: "bgpview", search: c.bgpviewSearch, prefixes: c.bgpviewPrefixes, origin: c.bgpviewOrigin}
+}
+
+func (c *Client) ripestatProvider() bgpProvider {
+	return bgpProvider{name: "ripestat", search: c.RIPEstatSearchASNs, prefixes: c.RIPEstatPrefixes, origin: c.RIPEstatIPOrigin}
+}
+
+// SetProviders makes SearchASNs, ASNPrefixes and IPOrigin ask providers in
+// order, moving to the next when one fails hard. Without providers the
+// client asks bgpview at BaseURL directly. With logServed, every answer is
+// logged with the provider it came from.
+func (c *Client) SetProviders(logServed bool, providers ...bgpProvider) {
+	c.providers, c.logServed = providers, logServed
+}
+
+// hardFailure tells whether the next provider could answer where this one
+// failed: a timeout, a dropped connection, a server error or rate limiting.
+// A client error such as 404 is an answer the next one would only repeat.
+func hardFailure(err error) bool {
+	var status *statusError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return false
+	case errors.As(err, &status):
+		return status.code >= 500 || status.code == http.StatusTooManyRequests
 	}
+	return true
+}
 
-	fmt.Print(Purple + "\nSelect ASN number: " + Reset)
-	var choiceStr string
-	fmt.Scanln(&choiceStr)
-	choice, err := strconv.Atoi(choiceStr)
-	if err != nil || choice < 1 || choice > len(asns) {
-		fmt.Println(Red + "Invalid selection." + Reset)
-		os.Exit(1)
+// failover runs try against the providers until one answers, and records
+// which one served what (a piece of data, e.g. "AS64500 prefixes") in the
+// manifest.
+func (c *Client) failover(what string, try func(p bgpProvider) error) error {
+	if len(c.providers) == 0 {
+		return try(c.bgpviewProvider())
+	}
+	var failed []string
+	for i, p := range c.providers {
+		err := try(p)
+		if err != nil && i < len(c.providers)-1 && hardFailure(err) {
+			failed = append(failed, fmt.Sprintf("%s (%v)", p.name, err))
+			continue
+		}
+		switch {
+		case errors.Is(err, errNotCached):
+			// Offline, every provider missed in the cache.
+			return fmt.Errorf("%s: %w", what, errNotCached)
+		case err != nil && len(failed) > 0:
+			return fmt.Errorf("%w, after %s failed", err, strings.Join(failed, ", "))
+		case err != nil:
+			return err
+		}
+		switch {
+		case len(failed) > 0:
+			fmt.Printf(Purple+"[~] %s served by %s, %s failed\n"+Reset, what, p.name, strings.Join(failed, ", "))
+		case c.logServed:
+			fmt.Printf("[-] %s served by %s\n", what, p.name)
+		}
+		updateManifest(func(m *Manifest) {
+			if m.ServedBy == nil {
+				m.ServedBy = map[string]string{}
+			}
+			m.ServedBy[what] = p.name
+		})
+		return nil
 	}
+	return nil
+}
+
+func (c *Client) SearchASNs(ctx context.Context, query string) (asns []ASN, err error) {
+	err = c.failover(fmt.Sprintf("search %q", query), func(p bgpProvider) (err error) {
+		asns, err = p.search(ctx, query)
+		return err
+	})
+	return asns, err
+}
+
+func (c *Client) ASNPrefixes(ctx context.Context, asn int) (prefixes []Prefix, err error) {
+	err = c.failover(fmt.Sprintf("AS%d prefixes", asn), func(p bgpProvider) (err error) {
+		prefixes, err = p.prefixes(ctx, asn)
+		return err
+	})
+	return prefixes, err
+}
+
+// IPOrigin returns the ASN announcing the most specific prefix that covers
+// ip, with that prefix. asn is nil if nothing covering ip is announced.
+func (c *Client) IPOrigin(ctx context.Context, ip string) (asn *ASN, prefix string, err error) {
+	err = c.failover("origin of "+ip, func(p bgpProvider) (err error) {
+		asn, prefix, err = p.origin(ctx, ip)
+		return err
+	})
+	return asn, prefix, err
+}
 
-	selectedASN := int(asns[choice-1]["asn"].(int))
-	ipRanges, err := getIPRanges(selectedASN)
+func (c *Client) bgpviewSearch(ctx context.Context, query string) ([]ASN, error) {
+	var result SearchResponse
+	prov, err := c.getJSONFrom(ctx, sourceBGPView, c.endpoint("/search?query_term=%s", url.QueryEscape(query)), &result)
 	if err != nil {
-		fmt.Println(Red+"Error fetching IP ranges:", err, Reset)
-		os.Exit(1)
+		return nil, err
 	}
+	for i := range result.Data.ASNs {
+		result.Data.ASNs[i].Provenance = prov
+	}
+	return result.Data.ASNs, nil
+}
 
-	fmt.Printf(Green+"\n[+] IP ranges for ASN %d:\n"+Reset, selectedASN)
-	for _, ip := range ipRanges {
-		fmt.Println(ip)
+// ASNDownstreams lists the ASNs bgpview sees behind asn, over IPv4 or IPv6.
+func (c *Client) ASNDownstreams(ctx context.Context, asn int) ([]ASN, error) {
+	var result struct {
+		apiEnvelope
+		Data struct {
+			IPv4 []ASN `json:"ipv4_downstreams"`
+			IPv6 []ASN `json:"ipv6_downstreams"`
+		} `json:"data"`
+	}
+	if err := c.getJSON(ctx, c.endpoint("/asn/%d/downstreams", asn), &result); err != nil {
+		return nil, err
+	}
+	seen := map[int]bool{}
+	var asns []ASN
+	for _, a := range append(result.Data.IPv4, result.Data.IPv6...) {
+		if !seen[a.Number] {
+			seen[a.Number] = true
+			asns = append(asns, a)
+		}
 	}
+	return asns, nil
+}
 
-	fmt.Printf(Purple+"\n[~] Starting reverse DNS lookups for all IPs in found ranges...\n"+Reset)
-	time.Sleep(1 * time.Second)
+func (c *Client) bgpviewPrefixes(ctx context.Context, asn int) ([]Prefix, error) {
+	var result PrefixResponse
+	prov, err := c.getJSONFrom(ctx, sourceBGPView, c.endpoint("/asn/%d/prefixes", asn), &result)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := append(result.Data.IPv4Prefixes, result.Data.IPv6Prefixes...)
+	for i := range prefixes {
+		prefixes[i].Provenance = prov
+	}
+	return prefixes, nil
+}
 
-	for _, prefix := range ipRanges {
-		allIPs, err := ipsInCIDR(prefix)
+func (c *Client) bgpviewOrigin(ctx context.Context, ip string) (asn *ASN, prefix string, err error) {
+	var result IPResponse
+	prov, err := c.getJSONFrom(ctx, sourceBGPView, c.endpoint("/ip/%s", ip), &result)
+	if err != nil {
+		return nil, "", err
+	}
+	bits := -1
+	for _, p := range result.Data.Prefixes {
+		_, n, err := net.ParseCIDR(p.Prefix)
 		if err != nil {
-			fmt.Println(Red+"[!] Failed to parse CIDR:", prefix, err, Reset)
 			continue
 		}
+		if ones, _ := n.Mask.Size(); ones > bits {
+			bits, prefix = ones, p.Prefix
+			asn = &p.ASN
+			asn.Provenance = prov
+		}
+	}
+	return asn, prefix, nil
+}
+
+const defaultRIPEstatURL = "https://stat.ripe.net"
+
+// newRIPEstatClient returns a Client for the RIPEstat data API (or another
+// service at baseURL), with the bgpview client's timeout and cache. It has a
+// rate limiter of its own, since the limits are per service.
+func newRIPEstatClient(api *Client, baseURL string) *Client {
+	c := NewClient()
+	c.BaseURL, c.HTTPClient.Timeout, c.Cache = baseURL, api.HTTPClient.Timeout, api.Cache
+	return c
+}
+
+const defaultPeeringDBURL = "https://www.peeringdb.com"
+
+type PeeringDBOrg struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Country string `json:"country"`
+}
+
+type PeeringDBNet struct {
+	ASN        int    `json:"asn"`
+	Name       string `json:"name"`
+	IXCount    int    `json:"ix_count"`
+	FacCount   int    `json:"fac_count"`
+	Provenance `json:"-"`
+}
+
+// PeeringDBOrgs searches PeeringDB's public API for organizations whose name
+// contains name.
+func (c *Client) PeeringDBOrgs(ctx context.Context, name string) ([]PeeringDBOrg, error) {
+	var result struct {
+		Data []PeeringDBOrg `json:"data"`
+	}
+	if err := c.getJSON(ctx, c.endpoint("/api/org?name__contains=%s", url.QueryEscape(name)), &result); err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
+
+// PeeringDBNets lists the networks, one per ASN, of a PeeringDB organization.
+func (c *Client) PeeringDBNets(ctx context.Context, orgID int) ([]PeeringDBNet, error) {
+	var result struct {
+		Data []PeeringDBNet `json:"data"`
+	}
+	prov, err := c.getJSONFrom(ctx, sourcePeeringDB, c.endpoint("/api/net?org_id=%d", orgID), &result)
+	if err != nil {
+		return nil, err
+	}
+	for i := range result.Data {
+		result.Data[i].Provenance = prov
+	}
+	return result.Data, nil
+}
+
+const defaultRDAPURL = "https://rdap.org"
 
-		fmt.Printf(Green+"\n[+] Scanning %d IPs in %s\n"+Reset, len(allIPs), prefix)
+// RDAPNetwork is the registry record of the network holding an address.
+type RDAPNetwork struct {
+	Name    string
+	Org     string
+	Country string
+}
 
-		for _, ip := range allIPs {
-			domains := reverseLookup(ip)
-			if len(domains) > 0 {
-				fmt.Printf(Blue+"[+] %s -> %s\n"+Reset, ip, strings.Join(domains, ", "))
+// RDAPLookup fetches the registry record of the network holding the first
+// address of prefix from an RDAP service such as rdap.org, which redirects
+// to the responsible registry. Org is the registrant's vCard name.
+func (c *Client) RDAPLookup(ctx context.Context, prefix string) (*RDAPNetwork, error) {
+	ip, _, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Name     string `json:"name"`
+		Country  string `json:"country"`
+		Entities []struct {
+			Roles []string          `json:"roles"`
+			VCard []json.RawMessage `json:"vcardArray"`
+		} `json:"entities"`
+	}
+	if err := c.getJSON(ctx, c.endpoint("/ip/%s", ip), &result); err != nil {
+		return nil, err
+	}
+	network := &RDAPNetwork{Name: result.Name, Country: strings.ToUpper(result.Country)}
+	for _, e := range result.Entities {
+		registrant := false
+		for _, role := range e.Roles {
+			registrant = registrant || role == "registrant"
+		}
+		if !registrant || len(e.VCard) < 2 {
+			continue
+		}
+		// vcardArray is ["vcard", [[name, params, type, value], ...]].
+		var props [][]interface{}
+		if json.Unmarshal(e.VCard[1], &props) != nil {
+			continue
+		}
+		for _, prop := range props {
+			if len(prop) == 4 && prop[0] == "fn" {
+				network.Org, _ = prop[3].(string)
 			}
-			time.Sleep(100 * time.Millisecond) 
 		}
+		if network.Org != "" {
+			break
+		}
+	}
+	return network, nil
+}
+
+// RDAPCountry returns the registered country of the network holding the
+// first address of prefix.
+func (c *Client) RDAPCountry(ctx context.Context, prefix string) (string, error) {
+	network, err := c.RDAPLookup(ctx, prefix)
+	if err != nil {
+		return "", err
+	}
+	return network.Country, nil
+}
+
+const (
+	ownershipMatch    = "match"
+	ownershipMismatch = "mismatch"
+	ownershipUnknown  = "unknown"
+)
+
+// Ownership compares the registry holder of a prefix with the organization
+// of the ASN announcing it.
+type Ownership struct {
+	Netname string `json:"netname,omitempty"`
+	Org     string `json:"org,omitempty"`
+	Status  string `json:"status"`
+}
+
+func (o *Ownership) String() string {
+	holder := o.Netname
+	if o.Org != "" {
+		holder = strings.TrimPrefix(holder+" / "+o.Org, " / ")
+	}
+	if holder == "" {
+		holder = "no registry data"
+	}
+	return holder + " (" + o.Status + ")"
+}
+
+// sameOrg reports whether the registry names and the expected organization
+// names share a token, counting one token containing the other (ACMENET
+// and Acme). It errs towards a match: only registry data with nothing in
+// common with the announcing organization is flagged.
+func sameOrg(registry, expected []string) bool {
+	for _, r := range registry {
+		for _, rt := range orgTokens(r) {
+			for _, e := range expected {
+				for _, et := range orgTokens(e) {
+					if strings.Contains(rt, et) || strings.Contains(et, rt) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+const (
+	rpkiValid   = "valid"
+	rpkiInvalid = "invalid"
+	rpkiUnknown = "unknown"
+)
+
+// RIPEstatSearchASNs searches ASNs with RIPEstat's searchcomplete.
+func (c *Client) RIPEstatSearchASNs(ctx context.Context, query string) ([]ASN, error) {
+	var result struct {
+		Data struct {
+			Categories []struct {
+				Category    string `json:"category"`
+				Suggestions []struct {
+					Value       string `json:"value"`
+					Label       string `json:"label"`
+					Description string `json:"description"`
+				} `json:"suggestions"`
+			} `json:"categories"`
+		} `json:"data"`
+	}
+	prov, err := c.getJSONFrom(ctx, sourceRIPEstat, c.endpoint("/data/searchcomplete/data.json?resource=%s", url.QueryEscape(query)), &result)
+	if err != nil {
+		return nil, err
+	}
+	var asns []ASN
+	for _, cat := range result.Data.Categories {
+		if cat.Category != "ASNs" {
+			continue
+		}
+		for _, s := range cat.Suggestions {
+			n, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(s.Value), "AS"))
+			if err != nil {
+				continue
+			}
+			asn := ripestatHolder(n, cmp.Or(s.Description, s.Label))
+			asn.Provenance = prov
+			asns = append(asns, asn)
+		}
+	}
+	return asns, nil
+}
+
+// RIPEstatPrefixes lists the prefixes asn announces, per RIPEstat's
+// announced-prefixes, IPv4 first as bgpview does. RIPEstat has no names or
+// descriptions for them.
+func (c *Client) RIPEstatPrefixes(ctx context.Context, asn int) ([]Prefix, error) {
+	var result struct {
+		Data struct {
+			Prefixes []struct {
+				Prefix string `json:"prefix"`
+			} `json:"prefixes"`
+		} `json:"data"`
+	}
+	prov, err := c.getJSONFrom(ctx, sourceRIPEstat, c.endpoint("/data/announced-prefixes/data.json?resource=AS%d", asn), &result)
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 []Prefix
+	for _, p := range result.Data.Prefixes {
+		if prefixFamily(p.Prefix) == "ipv6" {
+			v6 = append(v6, Prefix{CIDR: p.Prefix, Provenance: prov})
+		} else {
+			v4 = append(v4, Prefix{CIDR: p.Prefix, Provenance: prov})
+		}
+	}
+	return append(v4, v6...), nil
+}
+
+// RIPEstatIPOrigin is IPOrigin answered by RIPEstat's prefix-overview,
+// which reports the most specific covering prefix.
+func (c *Client) RIPEstatIPOrigin(ctx context.Context, ip string) (*ASN, string, error) {
+	var result struct {
+		Data struct {
+			Resource  string `json:"resource"`
+			Announced bool   `json:"announced"`
+			ASNs      []struct {
+				ASN    int    `json:"asn"`
+				Holder string `json:"holder"`
+			} `json:"asns"`
+		} `json:"data"`
+	}
+	prov, err := c.getJSONFrom(ctx, sourceRIPEstat, c.endpoint("/data/prefix-overview/data.json?resource=%s", url.QueryEscape(ip)), &result)
+	if err != nil {
+		return nil, "", err
+	}
+	if !result.Data.Announced || len(result.Data.ASNs) == 0 {
+		return nil, "", nil
+	}
+	asn := ripestatHolder(result.Data.ASNs[0].ASN, result.Data.ASNs[0].Holder)
+	asn.Provenance = prov
+	return &asn, result.Data.Resource, nil
+}
+
+// ripestatHolder turns a RIPEstat holder string, "EXAMPLE-AS - Example
+// Networks Ltd" or "AS64500 (EXAMPLE-AS - ...)" in search suggestions, into
+// the name and description bgpview would list.
+func ripestatHolder(n int, holder string) ASN {
+	holder = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(holder), fmt.Sprintf("AS%d", n)))
+	if strings.HasPrefix(holder, "(") && strings.HasSuffix(holder, ")") {
+		holder = holder[1 : len(holder)-1]
+	}
+	name, desc, _ := strings.Cut(holder, " - ")
+	return ASN{Number: n, Name: strings.TrimSpace(name), Description: strings.TrimSpace(desc)}
+}
+
+// RIPEstatRPKI validates the origin asn of prefix with RIPEstat's
+// rpki-validation endpoint. invalid_asn and invalid_length count as invalid.
+func (c *Client) RIPEstatRPKI(ctx context.Context, asn int, prefix string) (string, error) {
+	var result struct {
+		Data struct {
+			Status string `json:"status"`
+		} `json:"data"`
+	}
+	if err := c.getJSON(ctx, c.endpoint("/data/rpki-validation/data.json?resource=AS%d&prefix=%s", asn, url.QueryEscape(prefix)), &result); err != nil {
+		return "", err
+	}
+	switch status := strings.ToLower(result.Data.Status); {
+	case status == rpkiValid:
+		return rpkiValid, nil
+	case strings.HasPrefix(status, rpkiInvalid):
+		return rpkiInvalid, nil
+	case status == rpkiUnknown || status == "not-found":
+		return rpkiUnknown, nil
+	default:
+		return "", fmt.Errorf("unexpected RPKI status %q", result.Data.Status)
+	}
+}
+
+// RoutinatorRPKI validates the origin asn of prefix with a Routinator (or
+// compatible) HTTP API at the client's base URL.
+func (c *Client) RoutinatorRPKI(ctx context.Context, asn int, prefix string) (string, error) {
+	var result struct {
+		ValidatedRoute struct {
+			Validity struct {
+				State string `json:"state"`
+			} `json:"validity"`
+		} `json:"validated_route"`
+	}
+	if err := c.getJSON(ctx, c.endpoint("/api/v1/validity/AS%d/%s", asn, prefix), &result); err != nil {
+		return "", err
+	}
+	switch state := result.ValidatedRoute.Validity.State; state {
+	case rpkiValid, rpkiInvalid:
+		return state, nil
+	case "not-found":
+		return rpkiUnknown, nil
+	default:
+		return "", fmt.Errorf("unexpected RPKI state %q", state)
+	}
+}
+
+// Visibility summarizes how RIPE RIS route collectors currently see a prefix.
+type Visibility struct {
+	SeenBy     int   `json:"seen_by"`
+	TotalPeers int   `json:"total_peers,omitempty"`
+	Collectors int   `json:"collectors"`
+	PeerASNs   []int `json:"peer_asns,omitempty"`
+}
+
+func (v *Visibility) String() string {
+	if v.TotalPeers > 0 {
+		return fmt.Sprintf("seen by %d/%d peers", v.SeenBy, v.TotalPeers)
+	}
+	return fmt.Sprintf("seen by %d peers", v.SeenBy)
+}
+
+// LookingGlass asks RIPEstat's looking-glass which RIS collectors and peers
+// currently carry a route for prefix. The number of peers a prefix could be
+// seen by comes from routing-status and is left out if that call fails.
+func (c *Client) LookingGlass(ctx context.Context, prefix string) (*Visibility, error) {
+	var lg struct {
+		Data struct {
+			RRCs []struct {
+				Peers []struct {
+					Peer   string `json:"peer"`
+					ASPath string `json:"as_path"`
+				} `json:"peers"`
+			} `json:"rrcs"`
+		} `json:"data"`
+	}
+	if err := c.getJSON(ctx, c.endpoint("/data/looking-glass/data.json?resource=%s", url.QueryEscape(prefix)), &lg); err != nil {
+		return nil, err
+	}
+	v := &Visibility{}
+	peers, asns := map[string]bool{}, map[int]bool{}
+	for _, rrc := range lg.Data.RRCs {
+		if len(rrc.Peers) > 0 {
+			v.Collectors++
+		}
+		for _, peer := range rrc.Peers {
+			peers[peer.Peer] = true
+			if hops := strings.Fields(peer.ASPath); len(hops) > 0 {
+				if n, err := strconv.Atoi(hops[0]); err == nil && !asns[n] {
+					asns[n] = true
+					v.PeerASNs = append(v.PeerASNs, n)
+				}
+			}
+		}
+	}
+	v.SeenBy = len(peers)
+	sort.Ints(v.PeerASNs)
+
+	var status struct {
+		Data struct {
+			Visibility struct {
+				V4 struct {
+					Total int `json:"total_ris_peers"`
+				} `json:"v4"`
+				V6 struct {
+					Total int `json:"total_ris_peers"`
+				} `json:"v6"`
+			} `json:"visibility"`
+		} `json:"data"`
+	}
+	if err := c.getJSON(ctx, c.endpoint("/data/routing-status/data.json?resource=%s", url.QueryEscape(prefix)), &status); err == nil {
+		v.TotalPeers = status.Data.Visibility.V4.Total
+		if strings.Contains(prefix, ":") {
+			v.TotalPeers = status.Data.Visibility.V6.Total
+		}
+	}
+	return v, nil
+}
+
+// History is a prefix's announcement history: when its current origin
+// started announcing it and which origins announced it before.
+type History struct {
+	FirstSeen       string `json:"first_seen,omitempty"`
+	PreviousOrigins []int  `json:"previous_origins,omitempty"`
+}
+
+func (h *History) String() string {
+	s := "since " + h.FirstSeen
+	if h.FirstSeen == "" {
+		s = "not seen"
+	}
+	if len(h.PreviousOrigins) > 0 {
+		prev := make([]string, len(h.PreviousOrigins))
+		for i, n := range h.PreviousOrigins {
+			prev[i] = fmt.Sprintf("AS%d", n)
+		}
+		s += ", before " + strings.Join(prev, ", ")
+	}
+	return s
+}
+
+// RoutingHistory asks RIPEstat's routing-history when origin first announced
+// prefix and which other origins announced it earlier, most recent first.
+// With origin 0 the latest origin seen is taken as the current one.
+func (c *Client) RoutingHistory(ctx context.Context, prefix string, origin int) (*History, error) {
+	var result struct {
+		Data struct {
+			ByOrigin []struct {
+				Origin   string `json:"origin"`
+				Prefixes []struct {
+					Prefix    string `json:"prefix"`
+					Timelines []struct {
+						Start string `json:"starttime"`
+						End   string `json:"endtime"`
+					} `json:"timelines"`
+				} `json:"prefixes"`
+			} `json:"by_origin"`
+		} `json:"data"`
+	}
+	if err := c.getJSON(ctx, c.endpoint("/data/routing-history/data.json?resource=%s", url.QueryEscape(prefix)), &result); err != nil {
+		return nil, err
+	}
+
+	// The times are RFC 3339 without a zone, so they sort as strings.
+	type span struct{ first, last string }
+	spans := map[int]*span{}
+	for _, o := range result.Data.ByOrigin {
+		n, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(o.Origin), "AS"))
+		if err != nil {
+			continue
+		}
+		for _, p := range o.Prefixes {
+			if p.Prefix != prefix {
+				continue
+			}
+			for _, t := range p.Timelines {
+				sp := spans[n]
+				if sp == nil {
+					sp = &span{first: t.Start, last: t.End}
+					spans[n] = sp
+				}
+				if t.Start < sp.first {
+					sp.first = t.Start
+				}
+				if t.End > sp.last {
+					sp.last = t.End
+				}
+			}
+		}
+	}
+	if origin == 0 {
+		for n, sp := range spans {
+			if origin == 0 || sp.last > spans[origin].last {
+				origin = n
+			}
+		}
+	}
+	h := &History{}
+	current := spans[origin]
+	if current == nil {
+		return h, nil
+	}
+	h.FirstSeen, _, _ = strings.Cut(current.first, "T")
+	for n, sp := range spans {
+		if n != origin && sp.first < current.first {
+			h.PreviousOrigins = append(h.PreviousOrigins, n)
+		}
+	}
+	sort.Slice(h.PreviousOrigins, func(i, j int) bool {
+		return spans[h.PreviousOrigins[i]].last > spans[h.PreviousOrigins[j]].last
+	})
+	return h, nil
+}
+
+// AbuseContacts asks RIPEstat's abuse-contact-finder for the abuse mailboxes
+// registered for resource (an ASN such as AS64500, a prefix or an address).
+func (c *Client) AbuseContacts(ctx context.Context, resource string) ([]string, error) {
+	var result struct {
+		Data struct {
+			AbuseContacts []string `json:"abuse_contacts"`
+		} `json:"data"`
+	}
+	if err := c.getJSON(ctx, c.endpoint("/data/abuse-contact-finder/data.json?resource=%s", url.QueryEscape(resource)), &result); err != nil {
+		return nil, err
+	}
+	return result.Data.AbuseContacts, nil
+}
+
+type LookupStatus int
+
+const (
+	StatusFound LookupStatus = iota
+	StatusNXDomain
+	StatusTimeout
+	StatusServFail
+	StatusError
+)
+
+var statusNames = [...]string{"found", "nxdomain", "timeout", "servfail", "error"}
+
+func (s LookupStatus) String() string {
+	return statusNames[s]
+}
+
+type LookupResult struct {
+	IP      string
+	Names   []string
+	Status  LookupStatus
+	Err     error
+	Geo     GeoInfo
+	Retried bool
+	// Confidence is set when findings are scored (-score / -min-confidence).
+	Confidence *int
+	// Answer is set by lookupers that read the DNS response themselves
+	// (-dns-mode raw and pipelined); net.Resolver does not expose it.
+	Answer   *PTRAnswer
+	Category string
+	Provenance
+}
+
+// PTRAnswer is what the PTR response said beyond the names, which keep the
+// order of the answer section.
+type PTRAnswer struct {
+	// TTL is the lowest TTL among the PTR records.
+	TTL           uint32
+	Rcode         int
+	Authoritative bool
+	Server        string
+}
+
+// ptrQuerier is a PTRLookuper that builds and parses its own DNS messages.
+// lookupWith prefers it, so its results carry a PTRAnswer.
+type ptrQuerier interface {
+	QueryPTR(ctx context.Context, ip string) LookupResult
+}
+
+// PTRLookuper resolves the PTR names of an address. *net.Resolver satisfies
+// it, as do the pipelined resolver and the in-memory staticPTR, so the scan
+// loop never cares where answers come from.
+type PTRLookuper interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// staticPTR answers from a fixed table; addresses missing from it are
+// NXDOMAIN. Handy for tests and for records obtained in bulk.
+type staticPTR map[string][]string
+
+func (t staticPTR) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	if names, ok := t[addr]; ok && len(names) > 0 {
+		return names, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func reverseLookup(ctx context.Context, ip string) LookupResult {
+	return lookupWith(ctx, net.DefaultResolver, ip)
+}
+
+func lookupWith(ctx context.Context, r PTRLookuper, ip string) LookupResult {
+	var res LookupResult
+	if q, ok := r.(ptrQuerier); ok {
+		res = q.QueryPTR(ctx, ip)
+	} else {
+		names, err := r.LookupAddr(ctx, ip)
+		res = LookupResult{IP: ip, Names: names, Status: classifyLookup(names, err), Err: err}
+	}
+	res.Provenance = retrievedFrom(sourceDNS)
+	return res
+}
+
+// failedLookup is the result for a query that got no DNS response at all.
+func failedLookup(ip string, err error) LookupResult {
+	return LookupResult{IP: ip, Status: classifyLookup(nil, err), Err: err}
+}
+
+// resolverAddress appends the default DNS port to a bare resolver host.
+func resolverAddress(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+}
+
+// DNS transports for -dns-transport. With auto, queries go over UDP and
+// are retried over TCP when the answer is truncated.
+const (
+	transportAuto = "auto"
+	transportUDP  = "udp"
+	transportTCP  = "tcp"
+)
+
+// truncations counts UDP answers that came back truncated. The Go resolver
+// only dials TCP to retry those, which is how they are noticed; the raw
+// resolver counts its own.
+var truncations atomic.Int64
+
+// customResolver returns a stub resolver that sends every query to addr
+// instead of the servers in /etc/resolv.conf (or to those if addr is empty),
+// over the given transport. The Go resolver never accepts a truncated
+// answer, so over udp such a lookup fails; PTR lookups over udp take the
+// raw path instead (newLookuper), which keeps what the answer holds.
+func customResolver(addr, transport string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, server string) (net.Conn, error) {
+			if network == "tcp" && transport == transportAuto {
+				truncations.Add(1)
+			}
+			switch transport {
+			case transportUDP:
+				// The retry of a truncated answer goes over UDP too, and
+				// fails when the answer is truncated again.
+				network = "udp"
+			case transportTCP:
+				network = "tcp"
+			}
+			return dnsDial(ctx, network, cmp.Or(addr, server), 0)
+		},
+	}
+}
+
+// newLookuper builds the PTR lookup path -dns-mode selects for addr, along
+// with the stub resolver for forward lookups. Standard lookups over udp use
+// the raw path, the only one that can keep a truncated answer. When the
+// pipelined connections cannot be opened, lookups fall back to the stub
+// resolver and the error is returned with it.
+func newLookuper(addr, mode, transport string, ednsSize, conns int) (PTRLookuper, *net.Resolver, error) {
+	r := customResolver(addr, transport)
+	if mode == "standard" && transport == transportUDP && addr != "" {
+		mode = "raw"
+	}
+	switch mode {
+	case "raw":
+		return &rawResolver{addr: addr, transport: transport, ednsSize: uint16(ednsSize), timeout: 5 * time.Second}, r, nil
+	case "pipelined":
+		p, err := newPipelinedResolver(addr, conns, r)
+		if err != nil {
+			return r, r, err
+		}
+		return p, r, nil
+	}
+	return r, r, nil
+}
+
+// dnsDial opens every connection to a DNS server: the stub resolver's, the
+// raw and pipelined lookup paths' and the zone checks'. -dns-proxy replaces
+// it with socksProxy.Dial.
+var dnsDial = func(ctx context.Context, network, addr string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	return d.DialContext(ctx, network, addr)
+}
+
+// socksTimeout bounds the SOCKS5 handshake when the caller sets no timeout.
+const socksTimeout = 10 * time.Second
+
+// SOCKS5 commands (RFC 1928).
+const (
+	socksConnect   = 1
+	socksAssociate = 3
+)
+
+// socksProxy reaches DNS servers through a SOCKS5 proxy (RFC 1928), with
+// username/password authentication (RFC 1929) when the URL has credentials.
+// TCP goes through CONNECT and UDP through UDP ASSOCIATE, unless the proxy
+// refused that and tcpOnly is set.
+type socksProxy struct {
+	addr     string
+	user     string
+	password string
+	tcpOnly  bool
+}
+
+// socksReplyError is a request the proxy answered with a failure code.
+type socksReplyError byte
+
+func (e socksReplyError) Error() string {
+	reasons := []string{1: "general failure", 2: "not allowed by ruleset", 3: "network unreachable", 4: "host unreachable",
+		5: "connection refused", 6: "TTL expired", 7: "command not supported", 8: "address type not supported"}
+	if int(e) < len(reasons) {
+		return reasons[e]
+	}
+	return fmt.Sprintf("reply code %d", byte(e))
+}
+
+func parseSOCKSProxy(raw string) (*socksProxy, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "socks5" || u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("want socks5://[user:password@]host:port, got %q", raw)
+	}
+	p := &socksProxy{addr: u.Host}
+	if u.User != nil {
+		p.user = u.User.Username()
+		p.password, _ = u.User.Password()
+		if len(p.user) == 0 || len(p.user) > 255 || len(p.password) > 255 {
+			return nil, errors.New("SOCKS5 username and password must be 1-255 and 0-255 bytes")
+		}
+	}
+	return p, nil
+}
+
+func (p *socksProxy) Dial(ctx context.Context, network, addr string, timeout time.Duration) (net.Conn, error) {
+	if strings.HasPrefix(network, "tcp") {
+		conn, _, err := p.open(ctx, socksConnect, addr, timeout)
+		return conn, err
+	}
+	if p.tcpOnly {
+		return nil, fmt.Errorf("SOCKS5 proxy %s does not relay UDP", p.addr)
+	}
+	return p.associate(ctx, addr, timeout)
+}
+
+// open connects to the proxy, authenticates and sends cmd for addr. It
+// returns the connection and the address the proxy bound for the request.
+func (p *socksProxy) open(ctx context.Context, cmd byte, addr string, timeout time.Duration) (net.Conn, string, error) {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, "", err
+	}
+	deadline := time.Now().Add(cmp.Or(timeout, socksTimeout))
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	conn.SetDeadline(deadline)
+	bound, err := p.handshake(conn, cmd, addr)
+	if err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("SOCKS5 proxy %s: %w", p.addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, bound, nil
+}
+
+func (p *socksProxy) handshake(conn net.Conn, cmd byte, addr string) (string, error) {
+	method := byte(0)
+	if p.user != "" {
+		method = 2
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return "", err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return "", err
+	}
+	if reply[0] != 5 || reply[1] != method {
+		return "", errors.New("no acceptable authentication method")
+	}
+	if method == 2 {
+		auth := append([]byte{1, byte(len(p.user))}, p.user...)
+		auth = append(append(auth, byte(len(p.password))), p.password...)
+		if _, err := conn.Write(auth); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return "", err
+		}
+		if reply[1] != 0 {
+			return "", errors.New("authentication failed")
+		}
+	}
+
+	dst, err := socksAddr(addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(append([]byte{5, cmd, 0}, dst...)); err != nil {
+		return "", err
+	}
+	var hdr [3]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != 5 {
+		return "", errors.New("malformed reply")
+	}
+	if hdr[1] != 0 {
+		return "", socksReplyError(hdr[1])
+	}
+	return readSocksAddr(conn)
+}
+
+// associate opens a UDP ASSOCIATE session for datagrams to addr.
+func (p *socksProxy) associate(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	dst, err := socksAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctrl, relay, err := p.open(ctx, socksAssociate, "0.0.0.0:0", timeout)
+	if err != nil {
+		return nil, err
+	}
+	// Proxies commonly answer 0.0.0.0 for "the address you reached me at".
+	host, port, _ := net.SplitHostPort(relay)
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		proxyHost, _, _ := net.SplitHostPort(p.addr)
+		relay = net.JoinHostPort(proxyHost, port)
+	}
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "udp", relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	return &socksUDPConn{UDPConn: conn.(*net.UDPConn), ctrl: ctrl, header: append([]byte{0, 0, 0}, dst...)}, nil
+}
+
+// probeUDP tells whether the proxy grants UDP ASSOCIATE. Only a refusal
+// counts as no; failing to reach the proxy is returned as an error.
+func (p *socksProxy) probeUDP(ctx context.Context) (bool, error) {
+	conn, _, err := p.open(ctx, socksAssociate, "0.0.0.0:0", socksTimeout)
+	var refused socksReplyError
+	switch {
+	case errors.As(err, &refused):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	conn.Close()
+	return true, nil
+}
+
+// socksAddr encodes host:port as a SOCKS5 address (ATYP, address, port).
+func socksAddr(hostport string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", hostport)
+	}
+	var b []byte
+	switch ip := net.ParseIP(host); {
+	case ip.To4() != nil:
+		b = append([]byte{1}, ip.To4()...)
+	case ip != nil:
+		b = append([]byte{4}, ip.To16()...)
+	case len(host) > 255:
+		return nil, fmt.Errorf("host name too long: %s", host)
+	default:
+		b = append([]byte{3, byte(len(host))}, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// parseSocksAddr decodes the SOCKS5 address at the start of b and returns
+// it with its encoded length.
+func parseSocksAddr(b []byte) (string, int, error) {
+	if len(b) < 2 {
+		return "", 0, errors.New("short address")
+	}
+	var host string
+	n := 1
+	switch b[0] {
+	case 1:
+		n += net.IPv4len
+	case 4:
+		n += net.IPv6len
+	case 3:
+		n += 1 + int(b[1])
+	default:
+		return "", 0, fmt.Errorf("unknown address type %d", b[0])
+	}
+	if len(b) < n+2 {
+		return "", 0, errors.New("short address")
+	}
+	if b[0] == 3 {
+		host = string(b[2:n])
+	} else {
+		host = net.IP(b[1:n]).String()
+	}
+	port := binary.BigEndian.Uint16(b[n:])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), n + 2, nil
+}
+
+func readSocksAddr(r io.Reader) (string, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", err
+	}
+	size := map[byte]int{1: net.IPv4len - 1, 4: net.IPv6len - 1, 3: int(head[1])}[head[0]]
+	rest := make([]byte, size+2)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return "", err
+	}
+	addr, _, err := parseSocksAddr(append(head[:], rest...))
+	return addr, err
+}
+
+// socksUDPConn is a UDP ASSOCIATE session dedicated to one DNS server. It
+// wraps every datagram in the SOCKS5 UDP header; the session lasts as long
+// as the control connection.
+type socksUDPConn struct {
+	*net.UDPConn
+	ctrl   net.Conn
+	header []byte
+}
+
+func (c *socksUDPConn) Write(b []byte) (int, error) {
+	packet := append(slices.Clip(c.header), b...)
+	if _, err := c.UDPConn.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read drops fragmented and malformed datagrams.
+func (c *socksUDPConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		n, err := c.UDPConn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		if _, hlen, err := parseSocksAddr(buf[3:n]); err == nil {
+			return copy(b, buf[3+hlen:n]), nil
+		}
+	}
+}
+
+// ReadFrom and WriteTo let the Go resolver treat the session as the packet
+// connection it expects for UDP.
+func (c *socksUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+func (c *socksUDPConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+func (c *socksUDPConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
+
+// useDNSProxy sends all DNS traffic through the -dns-proxy URL and returns
+// the transport lookups must use: TCP when the proxy does not relay UDP.
+func useDNSProxy(ctx context.Context, raw, transport string) (string, error) {
+	p, err := parseSOCKSProxy(raw)
+	if err != nil {
+		return "", err
+	}
+	udp, err := p.probeUDP(ctx)
+	if err != nil {
+		return "", err
+	}
+	dnsDial = p.Dial
+	if !udp {
+		p.tcpOnly = true
+		fmt.Printf(Red+"[!] SOCKS5 proxy %s does not relay UDP, DNS goes over TCP only\n"+Reset, p.addr)
+		return transportTCP, nil
+	}
+	fmt.Printf(Green+"[+] DNS goes through SOCKS5 proxy %s\n"+Reset, p.addr)
+	return transport, nil
+}
+
+// Known-good queries for the resolver health check: Cloudflare's anycast
+// address has a PTR record and Google's resolver name an A record.
+const (
+	healthPTR     = "1.1.1.1"
+	healthHost    = "dns.google"
+	healthTimeout = 5 * time.Second
+)
+
+// checkResolver sends the health check queries to addr (host:port) and
+// returns how long each took.
+func checkResolver(ctx context.Context, addr, transport string) (ptr, a time.Duration, err error) {
+	r := customResolver(addr, transport)
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if names, err := r.LookupAddr(ctx, healthPTR); err != nil || len(names) == 0 {
+		return 0, 0, fmt.Errorf("no PTR record for %s: %v", healthPTR, healthErr(err))
+	}
+	ptr, start = time.Since(start), time.Now()
+	if addrs, err := r.LookupHost(ctx, healthHost); err != nil || len(addrs) == 0 {
+		return 0, 0, fmt.Errorf("no address for %s: %v", healthHost, healthErr(err))
+	}
+	return ptr, time.Since(start), nil
+}
+
+// healthErr shortens a failed check's error. The resolver names the server
+// from resolv.conf in it even though the query went to addr.
+func healthErr(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		return "empty answer"
+	case errors.As(err, &dnsErr):
+		return dnsErr.Err
+	}
+	return err.Error()
+}
+
+// healthyResolvers checks every server and returns those that answered,
+// reporting each one's latency or failure.
+func healthyResolvers(ctx context.Context, servers []string, transport string) []string {
+	var ok []string
+	for _, server := range servers {
+		addr := resolverAddress(server)
+		ptr, a, err := checkResolver(ctx, addr, transport)
+		if err != nil {
+			fmt.Printf(Red+"[!] Resolver %s failed the health check: %v\n"+Reset, addr, err)
+			continue
+		}
+		fmt.Printf(Green+"[+] Resolver %s OK (PTR %s, A %s)\n"+Reset, addr, ptr.Round(time.Millisecond), a.Round(time.Millisecond))
+		ok = append(ok, server)
+	}
+	return ok
+}
+
+func classifyLookup(names []string, err error) LookupStatus {
+	if err == nil {
+		if len(names) == 0 {
+			return StatusNXDomain
+		}
+		return StatusFound
+	}
+
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		return StatusError
+	}
+	switch {
+	case dnsErr.IsNotFound:
+		return StatusNXDomain
+	case dnsErr.IsTimeout:
+		return StatusTimeout
+	case dnsErr.Err == "server misbehaving":
+		// The stub resolver reports SERVFAIL (and REFUSED) this way.
+		return StatusServFail
+	}
+	return StatusError
+}
+
+// A prefix is reported as incomplete once this share of its lookups failed.
+const incompleteThreshold = 0.05
+
+type PrefixStats struct {
+	Prefix  string                `json:"prefix"`
+	Size    uint64                `json:"size"`
+	Total   int                   `json:"scanned"`
+	Counts  [len(statusNames)]int `json:"counts"`
+	Sampled bool                  `json:"sampled,omitempty"`
+	Apexes  map[string]bool       `json:"apexes,omitempty"`
+	// TimedOut marks a prefix abandoned after -prefix-timeout.
+	TimedOut bool `json:"timed_out,omitempty"`
+	// Transferred counts the addresses answered from a reverse-zone AXFR.
+	Transferred int `json:"transferred,omitempty"`
+	// NotDelegated counts the addresses skipped because their reverse zone
+	// does not exist, listed in UndelegatedZones (-probe-zones).
+	NotDelegated     int      `json:"not_delegated,omitempty"`
+	UndelegatedZones []string `json:"undelegated_zones,omitempty"`
+	// Zones lists the delegated reverse zones covering the prefix.
+	Zones []*ReverseZone `json:"zones,omitempty"`
+}
+
+func newPrefixStats(prefix string, sampled bool) *PrefixStats {
+	size, _ := prefixSize(prefix)
+	return &PrefixStats{Prefix: prefix, Size: size, Sampled: sampled, Apexes: map[string]bool{}}
+}
+
+// clone returns a copy of s that shares nothing the scan goes on updating.
+func (s *PrefixStats) clone() *PrefixStats {
+	c := *s
+	c.Apexes = make(map[string]bool, len(s.Apexes))
+	for apex := range s.Apexes {
+		c.Apexes[apex] = true
+	}
+	c.UndelegatedZones = slices.Clone(s.UndelegatedZones)
+	c.Zones = make([]*ReverseZone, len(s.Zones))
+	for i, rz := range s.Zones {
+		copied := *rz
+		copied.Nameservers = slices.Clone(rz.Nameservers)
+		if rz.SOA != nil {
+			soa := *rz.SOA
+			copied.SOA = &soa
+		}
+		c.Zones[i] = &copied
+	}
+	return &c
+}
+
+// Partial reports whether fewer addresses were looked up than the prefix
+// holds, because it was sampled, interrupted or abandoned. Addresses in
+// undelegated reverse zones count as looked up.
+func (s *PrefixStats) Partial() bool {
+	return uint64(s.Total+s.NotDelegated) < s.Size
+}
+
+func (s *PrefixStats) HitRate() float64 {
+	if s.Total == 0 {
+		return 0
+	}
+	return float64(s.Counts[StatusFound]) / float64(s.Total)
+}
+
+func (s *PrefixStats) Add(res LookupResult) {
+	s.Total++
+	s.Counts[res.Status]++
+	if res.Status == StatusFound {
+		if s.Apexes == nil {
+			s.Apexes = map[string]bool{}
+		}
+		for _, name := range res.Names {
+			if apex := apexDomain(name); apex != "" {
+				s.Apexes[apex] = true
+			}
+		}
+	}
+}
+
+// Replace swaps the outcome previously counted for a retried address.
+func (s *PrefixStats) Replace(prev LookupStatus, res LookupResult) {
+	s.Total--
+	s.Counts[prev]--
+	s.Add(res)
+}
+
+func (s *PrefixStats) Failed() int {
+	return s.Counts[StatusTimeout] + s.Counts[StatusServFail] + s.Counts[StatusError]
+}
+
+func (s *PrefixStats) failureReason() string {
+	timeouts, servfails, others := s.Counts[StatusTimeout], s.Counts[StatusServFail], s.Counts[StatusError]
+	switch {
+	case timeouts >= servfails && timeouts >= others:
+		return "timeouts"
+	case servfails >= others:
+		return "SERVFAIL"
+	}
+	return "errors"
+}
+
+func printSummary(stats []*PrefixStats) {
+	fmt.Println(Green + "\n[+] Scan summary" + Reset)
+	for _, s := range stats {
+		label := s.Prefix
+		if s.Sampled {
+			label += " (sampled)"
+		}
+		if s.TimedOut {
+			label += " (abandoned: -prefix-timeout)"
+		}
+		if s.Transferred > 0 {
+			label += fmt.Sprintf(" (%d via AXFR)", s.Transferred)
+		}
+		if s.NotDelegated > 0 {
+			label += fmt.Sprintf(" (%d skipped, zone not delegated)", s.NotDelegated)
+		}
+		fmt.Printf("%s: %d IPs, %d found, %d nxdomain, %d timeout, %d servfail, %d error\n",
+			label, s.Total, s.Counts[StatusFound], s.Counts[StatusNXDomain],
+			s.Counts[StatusTimeout], s.Counts[StatusServFail], s.Counts[StatusError])
+
+		if s.Total > 0 && float64(s.Failed())/float64(s.Total) >= incompleteThreshold {
+			fmt.Printf(Red+"[!] %.0f%% of %s failed with %s — results incomplete\n"+Reset,
+				100*float64(s.Failed())/float64(s.Total), s.Prefix, s.failureReason())
+		}
+	}
+}
+
+func formatGeo(g GeoInfo) string {
+	switch {
+	case g.Country != "" && g.City != "":
+		return fmt.Sprintf(" [%s, %s]", g.Country, g.City)
+	case g.Country != "":
+		return fmt.Sprintf(" [%s]", g.Country)
+	}
+	return ""
+}
+
+type jsonlRecord struct {
+	IP        string   `json:"ip"`
+	Query     string   `json:"query"`
+	Prefix    string   `json:"prefix"`
+	Family    string   `json:"family"`
+	Status    string   `json:"status"`
+	Hostnames []string `json:"hostnames,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Country   string   `json:"country,omitempty"`
+	City      string   `json:"city,omitempty"`
+	Sampled   bool     `json:"sampled,omitempty"`
+	Retried   bool     `json:"retried,omitempty"`
+	Source    string   `json:"source,omitempty"`
+	Domain    string   `json:"domain,omitempty"`
+	Record    string   `json:"record,omitempty"`
+	// ASN and Routed name the announcement covering an address found
+	// outside the scanned prefixes (-resolve-all).
+	ASN    int        `json:"asn,omitempty"`
+	Routed string     `json:"routed_prefix,omitempty"`
+	Port   int        `json:"port,omitempty"`
+	Banner string     `json:"banner,omitempty"`
+	SMTP   *SMTPProbe `json:"smtp,omitempty"`
+	// Confidence is a pointer so a score of 0 is still written.
+	Confidence *int `json:"confidence,omitempty"`
+	// ScopePath is the downstream chain of ASNs that brought the prefix's
+	// ASN into scope, e.g. [64500, 64510] (-include-downstreams).
+	ScopePath []int  `json:"scope_path,omitempty"`
+	Category  string `json:"category,omitempty"`
+	// TTL, Rcode, Authoritative and Server come from the PTR response in
+	// -dns-mode raw and pipelined. TTL is a pointer so 0 is still written.
+	TTL           *uint32 `json:"ttl,omitempty"`
+	Rcode         string  `json:"rcode,omitempty"`
+	Authoritative bool    `json:"authoritative,omitempty"`
+	Server        string  `json:"server,omitempty"`
+	// RetrievedAt and FetchedAt are the Provenance of a PTR answer, whose
+	// Source is dns or cache.
+	RetrievedAt *time.Time `json:"retrieved_at,omitempty"`
+	FetchedAt   *time.Time `json:"fetched_at,omitempty"`
+}
+
+func resultRecord(prefix string, sampled bool, res LookupResult) jsonlRecord {
+	rec := jsonlRecord{IP: res.IP, Query: reverseName(net.ParseIP(res.IP)), Prefix: prefix, Family: prefixFamily(prefix), Status: res.Status.String(), Hostnames: res.Names,
+		Country: res.Geo.Country, City: res.Geo.City, Sampled: sampled, Retried: res.Retried, Confidence: res.Confidence, Category: res.Category,
+		Source: res.Source, RetrievedAt: res.RetrievedAt, FetchedAt: res.FetchedAt}
+	if res.Err != nil && res.Status != StatusNXDomain {
+		rec.Error = res.Err.Error()
+	}
+	if a := res.Answer; a != nil {
+		rec.Rcode, rec.Authoritative, rec.Server = rcodeName(a.Rcode), a.Authoritative, a.Server
+		if len(res.Names) > 0 {
+			rec.TTL = &a.TTL
+		}
+	}
+	return rec
+}
+
+// reverseName returns the PTR query name for ip: dotted-quad form under
+// in-addr.arpa for IPv4 and nibble form under ip6.arpa for IPv6.
+func reverseName(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ipv4[3], ipv4[2], ipv4[1], ipv4[0])
+	}
+
+	const hexDigits = "0123456789abcdef"
+	ipv6 := ip.To16()
+	buf := make([]byte, 0, len(ipv6)*4+len("ip6.arpa."))
+	for i := len(ipv6) - 1; i >= 0; i-- {
+		buf = append(buf, hexDigits[ipv6[i]&0x0f], '.', hexDigits[ipv6[i]>>4], '.')
+	}
+	return string(append(buf, "ip6.arpa."...))
+}
+
+// IPv6 prefixes shorter than this are far too large to sweep address by address.
+const minIPv6PrefixLen = 112
+
+var errTooLarge = fmt.Errorf("IPv6 prefix is too large to enumerate (limit /%d)", minIPv6PrefixLen)
+
+// prefixFamily returns "ipv4" or "ipv6" for cidr, or "" if it does not parse.
+func prefixFamily(cidr string) string {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	switch {
+	case err != nil:
+		return ""
+	case ipnet.IP.To4() != nil:
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// filterFamilies keeps the prefixes of the wanted address families and
+// counts the dropped ones per family.
+func filterFamilies(prefixes []string, v4, v6 bool) ([]string, map[string]int) {
+	var kept []string
+	dropped := map[string]int{}
+	for _, p := range prefixes {
+		switch f := prefixFamily(p); {
+		case f == "ipv4" && v4, f == "ipv6" && v6, f == "":
+			kept = append(kept, p)
+		default:
+			dropped[f]++
+		}
+	}
+	return kept, dropped
+}
+
+// familySummary describes prefixes per address family, e.g.
+// "2 IPv4 prefixes (508 lookups), 1 IPv6 prefix (256 lookups)".
+func familySummary(prefixes []string, sample int) string {
+	byFamily := map[string][]string{}
+	for _, p := range prefixes {
+		f := prefixFamily(p)
+		byFamily[f] = append(byFamily[f], p)
+	}
+	var parts []string
+	for _, f := range []string{"ipv4", "ipv6"} {
+		ps := byFamily[f]
+		if len(ps) == 0 {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s (%d lookups)", familyCount(len(ps), f), plannedLookups(ps, sample)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// familyCount renders n prefixes of family, e.g. "1 IPv6 prefix".
+func familyCount(n int, family string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s prefix", familyLabel(family))
+	}
+	return fmt.Sprintf("%d %s prefixes", n, familyLabel(family))
+}
+
+func familyLabel(family string) string {
+	if family == "ipv6" {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// skipsNetworkBroadcast reports whether the first and last address of a
+// prefix are left out of a sweep. That only applies to IPv4 /30 and
+// larger: a /32 (typically an anycast announcement) is its single address,
+// and both addresses of a /31 are usable hosts per RFC 3021.
+func skipsNetworkBroadcast(ones, bits int) bool {
+	return bits == 32 && ones <= 30
+}
+
+// maxEnumerate is the most addresses ipsInCIDR returns in one slice, a /8.
+// The scan loop never needs more: it walks hostRange chunkSize at a time.
+const maxEnumerate = 1 << 24
+
+// ipsInCIDR expands the scannable addresses of cidr, which must hold at
+// most maxEnumerate of them.
+func ipsInCIDR(cidr string) ([]string, error) {
+	base, first, last, err := hostRange(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if last-first+1 > maxEnumerate {
+		return nil, fmt.Errorf("%s has %d addresses, more than the %d that can be listed at once", cidr, last-first+1, maxEnumerate)
+	}
+	return ipsInRange(base, first, last), nil
+}
+
+// hostRange returns the scannable addresses of cidr as the interval
+// [first, last] of values for the low four bytes of base.
+func hostRange(cidr string) (base net.IP, first, last uint64, err error) {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	if bits == 128 && ones < minIPv6PrefixLen {
+		return nil, 0, 0, errTooLarge
+	}
+
+	// Walk the numeric interval instead of incrementing until Contains fails,
+	// so a range ending at 255.255.255.255 terminates without wrapping. Host
+	// bits never exceed 32 (IPv6 is capped above), so the low four bytes hold
+	// the whole offset.
+	base = ip.Mask(ipnet.Mask)
+	first = uint64(binary.BigEndian.Uint32(base[len(base)-4:]))
+	last = first + (uint64(1) << uint(bits-ones)) - 1
+	if skipsNetworkBroadcast(ones, bits) {
+		first, last = first+1, last-1
+	}
+	return base, first, last, nil
+}
+
+// ipsInRange expands the addresses from through to of a hostRange.
+func ipsInRange(base net.IP, from, to uint64) []string {
+	ips := make([]string, 0, min(to-from+1, chunkSize))
+	for n := from; n <= to; n++ {
+		addr := make(net.IP, len(base))
+		copy(addr, base)
+		binary.BigEndian.PutUint32(addr[len(addr)-4:], uint32(n))
+		ips = append(ips, addr.String())
+	}
+	return ips
+}
+
+// prefixSize returns how many addresses ipsInCIDR would produce for cidr.
+func prefixSize(cidr string) (uint64, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return 0, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones >= 64 {
+		return math.MaxUint64, nil
+	}
+	size := uint64(1) << uint(bits-ones)
+	if skipsNetworkBroadcast(ones, bits) {
+		size -= 2
+	}
+	return size, nil
+}
+
+// splitPrefix explodes an IPv4 prefix shorter than /chunkLen into its
+// /chunkLen subnets. Other prefixes are returned unchanged.
+func splitPrefix(cidr string, chunkLen int) ([]string, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits != 32 || ones >= chunkLen {
+		return []string{ipnet.String()}, nil
+	}
+	if chunkLen > 32 || chunkLen-ones > 20 {
+		return nil, fmt.Errorf("splitting %s into /%d chunks would produce too many chunks", cidr, chunkLen)
+	}
+
+	start := binary.BigEndian.Uint32(ipnet.IP.To4())
+	step := uint32(1) << uint(32-chunkLen)
+	count := 1 << uint(chunkLen-ones)
+	chunks := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, start+uint32(i)*step)
+		chunks = append(chunks, fmt.Sprintf("%s/%d", ip, chunkLen))
+	}
+	return chunks, nil
+}
+
+// parseSelection parses a 1-based selection like "10-20,45" against a list
+// of max entries, returning the chosen indices once each in the order given.
+func parseSelection(spec string, max int) ([]int, error) {
+	var out []int
+	seen := map[int]bool{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			lo, hi = part[:i], part[i+1:]
+		}
+		a, errLo := strconv.Atoi(strings.TrimSpace(lo))
+		b, errHi := strconv.Atoi(strings.TrimSpace(hi))
+		if errLo != nil || errHi != nil {
+			return nil, fmt.Errorf("invalid selection %q", part)
+		}
+		if a < 1 || b > max || a > b {
+			return nil, fmt.Errorf("selection %q is outside 1-%d", part, max)
+		}
+		for i := a; i <= b; i++ {
+			if !seen[i] {
+				seen[i] = true
+				out = append(out, i)
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("empty selection")
+	}
+	return out, nil
+}
+
+// sampleIPv6 picks n distinct random addresses from an IPv6 prefix too
+// large to enumerate by filling its host bits at random.
+func sampleIPv6(ipnet *net.IPNet, n int, rng *rand.Rand) []string {
+	picked := make(map[string]bool, n)
+	ips := make([]string, 0, n)
+	for len(ips) < n {
+		addr := make(net.IP, net.IPv6len)
+		rng.Read(addr)
+		for i := range addr {
+			addr[i] = ipnet.IP[i] | addr[i]&^ipnet.Mask[i]
+		}
+		if s := addr.String(); !picked[s] {
+			picked[s] = true
+			ips = append(ips, s)
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(ips[i]), net.ParseIP(ips[j])) < 0
+	})
+	return ips
+}
+
+// sampleCIDR picks n distinct random addresses from the scannable part of
+// cidr without materializing the whole prefix, returning them in address
+// order. Prefixes with at most n addresses are returned in full.
+func sampleCIDR(cidr string, n int, rng *rand.Rand) ([]string, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The family comes from the mask, not the address: an IPv4-mapped
+	// prefix such as ::ffff:192.0.2.0/120 is an IPv6 one.
+	ones, bits := ipnet.Mask.Size()
+	if bits == 128 && ones < minIPv6PrefixLen {
+		return sampleIPv6(ipnet, n, rng), nil
+	}
+	if bits == 128 {
+		ips, err := ipsInCIDR(cidr)
+		if err != nil || len(ips) <= n {
+			return ips, err
+		}
+		rng.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+		ips = ips[:n]
+		sort.Slice(ips, func(i, j int) bool {
+			return bytes.Compare(net.ParseIP(ips[i]), net.ParseIP(ips[j])) < 0
+		})
+		return ips, nil
+	}
+
+	start, count := uint64(binary.BigEndian.Uint32(ipnet.IP.To4())), uint64(1)<<uint(32-ones)
+	if skipsNetworkBroadcast(ones, bits) {
+		start, count = start+1, count-2
+	}
+	if uint64(n) >= count {
+		return ipsInCIDR(cidr)
+	}
+
+	picked := make(map[uint64]bool, n)
+	for len(picked) < n {
+		picked[uint64(rng.Int63n(int64(count)))] = true
+	}
+	offsets := make([]uint64, 0, n)
+	for off := range picked {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	ips := make([]string, len(offsets))
+	for i, off := range offsets {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(start+off))
+		ips[i] = ip.String()
+	}
+	return ips, nil
+}
+
+func printBanner() {
+	fmt.Println(Purple + `   ______________   _
+                   / )
+    \______       (_/ \
+         \_ ) __      /        
+             (___\ \  
+            (____/  \
+             (___/   \
+s-v            ( ____/` + Reset)
+	fmt.Println()
+	fmt.Println(Green + "[+] github.com/unvalidor")
+	fmt.Println("[+] linkedin.com/in/unvalidor")
+	fmt.Println("[+] Usage : go run asn-lookup.go" + Reset)
+	fmt.Println()
+}
+
+// stdin is the only reader of standard input, so piped answers to several
+// prompts are never swallowed by a second buffer.
+var stdin = bufio.NewReader(os.Stdin)
+
+// prompt prints question and reads one trimmed line of input. It returns
+// io.EOF only when input ended before any answer was given.
+func prompt(question string) (string, error) {
+	fmt.Print(question)
+	line, err := stdin.ReadString('\n')
+	line = strings.TrimSpace(line)
+	if err != nil && line == "" {
+		return "", err
+	}
+	return line, nil
+}
+
+// mustPrompt is prompt for questions the run cannot continue without.
+func mustPrompt(question string) string {
+	line, err := prompt(question)
+	if err != nil {
+		fmt.Println(Red + "\nError: input ended before an answer was given." + Reset)
+		os.Exit(1)
+	}
+	return line
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// ageFlag is a duration flag that also takes whole days, e.g. 7d.
+type ageFlag time.Duration
+
+func (a *ageFlag) String() string {
+	d := time.Duration(*a)
+	if d > 0 && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+func (a *ageFlag) Set(v string) error {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid number of days %q", v)
+		}
+		*a = ageFlag(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*a = ageFlag(d)
+	return nil
+}
+
+// parseTargets reports whether input is a list of IP addresses and CIDRs
+// rather than an organization name, returning them as prefixes to scan.
+func parseTargets(input string) ([]string, bool) {
+	fields := strings.FieldsFunc(input, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+
+	var prefixes []string
+	for _, f := range fields {
+		if ip := net.ParseIP(f); ip != nil {
+			prefixes = append(prefixes, hostPrefix(ip))
+			continue
+		}
+		if _, ipnet, err := net.ParseCIDR(f); err == nil {
+			prefixes = append(prefixes, ipnet.String())
+			continue
+		}
+		return nil, false
+	}
+	return prefixes, len(prefixes) > 0
+}
+
+func hostPrefix(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
+
+// asnRefineThreshold is the number of search results above which the ASN
+// menu turns into a filterable, paged view.
+const (
+	asnRefineThreshold = 25
+	asnPageSize        = 20
+)
+
+// asnMatches reports whether an ASN search result passes a name substring
+// filter and a country set (empty means any country).
+func asnMatches(asn ASN, substr string, countries map[string]bool) bool {
+	if substr != "" {
+		text := strings.ToLower(asn.Name + " " + asn.Description)
+		if !strings.Contains(text, strings.ToLower(substr)) {
+			return false
+		}
+	}
+	return len(countries) == 0 || countries[strings.ToUpper(asn.CountryCode)]
+}
+
+// asnPicker selects search results without a prompt: every ASN whose name
+// or description contains substr (case-insensitive) and matches re.
+type asnPicker struct {
+	substr string
+	re     *regexp.Regexp
+}
+
+func (p *asnPicker) match(asn ASN) bool {
+	if !asnMatches(asn, p.substr, nil) {
+		return false
+	}
+	return p.re == nil || p.re.MatchString(asn.Name) || p.re.MatchString(asn.Description)
+}
+
+// prefixPicker keeps announced prefixes by their bgpview name and
+// description: they must contain substr and match re (case-insensitive),
+// when set, and must not contain exclude. Prefixes without a name or
+// description only pass a picker that merely excludes.
+type prefixPicker struct {
+	substr  string
+	re      *regexp.Regexp
+	exclude string
+}
+
+func (p *prefixPicker) match(meta Prefix) bool {
+	text := strings.ToLower(meta.Name + " " + meta.Description)
+	if p.exclude != "" && strings.Contains(text, strings.ToLower(p.exclude)) {
+		return false
+	}
+	if p.substr != "" && !strings.Contains(text, strings.ToLower(p.substr)) {
+		return false
+	}
+	return p.re == nil || p.re.MatchString(meta.Name) || p.re.MatchString(meta.Description)
+}
+
+func filterASNs(asns []ASN, substr string, countries map[string]bool) []ASN {
+	var out []ASN
+	for _, asn := range asns {
+		if asnMatches(asn, substr, countries) {
+			out = append(out, asn)
+		}
+	}
+	return out
+}
+
+// countrySet turns repeated or comma-separated country codes into a set.
+func countrySet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := map[string]bool{}
+	for _, v := range values {
+		for _, cc := range strings.Split(v, ",") {
+			if cc = strings.ToUpper(strings.TrimSpace(cc)); cc != "" {
+				set[cc] = true
+			}
+		}
+	}
+	return set
+}
+
+// prefixCountries finds where each prefix is: geolocated from its first
+// address with a GeoIP database, otherwise registered according to RDAP.
+// Prefixes whose lookup fails are left out of the map.
+func prefixCountries(ctx context.Context, geo *geoIP, rdap *Client, prefixes []string) map[string]string {
+	countries := map[string]string{}
+	if geo != nil {
+		for _, p := range prefixes {
+			if ip, _, err := net.ParseCIDR(p); err == nil {
+				if cc := geo.Lookup(ip.String()).Country; cc != "" {
+					countries[p] = strings.ToUpper(cc)
+				}
+			}
+		}
+		return countries
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	sem := make(chan struct{}, apiFetchers)
+	for _, p := range prefixes {
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			cc, err := rdap.RDAPCountry(ctx, p)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil || cc == "" {
+				failed++
+				return
+			}
+			countries[p] = cc
+		}(p)
+	}
+	wg.Wait()
+	if failed > 0 {
+		fmt.Printf(Red+"[!] No RDAP country for %d of %d prefixes\n"+Reset, failed, len(prefixes))
+	}
+	return countries
+}
+
+func printASN(i int, asn ASN) {
+	country := ""
+	if asn.CountryCode != "" {
+		country = " [" + asn.CountryCode + "]"
+	}
+	matched := ""
+	if len(asn.MatchedBy) > 0 {
+		quoted := make([]string, len(asn.MatchedBy))
+		for i, term := range asn.MatchedBy {
+			quoted[i] = strconv.Quote(term)
+		}
+		matched = " (matched " + strings.Join(quoted, ", ") + ")"
+	}
+	switch {
+	case asn.PeeringDBOnly:
+		matched += " (PeeringDB only: " + asn.PeeringDBOrg + ")"
+	case asn.PeeringDBOrg != "":
+		matched += " (also PeeringDB: " + asn.PeeringDBOrg + ")"
+	case asn.Whois != "":
+		matched += " (WHOIS: " + asn.Whois + ")"
+	case asn.ScopePath != nil:
+		matched += " (via " + asn.scopeLabel() + ")"
+	}
+	fmt.Printf(Blue+"%d."+Reset+" AS%d - %s%s%s\n", i+1, asn.Number, asn.Name, country, matched)
+}
+
+// asnGroupSimilarity is the share of name tokens two search results must
+// have in common to be shown as the same organization.
+const asnGroupSimilarity = 0.5
+
+// asnGroup is a run of search results that look like the same organization.
+// first is the position of its first member in the flat list.
+type asnGroup struct {
+	label   string
+	first   int
+	members []ASN
+}
+
+// asnNameTokens normalizes a search result's name for grouping: case folded,
+// punctuation stripped and legal/network suffixes dropped, so "EXAMPLE-AS",
+// "EXAMPLE-NET" and "Example Networks Inc." all reduce to [example].
+func asnNameTokens(asn ASN) map[string]bool {
+	tokens := orgTokens(asn.Name)
+	if len(tokens) == 0 {
+		tokens = orgTokens(asn.Description)
+	}
+	set := map[string]bool{}
+	for _, t := range tokens {
+		set[t] = true
+	}
+	return set
+}
+
+func tokenOverlap(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for t := range a {
+		if b[t] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// groupASNs clusters search results by name similarity and returns the
+// groups together with the results reordered so each group is contiguous.
+// Every result is compared with the first member of a group only, so a chain
+// of loosely similar names never pulls unrelated organizations together.
+func groupASNs(asns []ASN) ([]asnGroup, []ASN) {
+	var (
+		groups []asnGroup
+		heads  []map[string]bool
+	)
+	for _, asn := range asns {
+		tokens := asnNameTokens(asn)
+		joined := false
+		for i, head := range heads {
+			if tokenOverlap(tokens, head) >= asnGroupSimilarity {
+				groups[i].members = append(groups[i].members, asn)
+				joined = true
+				break
+			}
+		}
+		if !joined {
+			label := make([]string, 0, len(tokens))
+			for t := range tokens {
+				label = append(label, t)
+			}
+			sort.Strings(label)
+			groups = append(groups, asnGroup{label: strings.Join(label, " "), members: []ASN{asn}})
+			heads = append(heads, tokens)
+		}
+	}
+	flat := make([]ASN, 0, len(asns))
+	for i := range groups {
+		groups[i].first = len(flat)
+		flat = append(flat, groups[i].members...)
+	}
+	return groups, flat
+}
+
+// printASNGroups prints flat[from:to], heading every multi-member group with
+// its number so it can be selected as a whole.
+func printASNGroups(groups []asnGroup, flat []ASN, from, to int) {
+	for gi, g := range groups {
+		for j := range g.members {
+			i := g.first + j
+			if i < from || i >= to {
+				continue
+			}
+			if len(g.members) > 1 && (j == 0 || i == from) {
+				fmt.Printf(Purple+"g%d"+Reset+" %q - %d entries:\n", gi+1, g.label, len(g.members))
+			}
+			if len(g.members) > 1 {
+				fmt.Print("  ")
+			}
+			printASN(i, flat[i])
+		}
+	}
+}
+
+// expandGroupSelection rewrites "gN" parts of a selection into the range of
+// entries group N covers, so "g1,7" becomes e.g. "1-3,7".
+func expandGroupSelection(spec string, groups []asnGroup) (string, error) {
+	parts := strings.Split(spec, ",")
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(strings.ToLower(part), "g") {
+			continue
+		}
+		n, err := strconv.Atoi(part[1:])
+		if err != nil || n < 1 || n > len(groups) {
+			return "", fmt.Errorf("invalid group %q", part)
+		}
+		g := groups[n-1]
+		parts[i] = fmt.Sprintf("%d-%d", g.first+1, g.first+len(g.members))
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// confirmAllASNs asks whether an empty answer at a selection prompt really
+// means every listed ASN. It shows what the ASNs announce first, since a
+// hosting group can add up to weeks of scanning.
+func confirmAllASNs(asns []ASN, ranges []string) bool {
+	fmt.Printf(Purple+"\n[~] All %d ASNs announce %s\n"+Reset, len(asns), describeRanges(ranges))
+	answer := mustPrompt(Purple + "Scan all of them? [y/N]: " + Reset)
+	return strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes")
+}
+
+// describeRanges sums up the size of ranges: "12 prefixes: 8 IPv4 (4096
+// addresses) and 4 IPv6".
+func describeRanges(ranges []string) string {
+	var v4, v6 int
+	var addrs uint64
+	for _, p := range ranges {
+		if prefixFamily(p) == "ipv6" {
+			v6++
+			continue
+		}
+		v4++
+		size, _ := prefixSize(p)
+		addrs += size
+	}
+	return fmt.Sprintf("%d prefixes: %d IPv4 (%d addresses) and %d IPv6", len(ranges), v4, addrs, v6)
+}
+
+// maxDownstreams caps the ASNs -include-downstreams offers; a transit
+// provider can have thousands.
+const maxDownstreams = 200
+
+// downstreamsOf walks the downstreams of selected breadth-first, depth
+// levels deep, and returns the ASNs not selected yet, each with the path
+// that leads to it.
+func downstreamsOf(ctx context.Context, api *Client, selected []ASN, depth int) []ASN {
+	seen := map[int]bool{}
+	for _, asn := range selected {
+		seen[asn.Number] = true
+	}
+	var found []ASN
+	frontier := selected
+	for level := 0; level < depth && len(frontier) > 0; level++ {
+		var next []ASN
+		for _, parent := range frontier {
+			downs, err := api.ASNDownstreams(ctx, parent.Number)
+			if err != nil {
+				fmt.Printf(Red+"[!] Error fetching downstreams of AS%d: %v\n"+Reset, parent.Number, err)
+				continue
+			}
+			for _, asn := range downs {
+				if seen[asn.Number] {
+					continue
+				}
+				if len(found) == maxDownstreams {
+					fmt.Printf(Red+"[!] Stopping at %d downstream ASNs\n"+Reset, maxDownstreams)
+					return found
+				}
+				seen[asn.Number] = true
+				path := parent.ScopePath
+				if path == nil {
+					path = []int{parent.Number}
+				}
+				asn.ScopePath = append(slices.Clip(path), asn.Number)
+				found = append(found, asn)
+				next = append(next, asn)
+			}
+		}
+		frontier = next
+	}
+	return found
+}
+
+// addDownstreams offers the downstream ASNs of selected with the total size
+// of what they announce, and on confirmation adds them and their prefixes
+// to the scope. origin and meta are updated in place.
+func addDownstreams(ctx context.Context, api *Client, selected []ASN, ranges []string, origin map[string]int, meta map[string]Prefix, depth int) ([]ASN, []string) {
+	downs := downstreamsOf(ctx, api, selected, depth)
+	if len(downs) == 0 {
+		fmt.Println(Purple + "[~] No downstream ASNs found" + Reset)
+		return selected, ranges
+	}
+	fmt.Printf(Green+"\n[+] %d downstream ASNs\n"+Reset, len(downs))
+	for i, asn := range downs {
+		printASN(i, asn)
+	}
+	extra, o, m := rangesForASNs(ctx, api, asnNumbers(downs))
+	fresh, from := prefixesOutside(extra, ranges)
+	if len(fresh) == 0 {
+		fmt.Println(Purple + "[~] The downstream ASNs announce nothing new" + Reset)
+		return selected, ranges
+	}
+	fmt.Printf(Purple+"\n[~] They add %s\n"+Reset, describeRanges(fresh))
+	answer, _ := prompt(Purple + "Add them to the scan? [y/N]: " + Reset)
+	if !strings.EqualFold(answer, "y") && !strings.EqualFold(answer, "yes") {
+		fmt.Println(Purple + "[~] Keeping the selected ASNs only" + Reset)
+		return selected, ranges
+	}
+	for _, p := range fresh {
+		if _, ok := origin[p]; !ok {
+			origin[p], meta[p] = o[from[p]], m[from[p]]
+		}
+	}
+	return append(selected, downs...), append(ranges, fresh...)
+}
+
+// prefixesOutside returns the parts of extra that lie outside every prefix
+// in ranges, mapped to the extra prefix each was cut from. A selected
+// prefix inside a downstream announcement is thus scanned, and attributed,
+// as selected; only the rest of the downstream prefix is added.
+func prefixesOutside(extra, ranges []string) ([]string, map[string]string) {
+	var holes []*net.IPNet
+	for _, p := range ranges {
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			holes = append(holes, n)
+		}
+	}
+	var parts []string
+	from := map[string]string{}
+	for _, p := range aggregatePrefixes(extra) {
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			continue
+		}
+		for _, part := range subtractNets(n, holes) {
+			if s := part.String(); from[s] == "" {
+				from[s] = p
+				parts = append(parts, s)
+			}
+		}
+	}
+	return parts, from
+}
+
+// refineASNs lets the user narrow a long result list without re-querying
+// the API, and returns the chosen entries. Selection numbers always refer to
+// the filtered view currently on screen. An empty answer offers the whole
+// view after confirmAll agrees.
+func refineASNs(asns []ASN, confirmAll func([]ASN) bool) []ASN {
+	var (
+		substr    string
+		countries = map[string]bool{}
+		page      int
+	)
+	for {
+		groups, view := groupASNs(filterASNs(asns, substr, countries))
+		pages := (len(view) + asnPageSize - 1) / asnPageSize
+		if page >= pages {
+			page = max(0, pages-1)
+		}
+
+		var active []string
+		if substr != "" {
+			active = append(active, fmt.Sprintf("name contains %q", substr))
+		}
+		if len(countries) > 0 {
+			ccs := make([]string, 0, len(countries))
+			for cc := range countries {
+				ccs = append(ccs, cc)
+			}
+			sort.Strings(ccs)
+			active = append(active, "country "+strings.Join(ccs, "/"))
+		}
+		fmt.Printf(Green+"\n[+] %d of %d ASNs"+Reset, len(view), len(asns))
+		if len(active) > 0 {
+			fmt.Printf(" (%s)", strings.Join(active, ", "))
+		}
+		if pages > 1 {
+			fmt.Printf(", page %d/%d", page+1, pages)
+		}
+		fmt.Println()
+		printASNGroups(groups, view, page*asnPageSize, min(len(view), (page+1)*asnPageSize))
+
+		line := mustPrompt(Purple + "\nSelect ASN number(s) or group(s) gN (Enter for all), or: f <text> filter by name, c <CC> toggle country, n/p page, x clear: " + Reset)
+		cmd, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+		switch strings.ToLower(cmd) {
+		case "f":
+			substr, page = arg, 0
+		case "c":
+			if arg == "" {
+				countries = map[string]bool{}
+			} else if cc := strings.ToUpper(arg); countries[cc] {
+				delete(countries, cc)
+			} else {
+				countries[cc] = true
+			}
+			page = 0
+		case "n":
+			if page < pages-1 {
+				page++
+			}
+		case "p":
+			if page > 0 {
+				page--
+			}
+		case "x":
+			substr, countries, page = "", map[string]bool{}, 0
+		case "":
+			if len(view) > 0 && confirmAll(view) {
+				return view
+			}
+		default:
+			spec, err := expandGroupSelection(line, groups)
+			var choices []int
+			if err == nil {
+				choices, err = parseSelection(spec, len(view))
+			}
+			if err != nil {
+				fmt.Println(Red+"Invalid selection:", err, Reset)
+				continue
+			}
+			var chosen []ASN
+			for _, c := range choices {
+				chosen = append(chosen, view[c-1])
+			}
+			return chosen
+		}
+	}
+}
+
+// splitOrgTerms turns repeated and comma-separated -org values into search
+// terms. A part that is only a legal suffix ("Example, Inc.") stays attached
+// to the term before it.
+func splitOrgTerms(values []string) []string {
+	var terms []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			switch {
+			case part == "":
+			case len(terms) > 0 && len(orgTokens(part)) == 0:
+				terms[len(terms)-1] += ", " + part
+			default:
+				terms = append(terms, part)
+			}
+		}
+	}
+	return terms
+}
+
+// maxSearchVariants caps the extra searches spent on suggestions when a
+// term finds nothing.
+const maxSearchVariants = 4
+
+// legalSuffixes are the company-form words dropped from the end of a term
+// when looking for a variant that does return results, and from an
+// organization name when matching it against domains (orgTokens).
+var legalSuffixes = map[string]bool{"inc": true, "incorporated": true, "llc": true, "ltd": true, "limited": true,
+	"corp": true, "corporation": true, "co": true, "company": true, "gmbh": true, "ag": true, "kg": true, "sa": true,
+	"sas": true, "sarl": true, "plc": true, "bv": true, "nv": true, "srl": true, "spa": true, "oy": true, "ab": true,
+	"as": true, "pty": true, "pte": true, "kk": true, "llp": true, "lp": true}
+
+// searchVariants lists the obvious rewrites of a search term, most specific
+// first: without its legal suffix ("Example GmbH" -> "Example"), with the
+// punctuation split out ("Example-Net" -> "Example Net"), the first word of
+// a longer name, and the domain label of a domain ("example.co.uk" ->
+// "example"). The term itself is never included.
+func searchVariants(term string) []string {
+	term = strings.TrimSpace(term)
+	seen := map[string]bool{strings.ToLower(term): true}
+	var variants []string
+	add := func(v string) {
+		v = strings.Join(strings.Fields(v), " ")
+		if len(v) < 2 || seen[strings.ToLower(v)] || len(variants) == maxSearchVariants {
+			return
+		}
+		seen[strings.ToLower(v)] = true
+		variants = append(variants, v)
+	}
+
+	if strings.Contains(term, ".") && !strings.Contains(term, " ") {
+		if apex := apexDomain(term); apex != "" {
+			add(strings.SplitN(apex, ".", 2)[0])
+		}
+	}
+	words := strings.Fields(term)
+	for len(words) > 1 && legalSuffixes[strings.ToLower(strings.Trim(words[len(words)-1], ".,"))] {
+		words = words[:len(words)-1]
+	}
+	base := strings.TrimRight(strings.Join(words, " "), ".,")
+	add(base)
+	split := strings.Fields(strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return ' '
+	}, base))
+	add(strings.Join(split, " "))
+	if len(split) > 1 {
+		add(split[0])
+	}
+	return variants
+}
+
+// suggestSearches runs the variants of each term and reports the ones that
+// return ASNs. Nothing is selected: the user reruns with the suggestion.
+func suggestSearches(ctx context.Context, api *Client, terms []string) {
+	type suggestion struct {
+		term string
+		asns int
+	}
+	var found []suggestion
+	budget := maxSearchVariants
+	for _, term := range terms {
+		for _, v := range searchVariants(term) {
+			if budget == 0 || ctx.Err() != nil {
+				break
+			}
+			budget--
+			asns, err := api.SearchASNs(ctx, v)
+			if err == nil && len(asns) > 0 {
+				found = append(found, suggestion{v, len(asns)})
+			}
+		}
+	}
+	if len(found) == 0 {
+		return
+	}
+	fmt.Println(Purple + "[~] These searches return results, rerun with one of them as -org:" + Reset)
+	for _, s := range found {
+		fmt.Printf(Purple+"    %q (%d ASNs)\n"+Reset, s.term, s.asns)
+	}
+}
+
+// searchASNs runs one search per term, one after another through the
+// client's rate limiter, and merges the results by ASN. Entries keep the
+// order in which they were first returned and record every term that
+// matched them. A failed term is reported and skipped.
+func searchASNs(ctx context.Context, api *Client, terms []string) ([]ASN, error) {
+	var (
+		merged []ASN
+		index  = map[int]int{}
+		failed error
+	)
+	for _, term := range terms {
+		asns, err := api.SearchASNs(ctx, term)
+		if err != nil {
+			if len(terms) > 1 {
+				fmt.Printf(Red+"[!] Search for %q failed: %v\n"+Reset, term, err)
+			}
+			failed = err
+			continue
+		}
+		for _, asn := range asns {
+			i, ok := index[asn.Number]
+			if !ok {
+				i = len(merged)
+				index[asn.Number] = i
+				merged = append(merged, asn)
+			}
+			if len(terms) > 1 {
+				merged[i].MatchedBy = append(merged[i].MatchedBy, term)
+			}
+		}
+	}
+	if len(merged) == 0 && failed != nil {
+		return nil, failed
+	}
+	return merged, nil
+}
+
+// peeringDBOrgLimit caps the organizations per search term whose networks
+// are fetched, as anonymous PeeringDB clients get few queries per minute.
+const peeringDBOrgLimit = 5
+
+// peeringDBASNs finds the PeeringDB organizations matching terms and returns
+// the ASNs registered under them. PeeringDB being down, rate limiting or
+// having no matching record only costs the extra ASNs.
+func peeringDBASNs(ctx context.Context, pdb *Client, terms []string) []ASN {
+	var (
+		asns []ASN
+		seen = map[int]bool{}
+	)
+	for _, term := range terms {
+		orgs, err := pdb.PeeringDBOrgs(ctx, term)
+		if err != nil {
+			fmt.Printf(Red+"[!] PeeringDB search for %q failed, continuing without it: %v\n"+Reset, term, err)
+			continue
+		}
+		if len(orgs) == 0 {
+			fmt.Printf(Purple+"[~] No PeeringDB organization matches %q\n"+Reset, term)
+			continue
+		}
+		if len(orgs) > peeringDBOrgLimit {
+			fmt.Printf(Purple+"[~] %d PeeringDB organizations match %q, using the first %d\n"+Reset, len(orgs), term, peeringDBOrgLimit)
+			orgs = orgs[:peeringDBOrgLimit]
+		}
+		for _, org := range orgs {
+			nets, err := pdb.PeeringDBNets(ctx, org.ID)
+			if err != nil {
+				fmt.Printf(Red+"[!] PeeringDB networks of %s failed: %v\n"+Reset, org.Name, err)
+				continue
+			}
+			fmt.Printf(Green+"[+] PeeringDB organization %s (id %d): %d networks\n"+Reset, org.Name, org.ID, len(nets))
+			for _, n := range nets {
+				fmt.Printf("    AS%d %s, %d IXPs, %d facilities\n", n.ASN, n.Name, n.IXCount, n.FacCount)
+				if n.ASN == 0 || seen[n.ASN] {
+					continue
+				}
+				seen[n.ASN] = true
+				asns = append(asns, ASN{Number: n.ASN, Name: n.Name, CountryCode: org.Country, PeeringDBOrg: org.Name, Provenance: n.Provenance})
+			}
+		}
+	}
+	return asns
+}
+
+// mergePeeringDB tags the bgpview results also registered in PeeringDB and
+// appends the ones bgpview did not return.
+func mergePeeringDB(asns, pdb []ASN) []ASN {
+	index := map[int]int{}
+	for i, asn := range asns {
+		index[asn.Number] = i
+	}
+	for _, asn := range pdb {
+		if i, ok := index[asn.Number]; ok {
+			asns[i].PeeringDBOrg = asn.PeeringDBOrg
+			continue
+		}
+		asn.PeeringDBOnly = true
+		asns = append(asns, asn)
+	}
+	return asns
+}
+
+func selectASNRanges(ctx context.Context, api *Client, terms []string, nameFilter string, countries map[string]bool, pick *asnPicker, pdb *Client, whois whoisSource, downstreamDepth int) ([]ASN, []string, map[string]int, map[string]Prefix) {
+	orgName := strings.Join(terms, " | ")
+	var asns []ASN
+	searched := false
+	if !whois.only {
+		var err error
+		asns, err = searchASNs(ctx, api, terms)
+		var fromPDB []ASN
+		if pdb != nil {
+			fromPDB = peeringDBASNs(ctx, pdb, terms)
+		}
+		if err != nil && len(fromPDB) == 0 {
+			fmt.Println(Red+"Error fetching ASNs:", err, Reset)
+			exitIfStopped(ctx, "")
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Println(Red+"[!] bgpview search failed, offering PeeringDB ASNs only:", err, Reset)
+		}
+		asns = mergePeeringDB(asns, fromPDB)
+		searched = err == nil && len(asns) == 0
+	}
+	if len(asns) == 0 && whois.offline {
+		fmt.Println(Purple + "[~] -offline: not trying WHOIS discovery" + Reset)
+	} else if len(asns) == 0 && whois.domain != "" {
+		if !whois.only {
+			fmt.Printf(Purple+"\n[~] bgpview found no ASN for %s, trying WHOIS for %s (heuristic, check the evidence)\n"+Reset, orgName, whois.domain)
+		}
+		leads, err := whoisDiscover(ctx, whois.server, whois.domain)
+		if err != nil {
+			fmt.Println(Red+"[!] WHOIS discovery failed:", err, Reset)
+		}
+		asns = whoisASNs(leads)
+	} else if len(asns) == 0 {
+		fmt.Println(Purple + "[~] Pass the organization's domain with -whois-domain to try WHOIS discovery" + Reset)
+	}
+	if nameFilter != "" {
+		asns = filterASNs(asns, nameFilter, nil)
+	}
+	if len(countries) > 0 {
+		all := len(asns)
+		asns = filterASNs(asns, "", countries)
+		fmt.Printf(Purple+"[~] -country kept %d of %d ASNs\n"+Reset, len(asns), all)
+	}
+
+	if len(asns) == 0 {
+		fmt.Printf(Red+"No ASN found for %s\n"+Reset, orgName)
+		if searched {
+			suggestSearches(ctx, api, terms)
+		}
+		os.Exit(0)
+	}
+
+	// Offering all ASNs means fetching their prefixes to show the impact;
+	// a confirmed answer keeps them so they are not fetched twice.
+	var (
+		fetched    []string
+		origin     map[string]int
+		meta       map[string]Prefix
+		confirmAll = func(list []ASN) bool {
+			ranges, o, m := rangesForASNs(ctx, api, asnNumbers(list))
+			if !confirmAllASNs(list, ranges) {
+				return false
+			}
+			fetched, origin, meta = ranges, o, m
+			return true
+		}
+	)
+	var selected []ASN
+	if pick != nil {
+		for _, asn := range asns {
+			if pick.match(asn) {
+				selected = append(selected, asn)
+			}
+		}
+		if len(selected) == 0 {
+			fmt.Fprintf(os.Stderr, Red+"No ASN for %s matches the filter. Candidates:\n"+Reset, orgName)
+			for _, asn := range asns {
+				desc := ""
+				if asn.Description != "" {
+					desc = " (" + asn.Description + ")"
+				}
+				fmt.Fprintf(os.Stderr, "AS%d - %s%s\n", asn.Number, asn.Name, desc)
+			}
+			os.Exit(exitNoSelection)
+		}
+		fmt.Printf(Green+"\n[+] Filter selected %d of %d ASNs for %s\n"+Reset, len(selected), len(asns), orgName)
+		for i, asn := range selected {
+			printASN(i, asn)
+		}
+	} else if len(asns) > asnRefineThreshold {
+		fmt.Printf(Green+"\n[+] Found %d ASNs for %s, refine the list or select directly\n"+Reset, len(asns), orgName)
+		selected = refineASNs(asns, confirmAll)
+	} else {
+		groups, flat := groupASNs(asns)
+		asns = flat
+		fmt.Printf(Green+"\n[+] Found ASNs for %s\n"+Reset, orgName)
+		printASNGroups(groups, asns, 0, len(asns))
+
+		choiceStr := ""
+		for choiceStr == "" {
+			choiceStr = mustPrompt(Purple + "\nSelect ASN number(s) or group(s) (e.g. 2, 1,3-5 or g1, Enter for all): " + Reset)
+			if choiceStr == "" && confirmAll(asns) {
+				choiceStr = "1-" + strconv.Itoa(len(asns))
+			}
+		}
+		spec, err := expandGroupSelection(choiceStr, groups)
+		var choices []int
+		if err == nil {
+			choices, err = parseSelection(spec, len(asns))
+		}
+		if err != nil {
+			fmt.Println(Red + "Invalid selection." + Reset)
+			os.Exit(1)
+		}
+		for _, c := range choices {
+			selected = append(selected, asns[c-1])
+		}
+	}
+
+	nums := asnNumbers(selected)
+	ipRanges := fetched
+	if ipRanges == nil {
+		ipRanges, origin, meta = rangesForASNs(ctx, api, nums)
+	}
+	if len(ipRanges) == 0 {
+		fmt.Println(Red + "Error fetching IP ranges: no prefixes retrieved." + Reset)
+		exitIfStopped(ctx, "")
+		os.Exit(1)
+	}
+	if downstreamDepth > 0 {
+		selected, ipRanges = addDownstreams(ctx, api, selected, ipRanges, origin, meta, downstreamDepth)
+		nums = asnNumbers(selected)
+	}
+
+	if len(nums) == 1 {
+		fmt.Printf(Green+"\n[+] IP ranges for ASN %d:\n"+Reset, nums[0])
+	} else {
+		fmt.Printf(Green+"\n[+] IP ranges for %d ASNs:\n"+Reset, len(nums))
+	}
+	for _, ip := range ipRanges {
+		fmt.Printf("%s (%s)", ip, familyLabel(prefixFamily(ip)))
+		if about := meta[ip].About(); about != "" {
+			fmt.Print("  " + Blue + about + Reset)
+		}
+		fmt.Println()
+	}
+	return selected, ipRanges, origin, meta
+}
+
+func asnNumbers(asns []ASN) []int {
+	nums := make([]int, 0, len(asns))
+	for _, asn := range asns {
+		nums = append(nums, asn.Number)
+	}
+	return nums
+}
+
+// recordClock stamps the record formats that carry a time (dnsx-json, CEF).
+// Pinning it makes their output reproducible.
+var recordClock = time.Now
+
+// outputFile is a buffered writer that flushes at every line end, so a
+// killed process never loses a result line it already reported. Every open
+// outputFile is registered so a panic can flush them all on the way out.
+type outputFile struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+var (
+	outputsMu sync.Mutex
+	outputs   []*outputFile
+)
+
+func openOutput(path string, appendMode bool) (*outputFile, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appendMode {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	out := &outputFile{f: f, w: bufio.NewWriter(f)}
+	outputsMu.Lock()
+	outputs = append(outputs, out)
+	outputsMu.Unlock()
+	return out, nil
+}
+
+func (o *outputFile) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n, err := o.w.Write(p)
+	if err == nil && bytes.IndexByte(p, '\n') >= 0 {
+		err = o.w.Flush()
+	}
+	return n, err
+}
+
+func (o *outputFile) flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.w.Flush(); err != nil {
+		return err
+	}
+	return o.f.Sync()
+}
+
+func (o *outputFile) Close() error {
+	err := o.flush()
+	if cerr := o.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func flushOutputs() {
+	fanoutsMu.Lock()
+	for _, f := range fanouts {
+		f.Close()
+	}
+	fanoutsMu.Unlock()
+
+	outputsMu.Lock()
+	defer outputsMu.Unlock()
+	for _, o := range outputs {
+		o.flush()
+	}
+}
+
+// flushOnPanic is deferred at the top of every goroutine that produces
+// output; it flushes all writers before letting the panic continue.
+func flushOnPanic() {
+	if r := recover(); r != nil {
+		liveStatus.Stop()
+		flushOutputs()
+		finishManifest(runFailed)
+		panic(r)
+	}
+}
+
+const (
+	runRunning     = "running"
+	runCompleted   = "completed"
+	runInterrupted = "interrupted"
+	runDeadline    = "deadline"
+	runFailed      = "failed"
+)
+
+// Manifest records what a run was asked to do and what it produced. It is
+// written when the run starts and again when it ends, so a run that dies
+// half way still leaves the attempt on disk with status running.
+type Manifest struct {
+	Tool       string            `json:"tool"`
+	Version    string            `json:"version"`
+	GoVersion  string            `json:"go_version"`
+	Flags      map[string]string `json:"flags"`
+	Args       []string          `json:"args,omitempty"`
+	DataSource []string          `json:"data_source"`
+	ServedBy   map[string]string `json:"served_by,omitempty"`
+	Resolvers  []string          `json:"resolvers"`
+	Org        string            `json:"org,omitempty"`
+	ASNs       []int             `json:"asns,omitempty"`
+	Prefixes   []string          `json:"prefixes,omitempty"`
+	Shard      string            `json:"shard,omitempty"`
+	Selection  string            `json:"prefix_selection,omitempty"`
+	Status     string            `json:"status"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+	Outputs    []ManifestOutput  `json:"outputs,omitempty"`
+
+	path        string
+	outputPaths []string
+}
+
+type ManifestOutput struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+var (
+	manifestMu  sync.Mutex
+	runManifest *Manifest
+)
+
+// secretFlags are recorded in the manifest as set, but never with their value.
+var secretFlags = map[string]bool{"api-key": true}
+
+// toolVersion is the module version and VCS revision the binary was built
+// from, as far as the build recorded them.
+func toolVersion() string {
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Version != "" {
+			version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				version += " " + s.Value
+			}
+		}
+	}
+	return version
+}
+
+func newManifest(path string, fs *flag.FlagSet) *Manifest {
+	m := &Manifest{Tool: "asn-lookup", Version: toolVersion(), GoVersion: runtime.Version(), Flags: map[string]string{},
+		Args: fs.Args(), Status: runRunning, StartedAt: time.Now(), path: path}
+	fs.Visit(func(f *flag.Flag) {
+		m.Flags[f.Name] = f.Value.String()
+		if secretFlags[f.Name] {
+			m.Flags[f.Name] = "[redacted]"
+		}
+	})
+	return m
+}
+
+// systemResolvers lists the nameservers in /etc/resolv.conf.
+func systemResolvers() []string {
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return []string{"system"}
+	}
+	var servers []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if f := strings.Fields(line); len(f) >= 2 && f[0] == "nameserver" {
+			servers = append(servers, f[1])
+		}
+	}
+	if len(servers) == 0 {
+		return []string{"system"}
+	}
+	return servers
+}
+
+func (m *Manifest) save() error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path, append(data, '\n'))
+}
+
+// startManifest writes m and makes it the manifest finished on exit.
+func startManifest(m *Manifest) {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	runManifest = m
+	if err := m.save(); err != nil {
+		fmt.Println(Red+"[!] Failed to write manifest:", err, Reset)
+	}
+}
+
+// updateManifest applies fn to the run's manifest, if any, and rewrites it.
+func updateManifest(fn func(m *Manifest)) {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	if runManifest == nil || runManifest.Status != runRunning {
+		return
+	}
+	fn(runManifest)
+	if err := runManifest.save(); err != nil {
+		fmt.Println(Red+"[!] Failed to write manifest:", err, Reset)
+	}
+}
+
+// finishManifest stamps the run's manifest with status and the checksums of
+// the output files. Outputs must already be flushed.
+func finishManifest(status string) {
+	updateManifest(func(m *Manifest) {
+		now := time.Now()
+		m.Status, m.FinishedAt = status, &now
+		for _, path := range m.outputPaths {
+			sum, size, err := fileSHA256(path)
+			if err != nil {
+				continue
+			}
+			m.Outputs = append(m.Outputs, ManifestOutput{Path: path, Size: size, SHA256: sum})
+		}
+	})
+}
+
+func fileSHA256(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// recordWriter formats the record stream for one -output destination.
+type recordWriter interface {
+	WriteRecord(rec jsonlRecord) error
+}
+
+type jsonlWriter struct{ enc *json.Encoder }
+
+func (w jsonlWriter) WriteRecord(rec jsonlRecord) error {
+	return w.enc.Encode(rec)
+}
+
+var csvHeader = []string{"ip", "prefix", "family", "status", "hostnames", "country", "city", "confidence", "source", "ttl", "retrieved_at", "fetched_at"}
+
+// csvTime writes t in RFC 3339, or nothing if it is unset.
+func csvTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (w *csvWriter) WriteRecord(rec jsonlRecord) error {
+	if !w.header {
+		w.header = true
+		w.w.Write(csvHeader)
+	}
+	confidence := ""
+	if rec.Confidence != nil {
+		confidence = strconv.Itoa(*rec.Confidence)
+	}
+	ttl := ""
+	if rec.TTL != nil {
+		ttl = strconv.FormatUint(uint64(*rec.TTL), 10)
+	}
+	w.w.Write([]string{rec.IP, rec.Prefix, rec.Family, rec.Status, strings.Join(rec.Hostnames, ";"), rec.Country, rec.City, confidence, rec.Source, ttl,
+		csvTime(rec.RetrievedAt), csvTime(rec.FetchedAt)})
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// txtWriter prints findings only, one "ip hostname[,hostname]" line each.
+type txtWriter struct{ w io.Writer }
+
+func (w txtWriter) WriteRecord(rec jsonlRecord) error {
+	if rec.Status != StatusFound.String() {
+		return nil
+	}
+	_, err := fmt.Fprintf(w.w, "%s %s\n", rec.IP, strings.Join(rec.Hostnames, ","))
+	return err
+}
+
+// dnsxWriter mimics projectdiscovery dnsx -ptr -resp output, one
+// "ip [PTR] [hostname]" line per hostname, or with asJSON its -json records,
+// so existing dnsx parsers can consume the findings unchanged. Like dnsx it
+// only reports addresses that answered, and hostnames lose the trailing dot.
+type dnsxWriter struct {
+	w      io.Writer
+	asJSON bool
+}
+
+type dnsxRecord struct {
+	Host       string    `json:"host"`
+	PTR        []string  `json:"ptr,omitempty"`
+	StatusCode string    `json:"status_code"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+func (w dnsxWriter) WriteRecord(rec jsonlRecord) error {
+	if rec.Status != StatusFound.String() || rec.Domain != "" {
+		return nil
+	}
+	names := make([]string, len(rec.Hostnames))
+	for i, name := range rec.Hostnames {
+		names[i] = strings.ToLower(strings.TrimSuffix(name, "."))
+	}
+	if w.asJSON {
+		data, err := json.Marshal(dnsxRecord{Host: rec.IP, PTR: names, StatusCode: "NOERROR", Timestamp: recordClock()})
+		if err != nil {
+			return err
+		}
+		_, err = w.w.Write(append(data, '\n'))
+		return err
+	}
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s [PTR] [%s]\n", rec.IP, name)
+	}
+	_, err := io.WriteString(w.w, b.String())
+	return err
+}
+
+// cefWriter writes one ArcSight Common Event Format line per finding, for
+// SIEMs that ingest CEF. Banner, SMTP and DNS enrichment records are left
+// out. asnOf, set once the prefixes are known, names the ASN of a prefix.
+type cefWriter struct {
+	w     io.Writer
+	asnOf func(prefix string) int
+}
+
+const (
+	cefVendor   = "unvalidor"
+	cefProduct  = "Recon"
+	cefSignID   = "ptr-finding"
+	cefName     = "Reverse DNS finding"
+	cefSeverity = 3
+)
+
+var (
+	// cefHeader escapes header fields, where a pipe ends the field.
+	cefHeader = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	// cefValue escapes extension values, where an equals sign starts the
+	// next key.
+	cefValue = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+func (w *cefWriter) WriteRecord(rec jsonlRecord) error {
+	if rec.Status != StatusFound.String() || rec.Domain != "" || rec.Port != 0 {
+		return nil
+	}
+	_, err := io.WriteString(w.w, cefLine(rec, w.asn(rec), recordClock())+"\n")
+	return err
+}
+
+func (w *cefWriter) asn(rec jsonlRecord) int {
+	if rec.ASN != 0 || w.asnOf == nil {
+		return rec.ASN
+	}
+	return w.asnOf(rec.Prefix)
+}
+
+func cefLine(rec jsonlRecord, asn int, at time.Time) string {
+	var ext []string
+	add := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefValue.Replace(value))
+		}
+	}
+	add("rt", strconv.FormatInt(at.UnixMilli(), 10))
+	if ip := net.ParseIP(rec.IP); ip != nil && ip.To4() == nil {
+		add("c6a2", rec.IP)
+		add("c6a2Label", "Source IPv6 Address")
+	} else {
+		add("src", rec.IP)
+	}
+	names := make([]string, len(rec.Hostnames))
+	for i, name := range rec.Hostnames {
+		names[i] = strings.TrimSuffix(name, ".")
+	}
+	if len(names) > 0 {
+		add("shost", names[0])
+	}
+	if asn != 0 {
+		add("cs1", strconv.Itoa(asn))
+		add("cs1Label", "ASN")
+	}
+	if rec.Prefix != "" {
+		add("cs2", rec.Prefix)
+		add("cs2Label", "Prefix")
+	}
+	if len(names) > 1 {
+		add("cs3", strings.Join(names, ","))
+		add("cs3Label", "Hostnames")
+	}
+	if rec.Country != "" {
+		add("cs4", rec.Country)
+		add("cs4Label", "Country")
+	}
+	if rec.Confidence != nil {
+		add("cn1", strconv.Itoa(*rec.Confidence))
+		add("cn1Label", "Confidence")
+	}
+	header := []string{"CEF:0", cefVendor, cefProduct, toolVersion(), cefSignID, cefName, strconv.Itoa(cefSeverity)}
+	for i := 1; i < len(header)-1; i++ {
+		header[i] = cefHeader.Replace(header[i])
+	}
+	return strings.Join(header, "|") + "|" + strings.Join(ext, " ")
+}
+
+// socketWriter streams findings as newline-delimited JSON over a unix
+// socket, dialing path or, with listen, serving whoever connects to it. A
+// missing or vanished consumer never stalls the scan: events queue in a
+// bounded buffer, oldest dropped first, and are sent once a connection is
+// back.
+type socketWriter struct {
+	path     string
+	listener net.Listener
+
+	mu       sync.Mutex
+	conn     net.Conn
+	pending  [][]byte
+	dropped  int
+	nextDial time.Time
+}
+
+const (
+	socketBuffer       = 1000
+	socketRedial       = time.Second
+	socketWriteTimeout = 2 * time.Second
+)
+
+func newSocketWriter(path string, listen bool) (*socketWriter, error) {
+	w := &socketWriter{path: path}
+	if !listen {
+		return w, nil
+	}
+	// Clear a socket left behind by an earlier run, but nothing else.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	w.listener = l
+	go w.accept()
+	return w, nil
+}
+
+// accept hands the socket to each new consumer in turn.
+func (w *socketWriter) accept() {
+	defer flushOnPanic()
+	for {
+		conn, err := w.listener.Accept()
+		if err != nil {
+			return
+		}
+		w.mu.Lock()
+		if w.conn != nil {
+			w.conn.Close()
+		}
+		w.conn = conn
+		w.flush()
+		w.mu.Unlock()
+	}
+}
+
+func (w *socketWriter) WriteRecord(rec jsonlRecord) error {
+	if rec.Status != StatusFound.String() {
+		return nil
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, append(line, '\n'))
+	if over := len(w.pending) - socketBuffer; over > 0 {
+		w.pending = w.pending[over:]
+		w.dropped += over
+	}
+	w.redial()
+	w.flush()
+	return nil
+}
+
+// redial reconnects in dial mode, at most once per socketRedial.
+func (w *socketWriter) redial() {
+	if w.conn != nil || w.listener != nil || time.Now().Before(w.nextDial) {
+		return
+	}
+	conn, err := net.DialTimeout("unix", w.path, socketWriteTimeout)
+	if err != nil {
+		w.nextDial = time.Now().Add(socketRedial)
+		return
+	}
+	w.conn = conn
+}
+
+// flush sends the pending events. A failed write drops the connection; the
+// event stays queued and is sent again in full on the next one.
+func (w *socketWriter) flush() {
+	for w.conn != nil && len(w.pending) > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+		if _, err := w.conn.Write(w.pending[0]); err != nil {
+			fmt.Printf(Red+"[!] Lost socket consumer on %s, buffering events: %v\n"+Reset, w.path, err)
+			w.conn.Close()
+			w.conn, w.nextDial = nil, time.Now().Add(socketRedial)
+			return
+		}
+		w.pending = w.pending[1:]
+	}
+}
+
+// Close makes a last attempt to deliver what is queued and reports the rest.
+func (w *socketWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.nextDial = time.Time{}
+	w.redial()
+	w.flush()
+	if w.conn != nil {
+		w.conn.Close()
+	}
+	if w.listener != nil {
+		w.listener.Close()
+	}
+	if n := len(w.pending) + w.dropped; n > 0 {
+		fmt.Printf(Red+"[!] %d findings were never delivered to %s\n"+Reset, n, w.path)
+	}
+	return nil
+}
+
+// syslogWriter sends RFC 5424 messages about a scan to a syslog collector.
+// It never holds up the scan: messages are queued for one goroutine to
+// write, anything over the rate cap or a full queue is dropped and counted,
+// and a lost collector is redialed at most once per syslogRedial.
+type syslogWriter struct {
+	target   string
+	network  string
+	addr     string
+	facility int
+	rate     int
+	hostname string
+	ch       chan []byte
+	done     chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	window  time.Time
+	sent    int
+	dropped int
+	failed  int
+
+	conn     net.Conn
+	stream   bool
+	nextDial time.Time
+	down     bool
+}
+
+const (
+	syslogAppName = "recon"
+	syslogMsgSD   = "recon@32473"
+	syslogQueue   = 1000
+	syslogRedial  = time.Second
+	syslogTimeout = 2 * time.Second
+
+	syslogWarning = 4
+	syslogNotice  = 5
+	syslogInfo    = 6
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "local0": 16, "local1": 17, "local2": 18,
+	"local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// newSyslogWriter parses udp://host[:port], tcp://host[:port] or
+// unix:///path targets; nothing is dialed until the first message.
+func newSyslogWriter(target, facility string, rate int) (*syslogWriter, error) {
+	fac, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	w := &syslogWriter{target: target, network: u.Scheme, facility: fac, rate: rate, hostname: "-",
+		ch: make(chan []byte, syslogQueue), done: make(chan struct{})}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("%q has no host", target)
+		}
+		w.addr = u.Host
+		if u.Port() == "" {
+			w.addr = net.JoinHostPort(u.Hostname(), "514")
+		}
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("%q has no socket path", target)
+		}
+		w.addr = u.Path
+	default:
+		return nil, fmt.Errorf("%q is not a udp://, tcp:// or unix:// target", target)
+	}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		w.hostname = h
+	}
+	go w.run()
+	return w, nil
+}
+
+// Send queues a message with structured data given as name, value pairs; a
+// name may repeat. A nil writer sends nothing.
+func (w *syslogWriter) Send(severity int, msgID, msg string, params ...string) {
+	if w == nil {
+		return
+	}
+	now := time.Now()
+	var sd strings.Builder
+	if len(params) > 0 {
+		sd.WriteString("[" + syslogMsgSD)
+		for i := 0; i+1 < len(params); i += 2 {
+			sd.WriteString(" " + params[i] + `="` + syslogEscaper.Replace(params[i+1]) + `"`)
+		}
+		sd.WriteString("]")
+	} else {
+		sd.WriteString("-")
+	}
+	line := fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s", w.facility*8+severity, now.Format("2006-01-02T15:04:05.000000Z07:00"),
+		w.hostname, syslogAppName, os.Getpid(), msgID, sd.String(), msg)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if now.Sub(w.window) >= time.Second {
+		w.window, w.sent = now, 0
+	}
+	if w.closed || w.rate > 0 && w.sent >= w.rate {
+		w.dropped++
+		return
+	}
+	select {
+	case w.ch <- []byte(line):
+		w.sent++
+	default:
+		w.dropped++
+	}
+}
+
+// syslogEscaper escapes structured data values as RFC 5424 section 6.3.3
+// requires.
+var syslogEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func (w *syslogWriter) run() {
+	defer close(w.done)
+	for msg := range w.ch {
+		if err := w.write(msg); err != nil {
+			w.mu.Lock()
+			w.failed++
+			w.mu.Unlock()
+			if !w.down {
+				fmt.Printf(Red+"[!] Syslog %s unreachable, dropping messages: %v\n"+Reset, w.target, err)
+				w.down = true
+			}
+			continue
+		}
+		w.down = false
+	}
+	if w.conn != nil {
+		w.conn.Close()
+	}
+}
+
+// write sends one message. Stream sockets use octet-counting framing (RFC
+// 6587); datagrams carry one message each.
+func (w *syslogWriter) write(msg []byte) error {
+	if w.conn == nil {
+		if time.Now().Before(w.nextDial) {
+			return errors.New("waiting to redial")
+		}
+		conn, err := w.dial()
+		if err != nil {
+			w.nextDial = time.Now().Add(syslogRedial)
+			return err
+		}
+		w.conn = conn
+	}
+	if w.stream {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	if _, err := w.conn.Write(msg); err != nil {
+		w.conn.Close()
+		w.conn, w.nextDial = nil, time.Now().Add(syslogRedial)
+		return err
+	}
+	return nil
+}
+
+// dial connects to the collector. A local socket is a datagram socket on
+// most systems and a stream socket on some, so both are tried.
+func (w *syslogWriter) dial() (net.Conn, error) {
+	if w.network != "unix" {
+		w.stream = w.network == "tcp"
+		return net.DialTimeout(w.network, w.addr, syslogTimeout)
+	}
+	conn, err := net.DialTimeout("unixgram", w.addr, syslogTimeout)
+	if err == nil {
+		w.stream = false
+		return conn, nil
+	}
+	w.stream = true
+	return net.DialTimeout("unix", w.addr, syslogTimeout)
+}
+
+// Close delivers what is still queued, giving up after syslogTimeout, and
+// reports the messages that were dropped.
+func (w *syslogWriter) Close() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.closed = true
+	close(w.ch)
+	w.mu.Unlock()
+	select {
+	case <-w.done:
+	case <-time.After(syslogTimeout):
+	}
+	w.mu.Lock()
+	n := w.dropped + w.failed + len(w.ch)
+	w.mu.Unlock()
+	if n > 0 {
+		fmt.Printf(Red+"[!] %d syslog messages were not delivered to %s\n"+Reset, n, w.target)
+	}
+}
+
+// outputSink is one -output destination. Files and stdout are written as
+// each record is emitted, so a record is on disk before its line is printed;
+// sockets are fed from their own channel, so a slow or broken collector
+// never holds up the scan.
+type outputSink struct {
+	spec   string
+	w      recordWriter
+	closer io.Closer
+	ch     chan jsonlRecord
+	failed bool
+	// dropped counts records Emit could not queue because the writer had
+	// fallen sinkBuffer records behind.
+	dropped int
+}
+
+// sinkBuffer is how many records an output may fall behind the scan before
+// Emit drops records for it rather than stalling the scan.
+const sinkBuffer = 4096
+
+func (s *outputSink) run(wg *sync.WaitGroup) {
+	defer flushOnPanic()
+	defer wg.Done()
+	for rec := range s.ch {
+		s.write(rec)
+	}
+	s.close()
+}
+
+// write writes rec unless the sink has already failed, and disables the
+// sink on its first error.
+func (s *outputSink) write(rec jsonlRecord) {
+	if s.failed {
+		return
+	}
+	if err := s.w.WriteRecord(rec); err != nil {
+		fmt.Printf(Red+"[!] Output %s failed, disabling it: %v\n"+Reset, s.spec, err)
+		s.failed = true
+	}
+}
+
+func (s *outputSink) close() {
+	if s.closer != nil {
+		if err := s.closer.Close(); err != nil && !s.failed {
+			fmt.Printf(Red+"[!] Output %s failed on close: %v\n"+Reset, s.spec, err)
+		}
+	}
+}
+
+// fanout copies every record to all output sinks. It is registered so an
+// early exit still drains what was already emitted.
+type fanout struct {
+	mu      sync.Mutex
+	closed  bool
+	sinks   []*outputSink
+	wg      sync.WaitGroup
+	scopeOf func(prefix string) []int
+}
+
+var (
+	fanoutsMu sync.Mutex
+	fanouts   []*fanout
+)
+
+// openOutputs opens every "format:path" spec; a path of - is stdout. When a
+// spec is bad, the outputs opened before it are closed again.
+func openOutputs(specs []string) (*fanout, error) {
+	f, err := openSinks(specs)
+	if err != nil {
+		for _, sink := range f.sinks {
+			if sink.closer != nil {
+				sink.closer.Close()
+			}
+		}
+		return nil, err
+	}
+	for _, sink := range f.sinks {
+		if sink.ch != nil {
+			f.wg.Add(1)
+			go sink.run(&f.wg)
+		}
+	}
+	fanoutsMu.Lock()
+	fanouts = append(fanouts, f)
+	fanoutsMu.Unlock()
+	return f, nil
+}
+
+// openSinks opens the sinks of openOutputs without starting them. On error
+// the returned fanout still holds every sink opened so far.
+func openSinks(specs []string) (*fanout, error) {
+	f := &fanout{}
+	for _, spec := range specs {
+		format, path, ok := strings.Cut(spec, ":")
+		if !ok || path == "" {
+			return f, fmt.Errorf("%q is not format:path", spec)
+		}
+		if format == "socket" || format == "socket-listen" {
+			w, err := newSocketWriter(path, format == "socket-listen")
+			if err != nil {
+				return f, err
+			}
+			f.sinks = append(f.sinks, &outputSink{spec: spec, w: w, closer: w, ch: make(chan jsonlRecord, sinkBuffer)})
+			continue
+		}
+		var dst io.Writer = os.Stdout
+		var closer io.Closer
+		if path != "-" {
+			out, err := openOutput(path, false)
+			if err != nil {
+				return f, err
+			}
+			dst, closer = out, out
+		}
+		sink := &outputSink{spec: spec, closer: closer}
+		f.sinks = append(f.sinks, sink)
+		switch strings.ToLower(format) {
+		case "jsonl":
+			sink.w = jsonlWriter{json.NewEncoder(dst)}
+		case "csv":
+			sink.w = &csvWriter{w: csv.NewWriter(dst)}
+		case "txt":
+			sink.w = txtWriter{dst}
+		case "dnsx":
+			sink.w = dnsxWriter{w: dst}
+		case "dnsx-json":
+			sink.w = dnsxWriter{w: dst, asJSON: true}
+		case "cef":
+			sink.w = &cefWriter{w: dst}
+		default:
+			return f, fmt.Errorf("unknown output format %q (want jsonl, csv, txt, dnsx, dnsx-json or cef)", format)
+		}
+	}
+	return f, nil
+}
+
+// Emit writes rec to the file and stdout sinks and queues it for the socket
+// sinks without waiting on them: a socket whose queue is full loses the
+// record, and the loss is reported when the fanout is closed. Records
+// emitted after Close are dropped.
+func (f *fanout) Emit(rec jsonlRecord) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	if f.scopeOf != nil && rec.ScopePath == nil {
+		rec.ScopePath = f.scopeOf(rec.Prefix)
+	}
+	for _, sink := range f.sinks {
+		if sink.ch == nil {
+			sink.write(rec)
+			continue
+		}
+		select {
+		case sink.ch <- rec:
+		default:
+			sink.dropped++
+		}
+	}
+}
+
+// SetScope makes every record carry the scope path of its prefix. It must
+// be called before the first record is emitted.
+func (f *fanout) SetScope(scopeOf func(prefix string) []int) {
+	if f != nil {
+		f.scopeOf = scopeOf
+	}
+}
+
+// SetASNs gives the sinks that report ASNs a way to look them up. It must be
+// called before the first record is emitted.
+func (f *fanout) SetASNs(asnOf func(prefix string) int) {
+	if f == nil {
+		return
+	}
+	for _, sink := range f.sinks {
+		if w, ok := sink.w.(*cefWriter); ok {
+			w.asnOf = asnOf
+		}
+	}
+}
+
+// Close waits until every sink has written what it was given, and reports
+// the records sinks that fell behind never got.
+func (f *fanout) Close() {
+	f.mu.Lock()
+	first := !f.closed
+	if first {
+		f.closed = true
+		for _, sink := range f.sinks {
+			if sink.ch == nil {
+				sink.close()
+			} else {
+				close(sink.ch)
+			}
+		}
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+	if !first {
+		return
+	}
+	for _, sink := range f.sinks {
+		if sink.dropped > 0 {
+			fmt.Printf(Red+"[!] Output %s fell behind the scan, %d records were dropped\n"+Reset, sink.spec, sink.dropped)
+		}
+	}
+}
+
+// writeFileAtomic replaces path with data via a temporary file and rename,
+// so readers never see a half-written file.
+func writeFileAtomic(path string, data []byte) error {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+const (
+	bucketOrgs     = "orgs"
+	bucketASNs     = "asns"
+	bucketPrefixes = "prefixes"
+	bucketHosts    = "hosts"
+	// Scan jobs submitted in serve mode, keyed by job ID.
+	bucketScans = "scans"
+)
+
+// Store is a small embedded key-value database. Records are grouped in
+// buckets and every bucket key other than in the orgs and scans buckets is
+// prefixed with the normalized organization name.
+//
+// The file is an append-only log with one JSON line per record set, so
+// processes sharing a store (a watch loop next to serve mode, say) add their
+// changes to it instead of overwriting each other's. Compaction replaces the
+// log with a snapshot line of all buckets, the same shape as stores written
+// before the log.
+type Store struct {
+	path    string
+	Buckets map[string]map[string]json.RawMessage `json:"buckets"`
+	// pending holds the records put since the last Save, logged the number
+	// of lines in the log, to tell when compacting it is worthwhile.
+	pending []storeEntry
+	logged  int
+}
+
+// storeEntry is one line of the store log.
+type storeEntry struct {
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value"`
+}
+
+type SeenTimes struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+func (t *SeenTimes) touch(now time.Time) {
+	if t.FirstSeen.IsZero() {
+		t.FirstSeen = now
+	}
+	t.LastSeen = now
+}
+
+type OrgRecord struct {
+	Name string `json:"name"`
+	SeenTimes
+}
+
+type ASNRecord struct {
+	Org  string `json:"org"`
+	ASN  int    `json:"asn"`
+	Name string `json:"name"`
+	SeenTimes
+}
+
+type PrefixRecord struct {
+	Org    string `json:"org"`
+	Prefix string `json:"prefix"`
+	ASN    int    `json:"asn,omitempty"`
+	// ScannedAt is when every address of the prefix was last looked up;
+	// LastSeen also moves for sampled and partial runs.
+	ScannedAt *time.Time `json:"scanned_at,omitempty"`
+	SeenTimes
+}
+
+type HostRecord struct {
+	Org       string   `json:"org"`
+	IP        string   `json:"ip"`
+	Prefix    string   `json:"prefix"`
+	Hostnames []string `json:"hostnames"`
+	SeenTimes
+}
+
+func openStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replays the log into s.Buckets. A line that does not parse, such as
+// the torn last line of a process killed mid-append, is skipped.
+func (s *Store) load() error {
+	s.Buckets, s.logged = map[string]map[string]json.RawMessage{}, 0
+	for _, b := range []string{bucketOrgs, bucketASNs, bucketPrefixes, bucketHosts, bucketScans} {
+		s.Buckets[b] = map[string]json.RawMessage{}
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if first, _, _ := bytes.Cut(data, []byte("\n")); string(bytes.TrimSpace(first)) == "{" {
+		// A store from before the log: one indented snapshot, possibly
+		// followed by lines appended since.
+		dec := json.NewDecoder(bytes.NewReader(data))
+		var snap Store
+		if err := dec.Decode(&snap); err != nil {
+			return fmt.Errorf("corrupt store %s: %v", s.path, err)
+		}
+		s.apply(snap.Buckets, storeEntry{})
+		s.logged++
+		data = data[dec.InputOffset():]
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var rec struct {
+			Buckets map[string]map[string]json.RawMessage `json:"buckets"`
+			storeEntry
+		}
+		if len(bytes.TrimSpace(line)) == 0 || json.Unmarshal(line, &rec) != nil {
+			continue
+		}
+		s.apply(rec.Buckets, rec.storeEntry)
+		s.logged++
+	}
+	return nil
+}
+
+// apply merges a snapshot and a single record into s.Buckets.
+func (s *Store) apply(snap map[string]map[string]json.RawMessage, e storeEntry) {
+	for b, records := range snap {
+		if s.Buckets[b] == nil {
+			s.Buckets[b] = map[string]json.RawMessage{}
+		}
+		for k, v := range records {
+			s.Buckets[b][k] = v
+		}
+	}
+	if e.Bucket != "" {
+		if s.Buckets[e.Bucket] == nil {
+			s.Buckets[e.Bucket] = map[string]json.RawMessage{}
+		}
+		s.Buckets[e.Bucket][e.Key] = e.Value
+	}
+}
+
+// Save appends the records put since the last Save to the log, holding the
+// store's lock so writers never interleave. Once the log holds several
+// times as many lines as there are records, it is reloaded (picking up what
+// other processes appended) and compacted into a single snapshot.
+func (s *Store) Save() error {
+	unlock, err := lockFile(s.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if len(s.pending) > 0 {
+		if err := s.appendPending(); err != nil {
+			return err
+		}
+	}
+	live := 0
+	for _, records := range s.Buckets {
+		live += len(records)
+	}
+	if s.logged < storeCompactMin || s.logged < 4*live {
+		return nil
+	}
+	if err := s.load(); err != nil {
+		return err
+	}
+	line, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, append(line, '\n')); err != nil {
+		return err
+	}
+	s.logged = 1
+	return nil
+}
+
+// Compaction waits for the log to reach this many lines.
+const storeCompactMin = 1024
+
+// appendPending writes s.pending to the end of the log. s's lock must be
+// held.
+func (s *Store) appendPending() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	// Start on a line of its own after a torn last line.
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, fi.Size()-1); err == nil && last[0] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	for _, e := range s.pending {
+		line, err := json.Marshal(e)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.logged += len(s.pending)
+	s.pending = nil
+	return nil
+}
+
+// A lock older than this was left behind by a killed process: appends and
+// compactions hold it for well under a second.
+const staleLock = 30 * time.Second
+
+// lockFile takes the lock on path, a path+".lock" file created exclusively,
+// waiting up to a few seconds for another process to release it. A lock
+// file is used rather than flock(2) because the syscall package has none on
+// Windows. The returned func releases the lock.
+func lockFile(path string) (func(), error) {
+	lock := path + ".lock"
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(lock); err == nil && time.Since(fi.ModTime()) > staleLock {
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is locked by another process (remove %s if none is running)", path, lock)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (s *Store) Get(bucket, key string, v interface{}) (bool, error) {
+	raw, ok := s.Buckets[bucket][key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+func (s *Store) Put(bucket, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.Buckets[bucket][key] = raw
+	s.pending = append(s.pending, storeEntry{Bucket: bucket, Key: key, Value: raw})
+	return nil
+}
+
+// ForEach calls fn for every key in bucket starting with prefix, in key order.
+func (s *Store) ForEach(bucket, prefix string, fn func(key string, raw json.RawMessage) error) error {
+	keys := make([]string, 0, len(s.Buckets[bucket]))
+	for k := range s.Buckets[bucket] {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(k, s.Buckets[bucket][k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func orgKey(org string) string {
+	return strings.ToLower(strings.TrimSpace(org))
+}
+
+func storeKey(org, item string) string {
+	return orgKey(org) + "|" + item
+}
+
+func (s *Store) TouchOrg(org string, now time.Time) error {
+	var rec OrgRecord
+	if _, err := s.Get(bucketOrgs, orgKey(org), &rec); err != nil {
+		return err
+	}
+	rec.Name = org
+	rec.touch(now)
+	return s.Put(bucketOrgs, orgKey(org), rec)
+}
+
+func (s *Store) TouchASN(org string, asn int, name string, now time.Time) error {
+	key := storeKey(org, fmt.Sprintf("AS%d", asn))
+	var rec ASNRecord
+	if _, err := s.Get(bucketASNs, key, &rec); err != nil {
+		return err
+	}
+	rec.Org, rec.ASN, rec.Name = org, asn, name
+	rec.touch(now)
+	return s.Put(bucketASNs, key, rec)
+}
+
+func (s *Store) TouchPrefix(org, prefix string, asn int, now time.Time) error {
+	key := storeKey(org, prefix)
+	var rec PrefixRecord
+	if _, err := s.Get(bucketPrefixes, key, &rec); err != nil {
+		return err
+	}
+	rec.Org, rec.Prefix = org, prefix
+	if asn != 0 {
+		rec.ASN = asn
+	}
+	rec.touch(now)
+	return s.Put(bucketPrefixes, key, rec)
+}
+
+// MarkScanned records that a scan of prefix for org ran to completion.
+func (s *Store) MarkScanned(org, prefix string, now time.Time) error {
+	key := storeKey(org, prefix)
+	var rec PrefixRecord
+	if _, err := s.Get(bucketPrefixes, key, &rec); err != nil {
+		return err
+	}
+	rec.Org, rec.Prefix, rec.ScannedAt = org, prefix, &now
+	return s.Put(bucketPrefixes, key, rec)
+}
+
+// LastScanned returns when prefix was last scanned to completion for org,
+// or nil if it never was.
+func (s *Store) LastScanned(org, prefix string) (*time.Time, error) {
+	var rec PrefixRecord
+	if _, err := s.Get(bucketPrefixes, storeKey(org, prefix), &rec); err != nil {
+		return nil, err
+	}
+	return rec.ScannedAt, nil
+}
+
+func (s *Store) TouchHost(org, prefix string, res LookupResult, now time.Time) error {
+	key := storeKey(org, res.IP)
+	var rec HostRecord
+	if _, err := s.Get(bucketHosts, key, &rec); err != nil {
+		return err
+	}
+	rec.Org, rec.IP, rec.Prefix, rec.Hostnames = org, res.IP, prefix, res.Names
+	rec.touch(now)
+	return s.Put(bucketHosts, key, rec)
+}
+
+func formatSeen(t SeenTimes) string {
+	return fmt.Sprintf("first seen %s, last seen %s", t.FirstSeen.Format(time.RFC3339), t.LastSeen.Format(time.RFC3339))
+}
+
+func runDB(args []string) {
+	if len(args) == 0 || args[0] != "show" {
+		fmt.Println(Red + "Usage: go run asn-lookup.go db show -db path -org name" + Reset)
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("db show", flag.ExitOnError)
+	dbPath := fs.String("db", "", "path of the results store")
+	org := fs.String("org", "", "organization to show")
+	fs.Parse(args[1:])
+
+	if *dbPath == "" || *org == "" {
+		fmt.Println(Red + "Error: db show requires -db and -org." + Reset)
+		os.Exit(1)
+	}
+
+	store, err := openStore(*dbPath)
+	if err != nil {
+		fmt.Println(Red+"Error opening store:", err, Reset)
+		os.Exit(1)
+	}
+
+	var orgRec OrgRecord
+	found, err := store.Get(bucketOrgs, orgKey(*org), &orgRec)
+	if err != nil || !found {
+		fmt.Printf(Red+"No stored results for %s\n"+Reset, *org)
+		os.Exit(1)
+	}
+
+	fmt.Printf(Green+"[+] %s (%s)\n"+Reset, orgRec.Name, formatSeen(orgRec.SeenTimes))
+	keyPrefix := storeKey(*org, "")
+
+	fmt.Println(Green + "\n[+] ASNs" + Reset)
+	store.ForEach(bucketASNs, keyPrefix, func(_ string, raw json.RawMessage) error {
+		var rec ASNRecord
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return err
+		}
+		fmt.Printf(Blue+"AS%d"+Reset+" - %s (%s)\n", rec.ASN, rec.Name, formatSeen(rec.SeenTimes))
+		return nil
+	})
+
+	fmt.Println(Green + "\n[+] Prefixes" + Reset)
+	store.ForEach(bucketPrefixes, keyPrefix, func(_ string, raw json.RawMessage) error {
+		var rec PrefixRecord
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return err
+		}
+		fmt.Printf("%s (%s)\n", rec.Prefix, formatSeen(rec.SeenTimes))
+		return nil
+	})
+
+	fmt.Println(Green + "\n[+] Hosts" + Reset)
+	store.ForEach(bucketHosts, keyPrefix, func(_ string, raw json.RawMessage) error {
+		var rec HostRecord
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return err
+		}
+		if len(rec.Hostnames) == 0 {
+			fmt.Printf("%s (no longer resolves, %s)\n", rec.IP, formatSeen(rec.SeenTimes))
+			return nil
+		}
+		fmt.Printf(Blue+"%s -> %s"+Reset+" (%s)\n", rec.IP, strings.Join(rec.Hostnames, ", "), formatSeen(rec.SeenTimes))
+		return nil
+	})
+}
+
+type mmdbReader struct {
+	buf        []byte
+	dataStart  int
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// openMMDB loads a MaxMind DB file (GeoLite2-City / GeoLite2-Country) into
+// memory. Only the subset of the format needed for lookups is implemented.
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	idx := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if idx < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	metaStart := idx + len(mmdbMetadataMarker)
+	meta, _, err := (&mmdbReader{buf: buf[metaStart:]}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("bad metadata: %v", err)
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("bad metadata")
+	}
+
+	r := &mmdbReader{
+		nodeCount:  uint(toUint(m["node_count"])),
+		recordSize: uint(toUint(m["record_size"])),
+		ipVersion:  uint(toUint(m["ip_version"])),
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	treeSize := int(r.nodeCount * r.recordSize / 4)
+	if treeSize+16 > metaStart {
+		return nil, errors.New("truncated search tree")
+	}
+	r.dataStart = treeSize + 16
+	r.buf = buf[:idx]
+
+	if r.ipVersion == 6 {
+		// IPv4 addresses live under ::/96 in IPv6 trees.
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func toUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		return uint64(n)
+	}
+	return 0
+}
+
+func (r *mmdbReader) record(node, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.buf[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.buf[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	b := r.buf[node*8+bit*4:]
+	return uint(binary.BigEndian.Uint32(b))
+}
+
+// lookup returns the decoded data record for ip, or nil if it is not covered.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	addr, node := ip.To16(), uint(0)
+	if ipv4 := ip.To4(); ipv4 != nil {
+		addr = ipv4
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(addr)*8 && node < r.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	if node <= r.nodeCount {
+		return nil, nil
+	}
+	// Records past the node count point 16 bytes beyond the data section
+	// separator, so the 15 values just above it point nowhere.
+	if node < r.nodeCount+16 || int(node-r.nodeCount)-16 >= len(r.buf)-r.dataStart {
+		return nil, errors.New("invalid data pointer")
+	}
+	v, _, err := r.decode(int(node-r.nodeCount) - 16)
+	return v, err
+}
+
+// mmdbMaxDepth caps how deeply maps, arrays and pointers may nest, as in
+// libmaxminddb, so a pointer cycle in a corrupt file cannot recurse forever.
+const mmdbMaxDepth = 512
+
+// decode reads the data section value at offset (relative to the start of
+// the data section) and returns it with the offset following it.
+func (r *mmdbReader) decode(offset int) (interface{}, int, error) {
+	return r.decodeAt(offset, 0)
+}
+
+func (r *mmdbReader) decodeAt(offset, depth int) (interface{}, int, error) {
+	data := r.buf[r.dataStart:]
+	if offset < 0 || offset >= len(data) {
+		return nil, 0, errors.New("offset out of range")
+	}
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	ctrl := data[offset]
+	offset++
+	typ := int(ctrl >> 5)
+
+	if typ == 1 {
+		ss, vvv := int(ctrl>>3)&3, int(ctrl&7)
+		if offset+ss+1 > len(data) {
+			return nil, 0, errors.New("truncated pointer")
+		}
+		var ptr int
+		switch ss {
+		case 0:
+			ptr = vvv<<8 | int(data[offset])
+		case 1:
+			ptr = 2048 + (vvv<<16 | int(data[offset])<<8 | int(data[offset+1]))
+		case 2:
+			ptr = 526336 + (vvv<<24 | int(data[offset])<<16 | int(data[offset+1])<<8 | int(data[offset+2]))
+		case 3:
+			ptr = int(binary.BigEndian.Uint32(data[offset:]))
+		}
+		v, _, err := r.decodeAt(ptr, depth+1)
+		return v, offset + ss + 1, err
+	}
+
+	if typ == 0 {
+		if offset >= len(data) {
+			return nil, 0, errors.New("truncated type")
+		}
+		typ = 7 + int(data[offset])
+		offset++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(data) {
+			return nil, 0, errors.New("truncated size")
+		}
+		ext := 0
+		for _, b := range data[offset : offset+n] {
+			ext = ext<<8 | int(b)
+		}
+		size = [...]int{29, 285, 65821}[n-1] + ext
+		offset += n
+	}
+
+	// Every map entry and array element takes at least one byte, so a size
+	// beyond what is left is corrupt, and must not size an allocation.
+	if (typ == 7 || typ == 11) && size > len(data)-offset {
+		return nil, 0, errors.New("truncated container")
+	}
+	switch typ {
+	case 7:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			k, next, err := r.decodeAt(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			v, next, err := r.decodeAt(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, _ := k.(string)
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case 11:
+		a := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			v, next, err := r.decodeAt(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > len(data) {
+		return nil, 0, errors.New("truncated value")
+	}
+	raw := data[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2:
+		return string(raw), offset, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, errors.New("bad double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), offset, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, errors.New("bad float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), offset, nil
+	case 5, 6, 9, 10:
+		var n uint64
+		for _, b := range raw {
+			n = n<<8 | uint64(b)
+		}
+		return n, offset, nil
+	case 8:
+		var n uint32
+		for _, b := range raw {
+			n = n<<8 | uint32(b)
+		}
+		return int64(int32(n)), offset, nil
+	}
+	return raw, offset, nil
+}
+
+func lookupPath(v interface{}, path ...string) string {
+	for _, p := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = m[p]
+	}
+	str, _ := v.(string)
+	return str
+}
+
+type GeoInfo struct {
+	Country string
+	City    string
+}
+
+// geoIP enriches findings from a local mmdb file. Results are cached per
+// /24 (per /48 for IPv6) since neighbouring addresses almost always share a
+// location and the hot path should not decode records for every hit.
+type geoIP struct {
+	db    *mmdbReader
+	mu    sync.Mutex
+	cache map[string]GeoInfo
+}
+
+func newGeoIP(path string) (*geoIP, error) {
+	db, err := openMMDB(path)
+	if err != nil {
+		return nil, err
+	}
+	return &geoIP{db: db, cache: map[string]GeoInfo{}}, nil
+}
+
+func (g *geoIP) Lookup(ip string) GeoInfo {
+	if g == nil {
+		return GeoInfo{}
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return GeoInfo{}
+	}
+	mask := net.CIDRMask(24, 32)
+	if parsed.To4() == nil {
+		mask = net.CIDRMask(48, 128)
+	}
+	key := parsed.Mask(mask).String()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if info, ok := g.cache[key]; ok {
+		return info
+	}
+	var info GeoInfo
+	if rec, err := g.db.lookup(parsed); err == nil && rec != nil {
+		info.Country = lookupPath(rec, "country", "iso_code")
+		if info.Country == "" {
+			info.Country = lookupPath(rec, "registered_country", "iso_code")
+		}
+		info.City = lookupPath(rec, "city", "names", "en")
+	}
+	g.cache[key] = info
+	return info
+}
+
+func printCountryBreakdown(counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+	countries := make([]string, 0, len(counts))
+	for c := range counts {
+		countries = append(countries, c)
+	}
+	sort.Slice(countries, func(i, j int) bool {
+		if counts[countries[i]] != counts[countries[j]] {
+			return counts[countries[i]] > counts[countries[j]]
+		}
+		return countries[i] < countries[j]
+	})
+
+	fmt.Println(Green + "\n[+] Findings by country" + Reset)
+	for _, c := range countries {
+		label := c
+		if label == "" {
+			label = "unknown"
+		}
+		fmt.Printf("%s: %d\n", label, counts[c])
+	}
+}
+
+const (
+	dnsTypeNS    = 2
+	dnsTypeCNAME = 5
+	dnsTypeSOA   = 6
+	dnsTypePTR   = 12
+	dnsTypeOPT   = 41
+	dnsTypeAXFR  = 252
+	dnsClassIN   = 1
+
+	rcodeNoError  = 0
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeRefused  = 5
+)
+
+type dnsRR struct {
+	Name   string
+	Type   uint16
+	Class  uint16
+	TTL    uint32
+	Data   []byte
+	Target string // decoded domain name for NS, CNAME and PTR records, and the SOA primary
+	SOA    *SOARecord
+}
+
+type dnsMsg struct {
+	ID            uint16
+	Rcode         int
+	Authoritative bool
+	Truncated     bool
+	Answers       []dnsRR
+}
+
+var rcodeNames = map[int]string{0: "NOERROR", 1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED"}
+
+// rcodeName returns the mnemonic for a DNS response code, or RCODE<n> for
+// one without.
+func rcodeName(rcode int) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, fmt.Errorf("invalid DNS name %q", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// buildQuery encodes a recursive single-question query.
+func buildQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	b := make([]byte, 12, 64)
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], 0x0100) // RD
+	binary.BigEndian.PutUint16(b[4:], 1)
+	b, err := appendName(b, name)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	return binary.BigEndian.AppendUint16(b, dnsClassIN), nil
+}
+
+// withEDNS adds an EDNS0 OPT record advertising a UDP payload of size bytes
+// to query q.
+func withEDNS(q []byte, size uint16) []byte {
+	binary.BigEndian.PutUint16(q[10:], binary.BigEndian.Uint16(q[10:])+1)
+	q = append(q, 0) // root name
+	q = binary.BigEndian.AppendUint16(q, dnsTypeOPT)
+	q = binary.BigEndian.AppendUint16(q, size)
+	q = binary.BigEndian.AppendUint32(q, 0) // extended rcode and flags
+	return binary.BigEndian.AppendUint16(q, 0)
+}
+
+// readName decodes a possibly compressed domain name starting at off and
+// returns it with the offset just past it in the original (uncompressed) position.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 127 {
+			return "", 0, errors.New("malformed name")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("malformed name pointer")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errors.New("malformed label")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+func parseMsg(msg []byte) (*dnsMsg, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("short DNS message")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	m := &dnsMsg{
+		ID:            binary.BigEndian.Uint16(msg[0:]),
+		Rcode:         int(flags & 0x0f),
+		Authoritative: flags&0x0400 != 0,
+		Truncated:     flags&0x0200 != 0,
+	}
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	anCount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < qdCount; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+
+	for i := 0; i < anCount; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(msg) {
+			return nil, errors.New("truncated resource record")
+		}
+		rr := dnsRR{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[next:]),
+			Class: binary.BigEndian.Uint16(msg[next+2:]),
+			TTL:   binary.BigEndian.Uint32(msg[next+4:]),
+		}
+		rdLen := int(binary.BigEndian.Uint16(msg[next+8:]))
+		start := next + 10
+		if start+rdLen > len(msg) {
+			return nil, errors.New("truncated record data")
+		}
+		rr.Data = msg[start : start+rdLen]
+		switch rr.Type {
+		case dnsTypeNS, dnsTypeCNAME, dnsTypePTR:
+			if rr.Target, _, err = readName(msg, start); err != nil {
+				return nil, err
+			}
+		case dnsTypeSOA:
+			if rr.SOA, err = readSOA(msg, start, start+rdLen); err != nil {
+				return nil, err
+			}
+			rr.Target = rr.SOA.Primary
+		}
+		m.Answers = append(m.Answers, rr)
+		off = start + rdLen
+	}
+	return m, nil
+}
+
+// readSOA decodes SOA rdata spanning msg[start:end]; only the fields worth
+// reporting are kept.
+func readSOA(msg []byte, start, end int) (*SOARecord, error) {
+	primary, off, err := readName(msg, start)
+	if err != nil {
+		return nil, err
+	}
+	contact, off, err := readName(msg, off)
+	if err != nil {
+		return nil, err
+	}
+	if off+20 > end {
+		return nil, errors.New("truncated SOA record")
+	}
+	return &SOARecord{Primary: primary, Contact: contact, Serial: binary.BigEndian.Uint32(msg[off:])}, nil
+}
+
+// resultFromMsg maps a raw PTR response onto the same outcomes the stub
+// resolver path produces.
+func resultFromMsg(ip, server string, msg *dnsMsg) LookupResult {
+	res := LookupResult{IP: ip, Answer: &PTRAnswer{Rcode: msg.Rcode, Authoritative: msg.Authoritative, Server: server}}
+	switch msg.Rcode {
+	case rcodeNoError:
+		for _, rr := range msg.Answers {
+			if rr.Type == dnsTypePTR {
+				if len(res.Names) == 0 || rr.TTL < res.Answer.TTL {
+					res.Answer.TTL = rr.TTL
+				}
+				res.Names = append(res.Names, rr.Target)
+			}
+		}
+		switch {
+		case len(res.Names) == 0 && msg.Truncated:
+			// Truncated before the first record: nothing is known.
+			res.Status = StatusError
+			res.Err = &net.DNSError{Err: "answer truncated before any record", Name: ip, Server: server}
+		case len(res.Names) == 0:
+			res.Status = StatusNXDomain
+			res.Err = &net.DNSError{Err: "no such host", Name: ip, Server: server, IsNotFound: true}
+		}
+	case rcodeNXDomain:
+		res.Status = StatusNXDomain
+		res.Err = &net.DNSError{Err: "no such host", Name: ip, Server: server, IsNotFound: true}
+	case rcodeServFail, rcodeRefused:
+		res.Status = StatusServFail
+		res.Err = &net.DNSError{Err: "server misbehaving", Name: ip, Server: server, IsTemporary: true}
+	default:
+		res.Status = StatusError
+		res.Err = &net.DNSError{Err: fmt.Sprintf("unexpected rcode %d", msg.Rcode), Name: ip, Server: server}
+	}
+	return res
+}
+
+var errPipeClosed = errors.New("pipelined DNS connection closed")
+
+// pipeConn is one persistent TCP connection carrying many outstanding
+// queries at once. Responses are matched back to callers by message ID.
+type pipeConn struct {
+	addr string
+
+	mu      sync.Mutex
+	conn    net.Conn
+	pending map[uint16]chan *dnsMsg
+	nextID  uint16
+
+	wmu sync.Mutex
+}
+
+func (c *pipeConn) connect() (net.Conn, error) {
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	conn, err := dnsDial(context.Background(), "tcp", c.addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	c.pending = map[uint16]chan *dnsMsg{}
+	go c.readLoop(conn)
+	return conn, nil
+}
+
+func (c *pipeConn) readLoop(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	var lenBuf [2]byte
+	for {
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			c.fail(conn)
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			c.fail(conn)
+			return
+		}
+		msg, err := parseMsg(buf)
+		if err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[msg.ID]
+		delete(c.pending, msg.ID)
+		c.mu.Unlock()
+		if ok {
+			ch <- msg
+		}
+	}
+}
+
+// fail tears down conn and wakes every caller still waiting on it.
+func (c *pipeConn) fail(conn net.Conn) {
+	c.mu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+		for id, ch := range c.pending {
+			close(ch)
+			delete(c.pending, id)
+		}
+	}
+	c.mu.Unlock()
+	conn.Close()
+}
+
+func (c *pipeConn) query(name string, qtype uint16, timeout time.Duration) (*dnsMsg, error) {
+	c.mu.Lock()
+	conn, err := c.connect()
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	for c.pending[c.nextID] != nil {
+		c.nextID++
+	}
+	id := c.nextID
+	c.nextID++
+	ch := make(chan *dnsMsg, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	q, err := buildQuery(id, name, qtype)
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, err
+	}
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, len(q)+2), uint16(len(q)))
+	frame = append(frame, q...)
+
+	c.wmu.Lock()
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err = conn.Write(frame)
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(conn)
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return nil, errPipeClosed
+		}
+		return msg, nil
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, &net.DNSError{Err: "i/o timeout", Name: name, Server: c.addr, IsTimeout: true}
+	}
+}
+
+// pipelinedResolver spreads PTR queries over a few persistent TCP
+// connections. Connection-level failures fall back to the standard path
+// for the affected lookup so a flaky resolver link never loses results.
+type pipelinedResolver struct {
+	addr     string
+	timeout  time.Duration
+	conns    []*pipeConn
+	next     uint32
+	fallback PTRLookuper
+}
+
+func newPipelinedResolver(addr string, conns int, fallback PTRLookuper) (*pipelinedResolver, error) {
+	if conns < 1 {
+		conns = 1
+	}
+	p := &pipelinedResolver{addr: addr, timeout: 5 * time.Second, fallback: fallback}
+	for i := 0; i < conns; i++ {
+		c := &pipeConn{addr: addr, nextID: uint16(rand.Intn(1 << 16))}
+		c.mu.Lock()
+		_, err := c.connect()
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		p.conns = append(p.conns, c)
+	}
+	return p, nil
+}
+
+func (p *pipelinedResolver) LookupAddr(ctx context.Context, ip string) ([]string, error) {
+	res := p.QueryPTR(ctx, ip)
+	return res.Names, res.Err
+}
+
+func (p *pipelinedResolver) QueryPTR(ctx context.Context, ip string) LookupResult {
+	if err := ctx.Err(); err != nil {
+		return failedLookup(ip, err)
+	}
+	c := p.conns[atomic.AddUint32(&p.next, 1)%uint32(len(p.conns))]
+	timeout := p.timeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	msg, err := c.query(reverseName(net.ParseIP(ip)), dnsTypePTR, timeout)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsTimeout {
+			return failedLookup(ip, err)
+		}
+		return lookupWith(ctx, p.fallback, ip)
+	}
+	return resultFromMsg(ip, p.addr, msg)
+}
+
+// defaultEDNSSize is the UDP payload size advertised by the raw resolver,
+// the DNS flag day 2020 recommendation.
+const defaultEDNSSize = 1232
+
+// rawResolver sends its own PTR queries to addr, with an EDNS0 OPT record
+// advertising ednsSize (none if 0). An answer that is truncated or larger
+// than advertised is asked for again over TCP, unless transport is udp.
+type rawResolver struct {
+	addr      string
+	transport string
+	ednsSize  uint16
+	timeout   time.Duration
+}
+
+func (r *rawResolver) LookupAddr(ctx context.Context, ip string) ([]string, error) {
+	res := r.QueryPTR(ctx, ip)
+	return res.Names, res.Err
+}
+
+func (r *rawResolver) QueryPTR(ctx context.Context, ip string) LookupResult {
+	msg, err := r.exchange(ctx, ip)
+	if err != nil {
+		return failedLookup(ip, err)
+	}
+	return resultFromMsg(ip, r.addr, msg)
+}
+
+// exchange sends the PTR query for ip and returns the final answer, after
+// any retry over TCP.
+func (r *rawResolver) exchange(ctx context.Context, ip string) (*dnsMsg, error) {
+	return r.query(ctx, reverseName(net.ParseIP(ip)), dnsTypePTR)
+}
+
+// query sends a qtype query for name and returns the final answer, after
+// any retry over TCP.
+func (r *rawResolver) query(ctx context.Context, name string, qtype uint16) (*dnsMsg, error) {
+	id := uint16(rand.Intn(1 << 16))
+	q, err := buildQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if r.ednsSize > 0 {
+		q = withEDNS(q, r.ednsSize)
+	}
+
+	var msg *dnsMsg
+	if r.transport != transportTCP {
+		var oversized bool
+		if msg, oversized, err = r.exchangeUDP(ctx, id, q); err != nil {
+			return nil, err
+		}
+		if msg.Truncated || oversized {
+			truncations.Add(1)
+		}
+		if r.transport == transportUDP || !msg.Truncated && !oversized {
+			return msg, nil
+		}
+	}
+	return r.exchangeTCP(ctx, id, q)
+}
+
+// exchangeUDP reports an answer bigger than the advertised payload as
+// oversized; some servers send one instead of truncating.
+func (r *rawResolver) exchangeUDP(ctx context.Context, id uint16, q []byte) (msg *dnsMsg, oversized bool, err error) {
+	conn, err := dnsDial(ctx, "udp", r.addr, r.timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.timeout))
+
+	if _, err := conn.Write(q); err != nil {
+		return nil, false, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, false, &net.DNSError{Err: "i/o timeout", Server: r.addr, IsTimeout: true}
+			}
+			return nil, false, err
+		}
+		if msg, err = parseMsg(buf[:n]); err != nil || msg.ID != id {
+			continue
+		}
+		return msg, n > max(int(r.ednsSize), 512), nil
+	}
+}
+
+func (r *rawResolver) exchangeTCP(ctx context.Context, id uint16, q []byte) (*dnsMsg, error) {
+	conn, err := dnsDial(ctx, "tcp", r.addr, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.timeout))
+
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, len(q)+2), uint16(len(q)))
+	if _, err := conn.Write(append(frame, q...)); err != nil {
+		return nil, err
+	}
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	msg, err := parseMsg(buf)
+	if err != nil {
+		return nil, err
+	}
+	if msg.ID != id {
+		return nil, errors.New("DNS response ID mismatch")
+	}
+	return msg, nil
+}
+
+const (
+	// failoverThreshold is how many lookups in a row may fail (timeout,
+	// SERVFAIL or error) before a resolver is taken out of the chain.
+	failoverThreshold = 20
+	// probeInterval is how often an unhealthy resolver gets one lookup to
+	// show whether it has recovered.
+	probeInterval = 30 * time.Second
+)
+
+// ResolverEvent is a health transition of a resolver in the fallback chain.
+type ResolverEvent struct {
+	Time     time.Time `json:"time"`
+	Resolver string    `json:"resolver"`
+	Healthy  bool      `json:"healthy"`
+}
+
+type chainMember struct {
+	name      string
+	ptr       PTRLookuper
+	healthy   bool
+	failures  int
+	nextProbe time.Time
+}
+
+// resolverChain sends lookups to the first healthy resolver of an ordered
+// list, so a primary dying mid-scan shifts traffic to the fallbacks instead
+// of turning every lookup into a timeout.
+type resolverChain struct {
+	mu      sync.Mutex
+	members []*chainMember
+	events  []ResolverEvent
+}
+
+func newResolverChain() *resolverChain {
+	return &resolverChain{}
+}
+
+func (c *resolverChain) Add(name string, ptr PTRLookuper) {
+	c.members = append(c.members, &chainMember{name: name, ptr: ptr, healthy: true})
+}
+
+// pick returns the resolver for the next lookup: an unhealthy one that is
+// due for a probe, else the first healthy one, else the primary.
+func (c *resolverChain) pick() *chainMember {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for _, m := range c.members {
+		if !m.healthy && now.After(m.nextProbe) {
+			m.nextProbe = now.Add(probeInterval)
+			return m
+		}
+	}
+	for _, m := range c.members {
+		if m.healthy {
+			return m
+		}
+	}
+	return c.members[0]
+}
+
+func (c *resolverChain) LookupAddr(ctx context.Context, ip string) ([]string, error) {
+	res := c.QueryPTR(ctx, ip)
+	return res.Names, res.Err
+}
+
+// QueryPTR goes through lookupWith so members that read the response
+// themselves still report its details.
+func (c *resolverChain) QueryPTR(ctx context.Context, ip string) LookupResult {
+	m := c.pick()
+	res := lookupWith(ctx, m.ptr, ip)
+	if ctx.Err() != nil {
+		return res
+	}
+	switch res.Status {
+	case StatusTimeout, StatusServFail, StatusError:
+		c.failed(m)
+	default:
+		c.answered(m)
+	}
+	return res
+}
+
+func (c *resolverChain) failed(m *chainMember) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m.failures++; m.healthy && m.failures >= failoverThreshold {
+		m.healthy, m.nextProbe = false, time.Now().Add(probeInterval)
+		c.events = append(c.events, ResolverEvent{Time: time.Now(), Resolver: m.name})
+		fmt.Printf(Red+"\n[!] Resolver %s unhealthy after %d failed lookups in a row, using %s\n"+Reset, m.name, m.failures, c.activeName())
+	}
+}
+
+func (c *resolverChain) answered(m *chainMember) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m.failures = 0
+	if !m.healthy {
+		m.healthy = true
+		c.events = append(c.events, ResolverEvent{Time: time.Now(), Resolver: m.name, Healthy: true})
+		fmt.Printf(Green+"\n[+] Resolver %s recovered, using %s\n"+Reset, m.name, c.activeName())
+	}
+}
+
+// activeName names the resolver lookups currently go to; c.mu is held.
+func (c *resolverChain) activeName() string {
+	for _, m := range c.members {
+		if m.healthy {
+			return m.name
+		}
+	}
+	return c.members[0].name + " (no healthy resolver left)"
+}
+
+// Events returns the health transitions so far.
+func (c *resolverChain) Events() []ResolverEvent {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]ResolverEvent(nil), c.events...)
+}
+
+// reverseZoneNet returns the IPv4 network an octet-aligned in-addr.arpa zone
+// name covers, e.g. 2.0.192.in-addr.arpa. -> 192.0.2.0/24. DNS names are
+// case-insensitive, and some servers hand back IN-ADDR.ARPA.
+func reverseZoneNet(zone string) *net.IPNet {
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+	labels := strings.Split(strings.TrimSuffix(zone, ".in-addr.arpa"), ".")
+	if len(labels) < 1 || len(labels) > 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for i, l := range labels {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		ip[len(labels)-1-i] = byte(n)
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(labels), 32)}
+}
+
+// reverseZoneName is the in-addr.arpa name of the /bits network holding ip
+// (bits is 8, 16 or 24).
+func reverseZoneName(ip net.IP, bits int) string {
+	v4 := ip.To4()
+	var labels []string
+	for i := bits/8 - 1; i >= 0; i-- {
+		labels = append(labels, strconv.Itoa(int(v4[i])))
+	}
+	return strings.Join(labels, ".") + ".in-addr.arpa."
+}
+
+// ptrNameIP decodes an in-addr.arpa owner name back into its address.
+func ptrNameIP(name string) string {
+	n := reverseZoneNet(name)
+	if n == nil || strings.Count(strings.TrimSuffix(name, "."), ".") != 5 {
+		return ""
+	}
+	return n.IP.String()
+}
+
+// axfr transfers zone from server (host:port) over TCP. The transfer only
+// counts when it starts and ends with the zone's SOA; anything else, from
+// REFUSED to a connection dropped midway, is an error.
+func axfr(ctx context.Context, server, zone string, timeout time.Duration) ([]dnsRR, error) {
+	conn, err := dnsDial(ctx, "tcp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(6 * timeout))
+
+	q, err := buildQuery(uint16(rand.Intn(1<<16)), zone, dnsTypeAXFR)
+	if err != nil {
+		return nil, err
+	}
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, len(q)+2), uint16(len(q)))
+	if _, err := conn.Write(append(frame, q...)); err != nil {
+		return nil, err
+	}
+
+	var records []dnsRR
+	soas := 0
+	r := bufio.NewReader(conn)
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, fmt.Errorf("transfer incomplete: %v", err)
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("transfer incomplete: %v", err)
+		}
+		msg, err := parseMsg(buf)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Rcode != rcodeNoError {
+			return nil, fmt.Errorf("rcode %d", msg.Rcode)
+		}
+		if len(msg.Answers) == 0 {
+			return nil, errors.New("empty transfer message")
+		}
+		for _, rr := range msg.Answers {
+			if len(records) == 0 && soas == 0 && rr.Type != dnsTypeSOA {
+				return nil, errors.New("transfer does not start with SOA")
+			}
+			if rr.Type == dnsTypeSOA {
+				if soas++; soas == 2 {
+					return records, nil
+				}
+				continue
+			}
+			records = append(records, rr)
+		}
+	}
+}
+
+// querySOA asks server (host:port) over UDP for the SOA of zone.
+func querySOA(ctx context.Context, server, zone string, timeout time.Duration) (*SOARecord, error) {
+	conn, err := dnsDial(ctx, "udp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	id := uint16(rand.Intn(1 << 16))
+	q, err := buildQuery(id, zone, dnsTypeSOA)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(q); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := parseMsg(buf[:n])
+		if err != nil || msg.ID != id {
+			continue
+		}
+		if msg.Rcode != rcodeNoError {
+			return nil, fmt.Errorf("rcode %d", msg.Rcode)
+		}
+		for _, rr := range msg.Answers {
+			if rr.Type == dnsTypeSOA {
+				return rr.SOA, nil
+			}
+		}
+		return nil, errors.New("no SOA in answer")
+	}
+}
+
+func coveringZone(zones []*zoneTransfer, ip string) *zoneTransfer {
+	parsed := net.ParseIP(ip)
+	for _, zt := range zones {
+		if zt.net != nil && zt.net.Contains(parsed) {
+			return zt
+		}
+	}
+	return nil
+}
+
+type SOARecord struct {
+	Primary string `json:"primary"`
+	Contact string `json:"contact"`
+	Serial  uint32 `json:"serial"`
+}
+
+// ReverseZone is an in-addr.arpa zone covering part of a scanned prefix,
+// with the nameservers it is delegated to.
+type ReverseZone struct {
+	Zone        string     `json:"zone"`
+	Nameservers []string   `json:"nameservers"`
+	SOA         *SOARecord `json:"soa,omitempty"`
+}
+
+func (z *ReverseZone) String() string {
+	s := fmt.Sprintf("%s NS %s", z.Zone, strings.Join(z.Nameservers, ", "))
+	if z.SOA != nil {
+		s += fmt.Sprintf(" SOA %s %s serial %d", z.SOA.Primary, z.SOA.Contact, z.SOA.Serial)
+	}
+	return s
+}
+
+// reverseZones finds the delegated reverse zones covering cidr. /24 zones are
+// looked up first; where a /24 has no delegation of its own the enclosing /16
+// zone is used, so a /22 carved into four /24 delegations yields four zones.
+// Lookups are cached per run; zones without NS records are left out.
+func (sc *scanner) reverseZones(cidr string) []*ReverseZone {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil || ipnet.IP.To4() == nil {
+		return nil
+	}
+	ctx, resolver := sc.context(), sc.dnsResolver()
+	if sc.zoneInfo == nil {
+		sc.zoneInfo = map[string]*ReverseZone{}
+	}
+
+	lookup := func(zone string) *ReverseZone {
+		if rz, ok := sc.zoneInfo[zone]; ok {
+			return rz
+		}
+		sc.throttle(ctx)
+		nss, err := resolver.LookupNS(ctx, zone)
+		if err != nil || len(nss) == 0 {
+			sc.zoneInfo[zone] = nil
+			return nil
+		}
+		rz := &ReverseZone{Zone: zone}
+		for _, ns := range nss {
+			rz.Nameservers = append(rz.Nameservers, ns.Host)
+		}
+		for _, ns := range rz.Nameservers {
+			server := net.JoinHostPort(strings.TrimSuffix(ns, "."), "53")
+			if soa, err := querySOA(ctx, server, zone, 5*time.Second); err == nil {
+				rz.SOA = soa
+				break
+			} else if sc.verbose {
+				fmt.Printf("[-] SOA query for %s at %s failed: %v\n", zone, ns, err)
+			}
+		}
+		sc.zoneInfo[zone] = rz
+		return rz
+	}
+
+	// Each candidate is a zone name plus the enclosing zone to fall back to.
+	type candidate struct{ zone, parent string }
+	var candidates []candidate
+	ones, _ := ipnet.Mask.Size()
+	base := binary.BigEndian.Uint32(ipnet.IP.To4())
+	if ones < 16 {
+		for i := uint32(0); i < 1<<uint(16-ones) && i < 256; i++ {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, base+i<<16)
+			candidates = append(candidates, candidate{reverseZoneName(ip, 16), ""})
+		}
+	} else {
+		count := uint32(1)
+		if ones < 24 {
+			count = 1 << uint(24-ones)
+		}
+		for i := uint32(0); i < count; i++ {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, base+i<<8)
+			candidates = append(candidates, candidate{reverseZoneName(ip, 24), reverseZoneName(ip, 16)})
+		}
+	}
+
+	var zones []*ReverseZone
+	seen := map[string]bool{}
+	for _, c := range candidates {
+		rz := lookup(c.zone)
+		if rz == nil && c.parent != "" {
+			rz = lookup(c.parent)
+		}
+		if rz != nil && !seen[rz.Zone] {
+			seen[rz.Zone] = true
+			zones = append(zones, rz)
+		}
+	}
+	return zones
+}
+
+// zoneTransfer is the outcome of trying AXFR on one reverse zone. On success
+// ptr holds every PTR record of the zone.
+type zoneTransfer struct {
+	zone   string
+	net    *net.IPNet
+	server string
+	ptr    staticPTR
+	err    error
+}
+
+// transferZones tries AXFR for every reverse zone covering cidr against each
+// of its nameservers and returns the zones whose transfer succeeded.
+// Outcomes are cached, so a /16 zone is only transferred once per run.
+func (sc *scanner) transferZones(cidr string) []*zoneTransfer {
+	ctx := sc.context()
+	if sc.zones == nil {
+		sc.zones = map[string]*zoneTransfer{}
+	}
+	var ok []*zoneTransfer
+	for _, rz := range sc.reverseZones(cidr) {
+		zt, cached := sc.zones[rz.Zone]
+		if !cached {
+			zt = &zoneTransfer{zone: rz.Zone, net: reverseZoneNet(rz.Zone)}
+			sc.zones[rz.Zone] = zt
+			for _, ns := range rz.Nameservers {
+				server := net.JoinHostPort(strings.TrimSuffix(ns, "."), "53")
+				records, err := axfr(ctx, server, rz.Zone, 10*time.Second)
+				if err != nil {
+					zt.err = err
+					if sc.verbose {
+						fmt.Printf("[-] AXFR of %s from %s failed: %v\n", rz.Zone, ns, err)
+					}
+					continue
+				}
+				zt.server, zt.err, zt.ptr = ns, nil, staticPTR{}
+				for _, rr := range records {
+					if rr.Type == dnsTypePTR {
+						if ip := ptrNameIP(rr.Name); ip != "" {
+							zt.ptr[ip] = append(zt.ptr[ip], rr.Target)
+						}
+					}
+				}
+				fmt.Printf(Green+"[+] AXFR of %s from %s succeeded: %d PTR records\n"+Reset, rz.Zone, ns, len(zt.ptr))
+				break
+			}
+		}
+		if zt.ptr != nil {
+			ok = append(ok, zt)
+		}
+	}
+	return ok
+}
+
+// hostnameFilter decides which findings are surfaced. Patterns are OR-ed;
+// with invert set, matching hostnames are hidden instead.
+type hostnameFilter struct {
+	patterns []*regexp.Regexp
+	invert   bool
+}
+
+func newHostnameFilter(exprs []string, invert bool) (*hostnameFilter, error) {
+	if len(exprs) == 0 {
+		return nil, nil
+	}
+	f := &hostnameFilter{invert: invert}
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -hostname-regex %q: %v", expr, err)
+		}
+		f.patterns = append(f.patterns, re)
+	}
+	return f, nil
+}
+
+func (f *hostnameFilter) Match(names []string) bool {
+	if f == nil {
+		return true
+	}
+	matched := false
+	for _, name := range names {
+		for _, re := range f.patterns {
+			if re.MatchString(name) {
+				matched = true
+			}
+		}
+	}
+	return matched != f.invert
+}
+
+// Events drops change events whose current and previous hostnames are both
+// filtered out, so notifications only fire for hostnames worth seeing.
+func (f *hostnameFilter) Events(events []ChangeEvent) []ChangeEvent {
+	if f == nil {
+		return events
+	}
+	var kept []ChangeEvent
+	for _, ev := range events {
+		if f.Match(append(append([]string(nil), ev.Hostnames...), ev.Previous...)) {
+			kept = append(kept, ev)
+		}
+	}
+	return kept
+}
+
+// Processor sees every finding before it reaches the outputs, in the order
+// processors were registered. It may rewrite the finding or drop it by
+// returning false. An error is reported for that finding and the finding
+// carries on unchanged, so a failing hook never stops the scan.
+type Processor interface {
+	Process(ctx context.Context, f Finding) (Finding, bool, error)
+}
+
+// dropFilter is the built-in Processor: it keeps findings matching keep and
+// counts the rest for the summary.
+type dropFilter struct {
+	why     string
+	keep    func(f Finding) bool
+	dropped int
+}
+
+func (d *dropFilter) Process(_ context.Context, f Finding) (Finding, bool, error) {
+	if d.keep(f) {
+		return f, true, nil
+	}
+	d.dropped++
+	return f, false, nil
+}
+
+// regexProcessor applies -hostname-regex.
+func regexProcessor(filter *hostnameFilter) Processor {
+	return &dropFilter{why: "hidden by -hostname-regex", keep: func(f Finding) bool { return filter.Match(f.Hostnames) }}
+}
+
+// confidenceProcessor drops scored findings below min.
+func confidenceProcessor(min int) Processor {
+	return &dropFilter{why: fmt.Sprintf("below -min-confidence %d", min), keep: func(f Finding) bool {
+		return f.Confidence == nil || *f.Confidence >= min
+	}}
+}
+
+// suffixProcessor keeps findings with a hostname at or under one of the
+// domains.
+func suffixProcessor(domains []string) Processor {
+	for i, d := range domains {
+		domains[i] = strings.TrimPrefix(normalizeHostname(d), ".")
+	}
+	return &dropFilter{why: "outside -hostname-suffix", keep: func(f Finding) bool {
+		for _, name := range f.Hostnames {
+			if underDomain(name, domains) {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// underDomain reports whether name is at or under one of the normalized
+// domains.
+func underDomain(name string, domains []string) bool {
+	name = normalizeHostname(name)
+	for _, d := range domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// genericPTRProcessor drops findings whose hostnames all look
+// provider-generated.
+func genericPTRProcessor() Processor {
+	return &dropFilter{why: "hidden by -hide-generic", keep: func(f Finding) bool {
+		for _, name := range f.Hostnames {
+			if !isGenericPTR(f.IP, name) {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// categoryAccessPool tags findings whose hostnames are all ISP access-pool
+// names, dynamic or static, rather than named infrastructure.
+const categoryAccessPool = "access-pool"
+
+// defaultPoolRules is the built-in access-pool ruleset. Each line is a rule
+// kind and its pattern, matched against the lowercased hostname without the
+// trailing dot: substring, prefix (of the whole name), suffix (a domain,
+// matched at a label boundary) or regex. A leading ! makes the rule an
+// allowlist entry; a name matching any of those is never a pool.
+const defaultPoolRules = `
+prefix dyn-
+prefix dynamic-
+prefix pool-
+prefix dsl-
+prefix adsl-
+prefix vdsl-
+prefix cable-
+prefix dhcp-
+prefix ppp-
+prefix dialup-
+prefix static-
+prefix customer-
+substring .dyn.
+substring .dynamic.
+substring .pool.
+substring .pools.
+substring .dsl.
+substring .cable.
+substring .dhcp.
+substring .dialup.
+substring -dyn.
+substring -dhcp.
+substring -pool.
+substring -static.
+regex ^(ip-?)?\d{1,3}[-.]\d{1,3}[-.]\d{1,3}[-.]\d{1,3}[-.]
+regex \.hsd1\.[a-z]{2}\.comcast\.net$
+
+# Reverse zones of access ISPs that are pools throughout
+suffix dip0.t-ipconnect.de
+suffix pools.vodafone-ip.de
+suffix dynamic.kabel-deutschland.de
+suffix res.rr.com
+suffix fios.verizon.net
+suffix abo.wanadoo.fr
+suffix fbx.proxad.net
+suffix btcentralplus.com
+suffix cable.virginm.net
+suffix dynamic.v4.ziggo.nl
+suffix bbtec.net
+`
+
+type poolRule struct {
+	kind    string
+	pattern string
+	re      *regexp.Regexp
+}
+
+func (r poolRule) match(host string) bool {
+	switch r.kind {
+	case "substring":
+		return strings.Contains(host, r.pattern)
+	case "prefix":
+		return strings.HasPrefix(host, r.pattern)
+	case "suffix":
+		return host == r.pattern || strings.HasSuffix(host, "."+r.pattern)
+	}
+	return r.re.MatchString(host)
+}
+
+// poolRules classifies hostnames as access-pool names. Allowlist entries
+// win over every other rule.
+type poolRules struct {
+	rules []poolRule
+	allow []poolRule
+}
+
+// parse adds the rules read from r to p; name labels errors.
+// Blank lines and # comments are skipped.
+func (p *poolRules) parse(r io.Reader, name string) error {
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, pattern, ok := strings.Cut(line, " ")
+		pattern = strings.TrimSpace(pattern)
+		if !ok || pattern == "" {
+			return fmt.Errorf("%s:%d: want \"kind pattern\", got %q", name, n, line)
+		}
+		allow := strings.HasPrefix(kind, "!")
+		rule := poolRule{kind: strings.TrimPrefix(kind, "!"), pattern: pattern}
+		switch rule.kind {
+		case "substring", "prefix":
+			rule.pattern = strings.ToLower(pattern)
+		case "suffix":
+			rule.pattern = strings.TrimPrefix(normalizeHostname(pattern), ".")
+		case "regex":
+			// Hostnames are matched lowercased, so a pattern written with
+			// capitals must not depend on case either.
+			re, err := regexp.Compile("(?i)" + pattern)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", name, n, err)
+			}
+			rule.re = re
+		default:
+			return fmt.Errorf("%s:%d: unknown rule kind %q (want substring, prefix, suffix or regex)", name, n, rule.kind)
+		}
+		if allow {
+			p.allow = append(p.allow, rule)
+		} else {
+			p.rules = append(p.rules, rule)
+		}
+	}
+	return sc.Err()
+}
+
+// loadPoolRules returns the built-in ruleset plus the rules in path, if set.
+func loadPoolRules(path string) (*poolRules, error) {
+	p := &poolRules{}
+	if err := p.parse(strings.NewReader(defaultPoolRules), "built-in rules"); err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return p, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return p, p.parse(f, path)
+}
+
+func (p *poolRules) IsPool(host string) bool {
+	host = normalizeHostname(host)
+	for _, r := range p.allow {
+		if r.match(host) {
+			return false
+		}
+	}
+	for _, r := range p.rules {
+		if r.match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// poolTagger sets the access-pool category on findings whose hostnames are
+// all pool names.
+type poolTagger struct{ rules *poolRules }
+
+func (t poolTagger) Process(_ context.Context, f Finding) (Finding, bool, error) {
+	for _, name := range f.Hostnames {
+		if !t.rules.IsPool(name) {
+			return f, true, nil
+		}
+	}
+	if len(f.Hostnames) > 0 {
+		f.Category = categoryAccessPool
+	}
+	return f, true, nil
+}
+
+// poolProcessor drops what poolTagger tagged, for -hide-pools.
+func poolProcessor() Processor {
+	return &dropFilter{why: "hidden by -hide-pools", keep: func(f Finding) bool { return f.Category != categoryAccessPool }}
+}
+
+// Confidence weights. A finding starts at confidenceBase and each signal
+// adjusts it; the result is clamped to 0-100 and the best-scoring hostname
+// of an address is its score.
+const (
+	confidenceBase = 50
+	// The hostname resolves back to the address (forward-confirmed rDNS).
+	weightForwardConfirmed = 30
+	// The hostname does not resolve back to the address at all.
+	weightNotConfirmed = -10
+	// The apex domain contains a token of the searched organization name.
+	weightOrgDomain = 20
+	// The apex answers for random labels, so forward confirmation proves
+	// little; it replaces the forward-confirmation signal.
+	weightWildcard = -10
+	// Looks like an ISP's generated name (embedded address, pool/dhcp
+	// style keywords).
+	weightGenericPTR = -30
+)
+
+var (
+	genericPTRWords = []string{"dynamic", "dyn", "dhcp", "pool", "static", "dsl", "adsl", "cable", "broadband",
+		"customer", "cust", "client", "dialup", "ppp", "unassigned", "unused", "reverse", "ptr", "host", "ip"}
+	// orgStopwords are the words besides the legal suffixes that say
+	// nothing about which organization a name belongs to.
+	orgStopwords = map[string]bool{"the": true, "group": true, "holdings": true, "networks": true, "network": true,
+		"net": true, "communications": true, "technologies": true, "services": true, "and": true}
+	nonAlnum = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// orgTokens splits an organization name into the words worth looking for
+// in a domain, e.g. "Example Networks, Inc." -> [example].
+func orgTokens(org string) []string {
+	var tokens []string
+	for _, t := range nonAlnum.Split(strings.ToLower(org), -1) {
+		if len(t) >= 3 && !legalSuffixes[t] && !orgStopwords[t] {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+func relatesToOrg(host string, tokens []string) bool {
+	apex := apexDomain(host)
+	if apex == "" {
+		return false
+	}
+	label := strings.SplitN(apex, ".", 2)[0]
+	for _, t := range tokens {
+		if strings.Contains(label, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGenericPTR spots provider-generated names such as
+// 203-0-113-7.dsl.example.net or host7.pool.example.net.
+func isGenericPTR(ip, host string) bool {
+	host = normalizeHostname(host)
+	if v4 := net.ParseIP(ip).To4(); v4 != nil {
+		for _, order := range [][4]byte{{v4[0], v4[1], v4[2], v4[3]}, {v4[3], v4[2], v4[1], v4[0]}} {
+			for _, sep := range []string{"-", ".", "_", ""} {
+				parts := []string{strconv.Itoa(int(order[0])), strconv.Itoa(int(order[1])), strconv.Itoa(int(order[2])), strconv.Itoa(int(order[3]))}
+				if sep == "" {
+					for i, b := range order {
+						parts[i] = fmt.Sprintf("%03d", b)
+					}
+				}
+				if strings.Contains(host, strings.Join(parts, sep)) {
+					return true
+				}
+			}
+		}
+	}
+	for _, label := range strings.Split(host, ".") {
+		word := strings.TrimRight(label, "0123456789-")
+		for _, w := range genericPTRWords {
+			if word == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scoreHostname applies the confidence weights to one hostname.
+func scoreHostname(ip, host string, tokens []string, confirmed, wildcard bool) int {
+	score := confidenceBase
+	switch {
+	case wildcard:
+		score += weightWildcard
+	case confirmed:
+		score += weightForwardConfirmed
+	default:
+		score += weightNotConfirmed
+	}
+	if relatesToOrg(host, tokens) {
+		score += weightOrgDomain
+	}
+	if isGenericPTR(ip, host) {
+		score += weightGenericPTR
+	}
+	return max(0, min(100, score))
+}
+
+// scorer gathers the network signals (forward confirmation, wildcard zones)
+// for scoreHostname. Wildcard probes are cached per apex domain.
+type scorer struct {
+	resolver *net.Resolver
+	tokens   []string
+	throttle func(ctx context.Context) error
+
+	mu       sync.Mutex
+	wildcard map[string]bool
+}
+
+func newScorer(resolver *net.Resolver, org string, throttle func(ctx context.Context) error) *scorer {
+	return &scorer{resolver: resolver, tokens: orgTokens(org), throttle: throttle, wildcard: map[string]bool{}}
+}
+
+func (s *scorer) isWildcard(ctx context.Context, apex string) bool {
+	s.mu.Lock()
+	w, ok := s.wildcard[apex]
+	s.mu.Unlock()
+	if ok {
+		return w
+	}
+	s.throttle(ctx)
+	probe := fmt.Sprintf("recon-%08x.%s", rand.Uint32(), apex)
+	addrs, err := s.resolver.LookupHost(ctx, probe)
+	w = err == nil && len(addrs) > 0
+	s.mu.Lock()
+	s.wildcard[apex] = w
+	s.mu.Unlock()
+	return w
+}
+
+func (s *scorer) confirmed(ctx context.Context, ip, host string) bool {
+	s.throttle(ctx)
+	addrs, err := s.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return false
+	}
+	want := net.ParseIP(ip)
+	for _, a := range addrs {
+		if a.IP.Equal(want) {
+			return true
+		}
+	}
+	return false
+}
+
+// Score returns the best confidence among the hostnames of ip.
+func (s *scorer) Score(ctx context.Context, ip string, names []string) int {
+	best := 0
+	for _, name := range names {
+		host := normalizeHostname(name)
+		wildcard := false
+		if apex := apexDomain(host); apex != "" {
+			wildcard = s.isWildcard(ctx, apex)
+		}
+		if score := scoreHostname(ip, host, s.tokens, s.confirmed(ctx, ip, host), wildcard); score > best {
+			best = score
+		}
+	}
+	return best
+}
+
+type scanner struct {
+	ctx           context.Context
+	verbose       bool
+	silent        bool // no per-prefix or per-result lines, for Run consumers
+	out           *fanout
+	geo           *geoIP
+	countries     map[string]int
+	sample        int
+	rng           *rand.Rand
+	ptr           PTRLookuper
+	scorer        *scorer
+	tryAXFR       bool
+	zones         map[string]*zoneTransfer
+	lookupZones   bool
+	zoneInfo      map[string]*ReverseZone
+	zoneProbe     *rawResolver
+	undelegated   map[string]bool
+	workers       int
+	filter        *hostnameFilter
+	processors    []Processor
+	patterns      *patternCounter
+	processErrors int
+	resolver      *net.Resolver
+	hostnames     map[string]bool
+	looked        map[string]LookupStatus // outcome of every address, for -resolve-all
+	findings      []FindingRow
+	delay         time.Duration
+	qps           *tokenBucket
+	queries       atomic.Int64
+	failed        []retryItem
+	pause         *pauser
+	started       time.Time
+	planned       int64
+	done          atomic.Int64
+	outcomes      [len(statusNames)]atomic.Int64
+	current       atomic.Value // prefix being scanned, for snapshots
+	onResult      func(prefix string, res LookupResult)
+	onPrefixDone  func(ps *PrefixStats)
+	onChunkDone   func(ps *PrefixStats, done uint64)
+	resume        *PrefixProgress
+	shard         shardSpec
+	prefixTimeout time.Duration
+	prefixCtx     context.Context
+	onFinding     func(f Finding)
+	onDeliver     func(f Finding)
+	metrics       *metrics
+	queued        atomic.Int64
+	errs          chan<- error
+	stats         []*PrefixStats
+	incomplete    int
+	cache         *resultCache
+}
+
+// resultCache is a bounded LRU of lookup results keyed by IP, so an address
+// met again in the same run (overlapping prefixes, imports, enrichment) is
+// answered without another query. Only definitive answers are kept: found
+// results for the rest of the run and NXDOMAINs for negTTL. Timeouts and
+// SERVFAILs are left to the retry passes.
+type resultCache struct {
+	mu      sync.Mutex
+	max     int
+	negTTL  time.Duration
+	order   *list.List
+	items   map[string]*list.Element
+	hits    int
+	negHits int
+}
+
+type cachedResult struct {
+	res     LookupResult
+	expires time.Time // zero for found results
+}
+
+func newResultCache(max int, negTTL time.Duration) *resultCache {
+	return &resultCache{max: max, negTTL: negTTL, order: list.New(), items: map[string]*list.Element{}}
+}
+
+// Get returns the cached result for ip. A nil cache never hits.
+func (c *resultCache) Get(ip string) (LookupResult, bool) {
+	if c == nil {
+		return LookupResult{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[ip]
+	if !ok {
+		return LookupResult{}, false
+	}
+	item := e.Value.(cachedResult)
+	if !item.expires.IsZero() && time.Now().After(item.expires) {
+		c.order.Remove(e)
+		delete(c.items, ip)
+		return LookupResult{}, false
+	}
+	c.order.MoveToFront(e)
+	c.hits++
+	if item.res.Status == StatusNXDomain {
+		c.negHits++
+	}
+	res := item.res
+	res.Provenance = retrievedFrom(sourceCache)
+	res.FetchedAt = item.res.asOf()
+	return res, true
+}
+
+// Put stores res if it is definitive, evicting the least recently used
+// entry once the cache is full.
+func (c *resultCache) Put(res LookupResult) {
+	switch {
+	case c == nil:
+		return
+	case res.Status == StatusFound:
+		c.add(cachedResult{res: res})
+	case res.Status == StatusNXDomain && c.negTTL > 0:
+		c.add(cachedResult{res: res, expires: time.Now().Add(c.negTTL)})
+	}
+}
+
+func (c *resultCache) add(item cachedResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[item.res.IP]; ok {
+		e.Value = item
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[item.res.IP] = c.order.PushFront(item)
+	if c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(cachedResult).res.IP)
+	}
+}
+
+// Clear drops every entry but keeps the hit counts.
+func (c *resultCache) Clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.order.Init()
+	c.items = map[string]*list.Element{}
+	c.mu.Unlock()
+}
+
+// Hits reports how many lookups were answered from the cache, and how many
+// of those were negative answers.
+func (c *resultCache) Hits() (hits, negative int) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.negHits
+}
+
+// negativeCacheFile keeps unexpired NXDOMAIN answers between runs, next to
+// the API responses in -cache-dir.
+const negativeCacheFile = "ptr-negative.json"
+
+// LoadNegative adds the unexpired NXDOMAIN answers saved in path. A missing
+// file is not an error.
+func (c *resultCache) LoadNegative(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved map[string]time.Time
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	now := time.Now()
+	for ip, expires := range saved {
+		if expires.After(now) {
+			c.add(cachedResult{res: LookupResult{IP: ip, Status: StatusNXDomain}, expires: expires})
+		}
+	}
+	return nil
+}
+
+// SaveNegative writes the unexpired NXDOMAIN answers to path.
+func (c *resultCache) SaveNegative(path string) error {
+	c.mu.Lock()
+	now, saved := time.Now(), map[string]time.Time{}
+	for ip, e := range c.items {
+		if item := e.Value.(cachedResult); item.res.Status == StatusNXDomain && item.expires.After(now) {
+			saved[ip] = item.expires
+		}
+	}
+	c.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// lookupAll resolves ips on the worker pool. Results arrive on a single
+// channel so stats, output and callbacks are only ever touched by the caller.
+// Once the context is done no new lookups are started. A deadline
+// (-max-runtime, -prefix-timeout) lets the lookups already under way finish
+// within their own per-query timeout and reports them; an interrupt drops
+// them so the addresses count as not scanned rather than as failures.
+func (sc *scanner) lookupAll(ips []string) <-chan LookupResult {
+	ctx, ptr, workers := sc.context(), sc.ptr, sc.workers
+	if ptr == nil {
+		ptr = net.DefaultResolver
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	// lctx carries the lookups themselves: it ignores ctx's deadline but
+	// follows its cancellation.
+	lctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			cancel()
+		}
+	})
+
+	jobs := make(chan string)
+	results := make(chan LookupResult, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer flushOnPanic()
+			for ip := range jobs {
+				sc.queued.Add(-1)
+				if res, ok := sc.cache.Get(ip); ok {
+					results <- res
+					continue
+				}
+				sc.pause.Wait()
+				// A job taken as the run is cancelled is dropped unasked.
+				if ctx.Err() != nil || sc.throttle(ctx) != nil {
+					continue
+				}
+				start := time.Now()
+				lr := lookupWith(lctx, ptr, ip)
+				if lctx.Err() != nil {
+					continue
+				}
+				sc.metrics.Latency(time.Since(start))
+				res := sc.score(lctx, lr)
+				if lctx.Err() != nil {
+					continue
+				}
+				sc.cache.Put(res)
+				results <- res
+				if sc.qps == nil {
+					time.Sleep(sc.delay)
+				}
+			}
+		}()
+	}
+	sc.queued.Add(int64(len(ips)))
+	go func() {
+	feed:
+		for i, ip := range ips {
+			select {
+			case jobs <- ip:
+			case <-ctx.Done():
+				sc.queued.Add(-int64(len(ips) - i))
+				break feed
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		stop()
+		cancel()
+		close(results)
+	}()
+	return results
+}
+
+// score attaches a confidence score to a found result when scoring is on.
+func (sc *scanner) score(ctx context.Context, res LookupResult) LookupResult {
+	if res.Status == StatusFound && sc.scorer != nil {
+		c := sc.scorer.Score(ctx, res.IP, res.Names)
+		res.Confidence = &c
+	}
+	return res
+}
+
+// handle enriches, records and outputs one lookup result that has already
+// been counted in ps.
+func (sc *scanner) handle(ps *PrefixStats, res LookupResult) {
+	ip, prefix := res.IP, ps.Prefix
+	if sc.looked != nil {
+		sc.looked[ip] = res.Status
+	}
+	if res.Status == StatusFound && sc.geo != nil {
+		res.Geo = sc.geo.Lookup(ip)
+		sc.countries[res.Geo.Country]++
+	}
+	if sc.onResult != nil {
+		sc.onResult(prefix, res)
+	}
+	if res.Status == StatusFound {
+		f, keep := sc.process(Finding{IP: ip, Prefix: prefix, Hostnames: res.Names, Country: res.Geo.Country, City: res.Geo.City, Retried: res.Retried, Confidence: res.Confidence,
+			Provenance: res.Provenance})
+		if !keep {
+			return
+		}
+		res.Names, res.Geo.Country, res.Geo.City, res.Confidence, res.Category = f.Hostnames, f.Country, f.City, f.Confidence, f.Category
+		sc.deliver(f)
+		if sc.patterns != nil {
+			for _, name := range f.Hostnames {
+				sc.patterns.Add(name)
+			}
+		}
+		if sc.hostnames != nil {
+			for _, name := range res.Names {
+				sc.hostnames[normalizeHostname(name)] = true
+			}
+		}
+	}
+
+	sc.out.Emit(resultRecord(prefix, ps.Sampled, res))
+	notes := ""
+	if res.Retried {
+		notes = " (retried)"
+	}
+	if res.Confidence != nil {
+		notes += fmt.Sprintf(" [confidence %d]", *res.Confidence)
+	}
+	if res.Category != "" {
+		notes += " [" + res.Category + "]"
+	}
+	switch {
+	case res.Status == StatusFound:
+		sc.printf(Blue+"[+] %s -> %s"+Reset+"%s%s\n", ip, strings.Join(res.Names, ", "), formatGeo(res.Geo), notes)
+	case sc.verbose:
+		sc.printf("[-] %s %s%s\n", ip, res.Status, notes)
+	}
+}
+
+// pauser lets the keyboard handler stop workers between lookups. Time spent
+// paused is tracked so it can be left out of rate and ETA calculations.
+type pauser struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+	since  time.Time
+	total  time.Duration
+}
+
+func newPauser() *pauser {
+	p := &pauser{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *pauser) Pause() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		return false
+	}
+	p.paused, p.since = true, time.Now()
+	return true
+}
+
+func (p *pauser) Resume() (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return 0, false
+	}
+	d := time.Since(p.since)
+	p.paused, p.total = false, p.total+d
+	p.cond.Broadcast()
+	return d, true
+}
+
+// Wait blocks while the scan is paused.
+func (p *pauser) Wait() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	for p.paused {
+		p.cond.Wait()
+	}
+	p.mu.Unlock()
+}
+
+func (p *pauser) Paused() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+func (p *pauser) PausedFor() time.Duration {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		return p.total + time.Since(p.since)
+	}
+	return p.total
+}
+
+// plannedLookups estimates how many lookups a scan of prefixes will issue.
+// IPv6 prefixes too large to enumerate only count when sampled.
+func plannedLookups(prefixes []string, sample int) int64 {
+	var total int64
+	for _, p := range prefixes {
+		size, err := prefixSize(p)
+		if err != nil {
+			continue
+		}
+		if _, ipnet, _ := net.ParseCIDR(p); sample == 0 && ipnet.IP.To4() == nil {
+			if ones, _ := ipnet.Mask.Size(); ones < minIPv6PrefixLen {
+				continue
+			}
+		}
+		if sample > 0 && uint64(sample) < size {
+			size = uint64(sample)
+		}
+		if size > math.MaxInt64/2 {
+			size = math.MaxInt64 / 2
+		}
+		total += int64(size)
+	}
+	return total
+}
+
+// shardSpec is the -shard share of a scan, shard Index (1-based) of Count.
+// Every prefix is cut into blocks of chunkSize addresses, counted from its
+// first host address, and block i of prefix p belongs to shard
+// fnv64a(p + "#" + i) mod Count + 1. The split depends only on the prefix
+// list, so the same list gives each shard the same blocks on every run, and
+// the Count shards together look up every address exactly once. A sampled
+// prefix is a single block. The zero value is the whole scan.
+type shardSpec struct {
+	Index, Count int
+}
+
+func parseShard(spec string) (shardSpec, error) {
+	k, n, ok := strings.Cut(spec, "/")
+	index, err1 := strconv.Atoi(k)
+	count, err2 := strconv.Atoi(n)
+	if !ok || err1 != nil || err2 != nil || count < 1 || index < 1 || index > count {
+		return shardSpec{}, fmt.Errorf("invalid shard %q, want K/N with 1 <= K <= N", spec)
+	}
+	return shardSpec{Index: index, Count: count}, nil
+}
+
+func (s shardSpec) String() string {
+	if s.Count <= 1 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", s.Index, s.Count)
+}
+
+// owns reports whether block chunk of prefix belongs to the shard.
+func (s shardSpec) owns(prefix string, chunk uint64) bool {
+	if s.Count <= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s#%d", prefix, chunk)
+	return int(h.Sum64()%uint64(s.Count)) == s.Index-1
+}
+
+// owned returns how many of the n host addresses of prefix lie in the
+// shard's blocks.
+func (s shardSpec) owned(prefix string, n uint64) uint64 {
+	if s.Count <= 1 {
+		return n
+	}
+	var total uint64
+	for from := uint64(0); from < n; from += chunkSize {
+		if s.owns(prefix, from/chunkSize) {
+			total += min(chunkSize, n-from)
+		}
+	}
+	return total
+}
+
+// planned is plannedLookups for the shard's blocks.
+func (s shardSpec) planned(prefixes []string, sample int) int64 {
+	if s.Count <= 1 {
+		return plannedLookups(prefixes, sample)
+	}
+	var total int64
+	for _, p := range prefixes {
+		if sample > 0 {
+			if s.owns(p, 0) {
+				total += plannedLookups([]string{p}, sample)
+			}
+			continue
+		}
+		if _, first, last, err := hostRange(p); err == nil {
+			total += int64(s.owned(p, last-first+1))
+		}
+	}
+	return total
+}
+
+// rate is the measured query rate, retries included, excluding paused time.
+func (sc *scanner) rate() float64 {
+	active := time.Since(sc.started) - sc.pause.PausedFor()
+	if active <= 0 {
+		return 0
+	}
+	return float64(sc.queries.Load()) / active.Seconds()
+}
+
+func (sc *scanner) printProgress() {
+	if sc.planned == 0 {
+		return
+	}
+	fmt.Printf(Purple+"[~] %d/%d lookups, %.1f q/s, ETA %s\n"+Reset,
+		sc.done.Load(), sc.planned, sc.rate(), sc.eta().Round(time.Second))
+}
+
+// tally counts a finished lookup towards progress and snapshots.
+func (sc *scanner) tally(res LookupResult) {
+	sc.done.Add(1)
+	sc.outcomes[res.Status].Add(1)
+	sc.metrics.Lookup(res.Status)
+}
+
+// snapshot describes the scan's progress. It only reads atomics and can be
+// taken from any goroutine while workers are busy.
+func (sc *scanner) snapshot() string {
+	current, _ := sc.current.Load().(string)
+	if current == "" {
+		current = "none yet"
+	}
+	return fmt.Sprintf("prefix %s, %d/%d lookups, %d found, %d timeout, %d servfail, %d error, %.1f q/s, ETA %s",
+		current, sc.done.Load(), sc.planned, sc.outcomes[StatusFound].Load(), sc.outcomes[StatusTimeout].Load(),
+		sc.outcomes[StatusServFail].Load(), sc.outcomes[StatusError].Load(), sc.rate(), sc.eta().Round(time.Second))
+}
+
+// metrics is a Prometheus registry of its own, rendered in the text
+// exposition format, for long-running watch and serve processes. Every
+// method is a no-op on a nil registry, so instrumented code needs no checks.
+type metrics struct {
+	mu          sync.Mutex
+	lookups     map[string]float64
+	apiRequests map[[2]string]float64
+	findings    float64
+	latency     []float64 // cumulative counts per latencyBuckets bound
+	latencySum  float64
+	latencyN    float64
+	window      [qpsWindow]struct{ sec, n int64 }
+	queueDepth  func() int64
+}
+
+// qpsWindow is how many seconds the current query rate is averaged over.
+const qpsWindow = 10
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func newMetrics() *metrics {
+	return &metrics{lookups: map[string]float64{}, apiRequests: map[[2]string]float64{}, latency: make([]float64, len(latencyBuckets))}
+}
+
+// Query counts a DNS query towards the current rate.
+func (m *metrics) Query() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().Unix()
+	b := &m.window[now%qpsWindow]
+	if b.sec != now {
+		b.sec, b.n = now, 0
+	}
+	b.n++
+}
+
+// Lookup records the outcome of a finished PTR lookup.
+func (m *metrics) Lookup(status LookupStatus) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.lookups[status.String()]++
+	m.mu.Unlock()
+}
+
+// Latency records how long a PTR query took to answer.
+func (m *metrics) Latency(took time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	secs := took.Seconds()
+	for i, bound := range latencyBuckets {
+		if secs <= bound {
+			m.latency[i]++
+		}
+	}
+	m.latencySum += secs
+	m.latencyN++
+}
+
+func (m *metrics) Finding() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.findings++
+	m.mu.Unlock()
+}
+
+// APIRequest records a bgpview request by endpoint and HTTP status, or
+// "error" when no response came back.
+func (m *metrics) APIRequest(endpoint, status string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.apiRequests[[2]string{endpoint, status}]++
+	m.mu.Unlock()
+}
+
+// apiEndpoint reduces a request URL to its path with the variable parts
+// (ASNs, addresses, prefixes) replaced, so labels stay few.
+func apiEndpoint(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "unknown"
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	// A prefix spans two segments, address and length.
+	for i := 0; i < len(parts); i++ {
+		if strings.ContainsAny(parts[i], "0123456789") {
+			parts[i] = ":id"
+			if i+1 < len(parts) && strings.Trim(parts[i+1], "0123456789") == "" {
+				parts = append(parts[:i+1], parts[i+2:]...)
+			}
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	family := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	family("recon_dns_lookups_total", "counter", "PTR lookups by outcome.")
+	for _, name := range statusNames {
+		fmt.Fprintf(&b, "recon_dns_lookups_total{outcome=%q} %g\n", name, m.lookups[name])
+	}
+
+	family("recon_api_requests_total", "counter", "bgpview API requests by endpoint and HTTP status.")
+	keys := make([][2]string, 0, len(m.apiRequests))
+	for k := range m.apiRequests {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b [2]string) int { return cmp.Or(cmp.Compare(a[0], b[0]), cmp.Compare(a[1], b[1])) })
+	for _, k := range keys {
+		fmt.Fprintf(&b, "recon_api_requests_total{endpoint=%q,status=%q} %g\n", k[0], k[1], m.apiRequests[k])
+	}
+
+	family("recon_findings_total", "counter", "Addresses found with a hostname.")
+	fmt.Fprintf(&b, "recon_findings_total %g\n", m.findings)
+
+	family("recon_dns_lookup_duration_seconds", "histogram", "Time a PTR lookup took to answer.")
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(&b, "recon_dns_lookup_duration_seconds_bucket{le=\"%g\"} %g\n", bound, m.latency[i])
+	}
+	fmt.Fprintf(&b, "recon_dns_lookup_duration_seconds_bucket{le=\"+Inf\"} %g\n", m.latencyN)
+	fmt.Fprintf(&b, "recon_dns_lookup_duration_seconds_sum %g\nrecon_dns_lookup_duration_seconds_count %g\n", m.latencySum, m.latencyN)
+
+	family("recon_queue_depth", "gauge", "Addresses waiting for a lookup worker.")
+	var depth int64
+	if m.queueDepth != nil {
+		depth = m.queueDepth()
+	}
+	fmt.Fprintf(&b, "recon_queue_depth %d\n", depth)
+
+	// The second in progress is left out, it is still filling.
+	family("recon_qps", "gauge", fmt.Sprintf("DNS queries per second over the last %d seconds.", qpsWindow))
+	var sent int64
+	now := time.Now().Unix()
+	for _, bucket := range m.window {
+		if bucket.sec < now && bucket.sec >= now-qpsWindow {
+			sent += bucket.n
+		}
+	}
+	fmt.Fprintf(&b, "recon_qps %g\n", float64(sent)/qpsWindow)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+// serveMetrics exposes m on addr at /metrics, on a mux of its own so
+// nothing else registered with net/http is exposed with it.
+func serveMetrics(addr string, m *metrics) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go http.Serve(l, mux)
+	fmt.Printf(Green+"[+] Serving metrics on http://%s/metrics\n"+Reset, l.Addr())
+	return nil
+}
+
+// usr1Signal returns SIGUSR1 for this platform, or nil where there is none.
+// The syscall package has no SIGUSR1 on Windows, so it is spelled out by
+// number to keep the tool a single file that builds everywhere.
+func usr1Signal() os.Signal {
+	switch runtime.GOOS {
+	case "windows", "plan9", "js", "wasip1":
+		return nil
+	case "linux":
+		if strings.HasPrefix(runtime.GOARCH, "mips") {
+			return syscall.Signal(16)
+		}
+		return syscall.Signal(10)
+	case "solaris", "illumos":
+		return syscall.Signal(16)
+	}
+	return syscall.Signal(30)
+}
+
+// watchSnapshots prints a progress snapshot to stderr, and appends it to
+// statusFile if set, on every SIGUSR1 or whenever the trigger file appears
+// (which it then removes), until the returned stop func is called.
+func (sc *scanner) watchSnapshots(statusFile, trigger string) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	if sig := usr1Signal(); sig != nil {
+		signal.Notify(sigs, sig)
+	}
+	ticker := time.NewTicker(time.Second)
+	if trigger == "" {
+		ticker.Stop()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer flushOnPanic()
+		for {
+			select {
+			case <-done:
+				return
+			case <-sigs:
+			case <-ticker.C:
+				if os.Remove(trigger) != nil {
+					continue
+				}
+			}
+			line := sc.snapshot()
+			fmt.Fprintln(os.Stderr, Purple+"[~] Snapshot: "+line+Reset)
+			if statusFile != "" {
+				if err := appendLine(statusFile, time.Now().Format(time.RFC3339)+" "+line); err != nil {
+					fmt.Fprintln(os.Stderr, Red+"[!] Failed to write status file:", err, Reset)
+				}
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		ticker.Stop()
+		close(done)
+	}
+}
+
+func appendLine(path, line string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (sc *scanner) eta() time.Duration {
+	done, planned := sc.done.Load(), sc.planned
+	if done == 0 || planned <= done {
+		return 0
+	}
+	active := time.Since(sc.started) - sc.pause.PausedFor()
+	return time.Duration(float64(active) / float64(done) * float64(planned-done))
+}
+
+// statusLine keeps a line of live scan counters under the result lines. On
+// a terminal stdout (and stderr, if it is the terminal too) is swapped for a
+// pipe drained by one goroutine, which clears the line, writes what was
+// printed and redraws it, so concurrent prints never land inside it.
+// Anywhere else the counters are printed as a plain line now and then.
+type statusLine struct {
+	sc       *scanner
+	real     *os.File
+	stderr   *os.File
+	pipe     *os.File
+	width    int
+	lastQ    int64
+	lastAt   time.Time
+	instant  float64
+	drained  chan struct{}
+	stopOnce sync.Once
+}
+
+const (
+	statusRedraw = time.Second
+	statusPlain  = 30 * time.Second
+)
+
+// liveStatus is the running status line, stopped on a panic so the pipe is
+// drained before the process dies.
+var liveStatus *statusLine
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// startStatus shows the status line until the returned stop func is called.
+func (sc *scanner) startStatus() (stop func()) {
+	s := &statusLine{sc: sc, real: os.Stdout, width: 80, lastAt: time.Now(), drained: make(chan struct{})}
+	if !isTerminal(os.Stdout) {
+		ticker := time.NewTicker(statusPlain)
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					s.tick()
+					fmt.Println(Purple + "[~] Status: " + s.line() + Reset)
+				}
+			}
+		}()
+		var once sync.Once
+		return func() {
+			once.Do(func() {
+				ticker.Stop()
+				close(done)
+			})
+		}
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return func() {}
+	}
+	if out, err := stty("size"); err == nil {
+		var rows, cols int
+		if _, err := fmt.Sscan(string(out), &rows, &cols); err == nil && cols > 0 {
+			s.width = cols
+		}
+	}
+	s.pipe, os.Stdout = w, w
+	if isTerminal(os.Stderr) {
+		s.stderr, os.Stderr = os.Stderr, w
+	}
+	liveStatus = s
+
+	chunks := make(chan []byte)
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, 32<<10)
+			n, err := r.Read(buf)
+			if n > 0 {
+				chunks <- buf[:n]
+			}
+			if err != nil {
+				r.Close()
+				return
+			}
+		}
+	}()
+	go func() {
+		defer close(s.drained)
+		ticker := time.NewTicker(statusRedraw)
+		defer ticker.Stop()
+		drawn, lineStart := false, true
+		for {
+			select {
+			case b, ok := <-chunks:
+				if drawn {
+					s.real.WriteString("\r\033[K")
+					drawn = false
+				}
+				if !ok {
+					return
+				}
+				s.real.Write(b)
+				// Colored lines end with the reset code after their newline.
+				lineStart = bytes.HasSuffix(bytes.TrimSuffix(b, []byte(Reset)), []byte("\n"))
+			case <-ticker.C:
+				s.tick()
+			}
+			// A partial line, such as a prompt, is left alone until its
+			// newline arrives.
+			if lineStart {
+				s.real.WriteString("\r\033[K" + Purple + "[~] " + s.line() + Reset)
+				drawn = true
+			}
+		}
+	}()
+	return s.Stop
+}
+
+// Stop puts stdout back and waits for everything printed to be written.
+func (s *statusLine) Stop() {
+	if s == nil {
+		return
+	}
+	s.stopOnce.Do(func() {
+		os.Stdout = s.real
+		if s.stderr != nil {
+			os.Stderr = s.stderr
+		}
+		s.pipe.Close()
+		<-s.drained
+		liveStatus = nil
+	})
+}
+
+// tick samples the query counter for the instantaneous rate.
+func (s *statusLine) tick() {
+	q, now := s.sc.queries.Load(), time.Now()
+	if d := now.Sub(s.lastAt); d > 0 {
+		s.instant = float64(q-s.lastQ) / d.Seconds()
+	}
+	s.lastQ, s.lastAt = q, now
+}
+
+func (s *statusLine) line() string {
+	sc := s.sc
+	done := sc.done.Load()
+	failed := sc.outcomes[StatusTimeout].Load() + sc.outcomes[StatusServFail].Load() + sc.outcomes[StatusError].Load()
+	errPct := 0.0
+	if done > 0 {
+		errPct = 100 * float64(failed) / float64(done)
+	}
+	line := fmt.Sprintf("%s elapsed, %d queries, %.1f q/s now, %.1f avg, %d found, %.1f%% errors",
+		time.Since(sc.started).Round(time.Second), sc.queries.Load(), s.instant, sc.rate(), sc.outcomes[StatusFound].Load(), errPct)
+	if sc.pause.Paused() {
+		line += " (paused)"
+	}
+	// Wrapping would leave the carriage return redrawing only the tail.
+	if s.width > 5 && len(line) >= s.width-4 {
+		line = line[:s.width-5]
+	}
+	return line
+}
+
+func stty(args ...string) ([]byte, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Output()
+}
+
+// watchKeyboard puts an interactive terminal into unbuffered mode and
+// handles p (pause) and r (resume) until the returned restore func is
+// called. Nothing happens when stdin is a pipe or file.
+func (sc *scanner) watchKeyboard() (restore func()) {
+	if !isTerminal(os.Stdin) {
+		return func() {}
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return func() {}
+	}
+	if _, err := stty("-icanon", "min", "1", "-echo"); err != nil {
+		return func() {}
+	}
+
+	var once sync.Once
+	restore = func() {
+		once.Do(func() { stty(strings.TrimSpace(string(saved))) })
+	}
+
+	// Keep the terminal usable and unblock paused workers once the scan is
+	// interrupted.
+	go func() {
+		<-sc.context().Done()
+		restore()
+		sc.pause.Resume()
+	}()
+
+	sc.pause = newPauser()
+	fmt.Println(Purple + "[~] Press p to pause, r to resume" + Reset)
+	go func() {
+		for {
+			b, err := stdin.ReadByte()
+			if err != nil {
+				return
+			}
+			switch b {
+			case 'p', 'P':
+				if sc.pause.Pause() {
+					fmt.Println(Purple + "\n[~] PAUSED - in-flight lookups will finish, press r to resume" + Reset)
+				}
+			case 'r', 'R':
+				if d, ok := sc.pause.Resume(); ok {
+					fmt.Printf(Purple+"[~] Resumed after %s paused\n"+Reset, d.Round(time.Second))
+					sc.printProgress()
+				}
+			}
+		}
+	}()
+	return restore
+}
+
+type retryItem struct {
+	ip     string
+	status LookupStatus
+	stats  *PrefixStats
+}
+
+// failedLookups lists the retry queue for the checkpoint.
+func (sc *scanner) failedLookups() []FailedLookup {
+	failed := make([]FailedLookup, len(sc.failed))
+	for i, item := range sc.failed {
+		failed[i] = FailedLookup{IP: item.ip, Prefix: item.stats.Prefix, Status: item.status}
+	}
+	return failed
+}
+
+// requeue restores the retry queue of a checkpoint being resumed. Each
+// address is attached to the stats of its prefix, a completed one or the
+// one the run stopped in; addresses of other prefixes are scanned again
+// anyway and are dropped.
+func (sc *scanner) requeue(cp *Checkpoint) {
+	stats := make(map[string]*PrefixStats, len(cp.Stats)+1)
+	for prefix, ps := range cp.Stats {
+		stats[prefix] = ps
+	}
+	if cp.Current != nil {
+		stats[cp.Current.Prefix] = cp.Current.Stats
+	}
+	for _, f := range cp.Failed {
+		if ps := stats[f.Prefix]; ps != nil {
+			sc.failed = append(sc.failed, retryItem{ip: f.IP, status: f.Status, stats: ps})
+		}
+	}
+	if len(sc.failed) > 0 {
+		fmt.Printf(Purple+"[~] %d failed lookups of the interrupted run are queued for the retry passes\n"+Reset, len(sc.failed))
+	}
+}
+
+// retryFailed re-queries every address whose lookup timed out or hit
+// SERVFAIL, one worker at a quarter of the normal rate, for up to passes
+// rounds. It returns how many of those holes ended with a conclusive answer:
+// a PTR record or NXDOMAIN. Other errors are kept in the results but are not
+// counted as recovered.
+func (sc *scanner) retryFailed(passes int) (recovered, total int) {
+	total = len(sc.failed)
+	workers, delay := sc.workers, sc.delay
+	sc.workers, sc.delay = 1, 4*delay
+	defer func() { sc.workers, sc.delay = workers, delay }()
+
+	for pass := 1; pass <= passes && len(sc.failed) > 0 && !sc.stopped(); pass++ {
+		queue := sc.failed
+		sc.failed = nil
+		fmt.Printf(Purple+"\n[~] Retry pass %d: %d failed lookups\n"+Reset, pass, len(queue))
+
+		byIP := make(map[string]retryItem, len(queue))
+		ips := make([]string, len(queue))
+		for i, item := range queue {
+			byIP[item.ip] = item
+			ips[i] = item.ip
+		}
+		for res := range sc.lookupAll(ips) {
+			item := byIP[res.IP]
+			res.Retried = true
+			item.stats.Replace(item.status, res)
+			if res.Status == StatusTimeout || res.Status == StatusServFail {
+				item.status = res.Status
+				sc.failed = append(sc.failed, item)
+				continue
+			}
+			if res.Status == StatusFound || res.Status == StatusNXDomain {
+				recovered++
+			}
+			sc.handle(item.stats, res)
+		}
+	}
+	return recovered, total
+}
+
+// throttle is called before every DNS query. With -qps it draws from the
+// shared token bucket, otherwise queries are paced by the per-worker delay.
+func (sc *scanner) throttle(ctx context.Context) error {
+	sc.queries.Add(1)
+	sc.metrics.Query()
+	if sc.qps == nil {
+		return nil
+	}
+	return sc.qps.Wait(ctx)
+}
+
+func (sc *scanner) context() context.Context {
+	if sc.prefixCtx != nil {
+		return sc.prefixCtx
+	}
+	if sc.ctx == nil {
+		return context.Background()
+	}
+	return sc.ctx
+}
+
+// stopped reports whether the run was interrupted or its deadline passed.
+func (sc *scanner) stopped() bool {
+	return sc.context().Err() != nil
+}
+
+// chunkSize is how many addresses of a prefix are expanded, looked up and
+// checkpointed at a time, so memory and resume granularity stay bounded
+// however large the prefix is.
+const chunkSize = 4096
+
+func (sc *scanner) scan(prefixes []string) []*PrefixStats {
+	var stats []*PrefixStats
+	for i, prefix := range prefixes {
+		if sc.stopped() {
+			sc.incomplete += len(prefixes) - i
+			break
+		}
+		var (
+			sampled     []string
+			base        net.IP
+			first, last uint64
+			err         error
+		)
+		if sc.sample > 0 {
+			sampled, err = sampleCIDR(prefix, sc.sample, sc.rng)
+		} else {
+			base, first, last, err = hostRange(prefix)
+		}
+		if errors.Is(err, errTooLarge) {
+			sc.report(fmt.Errorf("skipping %s: %v, use -sample to probe it", prefix, err))
+			continue
+		}
+		if err != nil {
+			sc.report(fmt.Errorf("failed to parse CIDR %s: %v", prefix, err))
+			continue
+		}
+
+		ps := newPrefixStats(prefix, sc.sample > 0)
+		total, start := uint64(len(sampled)), first
+		if !ps.Sampled {
+			total = last - first + 1
+		}
+		if ps.Sampled && !sc.shard.owns(prefix, 0) || !ps.Sampled && sc.shard.owned(prefix, total) == 0 {
+			continue
+		}
+		sc.current.Store(prefix)
+		if r := sc.resume; r != nil && r.Prefix == prefix && !ps.Sampled {
+			ps, start, sc.resume = r.Stats, first+r.Done, nil
+			sc.printf(Green+"\n[+] Resuming %s after %d of %d IPs\n"+Reset, prefix, r.Done, total)
+		} else if ps.Sampled {
+			sc.printf(Green+"\n[+] Sampling %d IPs in %s\n"+Reset, total, prefix)
+		} else if owned := sc.shard.owned(prefix, total); owned < total {
+			sc.printf(Green+"\n[+] Scanning %d of %d IPs in %s (shard %s)\n"+Reset, owned, total, prefix, sc.shard)
+		} else {
+			sc.printf(Green+"\n[+] Scanning %d IPs in %s\n"+Reset, total, prefix)
+		}
+		stats = append(stats, ps)
+		// The budget covers the prefix's zone lookups and transfers too.
+		cancelPrefix := func() {}
+		if sc.prefixTimeout > 0 {
+			sc.prefixCtx, cancelPrefix = context.WithTimeout(sc.context(), sc.prefixTimeout)
+		}
+		if sc.lookupZones && ps.Zones == nil {
+			ps.Zones = sc.reverseZones(prefix)
+			for _, rz := range ps.Zones {
+				fmt.Println("[~] Reverse zone", rz)
+			}
+		}
+		var zones []*zoneTransfer
+		if sc.tryAXFR {
+			zones = sc.transferZones(prefix)
+		}
+
+		complete := true
+		if ps.Sampled {
+			complete = sc.scanChunk(ps, sampled, zones)
+		}
+		for from := start; !ps.Sampled && from <= last; from += chunkSize {
+			to := min(from+chunkSize-1, last)
+			// Other shards' blocks are passed over but still count as done,
+			// so checkpoints advance past them.
+			if sc.shard.owns(prefix, (from-first)/chunkSize) {
+				if complete = sc.scanChunk(ps, ipsInRange(base, from, to), zones); !complete {
+					break
+				}
+			}
+			if to < last {
+				if sc.onChunkDone != nil {
+					sc.onChunkDone(ps, to-first+1)
+				}
+				sc.printProgress()
+			}
+		}
+
+		timedOut := sc.prefixCtx != nil && sc.prefixCtx.Err() != nil
+		cancelPrefix()
+		sc.prefixCtx = nil
+		if !complete && timedOut && !sc.stopped() {
+			// Over its budget: left incomplete, and out of the checkpoint's
+			// completed list, so a later run scans it again. Its failed
+			// lookups are dropped rather than retried.
+			ps.TimedOut = true
+			sc.incomplete++
+			sc.failed = slices.DeleteFunc(sc.failed, func(r retryItem) bool { return r.stats == ps })
+			fmt.Printf(Red+"\n[!] Abandoning %s after %s (-prefix-timeout), %d of %d IPs looked up\n"+Reset, prefix, sc.prefixTimeout, ps.Total, total)
+			continue
+		}
+		if !complete {
+			// Cut short by the deadline: not marked done, so a resumed
+			// checkpoint picks it up again after its last finished chunk.
+			sc.incomplete += len(prefixes) - i
+			break
+		}
+		if sc.onPrefixDone != nil {
+			sc.onPrefixDone(ps)
+		}
+		sc.printProgress()
+	}
+	return stats
+}
+
+// scanChunk looks up ips and folds the results into ps. It reports whether
+// every address was answered before the run was stopped.
+func (sc *scanner) scanChunk(ps *PrefixStats, ips []string, zones []*zoneTransfer) bool {
+	before := ps.Total + ps.NotDelegated
+
+	// Addresses inside a transferred reverse zone are answered from it
+	// without a query each; the rest are swept as usual.
+	pending := ips
+	if len(zones) > 0 {
+		pending = nil
+		for _, ip := range ips {
+			zt := coveringZone(zones, ip)
+			if zt == nil {
+				pending = append(pending, ip)
+				continue
+			}
+			res := sc.score(sc.context(), lookupWith(sc.context(), zt.ptr, ip))
+			sc.tally(res)
+			ps.Add(res)
+			ps.Transferred++
+			sc.handle(ps, res)
+		}
+	}
+	if sc.zoneProbe != nil {
+		pending = sc.skipUndelegated(ps, pending)
+	}
+	for res := range sc.lookupAll(pending) {
+		sc.tally(res)
+		ps.Add(res)
+		sc.handle(ps, res)
+		if res.Status == StatusTimeout || res.Status == StatusServFail {
+			sc.failed = append(sc.failed, retryItem{ip: res.IP, status: res.Status, stats: ps})
+		}
+	}
+	return ps.Total+ps.NotDelegated-before == len(ips)
+}
+
+// probeZone is the /24-equivalent reverse zone holding ip, which
+// skipUndelegated asks about: the /24 for IPv4 and the /120 for IPv6, 256
+// addresses either way.
+func probeZone(ip net.IP) string {
+	if ip.To4() != nil {
+		return reverseZoneName(ip, 24)
+	}
+	return reverseName(ip)[len("0.0."):]
+}
+
+// minProbeAddresses is the fewest addresses of a zone a chunk must hold for
+// skipUndelegated to probe it. A sampled or IPv6 sweep touches most zones
+// for an address or two, where the SOA query costs as much as it saves.
+const minProbeAddresses = 16
+
+// skipUndelegated drops the addresses whose reverse zone does not exist and
+// counts them in ps as not delegated. Each zone with at least
+// minProbeAddresses addresses in ips is asked for its SOA once per run: an
+// NXDOMAIN means no PTR record can exist anywhere below it. Any other
+// answer, a lame delegation's SERVFAIL or a timeout included, keeps the
+// zone's addresses in the sweep, as do the zones too small to probe.
+func (sc *scanner) skipUndelegated(ps *PrefixStats, ips []string) []string {
+	if sc.undelegated == nil {
+		sc.undelegated = map[string]bool{}
+	}
+	zones := make([]string, len(ips))
+	count := map[string]int{}
+	var probe []string
+	for i, ip := range ips {
+		zones[i] = probeZone(net.ParseIP(ip))
+		count[zones[i]]++
+		if _, probed := sc.undelegated[zones[i]]; !probed && count[zones[i]] == minProbeAddresses {
+			probe = append(probe, zones[i])
+		}
+	}
+	sc.probeZones(probe)
+
+	var pending []string
+	for i, ip := range ips {
+		zone := zones[i]
+		if !sc.undelegated[zone] {
+			pending = append(pending, ip)
+			continue
+		}
+		if !slices.Contains(ps.UndelegatedZones, zone) {
+			ps.UndelegatedZones = append(ps.UndelegatedZones, zone)
+		}
+		ps.NotDelegated++
+		sc.done.Add(1)
+		if sc.looked != nil {
+			sc.looked[ip] = StatusNXDomain
+		}
+	}
+	return pending
+}
+
+// probeZones asks for the SOA of each zone, sc.workers at a time, and
+// records in sc.undelegated which ones do not exist. Zones the run was
+// stopped before are left unrecorded.
+func (sc *scanner) probeZones(zones []string) {
+	ctx := sc.context()
+	type outcome struct {
+		msg *dnsMsg
+		err error
+	}
+	outcomes := make([]outcome, len(zones))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(sc.workers, 1))
+	for i, zone := range zones {
+		if sc.throttle(ctx) != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(o *outcome, zone string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			o.msg, o.err = sc.zoneProbe.query(ctx, zone, dnsTypeSOA)
+		}(&outcomes[i], zone)
+	}
+	wg.Wait()
+
+	for i, zone := range zones {
+		o := outcomes[i]
+		switch {
+		case o.err != nil:
+			if sc.verbose {
+				fmt.Printf("[-] SOA probe of %s failed, sweeping it: %v\n", zone, o.err)
+			}
+		case o.msg == nil:
+			continue
+		case o.msg.Rcode == rcodeNXDomain:
+			if sc.verbose {
+				fmt.Printf(Purple+"[~] %s is not delegated (NXDOMAIN), skipping its addresses\n"+Reset, zone)
+			}
+		case o.msg.Rcode != rcodeNoError && sc.verbose:
+			fmt.Printf("[-] SOA probe of %s answered %s, sweeping it\n", zone, rcodeName(o.msg.Rcode))
+		}
+		sc.undelegated[zone] = o.err == nil && o.msg.Rcode == rcodeNXDomain
+	}
+}
+
+// Finding is one resolved address as streamed by Run. Reports list the same
+// records.
+type Finding = FindingRow
+
+// findingBuffer bounds the channel Run streams findings on.
+const findingBuffer = 64
+
+// Run scans prefixes in the background and streams findings as they are
+// discovered. The findings channel holds findingBuffer entries; once it is
+// full the sweep waits for the consumer, so a slow consumer slows the scan
+// down but never loses a finding. Callers must drain findings until it is
+// closed, also after cancelling ctx. The error channel carries prefixes that
+// could not be scanned and, last, ctx's error if the run was cut short. It
+// is buffered for all of them, so it may be read after the findings are
+// drained. Both close when the run ends; Stats is valid from then on.
+//
+//	findings, errs := sc.Run(ctx, []string{"198.51.100.0/24"})
+//	for f := range findings {
+//		if strings.HasSuffix(f.Hostnames[0], ".example.com.") {
+//			store(f)
+//		}
+//	}
+//	for err := range errs {
+//		log.Print(err)
+//	}
+func (sc *scanner) Run(ctx context.Context, prefixes []string) (<-chan Finding, <-chan error) {
+	findings := make(chan Finding, findingBuffer)
+	errs := make(chan error, len(prefixes)+1)
+	sc.ctx, sc.errs = ctx, errs
+	sc.onFinding = func(f Finding) { findings <- f }
+	go func() {
+		defer flushOnPanic()
+		sc.stats = sc.scan(prefixes)
+		if err := ctx.Err(); err != nil {
+			errs <- err
+		}
+		sc.onFinding, sc.errs = nil, nil
+		close(findings)
+		close(errs)
+	}()
+	return findings, errs
+}
+
+// Stats returns the per-prefix stats of the last Run once it has ended.
+func (sc *scanner) Stats() []*PrefixStats {
+	return sc.stats
+}
+
+// process passes a finding through the processors and reports whether it
+// survived.
+func (sc *scanner) process(f Finding) (Finding, bool) {
+	for _, p := range sc.processors {
+		out, keep, err := p.Process(sc.context(), f)
+		if err != nil {
+			sc.processErrors++
+			fmt.Println(Red+"[!] Processing", f.IP, "failed:", err, Reset)
+			continue
+		}
+		if !keep {
+			return f, false
+		}
+		f = out
+	}
+	return f, true
+}
+
+// deliver hands a finding to onDeliver and to Run's consumer, or keeps it for
+// the report when the scanner is driven directly.
+func (sc *scanner) deliver(f Finding) {
+	sc.metrics.Finding()
+	if sc.onDeliver != nil {
+		sc.onDeliver(f)
+	}
+	if sc.onFinding != nil {
+		sc.onFinding(f)
+		return
+	}
+	sc.findings = append(sc.findings, f)
+}
+
+// printf prints a progress line unless the scanner is silent.
+func (sc *scanner) printf(format string, args ...any) {
+	if !sc.silent {
+		fmt.Printf(format, args...)
+	}
+}
+
+// report sends a per-prefix error to Run's consumer, or prints it.
+func (sc *scanner) report(err error) {
+	if sc.errs != nil {
+		sc.errs <- err
+		return
+	}
+	fmt.Println(Red+"[!]", err, Reset)
+}
+
+func normalizeHostname(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+// readSubs reads a subfinder/amass style list: one hostname per line, blank
+// lines and # comments ignored.
+func readSubs(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hosts []string
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		host := normalizeHostname(line)
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, sc.Err()
+}
+
+func writeSubs(path string, hosts map[string]bool) error {
+	names := make([]string, 0, len(hosts))
+	for h := range hosts {
+		names = append(names, h)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, h := range names {
+		buf.WriteString(h)
+		buf.WriteByte('\n')
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// httpTargets lists targets for httpx and aquatone, one host:port per line:
+// each hostname of a finding that keep accepts, paired with every port
+// found open on its address. A finding without such a hostname contributes
+// its address instead. Before any port probing (probed false) there are no
+// ports to pair, and the hosts are listed bare for the tools' defaults.
+func httpTargets(findings []FindingRow, probed bool, keep func(ip, name string) bool) []string {
+	var targets []string
+	seen := map[string]bool{}
+	add := func(t string) {
+		if !seen[t] {
+			seen[t] = true
+			targets = append(targets, t)
+		}
+	}
+	for _, f := range findings {
+		if probed && len(f.OpenPorts) == 0 {
+			continue
+		}
+		var hosts []string
+		for _, name := range f.Hostnames {
+			if name = normalizeHostname(name); name != "" && keep(f.IP, name) {
+				hosts = append(hosts, name)
+			}
+		}
+		if len(hosts) == 0 {
+			hosts = []string{f.IP}
+		}
+		for _, host := range hosts {
+			if !probed {
+				if strings.Contains(host, ":") {
+					host = "[" + host + "]"
+				}
+				add(host)
+				continue
+			}
+			for _, port := range f.OpenPorts {
+				add(net.JoinHostPort(host, strconv.Itoa(port)))
+			}
+		}
+	}
+	return targets
+}
+
+func writeHTTPTargets(path string, targets []string) error {
+	var buf bytes.Buffer
+	for _, t := range targets {
+		buf.WriteString(t)
+		buf.WriteByte('\n')
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+func parseNets(prefixes []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, p := range prefixes {
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+func (sc *scanner) dnsResolver() *net.Resolver {
+	if sc.resolver != nil {
+		return sc.resolver
+	}
+	return net.DefaultResolver
+}
+
+func containingPrefix(ip net.IP, nets []*net.IPNet) string {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return n.String()
+		}
+	}
+	return ""
+}
+
+// mergeImported forward-resolves hostnames from an external enumeration and
+// reports which of their addresses fall inside the scanned prefixes.
+func (sc *scanner) mergeImported(hosts []string, prefixes []string) {
+	nets, resolver := parseNets(prefixes), sc.dnsResolver()
+
+	fmt.Printf(Green+"\n[+] Resolving %d imported hostnames\n"+Reset, len(hosts))
+	inside := 0
+	for _, host := range hosts {
+		sc.hostnames[host] = true
+		if sc.throttle(sc.context()) != nil {
+			break
+		}
+		addrs, err := resolver.LookupIPAddr(sc.context(), host)
+		if err != nil || len(addrs) == 0 {
+			if sc.verbose {
+				fmt.Printf("[-] %s does not resolve\n", host)
+			}
+			sc.writeImported(LookupResult{Names: []string{host}, Status: classifyLookup(nil, err), Err: err}, "")
+			continue
+		}
+
+		hostInside := false
+		for _, a := range addrs {
+			prefix := containingPrefix(a.IP, nets)
+			if prefix != "" {
+				hostInside = true
+				fmt.Printf(Blue+"[+] %s -> %s"+Reset+" (in %s)\n", host, a.IP, prefix)
+			} else if sc.verbose {
+				fmt.Printf("[-] %s -> %s (outside scanned prefixes)\n", host, a.IP)
+			}
+			sc.writeImported(LookupResult{IP: a.IP.String(), Names: []string{host}, Status: StatusFound}, prefix)
+		}
+		if hostInside {
+			inside++
+		}
+	}
+	fmt.Printf(Green+"[+] %d of %d imported hostnames resolve inside the scanned prefixes\n"+Reset, inside, len(hosts))
+}
+
+// resolveAll forward-resolves every hostname the sweep discovered and reports
+// the addresses it did not already find, inside the scanned prefixes or, with
+// the announcing ASN from api, elsewhere. An address inside is said to have
+// no PTR record only when its lookup answered NXDOMAIN; sc.looked tells
+// those apart from failed lookups and addresses never looked up (sampling,
+// shards, an interrupted run).
+func (sc *scanner) resolveAll(api *Client, prefixes []string) {
+	nets, resolver := parseNets(prefixes), sc.dnsResolver()
+	seen := map[string]bool{}
+	for _, f := range sc.findings {
+		seen[f.IP] = true
+	}
+	hosts := make([]string, 0, len(sc.hostnames))
+	for host := range sc.hostnames {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	fmt.Printf(Green+"\n[+] Forward-resolving %d discovered hostnames\n"+Reset, len(hosts))
+	inside, outside := 0, 0
+	for _, host := range hosts {
+		if sc.throttle(sc.context()) != nil {
+			break
+		}
+		addrs, err := resolver.LookupIPAddr(sc.context(), host)
+		if err != nil {
+			if sc.verbose {
+				fmt.Printf("[-] %s does not resolve\n", host)
+			}
+			continue
+		}
+		for _, a := range addrs {
+			ip := a.IP.String()
+			if seen[ip] {
+				continue
+			}
+			seen[ip] = true
+			rec := jsonlRecord{IP: ip, Family: "ipv6", Status: StatusFound.String(), Hostnames: []string{host}, Source: "resolve-all"}
+			if a.IP.To4() != nil {
+				rec.Family = "ipv4"
+			}
+			if rec.Prefix = containingPrefix(a.IP, nets); rec.Prefix != "" {
+				inside++
+				fmt.Printf(Blue+"[+] %s -> %s"+Reset+" (in %s, %s)\n", host, ip, rec.Prefix, sc.ptrOutcome(ip))
+				sc.out.Emit(rec)
+				continue
+			}
+			outside++
+			asn, routed, err := api.IPOrigin(sc.context(), ip)
+			switch {
+			case err != nil:
+				fmt.Printf(Purple+"[~] %s -> %s (outside scanned prefixes, origin lookup failed: %v)\n"+Reset, host, ip, err)
+			case asn == nil:
+				fmt.Printf(Purple+"[~] %s -> %s (outside scanned prefixes, not announced)\n"+Reset, host, ip)
+			default:
+				rec.ASN, rec.Routed = asn.Number, routed
+				fmt.Printf(Purple+"[~] %s -> %s (outside scanned prefixes, AS%d %s, %s)\n"+Reset, host, ip, asn.Number, asn.Name, routed)
+			}
+			sc.out.Emit(rec)
+		}
+	}
+	fmt.Printf(Green+"[+] %d more addresses inside the scanned prefixes, %d elsewhere\n"+Reset, inside, outside)
+}
+
+// ptrOutcome describes what the sweep learned about ip's PTR record.
+func (sc *scanner) ptrOutcome(ip string) string {
+	status, ok := sc.looked[ip]
+	switch {
+	case !ok:
+		return "not looked up in this run"
+	case status == StatusNXDomain:
+		return "no PTR record"
+	case status == StatusFound:
+		return "PTR record filtered out"
+	}
+	return "PTR lookup failed: " + status.String()
+}
+
+// Banner is what a TCP service sent first after the connection was opened.
+type Banner struct {
+	Port int    `json:"port"`
+	Text string `json:"text"`
+}
+
+func (b Banner) String() string {
+	return fmt.Sprintf("%d: %s", b.Port, b.Text)
+}
+
+const (
+	// bannerTimeout bounds both the connect and the wait for a banner.
+	bannerTimeout = 3 * time.Second
+	bannerWorkers = 16
+)
+
+// grabBanner connects to ip:port and reads one chunk of at most max bytes.
+// Services that wait for the client to speak first yield "".
+func grabBanner(ctx context.Context, ip string, port, max int) (string, error) {
+	d := net.Dialer{Timeout: bannerTimeout}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(bannerTimeout))
+
+	buf := make([]byte, max)
+	n, err := conn.Read(buf)
+	if n == 0 {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, io.EOF) {
+			return "", nil
+		}
+		return "", err
+	}
+	text := sanitizeBanner(buf[:n])
+	if n == max {
+		text += "..."
+	}
+	return text, nil
+}
+
+// sanitizeBanner makes raw service output safe for terminals and reports:
+// printable ASCII is kept, line breaks are written as \n and \r, and any
+// other byte as \xNN.
+func sanitizeBanner(raw []byte) string {
+	var b strings.Builder
+	for _, c := range bytes.TrimRight(raw, "\r\n\t ") {
+		switch {
+		case c >= 0x20 && c < 0x7f:
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		default:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	return b.String()
+}
+
+// grabBanners connects to each port of every finding's address and records
+// the banners services send on their own, like SSH and FTP.
+func (sc *scanner) grabBanners(ports []int, max int) {
+	ctx := sc.context()
+	fmt.Printf(Green+"\n[+] Grabbing banners from %d hosts on %d ports\n"+Reset, len(sc.findings), len(ports))
+
+	type job struct{ finding, port int }
+	jobs := make(chan job)
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		found int
+	)
+	for w := 0; w < bannerWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer flushOnPanic()
+			for j := range jobs {
+				f := &sc.findings[j.finding]
+				text, err := grabBanner(ctx, f.IP, j.port, max)
+				if err != nil {
+					if sc.verbose {
+						fmt.Printf("[-] %s:%d %v\n", f.IP, j.port, err)
+					}
+					continue
+				}
+				mu.Lock()
+				f.OpenPorts = append(f.OpenPorts, j.port)
+				if text == "" {
+					mu.Unlock()
+					continue
+				}
+				found++
+				f.Banners = append(f.Banners, Banner{Port: j.port, Text: text})
+				fmt.Printf(Blue+"[+] %s:%d"+Reset+" %s\n", f.IP, j.port, text)
+				sc.out.Emit(jsonlRecord{IP: f.IP, Prefix: f.Prefix, Family: prefixFamily(f.Prefix), Status: StatusFound.String(),
+					Hostnames: f.Hostnames, Source: "banner", Port: j.port, Banner: text})
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for i := range sc.findings {
+		for _, port := range ports {
+			select {
+			case jobs <- job{i, port}:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i := range sc.findings {
+		sort.Slice(sc.findings[i].Banners, func(a, b int) bool { return sc.findings[i].Banners[a].Port < sc.findings[i].Banners[b].Port })
+		sort.Ints(sc.findings[i].OpenPorts)
+	}
+	fmt.Printf(Green+"[+] %d banners collected\n"+Reset, found)
+}
+
+// SMTPProbe is what a mail server said during EHLO: its greeting, the name
+// it gave and the extensions it advertised.
+type SMTPProbe struct {
+	Greeting   string   `json:"greeting"`
+	EHLOName   string   `json:"ehlo_name,omitempty"`
+	Extensions []string `json:"extensions,omitempty"`
+	StartTLS   bool     `json:"starttls"`
+	MaxSize    int64    `json:"max_size,omitempty"`
+	// MatchesPTR is set when the EHLO name is one of the address's PTR names.
+	MatchesPTR bool `json:"matches_ptr"`
+}
+
+func (p *SMTPProbe) String() string {
+	s := p.EHLOName
+	if s == "" {
+		s = p.Greeting
+	}
+	if p.MatchesPTR {
+		s += " (matches PTR)"
+	} else if p.EHLOName != "" {
+		s += " (differs from PTR)"
+	}
+	if p.StartTLS {
+		s += " STARTTLS"
+	}
+	if p.MaxSize > 0 {
+		s += fmt.Sprintf(" SIZE %d", p.MaxSize)
+	}
+	return s
+}
+
+// smtpTimeout bounds a whole SMTP probe session.
+const smtpTimeout = 10 * time.Second
+
+// mailWords mark PTR labels of mail hosts, e.g. mx1, mail-out, smtp.
+var mailWords = []string{"mx", "mail", "smtp"}
+
+func looksLikeMail(names []string) bool {
+	for _, name := range names {
+		for _, label := range strings.Split(normalizeHostname(name), ".") {
+			for _, w := range mailWords {
+				if strings.HasPrefix(label, w) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// probeSMTP reads the greeting of the mail server at ip, sends EHLO and
+// QUIT, and nothing else.
+func probeSMTP(ctx context.Context, ip string, ptrs []string) (*SMTPProbe, error) {
+	d := net.Dialer{Timeout: bannerTimeout}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip, "25"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	tp := textproto.NewConn(conn)
+	_, greeting, err := tp.ReadResponse(220)
+	if err != nil {
+		return nil, err
+	}
+	p := &SMTPProbe{Greeting: sanitizeBanner([]byte(strings.SplitN(greeting, "\n", 2)[0]))}
+	defer tp.PrintfLine("QUIT")
+
+	// Introduce ourselves by address literal, as RFC 5321 allows for
+	// clients without a meaningful hostname.
+	local, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	if strings.Contains(local, ":") {
+		local = "IPv6:" + local
+	}
+	if err := tp.PrintfLine("EHLO [%s]", local); err != nil {
+		return p, nil
+	}
+	_, reply, err := tp.ReadResponse(250)
+	if err != nil {
+		return p, nil
+	}
+	lines := strings.Split(reply, "\n")
+	if f := strings.Fields(lines[0]); len(f) > 0 {
+		p.EHLOName = sanitizeBanner([]byte(f[0]))
+	}
+	for _, line := range lines[1:] {
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		p.Extensions = append(p.Extensions, sanitizeBanner([]byte(line)))
+		switch strings.ToUpper(f[0]) {
+		case "STARTTLS":
+			p.StartTLS = true
+		case "SIZE":
+			if len(f) > 1 {
+				p.MaxSize, _ = strconv.ParseInt(f[1], 10, 64)
+			}
+		}
+	}
+	for _, name := range ptrs {
+		if normalizeHostname(name) == normalizeHostname(p.EHLOName) {
+			p.MatchesPTR = true
+		}
+	}
+	return p, nil
+}
+
+// probeMailHosts runs probeSMTP against findings that look like mail hosts,
+// or against all of them.
+func (sc *scanner) probeMailHosts(all bool) {
+	ctx := sc.context()
+	var targets []int
+	for i, f := range sc.findings {
+		if all || looksLikeMail(f.Hostnames) {
+			targets = append(targets, i)
+		}
+	}
+	fmt.Printf(Green+"\n[+] Probing SMTP on %d hosts\n"+Reset, len(targets))
+
+	jobs := make(chan int)
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		got int
+	)
+	for w := 0; w < bannerWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer flushOnPanic()
+			for i := range jobs {
+				f := &sc.findings[i]
+				p, err := probeSMTP(ctx, f.IP, f.Hostnames)
+				if err != nil {
+					if sc.verbose {
+						fmt.Printf("[-] %s:25 %v\n", f.IP, err)
+					}
+					continue
+				}
+				mu.Lock()
+				got++
+				f.SMTP = p
+				fmt.Printf(Blue+"[+] %s SMTP"+Reset+" %s\n", f.IP, p)
+				sc.out.Emit(jsonlRecord{IP: f.IP, Prefix: f.Prefix, Family: prefixFamily(f.Prefix), Status: StatusFound.String(),
+					Hostnames: f.Hostnames, Source: "smtp", Port: 25, SMTP: p})
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, i := range targets {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	fmt.Printf(Green+"[+] %d of %d hosts answered on port 25\n"+Reset, got, len(targets))
+}
+
+// parsePorts parses a comma-separated TCP port list such as "21,22,25".
+func parsePorts(spec string) ([]int, error) {
+	var ports []int
+	for _, field := range strings.Split(spec, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", field)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+func (sc *scanner) writeImported(res LookupResult, prefix string) {
+	rec := jsonlRecord{IP: res.IP, Prefix: prefix, Family: prefixFamily(prefix), Status: res.Status.String(), Hostnames: res.Names, Source: "import"}
+	if res.Err != nil && res.Status != StatusNXDomain {
+		rec.Error = res.Err.Error()
+	}
+	sc.out.Emit(rec)
+}
+
+// Public suffixes with more than one label that commonly show up in PTR
+// data. Anything else is treated as a single-label TLD.
+var multiLabelSuffixes = map[string]bool{
+	"co.uk": true, "org.uk": true, "ac.uk": true, "gov.uk": true, "net.uk": true,
+	"com.au": true, "net.au": true, "org.au": true, "edu.au": true,
+	"co.jp": true, "ne.jp": true, "or.jp": true, "ad.jp": true,
+	"co.nz": true, "net.nz": true, "com.br": true, "net.br": true,
+	"com.cn": true, "net.cn": true, "com.mx": true, "co.in": true,
+	"co.za": true, "com.tr": true, "com.sg": true, "com.hk": true,
+	"co.kr": true, "com.tw": true, "com.ar": true, "co.il": true,
+}
+
+// apexDomain returns the registrable domain of host, or "" when host has
+// no public suffix (single labels, reverse-zone names).
+func apexDomain(host string) string {
+	host = normalizeHostname(host)
+	if strings.HasSuffix(host, ".arpa") {
+		return ""
+	}
+	labels := strings.Split(host, ".")
+	n := 2
+	if len(labels) >= 3 && multiLabelSuffixes[strings.Join(labels[len(labels)-2:], ".")] {
+		n = 3
+	}
+	if len(labels) < n {
+		return ""
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+func apexDomains(hosts map[string]bool) []string {
+	set := map[string]bool{}
+	for h := range hosts {
+		if apex := apexDomain(h); apex != "" {
+			set[apex] = true
+		}
+	}
+	domains := make([]string, 0, len(set))
+	for d := range set {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+const (
+	// patternLimit caps how many templates are tracked at once; beyond it
+	// the rarest are forgotten, so memory stays bounded on huge scans.
+	patternLimit    = 10000
+	patternExamples = 3
+	patternTop      = 10
+	// wordMergeMin is how many templates must differ only in one word for
+	// that word to become a placeholder.
+	wordMergeMin = 3
+)
+
+// PatternStat is one hostname template, e.g. fw{n}.{w}{n}.example.com, with
+// how many hostnames fit it and a few of them.
+type PatternStat struct {
+	Template string   `json:"template"`
+	Count    int      `json:"count"`
+	Examples []string `json:"examples"`
+
+	tokens []string
+}
+
+// patternCounter clusters hostnames into templates as they stream in.
+type patternCounter struct {
+	templates map[string]*PatternStat
+	pruned    int
+}
+
+func newPatternCounter() *patternCounter {
+	return &patternCounter{templates: map[string]*PatternStat{}}
+}
+
+var patternToken = regexp.MustCompile(`[a-z]+|[0-9]+|[^a-z0-9]+`)
+
+// hostTemplate splits the part of host left of its apex domain into word,
+// number and separator tokens, numbers becoming {n}. The apex stays literal.
+func hostTemplate(host string) []string {
+	host = normalizeHostname(host)
+	apex := apexDomain(host)
+	left := strings.TrimSuffix(strings.TrimSuffix(host, apex), ".")
+	tokens := patternToken.FindAllString(left, -1)
+	for i, t := range tokens {
+		if t[0] >= '0' && t[0] <= '9' {
+			tokens[i] = "{n}"
+		}
+	}
+	if apex != "" {
+		if left != "" {
+			tokens = append(tokens, ".")
+		}
+		tokens = append(tokens, apex)
+	}
+	return tokens
+}
+
+func (pc *patternCounter) Add(host string) {
+	tokens := hostTemplate(host)
+	key := strings.Join(tokens, "")
+	st := pc.templates[key]
+	if st == nil {
+		if len(pc.templates) >= patternLimit {
+			pc.prune()
+		}
+		st = &PatternStat{Template: key, tokens: tokens}
+		pc.templates[key] = st
+	}
+	st.Count++
+	if len(st.Examples) < patternExamples {
+		st.Examples = append(st.Examples, normalizeHostname(host))
+	}
+}
+
+// prune drops the templates seen least often, at least half of them.
+func (pc *patternCounter) prune() {
+	counts := make([]int, 0, len(pc.templates))
+	for _, st := range pc.templates {
+		counts = append(counts, st.Count)
+	}
+	sort.Ints(counts)
+	cutoff := counts[len(counts)/2]
+	for key, st := range pc.templates {
+		if st.Count <= cutoff {
+			delete(pc.templates, key)
+			pc.pruned++
+		}
+	}
+}
+
+// Top merges templates that differ in a single word into {w} placeholders
+// and returns the n most common ones seen more than once.
+func (pc *patternCounter) Top(n int) []PatternStat {
+	stats := make([]*PatternStat, 0, len(pc.templates))
+	for _, st := range pc.templates {
+		stats = append(stats, st)
+	}
+	for pos := 0; ; pos++ {
+		longest := 0
+		groups := map[string][]*PatternStat{}
+		var order []string
+		for _, st := range stats {
+			longest = max(longest, len(st.tokens))
+			key := strings.Join(st.tokens, "")
+			if pos < len(st.tokens)-1 && isWord(st.tokens[pos]) {
+				generalized := append(append(append([]string(nil), st.tokens[:pos]...), "{w}"), st.tokens[pos+1:]...)
+				key = "\x00" + strings.Join(generalized, "")
+			}
+			if groups[key] == nil {
+				order = append(order, key)
+			}
+			groups[key] = append(groups[key], st)
+		}
+		if pos >= longest {
+			break
+		}
+		stats = stats[:0]
+		for _, key := range order {
+			group := groups[key]
+			switch {
+			case key[0] == 0 && len(group) >= wordMergeMin:
+				tokens := append(append(append([]string(nil), group[0].tokens[:pos]...), "{w}"), group[0].tokens[pos+1:]...)
+				stats = append(stats, mergePatterns(tokens, group))
+			case key[0] != 0 && len(group) > 1:
+				// Earlier merges can arrive at the same template.
+				stats = append(stats, mergePatterns(group[0].tokens, group))
+			default:
+				stats = append(stats, group...)
+			}
+		}
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		return stats[i].Template < stats[j].Template
+	})
+	var top []PatternStat
+	for _, st := range stats {
+		if len(top) == n || st.Count < 2 {
+			break
+		}
+		top = append(top, *st)
+	}
+	return top
+}
+
+func mergePatterns(tokens []string, group []*PatternStat) *PatternStat {
+	merged := &PatternStat{Template: strings.Join(tokens, ""), tokens: tokens}
+	for _, st := range group {
+		merged.Count += st.Count
+		for _, ex := range st.Examples {
+			if len(merged.Examples) < patternExamples {
+				merged.Examples = append(merged.Examples, ex)
+			}
+		}
+	}
+	return merged
+}
+
+func isWord(token string) bool {
+	return token != "" && token[0] >= 'a' && token[0] <= 'z'
+}
+
+func printPatterns(patterns []PatternStat) {
+	if len(patterns) == 0 {
+		return
+	}
+	fmt.Println(Green + "\n[+] Hostname naming patterns" + Reset)
+	for _, p := range patterns {
+		fmt.Printf(Blue+"%6d"+Reset+"  %s  (e.g. %s)\n", p.Count, p.Template, strings.Join(p.Examples, ", "))
+	}
+}
+
+// PivotLead is an ASN outside the scan that discovered apex domains point
+// at, with how each of them led there.
+type PivotLead struct {
+	ASN      int      `json:"asn"`
+	Name     string   `json:"name"`
+	Country  string   `json:"country_code,omitempty"`
+	Evidence []string `json:"evidence"`
+}
+
+// pivot runs every apex domain with at least minHosts discovered hostnames
+// back through discovery: the addresses the apex and its www host resolve to
+// are traced to their origin ASN, and the apex's first label is searched for
+// as an organization name. ASNs in scanned, or announcing the scanned
+// prefixes, are left out. Nothing is scanned.
+func (sc *scanner) pivot(api *Client, scanned map[int]bool, prefixes []string, minHosts int) []PivotLead {
+	counts := map[string]int{}
+	for host := range sc.hostnames {
+		if apex := apexDomain(host); apex != "" {
+			counts[apex]++
+		}
+	}
+	var apexes []string
+	for apex, n := range counts {
+		if n >= minHosts {
+			apexes = append(apexes, apex)
+		}
+	}
+	sort.Slice(apexes, func(i, j int) bool {
+		if counts[apexes[i]] != counts[apexes[j]] {
+			return counts[apexes[i]] > counts[apexes[j]]
+		}
+		return apexes[i] < apexes[j]
+	})
+	if len(apexes) == 0 {
+		fmt.Printf(Purple+"\n[~] No apex domain has %d hostnames to pivot on (-pivot-min)\n"+Reset, minHosts)
+		return nil
+	}
+
+	fmt.Printf(Green+"\n[+] Pivoting on %d apex domains with at least %d hostnames\n"+Reset, len(apexes), minHosts)
+	nets, resolver := parseNets(prefixes), sc.dnsResolver()
+	leads := map[int]*PivotLead{}
+	add := func(asn ASN, evidence string) {
+		if scanned[asn.Number] {
+			return
+		}
+		l := leads[asn.Number]
+		if l == nil {
+			l = &PivotLead{ASN: asn.Number, Name: asn.Name, Country: asn.CountryCode}
+			leads[asn.Number] = l
+		}
+		if !slices.Contains(l.Evidence, evidence) {
+			l.Evidence = append(l.Evidence, evidence)
+		}
+	}
+	for _, apex := range apexes {
+		if sc.stopped() {
+			break
+		}
+		for _, host := range []string{apex, "www." + apex} {
+			if sc.throttle(sc.context()) != nil {
+				break
+			}
+			addrs, err := resolver.LookupIPAddr(sc.context(), host)
+			if err != nil {
+				continue
+			}
+			for _, a := range addrs {
+				if containingPrefix(a.IP, nets) != "" {
+					continue
+				}
+				asn, routed, err := api.IPOrigin(sc.context(), a.IP.String())
+				if err != nil {
+					if sc.verbose {
+						fmt.Printf("[-] Origin lookup for %s failed: %v\n", a.IP, err)
+					}
+					continue
+				}
+				if asn != nil {
+					add(*asn, fmt.Sprintf("%s resolves to %s in %s (%d scanned hostnames under %s)", host, a.IP, routed, counts[apex], apex))
+				}
+			}
+		}
+		term := strings.SplitN(apex, ".", 2)[0]
+		asns, err := api.SearchASNs(sc.context(), term)
+		if err != nil {
+			if sc.verbose {
+				fmt.Printf("[-] Search for %q failed: %v\n", term, err)
+			}
+			continue
+		}
+		for _, asn := range asns {
+			add(asn, fmt.Sprintf("a search for %q matches its name (%d scanned hostnames under %s)", term, counts[apex], apex))
+		}
+	}
+
+	out := make([]PivotLead, 0, len(leads))
+	for _, l := range leads {
+		out = append(out, *l)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if len(out[i].Evidence) != len(out[j].Evidence) {
+			return len(out[i].Evidence) > len(out[j].Evidence)
+		}
+		return out[i].ASN < out[j].ASN
+	})
+	return out
+}
+
+func printPivots(leads []PivotLead) {
+	if leads == nil {
+		return
+	}
+	fmt.Println(Green + "\n[+] Related organizations you may want to scan next" + Reset)
+	if len(leads) == 0 {
+		fmt.Println("No ASNs outside this scan were found.")
+		return
+	}
+	for _, l := range leads {
+		fmt.Printf(Blue+"AS%d"+Reset+" %s", l.ASN, l.Name)
+		if l.Country != "" {
+			fmt.Printf(" (%s)", l.Country)
+		}
+		fmt.Println()
+		for _, e := range l.Evidence {
+			fmt.Printf("    %s\n", e)
+		}
+	}
+}
+
+// spfTargets extracts include: domains and ip4:/ip6: networks from an SPF record.
+func spfTargets(txt string) (includes, networks []string) {
+	fields := strings.Fields(txt)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "v=spf1") {
+		return nil, nil
+	}
+	for _, f := range fields[1:] {
+		f = strings.TrimLeft(f, "+-~?")
+		switch {
+		case strings.HasPrefix(f, "include:"):
+			includes = append(includes, normalizeHostname(strings.TrimPrefix(f, "include:")))
+		case strings.HasPrefix(f, "ip4:"), strings.HasPrefix(f, "ip6:"):
+			networks = append(networks, f[4:])
+		}
+	}
+	return includes, networks
+}
+
+// DNSInfraRow is one piece of an apex domain's infrastructure found by
+// -enrich-dns: an address of an MX or NS host, an SPF include, or an SPF
+// network, with the scanned prefix it falls in.
+type DNSInfraRow struct {
+	Domain string `json:"domain"`
+	Record string `json:"record"`
+	// Value is the MX or NS host, the SPF include domain or the SPF network.
+	Value  string `json:"value"`
+	IP     string `json:"ip,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	// Status is found, partial (an SPF network reaching past the scan),
+	// unresolved, or the failure of the host's address lookup.
+	Status string `json:"status"`
+}
+
+// enrichDNS looks up the mail and DNS infrastructure of every apex domain
+// and flags which of it sits inside the scanned prefixes. It stops, keeping
+// what it found, once the scan is cancelled.
+func (sc *scanner) enrichDNS(domains []string, prefixes []string, spf bool) []DNSInfraRow {
+	nets, resolver := parseNets(prefixes), sc.dnsResolver()
+	ctx := sc.context()
+	rows := []DNSInfraRow{}
+
+	fmt.Printf(Green+"\n[+] DNS infrastructure of %d apex domains\n"+Reset, len(domains))
+	for _, domain := range domains {
+		if sc.stopped() {
+			break
+		}
+		type target struct{ record, host string }
+		var targets []target
+
+		if sc.throttle(ctx) != nil {
+			break
+		}
+		if mxs, err := resolver.LookupMX(ctx, domain); err == nil {
+			for _, mx := range mxs {
+				targets = append(targets, target{"MX", normalizeHostname(mx.Host)})
+			}
+		}
+		if sc.throttle(ctx) != nil {
+			break
+		}
+		if nss, err := resolver.LookupNS(ctx, domain); err == nil {
+			for _, ns := range nss {
+				targets = append(targets, target{"NS", normalizeHostname(ns.Host)})
+			}
+		}
+
+		var spfNetworks []string
+		if spf {
+			if sc.throttle(ctx) != nil {
+				break
+			}
+			if txts, err := resolver.LookupTXT(ctx, domain); err == nil {
+				for _, txt := range txts {
+					includes, networks := spfTargets(txt)
+					for _, inc := range includes {
+						fmt.Printf("%s SPF include %s\n", domain, inc)
+						rows = append(rows, sc.writeEnrichment(DNSInfraRow{Domain: domain, Record: "SPF", Value: inc, Status: StatusFound.String()}))
+					}
+					spfNetworks = append(spfNetworks, networks...)
+				}
+			}
+		}
+
+		for _, t := range targets {
+			if sc.throttle(ctx) != nil {
+				break
+			}
+			addrs, err := resolver.LookupIPAddr(ctx, t.host)
+			if ctx.Err() != nil {
+				// Cancelled, not unresolved: leave it out.
+				break
+			}
+			if err != nil || len(addrs) == 0 {
+				row := DNSInfraRow{Domain: domain, Record: t.record, Value: t.host, Status: "unresolved"}
+				if status := classifyLookup(nil, err); status == StatusNXDomain {
+					fmt.Printf("%s %s %s (does not resolve)\n", domain, t.record, t.host)
+				} else {
+					row.Status = status.String()
+					fmt.Printf("%s %s %s (lookup failed: %s)\n", domain, t.record, t.host, row.Status)
+				}
+				rows = append(rows, sc.writeEnrichment(row))
+				continue
+			}
+			for _, a := range addrs {
+				rows = append(rows, sc.printEnrichment(domain, t.record, t.host, a.IP, nets))
+			}
+		}
+		for _, n := range spfNetworks {
+			network, err := parseSPFNetwork(n)
+			if err != nil {
+				continue
+			}
+			rows = append(rows, sc.printSPFNetwork(domain, n, network, nets))
+		}
+	}
+	return rows
+}
+
+func (sc *scanner) printEnrichment(domain, record, host string, ip net.IP, nets []*net.IPNet) DNSInfraRow {
+	prefix := containingPrefix(ip, nets)
+	if prefix != "" {
+		fmt.Printf(Blue+"%s %s %s -> %s"+Reset+" (in %s)\n", domain, record, host, ip, prefix)
+	} else {
+		fmt.Printf("%s %s %s -> %s (outside scanned prefixes)\n", domain, record, host, ip)
+	}
+	return sc.writeEnrichment(DNSInfraRow{Domain: domain, Record: record, Value: host, IP: ip.String(), Prefix: prefix, Status: StatusFound.String()})
+}
+
+// parseSPFNetwork turns an ip4:/ip6: value into a network; a bare address
+// is a single-host network.
+func parseSPFNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid SPF address %q", s)
+		}
+		bits := 128
+		if v4 := ip.To4(); v4 != nil {
+			ip, bits = v4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+// spfCoverage reports how an SPF network relates to the scanned prefixes:
+// the first scanned prefix that holds all of it, or failing that the first
+// one it overlaps.
+func spfCoverage(network *net.IPNet, nets []*net.IPNet) (prefix string, whole bool) {
+	ones, bits := network.Mask.Size()
+	for _, n := range nets {
+		nOnes, nBits := n.Mask.Size()
+		if nBits == bits && nOnes <= ones && n.Contains(network.IP) {
+			return n.String(), true
+		}
+	}
+	for _, n := range nets {
+		if _, nBits := n.Mask.Size(); nBits == bits && network.Contains(n.IP) {
+			return n.String(), false
+		}
+	}
+	return "", false
+}
+
+func (sc *scanner) printSPFNetwork(domain, value string, network *net.IPNet, nets []*net.IPNet) DNSInfraRow {
+	prefix, whole := spfCoverage(network, nets)
+	status := StatusFound.String()
+	switch {
+	case whole:
+		fmt.Printf(Blue+"%s SPF %s"+Reset+" (in %s)\n", domain, value, prefix)
+	case prefix != "":
+		fmt.Printf(Blue+"%s SPF %s"+Reset+" (partly in %s)\n", domain, value, prefix)
+		status = "partial"
+	default:
+		fmt.Printf("%s SPF %s (outside scanned prefixes)\n", domain, value)
+	}
+	return sc.writeEnrichment(DNSInfraRow{Domain: domain, Record: "SPF", Value: value, IP: network.String(), Prefix: prefix, Status: status})
+}
+
+// writeEnrichment streams row to the outputs and returns it for the report.
+func (sc *scanner) writeEnrichment(row DNSInfraRow) DNSInfraRow {
+	sc.out.Emit(jsonlRecord{IP: row.IP, Prefix: row.Prefix, Status: row.Status, Hostnames: []string{row.Value},
+		Source: "enrich-dns", Domain: row.Domain, Record: row.Record})
+	return row
+}
+
+// detachHooks strips the scanner down to bare lookups for a throwaway pass:
+// no outputs, processors or callbacks, and nothing it finds is kept. The
+// returned func puts everything back.
+func (sc *scanner) detachHooks() (restore func()) {
+	out, processors, scorer := sc.out, sc.processors, sc.scorer
+	onResult, onPrefixDone, onChunkDone, onDeliver, onFinding := sc.onResult, sc.onPrefixDone, sc.onChunkDone, sc.onDeliver, sc.onFinding
+	patterns, hostnames, sample, findings, failed := sc.patterns, sc.hostnames, sc.sample, sc.findings, sc.failed
+	sc.out, sc.processors, sc.scorer = nil, nil, nil
+	sc.onResult, sc.onPrefixDone, sc.onChunkDone, sc.onDeliver, sc.onFinding = nil, nil, nil, nil, nil
+	sc.patterns, sc.hostnames = nil, nil
+	return func() {
+		sc.out, sc.processors, sc.scorer = out, processors, scorer
+		sc.onResult, sc.onPrefixDone, sc.onChunkDone, sc.onDeliver, sc.onFinding = onResult, onPrefixDone, onChunkDone, onDeliver, onFinding
+		sc.patterns, sc.hostnames, sc.sample, sc.findings, sc.failed = patterns, hostnames, sample, findings, failed
+	}
+}
+
+// selectChunks deaggregates prefixes larger than /threshold into /chunkLen
+// chunks, optionally samples each chunk, and lets the user pick which chunks
+// to scan fully (interactively, or via the -chunks spec).
+func (sc *scanner) selectChunks(prefixes []string, threshold, chunkLen, sampleN int, spec string) []string {
+	var out, chunks []string
+	parent := map[string]string{}
+	for _, p := range prefixes {
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			out = append(out, p)
+			continue
+		}
+		if ones, bits := ipnet.Mask.Size(); bits != 32 || ones >= threshold {
+			out = append(out, p)
+			continue
+		}
+		split, err := splitPrefix(p, chunkLen)
+		if err != nil {
+			fmt.Println(Red+"[!]", err, Reset)
+			out = append(out, p)
+			continue
+		}
+		for _, c := range split {
+			parent[c] = p
+		}
+		chunks = append(chunks, split...)
+	}
+	if len(chunks) == 0 {
+		return prefixes
+	}
+
+	hitRate := map[string]float64{}
+	if sampleN > 0 {
+		fmt.Printf(Purple+"\n[~] Sampling %d addresses in each of %d chunks...\n"+Reset, sampleN, len(chunks))
+		restore := sc.detachHooks()
+		sc.sample = sampleN
+		for _, ps := range sc.scan(chunks) {
+			hitRate[ps.Prefix] = ps.HitRate()
+		}
+		restore()
+	}
+
+	fmt.Printf(Green+"\n[+] %d /%d chunks from prefixes larger than /%d\n"+Reset, len(chunks), chunkLen, threshold)
+	for i, c := range chunks {
+		if sampleN > 0 {
+			fmt.Printf(Blue+"%d."+Reset+" %s (from %s) sampled hit rate %.1f%%\n", i+1, c, parent[c], 100*hitRate[c])
+		} else {
+			fmt.Printf(Blue+"%d."+Reset+" %s (from %s)\n", i+1, c, parent[c])
+		}
+	}
+
+	if spec == "" {
+		spec = mustPrompt(Purple + "\nSelect chunks to scan (e.g. 10-20,45, empty for all): " + Reset)
+	}
+	if spec == "" || spec == "all" {
+		return append(out, chunks...)
+	}
+	picked, err := parseSelection(spec, len(chunks))
+	if err != nil {
+		fmt.Println(Red+"Invalid chunk selection:", err, Reset)
+		os.Exit(1)
+	}
+	for _, i := range picked {
+		out = append(out, chunks[i-1])
+	}
+	return out
+}
+
+// selectPrefixes narrows the announced prefixes to the ones to sweep: those
+// named in picks (each one listed or inside a listed prefix), else those in
+// the -prefixes spec, else, when interactive, the user's answer to a menu
+// listing every prefix with its size and description. It returns the
+// selection and the spec it amounts to, for the manifest.
+func selectPrefixes(prefixes []string, meta map[string]Prefix, spec string, picks []string, interactive bool) ([]string, string, error) {
+	if len(picks) > 0 {
+		nets := parseNets(prefixes)
+		var out []string
+		for _, p := range picks {
+			ip, n, err := net.ParseCIDR(p)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid -prefix %q", p)
+			}
+			if containingPrefix(ip, nets) == "" {
+				return nil, "", fmt.Errorf("-prefix %s is not announced by the selected ASNs", p)
+			}
+			out = append(out, n.String())
+		}
+		return out, strings.Join(out, ","), nil
+	}
+	if spec == "" && !interactive {
+		return prefixes, "", nil
+	}
+
+	if spec == "" {
+		fmt.Printf(Green+"\n[+] %d announced prefixes\n"+Reset, len(prefixes))
+		for i, p := range prefixes {
+			size := "too large to enumerate"
+			if _, first, last, err := hostRange(p); err == nil {
+				size = fmt.Sprintf("%d IPs", last-first+1)
+			}
+			fmt.Printf(Blue+"%d."+Reset+" %s  %s  %s\n", i+1, p, size, meta[p].About())
+		}
+		// An unanswered menu (end of input) scans everything.
+		spec, _ = prompt(Purple + "\nSelect prefixes to scan (e.g. 1,4-9), t to toggle a checklist, empty for all: " + Reset)
+		if spec == "t" {
+			spec = togglePrefixes(prefixes)
+		}
+	}
+	if spec == "" || spec == "all" {
+		return prefixes, "all", nil
+	}
+	picked, err := parseSelection(spec, len(prefixes))
+	if err != nil {
+		return nil, "", err
+	}
+	out := make([]string, 0, len(picked))
+	for _, i := range picked {
+		out = append(out, prefixes[i-1])
+	}
+	return out, spec, nil
+}
+
+// togglePrefixes runs a checklist of prefixes, all checked at first, and
+// returns the checked ones as a selection spec.
+func togglePrefixes(prefixes []string) string {
+	checked := make([]bool, len(prefixes))
+	for i := range checked {
+		checked[i] = true
+	}
+	for {
+		fmt.Println()
+		for i, p := range prefixes {
+			mark := " "
+			if checked[i] {
+				mark = "x"
+			}
+			fmt.Printf("[%s] "+Blue+"%d."+Reset+" %s\n", mark, i+1, p)
+		}
+		line, err := prompt(Purple + "Toggle (e.g. 2 or 1,3-5), a for all, n for none, empty to continue: " + Reset)
+		if err != nil || line == "" {
+			break
+		}
+		switch line {
+		case "a", "n":
+			for i := range checked {
+				checked[i] = line == "a"
+			}
+			continue
+		}
+		picked, err := parseSelection(line, len(prefixes))
+		if err != nil {
+			fmt.Println(Red+"Invalid selection:", err, Reset)
+			continue
+		}
+		for _, i := range picked {
+			checked[i-1] = !checked[i-1]
+		}
+	}
+	var parts []string
+	for i, ok := range checked {
+		if ok {
+			parts = append(parts, strconv.Itoa(i+1))
+		}
+	}
+	if len(parts) == len(prefixes) {
+		return "all"
+	}
+	if len(parts) == 0 {
+		// parseSelection rejects it, so nothing is scanned by accident.
+		return ","
+	}
+	return strings.Join(parts, ",")
+}
+
+// rankBySampledHitRate orders sampled prefixes from most to least populated.
+func rankBySampledHitRate(stats []*PrefixStats) []*PrefixStats {
+	var ranked []*PrefixStats
+	for _, ps := range stats {
+		if ps.Sampled {
+			ranked = append(ranked, ps)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].HitRate() > ranked[j].HitRate()
+	})
+	return ranked
+}
+
+func printSampleRanking(ranked []*PrefixStats) {
+	if len(ranked) == 0 {
+		return
+	}
+	fmt.Println(Green + "\n[+] Prefixes ranked by sampled hit rate" + Reset)
+	for i, ps := range ranked {
+		fmt.Printf(Blue+"%d."+Reset+" %s: %d/%d sampled IPs resolved (%.1f%%)\n",
+			i+1, ps.Prefix, ps.Counts[StatusFound], ps.Total, 100*ps.HitRate())
+	}
+}
+
+// Checkpoint records the prefix order chosen for a run and which prefixes
+// have been fully scanned, so an interrupted run can resume consistently.
+type Checkpoint struct {
+	path      string
+	Prefixes  []string  `json:"prefixes"`
+	Completed []string  `json:"completed"`
+	Shuffled  bool      `json:"shuffled,omitempty"`
+	Seed      int64     `json:"seed,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Stats of completed prefixes, so resumed runs still report them.
+	Stats map[string]*PrefixStats `json:"stats,omitempty"`
+	// Current is the prefix that was being scanned, so a resumed run
+	// continues inside it instead of starting it over.
+	Current *PrefixProgress `json:"current,omitempty"`
+	// Selection is the announced prefixes picked before scanning, so a
+	// resumed run skips the prefix menu.
+	Selection []string `json:"selection,omitempty"`
+	// Failed is the retry queue, so lookups that failed before an
+	// interruption still get their -retry-passes after resuming.
+	Failed []FailedLookup `json:"failed,omitempty"`
+}
+
+// FailedLookup is an address whose lookup timed out or hit SERVFAIL and
+// waits for a retry pass.
+type FailedLookup struct {
+	IP     string       `json:"ip"`
+	Prefix string       `json:"prefix"`
+	Status LookupStatus `json:"status"`
+}
+
+// PrefixProgress is how far into a prefix a scan got: the number of its
+// addresses covered by finished chunks and their stats.
+type PrefixProgress struct {
+	Prefix string       `json:"prefix"`
+	Done   uint64       `json:"done"`
+	Stats  *PrefixStats `json:"stats"`
+}
+
+func loadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cp := &Checkpoint{path: path}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("corrupt checkpoint %s: %v", path, err)
+	}
+	return cp, nil
+}
+
+func (cp *Checkpoint) Save() error {
+	cp.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cp.path, data)
+}
+
+// MarkChunk records that the first done addresses of ps's prefix are scanned.
+// The stats are copied since the scan keeps updating ps.
+func (cp *Checkpoint) MarkChunk(ps *PrefixStats, done uint64) {
+	cp.Current = &PrefixProgress{Prefix: ps.Prefix, Done: done, Stats: ps.clone()}
+}
+
+func (cp *Checkpoint) MarkDone(ps *PrefixStats) {
+	cp.Current = nil
+	cp.Completed = append(cp.Completed, ps.Prefix)
+	if cp.Stats == nil {
+		cp.Stats = map[string]*PrefixStats{}
+	}
+	cp.Stats[ps.Prefix] = ps
+}
+
+// CompletedStats returns the stats of prefixes finished in earlier runs, in
+// scan order.
+func (cp *Checkpoint) CompletedStats() []*PrefixStats {
+	var stats []*PrefixStats
+	for _, p := range cp.Completed {
+		if ps := cp.Stats[p]; ps != nil {
+			stats = append(stats, ps)
+		}
+	}
+	return stats
+}
+
+func (cp *Checkpoint) Remaining() []string {
+	done := map[string]bool{}
+	for _, p := range cp.Completed {
+		done[p] = true
+	}
+	var left []string
+	for _, p := range cp.Prefixes {
+		if !done[p] {
+			left = append(left, p)
+		}
+	}
+	return left
+}
+
+// covers reports whether the checkpoint was written for the same set of
+// prefixes, regardless of order.
+func (cp *Checkpoint) covers(prefixes []string) bool {
+	if len(cp.Prefixes) != len(prefixes) {
+		return false
+	}
+	set := map[string]bool{}
+	for _, p := range cp.Prefixes {
+		set[p] = true
+	}
+	for _, p := range prefixes {
+		if !set[p] {
+			return false
+		}
+	}
+	return true
+}
+
+type PrefixRow struct {
+	Prefix      string         `json:"prefix"`
+	Family      string         `json:"family"`
+	ASN         int            `json:"asn,omitempty"`
+	Name        string         `json:"name,omitempty"`
+	Description string         `json:"description,omitempty"`
+	CountryCode string         `json:"country_code,omitempty"`
+	Size        uint64         `json:"size"`
+	Scanned     int            `json:"scanned"`
+	Resolved    int            `json:"resolved"`
+	HitRate     float64        `json:"hit_rate"`
+	ApexDomains int            `json:"apex_domains"`
+	RPKI        string         `json:"rpki,omitempty"`
+	Visibility  *Visibility    `json:"visibility,omitempty"`
+	History     *History       `json:"history,omitempty"`
+	Ownership   *Ownership     `json:"ownership,omitempty"`
+	Abuse       []string       `json:"abuse_contacts,omitempty"`
+	Sampled     bool           `json:"sampled,omitempty"`
+	Partial     bool           `json:"partial,omitempty"`
+	TimedOut    bool           `json:"timed_out,omitempty"`
+	Outcomes    map[string]int `json:"outcomes"`
+	Zones       []*ReverseZone `json:"zones,omitempty"`
+	// NotDelegated addresses were skipped because their reverse zones,
+	// listed in UndelegatedZones, do not exist.
+	NotDelegated     int      `json:"not_delegated,omitempty"`
+	UndelegatedZones []string `json:"undelegated_zones,omitempty"`
+	// Provenance is that of the prefix's routing data.
+	Provenance
+}
+
+// statsTable turns per-prefix stats into rows sorted by hit rate, densest first.
+func statsTable(stats []*PrefixStats) []PrefixRow {
+	rows := make([]PrefixRow, 0, len(stats))
+	for _, ps := range stats {
+		row := PrefixRow{
+			Prefix:           ps.Prefix,
+			Family:           prefixFamily(ps.Prefix),
+			Size:             ps.Size,
+			Scanned:          ps.Total,
+			Resolved:         ps.Counts[StatusFound],
+			HitRate:          ps.HitRate(),
+			ApexDomains:      len(ps.Apexes),
+			Sampled:          ps.Sampled,
+			Partial:          ps.Partial(),
+			TimedOut:         ps.TimedOut,
+			Outcomes:         map[string]int{},
+			Zones:            ps.Zones,
+			NotDelegated:     ps.NotDelegated,
+			UndelegatedZones: ps.UndelegatedZones,
+		}
+		for i, n := range ps.Counts {
+			row.Outcomes[statusNames[i]] = n
+		}
+		rows = append(rows, row)
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].HitRate > rows[j].HitRate
+	})
+	return rows
+}
+
+func (r PrefixRow) label() string {
+	switch {
+	case r.Sampled:
+		return r.Prefix + " (sampled)"
+	case r.TimedOut:
+		return r.Prefix + " (timed out)"
+	case r.Partial:
+		return r.Prefix + " (partial)"
+	}
+	return r.Prefix
+}
+
+// About is the prefix's description as listed by bgpview.
+func (r PrefixRow) About() string {
+	return Prefix{Name: r.Name, Description: r.Description, CountryCode: r.CountryCode}.About()
+}
+
+func printStatsTable(rows []PrefixRow) {
+	if len(rows) == 0 {
+		return
+	}
+	fmt.Println(Green + "\n[+] Per-prefix statistics" + Reset)
+	withOwner, withAbout := false, false
+	for _, r := range rows {
+		withOwner = withOwner || r.Ownership != nil
+		withAbout = withAbout || r.About() != ""
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "PREFIX\tSIZE\tSCANNED\tRESOLVED\tHIT RATE\tAPEX DOMAINS"
+	if withAbout {
+		header += "\tDESCRIPTION"
+	}
+	if withOwner {
+		header += "\tREGISTRY"
+	}
+	fmt.Fprintln(tw, header)
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.1f%%\t%d", r.label(), r.Size, r.Scanned, r.Resolved, 100*r.HitRate, r.ApexDomains)
+		if withAbout {
+			fmt.Fprintf(tw, "\t%s", r.About())
+		}
+		if withOwner && r.Ownership != nil {
+			fmt.Fprintf(tw, "\t%s", r.Ownership)
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+}
+
+type FindingRow struct {
+	IP        string   `json:"ip"`
+	Prefix    string   `json:"prefix"`
+	Hostnames []string `json:"hostnames"`
+	Country   string   `json:"country,omitempty"`
+	City      string   `json:"city,omitempty"`
+	Retried   bool     `json:"retried,omitempty"`
+	// Confidence is a pointer so a score of 0 is still written.
+	Confidence *int     `json:"confidence,omitempty"`
+	Banners    []Banner `json:"banners,omitempty"`
+	// OpenPorts are the -banners ports that accepted a connection, with or
+	// without a banner.
+	OpenPorts []int      `json:"open_ports,omitempty"`
+	SMTP      *SMTPProbe `json:"smtp,omitempty"`
+	ASN       int        `json:"asn,omitempty"`
+	// ScopePath is the downstream chain of ASNs that brought ASN into
+	// scope (-include-downstreams).
+	ScopePath []int `json:"scope_path,omitempty"`
+	// Category classifies the hostnames, e.g. access-pool.
+	Category string `json:"category,omitempty"`
+	Provenance
+}
+
+// ASNRow is a scanned ASN as its source described it.
+type ASNRow struct {
+	ASN         int    `json:"asn"`
+	Name        string `json:"name,omitempty"`
+	CountryCode string `json:"country_code,omitempty"`
+	Provenance
+}
+
+// RecordConflict is a record two merged reports disagree on, e.g. the ASN
+// of a prefix or the hostnames of an address, with the fresher version
+// that was kept.
+type RecordConflict struct {
+	Record      string     `json:"record"`
+	Kept        string     `json:"kept"`
+	KeptAsOf    *time.Time `json:"kept_as_of,omitempty"`
+	Dropped     string     `json:"dropped"`
+	DroppedAsOf *time.Time `json:"dropped_as_of,omitempty"`
+}
+
+type Report struct {
+	Org        string       `json:"org,omitempty"`
+	ASNs       []int        `json:"asns,omitempty"`
+	ASNRecords []ASNRow     `json:"asn_records,omitempty"`
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt time.Time    `json:"finished_at"`
+	Prefixes   []PrefixRow  `json:"prefixes"`
+	Findings   []FindingRow `json:"findings"`
+	Excluded   []Exclusion  `json:"excluded,omitempty"`
+	// Contacts is nil unless abuse contacts were looked up.
+	Contacts []AbuseContact `json:"abuse_contacts,omitempty"`
+	// ResolverEvents lists fallback chain health transitions, which bear on
+	// how complete the results are.
+	ResolverEvents []ResolverEvent `json:"resolver_events,omitempty"`
+	// Patterns are the most common hostname templates.
+	Patterns []PatternStat `json:"naming_patterns,omitempty"`
+	// Pivots are ASNs outside the scan found with -pivot.
+	Pivots []PivotLead `json:"related_organizations,omitempty"`
+	// DNSInfra is the MX, NS and SPF infrastructure found with -enrich-dns.
+	DNSInfra []DNSInfraRow `json:"dns_infrastructure,omitempty"`
+	// Hosts and ByASN are the merged view of a report spanning several
+	// ASNs; Conflicts lists addresses claimed by more than one of them.
+	Hosts     []HostRow     `json:"hosts,omitempty"`
+	ByASN     []ASNPrefixes `json:"asn_prefixes,omitempty"`
+	Conflicts []Conflict    `json:"conflicts,omitempty"`
+	// RecordConflicts lists where merged reports disagreed.
+	RecordConflicts []RecordConflict `json:"record_conflicts,omitempty"`
+}
+
+// The report renderers are pure functions of the Report, so a fixed report
+// always renders to the same bytes; the write functions only store them.
+
+func renderJSONReport(rep *Report) ([]byte, error) {
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func writeJSONReport(path string, rep *Report) error {
+	data, err := renderJSONReport(rep)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// markdownEscape keeps hostnames and descriptions from breaking table cells.
+func markdownEscape(s string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ").Replace(s)
+}
+
+func writeMarkdownReport(path string, rep *Report) error {
+	return writeFileAtomic(path, renderMarkdownReport(rep))
+}
+
+func renderMarkdownReport(rep *Report) []byte {
+	var b strings.Builder
+	title := rep.Org
+	if title == "" {
+		title = "ad-hoc targets"
+	}
+	fmt.Fprintf(&b, "# Recon report: %s\n\n", markdownEscape(title))
+	if len(rep.ASNs) > 0 {
+		asns := make([]string, len(rep.ASNs))
+		for i, n := range rep.ASNs {
+			asns[i] = fmt.Sprintf("AS%d", n)
+		}
+		fmt.Fprintf(&b, "- ASNs: %s\n", strings.Join(asns, ", "))
+	}
+	fmt.Fprintf(&b, "- Started: %s\n- Finished: %s\n", rep.StartedAt.Format(time.RFC3339), rep.FinishedAt.Format(time.RFC3339))
+
+	withRPKI, withLG, withHistory, withOwner, withAbout := false, false, false, false, false
+	for _, r := range rep.Prefixes {
+		withRPKI = withRPKI || r.RPKI != ""
+		withLG = withLG || r.Visibility != nil
+		withHistory = withHistory || r.History != nil
+		withOwner = withOwner || r.Ownership != nil
+		withAbout = withAbout || r.About() != ""
+	}
+	b.WriteString("\n## Prefix statistics\n\n")
+	header, align := "| Prefix | Size | Scanned | Resolved | Hit rate | Apex domains |", "|---|---:|---:|---:|---:|---:|"
+	if withAbout {
+		header, align = header+" Description |", align+"---|"
+	}
+	if withRPKI {
+		header, align = header+" RPKI |", align+"---|"
+	}
+	if withLG {
+		header, align = header+" Visibility |", align+"---|"
+	}
+	if withHistory {
+		header, align = header+" History |", align+"---|"
+	}
+	if withOwner {
+		header, align = header+" Registry |", align+"---|"
+	}
+	b.WriteString(header + "\n" + align + "\n")
+	for _, r := range rep.Prefixes {
+		fmt.Fprintf(&b, "| %s | %d | %d | %d | %.1f%% | %d |", r.label(), r.Size, r.Scanned, r.Resolved, 100*r.HitRate, r.ApexDomains)
+		if withAbout {
+			fmt.Fprintf(&b, " %s |", markdownEscape(r.About()))
+		}
+		if withRPKI {
+			fmt.Fprintf(&b, " %s |", r.RPKI)
+		}
+		if withLG {
+			if r.Visibility != nil {
+				fmt.Fprintf(&b, " %s |", r.Visibility)
+			} else {
+				b.WriteString("  |")
+			}
+		}
+		if withHistory {
+			if r.History != nil {
+				fmt.Fprintf(&b, " %s |", r.History)
+			} else {
+				b.WriteString("  |")
+			}
+		}
+		if withOwner {
+			if r.Ownership != nil {
+				fmt.Fprintf(&b, " %s |", markdownEscape(r.Ownership.String()))
+			} else {
+				b.WriteString("  |")
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	var zoned []PrefixRow
+	for _, r := range rep.Prefixes {
+		if len(r.Zones) > 0 {
+			zoned = append(zoned, r)
+		}
+	}
+	if len(zoned) > 0 {
+		b.WriteString("\n## Reverse zones\n\n")
+		b.WriteString("| Prefix | Zone | Nameservers | SOA primary | SOA contact | Serial |\n")
+		b.WriteString("|---|---|---|---|---|---:|\n")
+		for _, r := range zoned {
+			for _, z := range r.Zones {
+				primary, contact, serial := "", "", ""
+				if z.SOA != nil {
+					primary, contact, serial = z.SOA.Primary, z.SOA.Contact, strconv.FormatUint(uint64(z.SOA.Serial), 10)
+				}
+				fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s |\n", r.Prefix, z.Zone,
+					markdownEscape(strings.Join(z.Nameservers, ", ")), markdownEscape(primary), markdownEscape(contact), serial)
+			}
+		}
+	}
+
+	if len(rep.Excluded) > 0 {
+		b.WriteString("\n## Excluded reserved space\n\n")
+		b.WriteString("| Prefix | Reserved range | Purpose |\n|---|---|---|\n")
+		for _, ex := range rep.Excluded {
+			label := ex.Prefix
+			if ex.Skipped {
+				label += " (skipped)"
+			}
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", label, ex.Reserved, markdownEscape(ex.Purpose))
+		}
+	}
+
+	if rep.Contacts != nil {
+		b.WriteString("\n## Abuse contacts\n\n")
+		if len(rep.Contacts) == 0 {
+			b.WriteString("None found.\n")
+		}
+		for _, c := range rep.Contacts {
+			fmt.Fprintf(&b, "- %s: %s\n", markdownEscape(c.Email), strings.Join(c.Resources, ", "))
+		}
+	}
+
+	if len(rep.Patterns) > 0 {
+		b.WriteString("\n## Naming patterns\n\n| Template | Hostnames | Examples |\n|---|---|---|\n")
+		for _, p := range rep.Patterns {
+			fmt.Fprintf(&b, "| `%s` | %d | %s |\n", markdownEscape(p.Template), p.Count, markdownEscape(strings.Join(p.Examples, ", ")))
+		}
+	}
+
+	if len(rep.DNSInfra) > 0 {
+		b.WriteString("\n## DNS infrastructure\n\n| Domain | Record | Value | Address | Scanned prefix | Status |\n|---|---|---|---|---|---|\n")
+		for _, r := range rep.DNSInfra {
+			fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s |\n", markdownEscape(r.Domain), r.Record, markdownEscape(r.Value), r.IP, r.Prefix, r.Status)
+		}
+	}
+
+	if len(rep.ByASN) > 0 {
+		b.WriteString("\n## Prefixes by ASN\n\n")
+		for _, g := range rep.ByASN {
+			fmt.Fprintf(&b, "- %s: %s\n", asnLabel(g.ASN), strings.Join(g.Prefixes, ", "))
+		}
+	}
+
+	if len(rep.Conflicts) > 0 {
+		b.WriteString("\n## Attribution conflicts\n\n| IP | Prefixes | ASNs | Kept |\n|---|---|---|---|\n")
+		for _, c := range rep.Conflicts {
+			fmt.Fprintf(&b, "| %s | %s | %s | %s (%s) |\n", c.IP, strings.Join(c.Prefixes, ", "), asnList(c.ASNs), c.Prefix, asnLabel(c.ASN))
+		}
+	}
+	if len(rep.RecordConflicts) > 0 {
+		b.WriteString("\n## Record conflicts\n\n| Record | Kept | As of | Dropped | As of |\n|---|---|---|---|---|\n")
+		for _, c := range rep.RecordConflicts {
+			fmt.Fprintf(&b, "| %s | %s | %s | %s | %s |\n", c.Record, markdownEscape(c.Kept), asOfLabel(c.KeptAsOf), markdownEscape(c.Dropped), asOfLabel(c.DroppedAsOf))
+		}
+	}
+
+	if len(rep.Hosts) > 0 {
+		b.WriteString("\n## Hostnames\n\n| Hostname | IPs | ASNs |\n|---|---|---|\n")
+		for _, h := range rep.Hosts {
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", markdownEscape(h.Hostname), strings.Join(h.IPs, ", "), asnList(h.ASNs))
+		}
+	}
+
+	withBanners := false
+	for _, f := range rep.Findings {
+		withBanners = withBanners || len(f.Banners) > 0
+	}
+	b.WriteString("\n## Findings\n\n")
+	if withBanners {
+		b.WriteString("| IP | Hostnames | Prefix | Banners |\n|---|---|---|---|\n")
+	} else {
+		b.WriteString("| IP | Hostnames | Prefix |\n|---|---|---|\n")
+	}
+	for _, f := range rep.Findings {
+		fmt.Fprintf(&b, "| %s | %s | %s |", f.IP, markdownEscape(strings.Join(f.Hostnames, ", ")), f.Prefix)
+		if withBanners {
+			banners := make([]string, len(f.Banners))
+			for i, bn := range f.Banners {
+				banners[i] = markdownEscape(bn.String())
+			}
+			fmt.Fprintf(&b, " %s |", strings.Join(banners, "<br>"))
+		}
+		b.WriteString("\n")
+	}
+	return []byte(b.String())
+}
+
+// asnLabel names an ASN in reports, "-" for prefixes of unknown origin.
+func asnLabel(n int) string {
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("AS%d", n)
+}
+
+// asOfLabel is when a record's data was fetched, "-" if unknown.
+func asOfLabel(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func asnList(asns []int) string {
+	labels := make([]string, len(asns))
+	for i, n := range asns {
+		labels[i] = asnLabel(n)
+	}
+	return strings.Join(labels, ", ")
+}
+
+type ASNSummary struct {
+	ASN       int
+	Prefixes  int
+	Addresses uint64
+	Resolved  int
+}
+
+// asnOverview groups the prefix rows by originating ASN; prefixes whose
+// origin is unknown (ad-hoc targets) are grouped under ASN 0.
+func asnOverview(rows []PrefixRow) []ASNSummary {
+	byASN := map[int]*ASNSummary{}
+	for _, r := range rows {
+		sum := byASN[r.ASN]
+		if sum == nil {
+			sum = &ASNSummary{ASN: r.ASN}
+			byASN[r.ASN] = sum
+		}
+		sum.Prefixes++
+		sum.Addresses += r.Size
+		sum.Resolved += r.Resolved
+	}
+	out := make([]ASNSummary, 0, len(byASN))
+	for _, sum := range byASN {
+		out = append(out, *sum)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ASN < out[j].ASN })
+	return out
+}
+
+// htmlReport is self-contained: styles and the table sorter are inline so the
+// file can be mailed or opened offline. Hostnames are deliberately plain text,
+// never links, so nobody clicks through to target infrastructure by accident.
+var htmlReport = template.Must(template.New("report").Funcs(template.FuncMap{
+	"join":    strings.Join,
+	"asn":     asnLabel,
+	"asns":    asnList,
+	"percent": func(f float64) string { return fmt.Sprintf("%.1f%%", 100*f) },
+	"ts":      func(t time.Time) string { return t.Format(time.RFC3339) },
+	"asOf":    asOfLabel,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Recon report: {{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.6em; }
+h2 { font-size: 1.2em; margin-top: 2em; border-bottom: 1px solid #ccc; }
+table { border-collapse: collapse; margin-top: 0.5em; }
+th, td { padding: 0.3em 0.8em; border: 1px solid #ddd; text-align: left; vertical-align: top; }
+th { background: #f3f3f3; cursor: pointer; user-select: none; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+tr:nth-child(even) td { background: #fafafa; }
+.tag { font-size: 0.8em; color: #777; }
+td.mismatch { color: #b00; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Recon report: {{.Title}}</h1>
+<ul>
+{{- if .Report.ASNs}}
+<li>ASNs: {{range $i, $n := .Report.ASNs}}{{if $i}}, {{end}}AS{{$n}}{{end}}</li>
+{{- end}}
+<li>Started: {{ts .Report.StartedAt}}</li>
+<li>Finished: {{ts .Report.FinishedAt}}</li>
+<li>Prefixes: {{len .Report.Prefixes}}, findings: {{len .Report.Findings}}</li>
+{{- range .Report.Excluded}}
+<li>Excluded {{.Reserved}} from {{.Prefix}}: {{.Purpose}}{{if .Skipped}} <span class="tag">(prefix skipped)</span>{{end}}</li>
+{{- end}}
+</ul>
+{{- with .Report.Contacts}}
+
+<h2>Abuse contacts</h2>
+<ul>
+{{- range .}}
+<li>{{.Email}}: {{join .Resources ", "}}</li>
+{{- end}}
+</ul>
+{{- end}}
+{{- with .Report.Patterns}}
+
+<h2>Naming patterns</h2>
+<table class="sortable">
+<thead><tr><th>Template</th><th>Hostnames</th><th>Examples</th></tr></thead>
+<tbody>
+{{- range .}}
+<tr><td><code>{{.Template}}</code></td><td class="num">{{.Count}}</td><td>{{join .Examples ", "}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{- end}}
+{{- with .Report.DNSInfra}}
+
+<h2>DNS infrastructure</h2>
+<table class="sortable">
+<thead><tr><th>Domain</th><th>Record</th><th>Value</th><th>Address</th><th>Scanned prefix</th><th>Status</th></tr></thead>
+<tbody>
+{{- range .}}
+<tr><td>{{.Domain}}</td><td>{{.Record}}</td><td>{{.Value}}</td><td>{{.IP}}</td><td>{{.Prefix}}</td><td>{{.Status}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{- end}}
+
+<h2>ASN overview</h2>
+<table class="sortable">
+<thead><tr><th>ASN</th><th>Prefixes</th><th>Addresses</th><th>Resolved</th></tr></thead>
+<tbody>
+{{- range .Overview}}
+<tr><td>{{if .ASN}}AS{{.ASN}}{{else}}-{{end}}</td><td class="num">{{.Prefixes}}</td><td class="num">{{.Addresses}}</td><td class="num">{{.Resolved}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{- with .Report.Conflicts}}
+
+<h2>Attribution conflicts</h2>
+<table class="sortable">
+<thead><tr><th>IP</th><th>Prefixes</th><th>ASNs</th><th>Kept</th></tr></thead>
+<tbody>
+{{- range .}}
+<tr><td>{{.IP}}</td><td>{{join .Prefixes ", "}}</td><td>{{asns .ASNs}}</td><td>{{.Prefix}} ({{asn .ASN}})</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{- end}}
+{{- with .Report.RecordConflicts}}
+
+<h2>Record conflicts</h2>
+<table class="sortable">
+<thead><tr><th>Record</th><th>Kept</th><th>As of</th><th>Dropped</th><th>As of</th></tr></thead>
+<tbody>
+{{- range .}}
+<tr><td>{{.Record}}</td><td>{{.Kept}}</td><td>{{asOf .KeptAsOf}}</td><td>{{.Dropped}}</td><td>{{asOf .DroppedAsOf}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{- end}}
+{{- with .Report.Hosts}}
+
+<h2>Hostnames</h2>
+<table class="sortable">
+<thead><tr><th>Hostname</th><th>IPs</th><th>ASNs</th></tr></thead>
+<tbody>
+{{- range .}}
+<tr><td>{{.Hostname}}</td><td>{{join .IPs ", "}}</td><td>{{asns .ASNs}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{- end}}
+
+<h2>Findings</h2>
+<table class="sortable">
+<thead><tr><th>IP</th><th>Hostnames</th><th>Prefix</th><th>Location</th>{{if .WithBanners}}<th>Banners</th>{{end}}</tr></thead>
+<tbody>
+{{- range .Report.Findings}}
+<tr><td>{{.IP}}</td><td>{{join .Hostnames ", "}}{{if .Retried}} <span class="tag">(retried)</span>{{end}}</td><td>{{.Prefix}}</td><td>{{.Country}}{{if .City}} / {{.City}}{{end}}</td>{{if $.WithBanners}}<td>{{range $i, $b := .Banners}}{{if $i}}<br>{{end}}{{$b}}{{end}}</td>{{end}}</tr>
+{{- end}}
+</tbody>
+</table>
+
+<h2>Prefix statistics</h2>
+<table class="sortable">
+<thead><tr><th>Prefix</th><th>ASN</th><th>Size</th><th>Scanned</th><th>Resolved</th><th>Hit rate</th><th>Apex domains</th>{{if .WithAbout}}<th>Description</th>{{end}}{{if .WithRPKI}}<th>RPKI</th>{{end}}{{if .WithLG}}<th>Visibility</th>{{end}}{{if .WithHistory}}<th>History</th>{{end}}{{if .WithOwner}}<th>Registry</th>{{end}}</tr></thead>
+<tbody>
+{{- range .Report.Prefixes}}
+<tr><td>{{.Prefix}}{{if .Sampled}} <span class="tag">(sampled)</span>{{else if .Partial}} <span class="tag">(partial)</span>{{end}}</td><td>{{if .ASN}}AS{{.ASN}}{{end}}</td><td class="num">{{.Size}}</td><td class="num">{{.Scanned}}</td><td class="num">{{.Resolved}}</td><td class="num" data-sort="{{.HitRate}}">{{percent .HitRate}}</td><td class="num">{{.ApexDomains}}</td>{{if $.WithAbout}}<td>{{.About}}</td>{{end}}{{if $.WithRPKI}}<td>{{.RPKI}}</td>{{end}}{{if $.WithLG}}<td{{with .Visibility}} data-sort="{{.SeenBy}}"{{end}}>{{with .Visibility}}{{.}}{{end}}</td>{{end}}{{if $.WithHistory}}<td{{with .History}} data-sort="{{.FirstSeen}}"{{end}}>{{with .History}}{{.}}{{end}}</td>{{end}}{{if $.WithOwner}}<td{{with .Ownership}}{{if eq .Status "mismatch"}} class="mismatch"{{end}}{{end}}>{{with .Ownership}}{{.}}{{end}}</td>{{end}}</tr>
+{{- end}}
+</tbody>
+</table>
+{{- if .Zoned}}
+
+<h2>Reverse zones</h2>
+<table class="sortable">
+<thead><tr><th>Prefix</th><th>Zone</th><th>Nameservers</th><th>SOA primary</th><th>SOA contact</th><th>Serial</th></tr></thead>
+<tbody>
+{{- range $r := .Report.Prefixes}}{{range .Zones}}
+<tr><td>{{$r.Prefix}}</td><td>{{.Zone}}</td><td>{{join .Nameservers ", "}}</td>{{with .SOA}}<td>{{.Primary}}</td><td>{{.Contact}}</td><td class="num">{{.Serial}}</td>{{else}}<td></td><td></td><td></td>{{end}}</tr>
+{{- end}}{{end}}
+</tbody>
+</table>
+{{- end}}
+
+<script>
+document.querySelectorAll("table.sortable th").forEach(function (th) {
+  th.addEventListener("click", function () {
+    var table = th.closest("table"), body = table.tBodies[0];
+    var col = Array.prototype.indexOf.call(th.parentNode.children, th);
+    var asc = th.dataset.dir !== "asc";
+    th.parentNode.querySelectorAll("th").forEach(function (h) { delete h.dataset.dir; });
+    th.dataset.dir = asc ? "asc" : "desc";
+    var key = function (row) {
+      var cell = row.children[col], v = cell.dataset.sort || cell.textContent.trim();
+      var n = parseFloat(v);
+      return isNaN(n) || !/^[\d.]+%?$/.test(v) ? v.toLowerCase() : n;
+    };
+    Array.from(body.rows).sort(function (a, b) {
+      var x = key(a), y = key(b);
+      return (x < y ? -1 : x > y ? 1 : 0) * (asc ? 1 : -1);
+    }).forEach(function (row) { body.appendChild(row); });
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+func writeHTMLReport(path string, rep *Report) error {
+	data, err := renderHTMLReport(rep)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func renderHTMLReport(rep *Report) ([]byte, error) {
+	title := rep.Org
+	if title == "" {
+		title = "ad-hoc targets"
+	}
+	zoned, withRPKI, withLG, withHistory, withOwner, withAbout := false, false, false, false, false, false
+	for _, r := range rep.Prefixes {
+		zoned = zoned || len(r.Zones) > 0
+		withRPKI = withRPKI || r.RPKI != ""
+		withLG = withLG || r.Visibility != nil
+		withHistory = withHistory || r.History != nil
+		withOwner = withOwner || r.Ownership != nil
+		withAbout = withAbout || r.About() != ""
+	}
+	withBanners := false
+	for _, f := range rep.Findings {
+		withBanners = withBanners || len(f.Banners) > 0
+	}
+	var b bytes.Buffer
+	err := htmlReport.Execute(&b, struct {
+		Title       string
+		Report      *Report
+		Overview    []ASNSummary
+		Zoned       bool
+		WithRPKI    bool
+		WithLG      bool
+		WithHistory bool
+		WithOwner   bool
+		WithBanners bool
+		WithAbout   bool
+	}{title, rep, asnOverview(rep.Prefixes), zoned, withRPKI, withLG, withHistory, withOwner, withBanners, withAbout})
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// dotQuote renders s as a quoted DOT ID; hostnames from PTR records can
+// contain anything, so quotes, backslashes and newlines are escaped.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", "").Replace(s) + `"`
+}
+
+// HostRow is one hostname with every address it was found on and the ASNs
+// originating those addresses.
+type HostRow struct {
+	Hostname string   `json:"hostname"`
+	IPs      []string `json:"ips"`
+	ASNs     []int    `json:"asns,omitempty"`
+}
+
+// ASNPrefixes lists the unique prefixes scanned for one ASN.
+type ASNPrefixes struct {
+	ASN      int      `json:"asn"`
+	Prefixes []string `json:"prefixes"`
+}
+
+// Conflict is an address found under overlapping prefixes of different
+// ASNs, with the attribution that was kept.
+type Conflict struct {
+	IP       string   `json:"ip"`
+	Prefixes []string `json:"prefixes"`
+	ASNs     []int    `json:"asns"`
+	Prefix   string   `json:"kept_prefix"`
+	ASN      int      `json:"kept_asn"`
+}
+
+// prefixLen is the mask length of a CIDR, -1 if it does not parse.
+func prefixLen(cidr string) int {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return -1
+	}
+	ones, _ := n.Mask.Size()
+	return ones
+}
+
+// consolidate deduplicates the findings by IP and fills in the merged view.
+// An address found under several prefixes is attributed to the most
+// specific one, then the lowest ASN, then the lowest prefix, so the outcome
+// does not depend on scan or file order; its hostnames are combined, and a
+// Conflict is recorded when the candidates' ASNs differ. Hosts and ByASN
+// are only filled in when the report spans more than one ASN.
+func consolidate(rep *Report) {
+	asnOf := map[string]int{}
+	for _, r := range rep.Prefixes {
+		asnOf[r.Prefix] = r.ASN
+	}
+	byIP := map[string][]FindingRow{}
+	var order []string
+	for _, f := range rep.Findings {
+		if f.ASN == 0 {
+			f.ASN = asnOf[f.Prefix]
+		}
+		if byIP[f.IP] == nil {
+			order = append(order, f.IP)
+		}
+		byIP[f.IP] = append(byIP[f.IP], f)
+	}
+
+	findings := make([]FindingRow, 0, len(order))
+	rep.Conflicts = nil
+	for _, ip := range order {
+		group := byIP[ip]
+		sort.SliceStable(group, func(i, j int) bool {
+			a, b := group[i], group[j]
+			if la, lb := prefixLen(a.Prefix), prefixLen(b.Prefix); la != lb {
+				return la > lb
+			}
+			if a.ASN != b.ASN {
+				return a.ASN < b.ASN
+			}
+			return a.Prefix < b.Prefix
+		})
+		kept := group[0]
+		var prefixes []string
+		var asns []int
+		for _, f := range group {
+			if !slices.Contains(prefixes, f.Prefix) {
+				prefixes = append(prefixes, f.Prefix)
+			}
+			if !slices.Contains(asns, f.ASN) {
+				asns = append(asns, f.ASN)
+			}
+			for _, name := range f.Hostnames {
+				if !slices.Contains(kept.Hostnames, name) {
+					kept.Hostnames = append(kept.Hostnames, name)
+				}
+			}
+		}
+		if len(asns) > 1 {
+			sortAddrs(prefixes)
+			sort.Ints(asns)
+			rep.Conflicts = append(rep.Conflicts, Conflict{IP: ip, Prefixes: prefixes, ASNs: asns, Prefix: kept.Prefix, ASN: kept.ASN})
+		}
+		findings = append(findings, kept)
+	}
+	rep.Findings = findings
+
+	rep.Hosts, rep.ByASN = nil, nil
+	prefixesOf := map[int][]string{}
+	seen := map[string]bool{}
+	for _, r := range rep.Prefixes {
+		if key := fmt.Sprint(r.ASN, " ", r.Prefix); !seen[key] {
+			seen[key] = true
+			prefixesOf[r.ASN] = append(prefixesOf[r.ASN], r.Prefix)
+		}
+	}
+	if len(prefixesOf) < 2 {
+		return
+	}
+	for asn, prefixes := range prefixesOf {
+		sortAddrs(prefixes)
+		rep.ByASN = append(rep.ByASN, ASNPrefixes{ASN: asn, Prefixes: prefixes})
+	}
+	sort.Slice(rep.ByASN, func(i, j int) bool { return rep.ByASN[i].ASN < rep.ByASN[j].ASN })
+
+	hosts := map[string]*HostRow{}
+	for _, f := range findings {
+		for _, name := range f.Hostnames {
+			name = normalizeHostname(name)
+			h := hosts[name]
+			if h == nil {
+				h = &HostRow{Hostname: name}
+				hosts[name] = h
+			}
+			// Generic names can sit on very many addresses.
+			if key := name + " " + f.IP; !seen[key] {
+				seen[key] = true
+				h.IPs = append(h.IPs, f.IP)
+			}
+			if f.ASN != 0 && !slices.Contains(h.ASNs, f.ASN) {
+				h.ASNs = append(h.ASNs, f.ASN)
+			}
+		}
+	}
+	rep.Hosts = make([]HostRow, 0, len(hosts))
+	for _, h := range hosts {
+		sortAddrs(h.IPs)
+		sort.Ints(h.ASNs)
+		rep.Hosts = append(rep.Hosts, *h)
+	}
+	sort.Slice(rep.Hosts, func(i, j int) bool { return rep.Hosts[i].Hostname < rep.Hosts[j].Hostname })
+}
+
+// Orders for -sort.
+const (
+	sortIP       = "ip"
+	sortHostname = "hostname"
+)
+
+// addrKey orders addresses and prefixes numerically, IPv4 before IPv6 and
+// anything that does not parse after both. Keys are computed once per
+// entry, so sorting large result sets only compares bytes.
+type addrKey struct {
+	family int
+	ip     net.IP
+	bits   int
+}
+
+func sortKey(s string) addrKey {
+	ip, bits := net.ParseIP(s), -1
+	if strings.Contains(s, "/") {
+		if _, n, err := net.ParseCIDR(s); err == nil {
+			ip, bits = n.IP, prefixLen(s)
+		}
+	}
+	switch {
+	case ip == nil:
+		return addrKey{family: 2}
+	case ip.To4() != nil:
+		return addrKey{family: 0, ip: ip.To16(), bits: bits}
+	}
+	return addrKey{family: 1, ip: ip.To16(), bits: bits}
+}
+
+func (k addrKey) compare(o addrKey) int {
+	if k.family != o.family {
+		return cmp.Compare(k.family, o.family)
+	}
+	if c := bytes.Compare(k.ip, o.ip); c != 0 {
+		return c
+	}
+	return cmp.Compare(k.bits, o.bits)
+}
+
+// sortAddrs sorts addresses or prefixes in numeric order.
+func sortAddrs(items []string) {
+	type keyed struct {
+		addr addrKey
+		s    string
+	}
+	ks := make([]keyed, len(items))
+	for i, it := range items {
+		ks[i] = keyed{sortKey(it), it}
+	}
+	slices.SortFunc(ks, func(a, b keyed) int {
+		if c := a.addr.compare(b.addr); c != 0 {
+			return c
+		}
+		return strings.Compare(a.s, b.s)
+	})
+	for i, k := range ks {
+		items[i] = k.s
+	}
+}
+
+// sortFindings orders findings by numeric IP, or with sortHostname by their
+// first hostname and then IP.
+func sortFindings(findings []FindingRow, by string) {
+	type keyed struct {
+		name string
+		addr addrKey
+		i    int
+	}
+	ks := make([]keyed, len(findings))
+	for i, f := range findings {
+		ks[i] = keyed{addr: sortKey(f.IP), i: i}
+		if by == sortHostname && len(f.Hostnames) > 0 {
+			ks[i].name = normalizeHostname(f.Hostnames[0])
+		}
+	}
+	slices.SortFunc(ks, func(a, b keyed) int {
+		if c := strings.Compare(a.name, b.name); c != 0 {
+			return c
+		}
+		if c := a.addr.compare(b.addr); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.i, b.i)
+	})
+	sorted := make([]FindingRow, len(findings))
+	for i, k := range ks {
+		sorted[i] = findings[k.i]
+	}
+	copy(findings, sorted)
+}
+
+// sortReport applies -sort to the end-of-run sections of a report.
+func sortReport(rep *Report, by string) {
+	sortFindings(rep.Findings, by)
+	slices.SortStableFunc(rep.Conflicts, func(a, b Conflict) int { return sortKey(a.IP).compare(sortKey(b.IP)) })
+}
+
+// mergeReports combines the reports of several runs into one. An ASN,
+// prefix or finding (an address under one prefix) in more than one report
+// keeps its freshest version, by when its data was fetched, and the later
+// report's on a tie; prefixes of equal age keep the row that covered the
+// most addresses. Versions that disagree are listed in RecordConflicts.
+// Findings without provenance, from older reports, are all kept and have
+// their hostnames combined. Findings are tagged with the ASN of their own
+// report before consolidate deduplicates them.
+func mergeReports(reps []*Report) *Report {
+	merged := &Report{}
+	var orgs []string
+	asnAt, rowAt, findingAt := map[int]int{}, map[string]int{}, map[string]int{}
+	contacts := map[string]*AbuseContact{}
+	patterns := map[string]*PatternStat{}
+	pivots := map[int]*PivotLead{}
+	for _, rep := range reps {
+		if rep.Org != "" && !slices.Contains(orgs, rep.Org) {
+			orgs = append(orgs, rep.Org)
+		}
+		for _, n := range rep.ASNs {
+			if !slices.Contains(merged.ASNs, n) {
+				merged.ASNs = append(merged.ASNs, n)
+			}
+		}
+		if merged.StartedAt.IsZero() || rep.StartedAt.Before(merged.StartedAt) {
+			merged.StartedAt = rep.StartedAt
+		}
+		if rep.FinishedAt.After(merged.FinishedAt) {
+			merged.FinishedAt = rep.FinishedAt
+		}
+
+		for _, a := range rep.ASNRecords {
+			i, ok := asnAt[a.ASN]
+			if !ok {
+				asnAt[a.ASN] = len(merged.ASNRecords)
+				merged.ASNRecords = append(merged.ASNRecords, a)
+				continue
+			}
+			prev := merged.ASNRecords[i]
+			if merged.keepFresher(asnLabel(a.ASN), prev.Provenance, a.Provenance, strings.TrimSpace(prev.Name+" "+prev.CountryCode), strings.TrimSpace(a.Name+" "+a.CountryCode), true) {
+				merged.ASNRecords[i] = a
+			}
+		}
+		asnOf := map[string]int{}
+		for _, r := range rep.Prefixes {
+			asnOf[r.Prefix] = r.ASN
+			i, ok := rowAt[r.Prefix]
+			if !ok {
+				rowAt[r.Prefix] = len(merged.Prefixes)
+				merged.Prefixes = append(merged.Prefixes, r)
+				continue
+			}
+			prev := merged.Prefixes[i]
+			describe := func(r PrefixRow) string { return strings.TrimSpace(asnLabel(r.ASN) + " " + r.About()) }
+			if merged.keepFresher("prefix "+r.Prefix, prev.Provenance, r.Provenance, describe(prev), describe(r), r.Scanned >= prev.Scanned) {
+				merged.Prefixes[i] = r
+			}
+		}
+		for _, f := range rep.Findings {
+			if f.ASN == 0 {
+				f.ASN = asnOf[f.Prefix]
+			}
+			key := f.IP + " " + f.Prefix
+			i, ok := findingAt[key]
+			if !ok || f.asOf() == nil && merged.Findings[i].asOf() == nil {
+				findingAt[key] = len(merged.Findings)
+				merged.Findings = append(merged.Findings, f)
+				continue
+			}
+			prev := merged.Findings[i]
+			describe := func(f FindingRow) string {
+				names := slices.Clone(f.Hostnames)
+				sort.Strings(names)
+				return strings.Join(names, ", ")
+			}
+			if merged.keepFresher("finding "+key, prev.Provenance, f.Provenance, describe(prev), describe(f), true) {
+				merged.Findings[i] = f
+			}
+		}
+		for _, ex := range rep.Excluded {
+			if !slices.Contains(merged.Excluded, ex) {
+				merged.Excluded = append(merged.Excluded, ex)
+			}
+		}
+		for _, c := range rep.Contacts {
+			if contacts[c.Email] == nil {
+				contacts[c.Email] = &AbuseContact{Email: c.Email}
+			}
+			for _, res := range c.Resources {
+				if !slices.Contains(contacts[c.Email].Resources, res) {
+					contacts[c.Email].Resources = append(contacts[c.Email].Resources, res)
+				}
+			}
+		}
+		if rep.Contacts != nil && merged.Contacts == nil {
+			merged.Contacts = []AbuseContact{}
+		}
+		merged.ResolverEvents = append(merged.ResolverEvents, rep.ResolverEvents...)
+		for _, p := range rep.Patterns {
+			st := patterns[p.Template]
+			if st == nil {
+				st = &PatternStat{Template: p.Template}
+				patterns[p.Template] = st
+			}
+			st.Count += p.Count
+			for _, ex := range p.Examples {
+				if len(st.Examples) < patternExamples && !slices.Contains(st.Examples, ex) {
+					st.Examples = append(st.Examples, ex)
+				}
+			}
+		}
+		for _, row := range rep.DNSInfra {
+			if !slices.Contains(merged.DNSInfra, row) {
+				merged.DNSInfra = append(merged.DNSInfra, row)
+			}
+		}
+		for _, p := range rep.Pivots {
+			lead := pivots[p.ASN]
+			if lead == nil {
+				lead = &PivotLead{ASN: p.ASN, Name: p.Name, Country: p.Country}
+				pivots[p.ASN] = lead
+			}
+			for _, ev := range p.Evidence {
+				if !slices.Contains(lead.Evidence, ev) {
+					lead.Evidence = append(lead.Evidence, ev)
+				}
+			}
+		}
+	}
+	merged.Org = strings.Join(orgs, ", ")
+	sort.Ints(merged.ASNs)
+	slices.SortFunc(merged.ASNRecords, func(a, b ASNRow) int { return cmp.Compare(a.ASN, b.ASN) })
+	for _, c := range contacts {
+		merged.Contacts = append(merged.Contacts, *c)
+	}
+	sort.Slice(merged.Contacts, func(i, j int) bool { return merged.Contacts[i].Email < merged.Contacts[j].Email })
+	sort.SliceStable(merged.ResolverEvents, func(i, j int) bool { return merged.ResolverEvents[i].Time.Before(merged.ResolverEvents[j].Time) })
+	for _, st := range patterns {
+		merged.Patterns = append(merged.Patterns, *st)
+	}
+	sort.Slice(merged.Patterns, func(i, j int) bool {
+		if merged.Patterns[i].Count != merged.Patterns[j].Count {
+			return merged.Patterns[i].Count > merged.Patterns[j].Count
+		}
+		return merged.Patterns[i].Template < merged.Patterns[j].Template
+	})
+	for _, lead := range pivots {
+		// A lead one run pivoted to may be an ASN another run scanned.
+		if !slices.Contains(merged.ASNs, lead.ASN) {
+			merged.Pivots = append(merged.Pivots, *lead)
+		}
+	}
+	sort.Slice(merged.Pivots, func(i, j int) bool { return merged.Pivots[i].ASN < merged.Pivots[j].ASN })
+	consolidate(merged)
+	return merged
+}
+
+// keepFresher tells whether a merge should replace the version of a record
+// it has kept with the next report's: if next's data was fetched later, or
+// as late and nextOnTie. When their descriptions differ, the disagreement is
+// recorded.
+func (rep *Report) keepFresher(record string, kept, next Provenance, keptDesc, nextDesc string, nextOnTie bool) bool {
+	c := next.fresher(kept)
+	replace := c > 0 || c == 0 && nextOnTie
+	if keptDesc != nextDesc {
+		conflict := RecordConflict{Record: record, Kept: keptDesc, KeptAsOf: kept.asOf(), Dropped: nextDesc, DroppedAsOf: next.asOf()}
+		if replace {
+			conflict = RecordConflict{Record: record, Kept: nextDesc, KeptAsOf: next.asOf(), Dropped: keptDesc, DroppedAsOf: kept.asOf()}
+		}
+		rep.RecordConflicts = append(rep.RecordConflicts, conflict)
+	}
+	return replace
+}
+
+func readReport(path string) (*Report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rep := &Report{}
+	if err := json.Unmarshal(data, rep); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rep, nil
+}
+
+// writeDOT exports the graph renderDOT draws to path.
+func writeDOT(path string, rep *Report, collapseApex bool, maxHosts int) error {
+	return writeFileAtomic(path, renderDOT(rep, collapseApex, maxHosts))
+}
+
+// proxyScope is what the Burp and ZAP exports put in scope: the discovered
+// hostnames, the apex domains collapsed into wildcards, and the scanned
+// prefixes minus the reserved ranges cut out of them. It is built from the
+// report, so prefix and hostname filters are already applied.
+type proxyScope struct {
+	Hosts     []string
+	Wildcards []string
+	Prefixes  []string
+	Excluded  []string
+}
+
+// buildProxyScope collects the scope of rep. Apex domains with at least
+// wildcardMin hostnames replace them with one wildcard entry (0 never does).
+func buildProxyScope(rep *Report, wildcardMin int) proxyScope {
+	var s proxyScope
+	byApex := map[string][]string{}
+	seen := map[string]bool{}
+	for _, f := range rep.Findings {
+		for _, name := range f.Hostnames {
+			name = normalizeHostname(name)
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			apex := apexDomain(name)
+			byApex[apex] = append(byApex[apex], name)
+		}
+	}
+	for apex, names := range byApex {
+		if wildcardMin > 0 && apex != "" && len(names) >= wildcardMin {
+			s.Wildcards = append(s.Wildcards, apex)
+			continue
+		}
+		s.Hosts = append(s.Hosts, names...)
+	}
+	sort.Strings(s.Hosts)
+	sort.Strings(s.Wildcards)
+
+	prefixes := make([]string, 0, len(rep.Prefixes))
+	for _, r := range rep.Prefixes {
+		prefixes = append(prefixes, r.Prefix)
+	}
+	s.Prefixes = aggregatePrefixes(prefixes)
+	sortAddrs(s.Prefixes)
+	for _, ex := range rep.Excluded {
+		if !ex.Skipped && !slices.Contains(s.Excluded, ex.Reserved) {
+			s.Excluded = append(s.Excluded, ex.Reserved)
+		}
+	}
+	sortAddrs(s.Excluded)
+	return s
+}
+
+func (s proxyScope) size() int {
+	return len(s.Hosts) + len(s.Wildcards) + len(s.Prefixes)
+}
+
+// hostRegex anchors a hostname for Burp's advanced scope.
+func hostRegex(name string) string {
+	return "^" + regexp.QuoteMeta(name) + "$"
+}
+
+// wildcardRegex matches an apex domain and every name under it.
+func wildcardRegex(apex string) string {
+	return `^(?:.*\.)?` + regexp.QuoteMeta(apex) + "$"
+}
+
+type burpScopeEntry struct {
+	Enabled  bool   `json:"enabled"`
+	Host     string `json:"host"`
+	Protocol string `json:"protocol"`
+}
+
+// renderBurpScope writes Burp Suite's target scope configuration in
+// advanced mode, loadable with Project options > Load. Prefixes and
+// excluded ranges are given as IP ranges, which Burp accepts in the host
+// field.
+func renderBurpScope(s proxyScope) ([]byte, error) {
+	include, exclude := []burpScopeEntry{}, []burpScopeEntry{}
+	for _, apex := range s.Wildcards {
+		include = append(include, burpScopeEntry{true, wildcardRegex(apex), "any"})
+	}
+	for _, name := range s.Hosts {
+		include = append(include, burpScopeEntry{true, hostRegex(name), "any"})
+	}
+	for _, p := range s.Prefixes {
+		include = append(include, burpScopeEntry{true, p, "any"})
+	}
+	for _, p := range s.Excluded {
+		exclude = append(exclude, burpScopeEntry{true, p, "any"})
+	}
+	var doc struct {
+		Target struct {
+			Scope struct {
+				Advanced bool             `json:"advanced_mode"`
+				Include  []burpScopeEntry `json:"include"`
+				Exclude  []burpScopeEntry `json:"exclude"`
+			} `json:"scope"`
+		} `json:"target"`
+	}
+	doc.Target.Scope.Advanced = true
+	doc.Target.Scope.Include, doc.Target.Scope.Exclude = include, exclude
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// ipv4Regex matches the dotted-quad addresses of an IPv4 network. An octet
+// split by the mask becomes an alternation of its possible values.
+func ipv4Regex(n *net.IPNet) string {
+	ip := n.IP.To4()
+	ones, _ := n.Mask.Size()
+	parts := make([]string, 4)
+	for i := 0; i < 4; i++ {
+		bits := min(max(ones-8*i, 0), 8)
+		lo := int(ip[i])
+		switch bits {
+		case 8:
+			parts[i] = strconv.Itoa(lo)
+		case 0:
+			parts[i] = `\d{1,3}`
+		default:
+			values := make([]string, 0, 1<<(8-bits))
+			for v := lo; v <= lo|(1<<(8-bits)-1); v++ {
+				values = append(values, strconv.Itoa(v))
+			}
+			parts[i] = "(?:" + strings.Join(values, "|") + ")"
+		}
+	}
+	return strings.Join(parts, `\.`)
+}
+
+// zapURL wraps a host pattern into the URL regex ZAP contexts match on.
+func zapURL(host string) string {
+	return `https?://` + host + `(?::\d+)?(?:/.*)?`
+}
+
+type zapConfiguration struct {
+	XMLName xml.Name `xml:"configuration"`
+	Context struct {
+		Name    string   `xml:"name"`
+		Desc    string   `xml:"desc"`
+		InScope bool     `xml:"inscope"`
+		Include []string `xml:"incregexes"`
+		Exclude []string `xml:"excregexes"`
+	} `xml:"context"`
+}
+
+// renderZAPContext writes an OWASP ZAP context, importable with File >
+// Import Context. ZAP only matches URL regexes, so IPv4 prefixes are turned
+// into address patterns; IPv6 prefixes cannot be and are left out, which
+// skipped reports.
+func renderZAPContext(s proxyScope, name string) (data []byte, skipped int, err error) {
+	var doc zapConfiguration
+	doc.Context.Name, doc.Context.Desc, doc.Context.InScope = name, "Scope exported by Recon", true
+	for _, apex := range s.Wildcards {
+		doc.Context.Include = append(doc.Context.Include, zapURL(`(?:[^/:]*\.)?`+regexp.QuoteMeta(apex)))
+	}
+	for _, host := range s.Hosts {
+		doc.Context.Include = append(doc.Context.Include, zapURL(regexp.QuoteMeta(host)))
+	}
+	for _, p := range s.Prefixes {
+		_, n, err := net.ParseCIDR(p)
+		if err != nil || n.IP.To4() == nil {
+			skipped++
+			continue
+		}
+		doc.Context.Include = append(doc.Context.Include, zapURL(ipv4Regex(n)))
+	}
+	for _, p := range s.Excluded {
+		if _, n, err := net.ParseCIDR(p); err == nil && n.IP.To4() != nil {
+			doc.Context.Exclude = append(doc.Context.Exclude, zapURL(ipv4Regex(n)))
+		}
+	}
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, 0, err
+	}
+	return append(append([]byte(xml.Header), out...), '\n'), skipped, nil
+}
+
+// exportProxyScope writes the -export-burp and -export-zap files.
+func exportProxyScope(rep *Report, burpPath, zapPath string, wildcardMin int) {
+	s := buildProxyScope(rep, wildcardMin)
+	if burpPath != "" {
+		data, err := renderBurpScope(s)
+		if err == nil {
+			err = writeFileAtomic(burpPath, data)
+		}
+		if err != nil {
+			fmt.Println(Red+"[!] Failed to write Burp scope:", err, Reset)
+		} else {
+			fmt.Printf(Green+"[+] Wrote Burp scope with %d entries to %s\n"+Reset, s.size(), burpPath)
+		}
+	}
+	if zapPath != "" {
+		title := rep.Org
+		if title == "" {
+			title = "ad-hoc targets"
+		}
+		data, skipped, err := renderZAPContext(s, "Recon: "+title)
+		if err == nil {
+			err = writeFileAtomic(zapPath, data)
+		}
+		if err != nil {
+			fmt.Println(Red+"[!] Failed to write ZAP context:", err, Reset)
+			return
+		}
+		fmt.Printf(Green+"[+] Wrote ZAP context with %d entries to %s\n"+Reset, s.size()-skipped, zapPath)
+		if skipped > 0 {
+			fmt.Printf(Purple+"[~] %d IPv6 prefixes left out of the ZAP context, which only matches URL regexes\n"+Reset, skipped)
+		}
+	}
+}
+
+// renderDOT draws the org -> ASN -> prefix -> hostname graph. With
+// collapseApex, hostnames are merged into one node per apex domain; at most
+// maxHosts hostname nodes are drawn per prefix (0 means no limit), the rest
+// being folded into a single "+N more" node.
+func renderDOT(rep *Report, collapseApex bool, maxHosts int) []byte {
+	var b strings.Builder
+	root := rep.Org
+	if root == "" {
+		root = "ad-hoc targets"
+	}
+
+	// prefix -> hostname -> number of addresses carrying it
+	hosts := map[string]map[string]int{}
+	for _, f := range rep.Findings {
+		if hosts[f.Prefix] == nil {
+			hosts[f.Prefix] = map[string]int{}
+		}
+		for _, name := range f.Hostnames {
+			name = normalizeHostname(name)
+			if collapseApex {
+				if apex := apexDomain(name); apex != "" {
+					name = apex
+				}
+			}
+			hosts[f.Prefix][name]++
+		}
+	}
+
+	asnPrefixes := map[int][]PrefixRow{}
+	for _, r := range rep.Prefixes {
+		asnPrefixes[r.ASN] = append(asnPrefixes[r.ASN], r)
+	}
+	// findings outside any scanned prefix (e.g. imported hostnames).
+	known := map[string]bool{}
+	for _, r := range rep.Prefixes {
+		known[r.Prefix] = true
+	}
+	for p := range hosts {
+		if !known[p] {
+			asnPrefixes[0] = append(asnPrefixes[0], PrefixRow{Prefix: p})
+		}
+	}
+	asns := make([]int, 0, len(asnPrefixes))
+	for n := range asnPrefixes {
+		asns = append(asns, n)
+	}
+	sort.Ints(asns)
+
+	b.WriteString("digraph recon {\n\trankdir=LR;\n\tnode [fontname=\"Helvetica\", fontsize=10];\n")
+	fmt.Fprintf(&b, "\t%s [shape=doubleoctagon, label=%s, prefixes=%d, findings=%d];\n",
+		dotQuote("org"), dotQuote(root), len(rep.Prefixes), len(rep.Findings))
+
+	for _, asn := range asns {
+		parent := "org"
+		if asn != 0 {
+			parent = fmt.Sprintf("as%d", asn)
+			label := fmt.Sprintf("AS%d\n%d prefixes", asn, len(asnPrefixes[asn]))
+			fmt.Fprintf(&b, "\t%s [shape=box, style=filled, fillcolor=\"#dde8f5\", label=%s, prefixes=%d];\n",
+				dotQuote(parent), dotQuote(label), len(asnPrefixes[asn]))
+			fmt.Fprintf(&b, "\t%s -> %s;\n", dotQuote("org"), dotQuote(parent))
+		}
+
+		for _, r := range asnPrefixes[asn] {
+			names := make([]string, 0, len(hosts[r.Prefix]))
+			for name := range hosts[r.Prefix] {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			pid, name := "prefix:"+r.Prefix, r.Prefix
+			if name == "" {
+				name = "unattributed"
+			}
+			label := fmt.Sprintf("%s\n%d hostnames", name, len(names))
+			fmt.Fprintf(&b, "\t%s [shape=ellipse, label=%s, resolved=%d, hostnames=%d];\n",
+				dotQuote(pid), dotQuote(label), r.Resolved, len(names))
+			fmt.Fprintf(&b, "\t%s -> %s;\n", dotQuote(parent), dotQuote(pid))
+
+			shown := names
+			if maxHosts > 0 && len(names) > maxHosts {
+				shown = names[:maxHosts]
+			}
+			for _, name := range shown {
+				hid := "host:" + r.Prefix + ":" + name
+				fmt.Fprintf(&b, "\t%s [shape=note, label=%s, addresses=%d];\n",
+					dotQuote(hid), dotQuote(fmt.Sprintf("%s (%d)", name, hosts[r.Prefix][name])), hosts[r.Prefix][name])
+				fmt.Fprintf(&b, "\t%s -> %s;\n", dotQuote(pid), dotQuote(hid))
+			}
+			if rest := len(names) - len(shown); rest > 0 {
+				mid := "more:" + r.Prefix
+				fmt.Fprintf(&b, "\t%s [shape=plaintext, label=%s, hostnames=%d];\n",
+					dotQuote(mid), dotQuote(fmt.Sprintf("+%d more", rest)), rest)
+				fmt.Fprintf(&b, "\t%s -> %s [style=dashed];\n", dotQuote(pid), dotQuote(mid))
+			}
+		}
+	}
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+type ChangeEvent struct {
+	Type      string    `json:"type"`
+	Org       string    `json:"org"`
+	IP        string    `json:"ip"`
+	Prefix    string    `json:"prefix"`
+	Hostnames []string  `json:"hostnames,omitempty"`
+	Previous  []string  `json:"previous,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = append([]string(nil), a...), append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// diffHosts compares one sweep against the stored baseline. Only conclusive
+// outcomes count: a timeout is never reported as a disappeared hostname.
+func diffHosts(org string, baseline map[string]HostRecord, current map[string]LookupResult, prefixOf map[string]string, now time.Time) []ChangeEvent {
+	var events []ChangeEvent
+	ips := make([]string, 0, len(current))
+	for ip := range current {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	for _, ip := range ips {
+		res := current[ip]
+		prev, known := baseline[ip]
+		ev := ChangeEvent{Org: org, IP: ip, Prefix: prefixOf[ip], Hostnames: res.Names, Time: now}
+		switch {
+		case res.Status == StatusFound && !known:
+			ev.Type = "new"
+		case res.Status == StatusFound && !sameNames(prev.Hostnames, res.Names):
+			ev.Type, ev.Previous = "changed", prev.Hostnames
+		case res.Status == StatusNXDomain && known:
+			ev.Type, ev.Hostnames, ev.Previous = "gone", nil, prev.Hostnames
+		default:
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func (s *Store) ClearHost(org, ip string) error {
+	key := storeKey(org, ip)
+	var rec HostRecord
+	found, err := s.Get(bucketHosts, key, &rec)
+	if err != nil || !found {
+		return err
+	}
+	rec.Hostnames = nil
+	return s.Put(bucketHosts, key, rec)
+}
+
+// baselineHosts returns the hosts of org that currently resolve and fall in
+// one of prefixes, keyed by IP.
+func (s *Store) baselineHosts(org string, prefixes []string) (map[string]HostRecord, error) {
+	inScope := map[string]bool{}
+	for _, p := range prefixes {
+		inScope[p] = true
+	}
+
+	hosts := map[string]HostRecord{}
+	err := s.ForEach(bucketHosts, storeKey(org, ""), func(_ string, raw json.RawMessage) error {
+		var rec HostRecord
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return err
+		}
+		if inScope[rec.Prefix] && len(rec.Hostnames) > 0 {
+			hosts[rec.IP] = rec
+		}
+		return nil
+	})
+	return hosts, err
+}
+
+// postWebhook POSTs payload as JSON to url, giving up after timeout so a
+// hanging receiver cannot stall the watch loop.
+func postWebhook(ctx context.Context, url string, payload interface{}, timeout time.Duration) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := newHTTPClient(timeout).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type watcher struct {
+	sc       *scanner
+	store    *Store
+	org      string
+	prefixes []string
+	interval time.Duration
+	events   *json.Encoder
+	webhook  string
+	// timeout bounds each webhook delivery (-api-timeout).
+	timeout time.Duration
+}
+
+// jitter spreads the interval by up to ±10% so several watchers started
+// together do not sweep in lockstep.
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d) / 5
+	if spread <= 0 {
+		return d
+	}
+	return d - time.Duration(spread/2) + time.Duration(rand.Int63n(spread))
+}
+
+func (w *watcher) run() {
+	for cycle := 1; ; cycle++ {
+		fmt.Printf(Purple+"\n[~] Watch cycle %d started at %s\n"+Reset, cycle, time.Now().Format(time.RFC3339))
+		if err := w.cycle(); err != nil {
+			fmt.Println(Red+"[!] Watch cycle failed, baseline kept:", err, Reset)
+		}
+
+		if w.sc.stopped() {
+			return
+		}
+
+		wait := jitter(w.interval)
+		fmt.Printf(Purple+"[~] Next cycle in %s\n"+Reset, wait.Round(time.Second))
+		select {
+		case <-time.After(wait):
+		case <-w.sc.context().Done():
+			return
+		}
+	}
+}
+
+func (w *watcher) cycle() error {
+	baseline, err := w.store.baselineHosts(w.org, w.prefixes)
+	if err != nil {
+		return err
+	}
+
+	current := map[string]LookupResult{}
+	prefixOf := map[string]string{}
+	w.sc.failed, w.sc.zones, w.sc.zoneInfo = nil, nil, nil
+	w.sc.cache.Clear()
+	w.sc.onResult = func(prefix string, res LookupResult) {
+		current[res.IP] = res
+		prefixOf[res.IP] = prefix
+	}
+	stats := w.sc.scan(w.prefixes)
+
+	total, failed := 0, 0
+	for _, ps := range stats {
+		total += ps.Total
+		failed += ps.Failed()
+	}
+	if total == 0 {
+		return errors.New("no addresses were scanned")
+	}
+	if float64(failed)/float64(total) >= incompleteThreshold {
+		return fmt.Errorf("%d of %d lookups failed", failed, total)
+	}
+
+	now := time.Now()
+	events := w.sc.filter.Events(diffHosts(w.org, baseline, current, prefixOf, now))
+	if len(baseline) == 0 {
+		events = nil
+	}
+
+	for ip, res := range current {
+		var err error
+		switch res.Status {
+		case StatusFound:
+			err = w.store.TouchHost(w.org, prefixOf[ip], res, now)
+		case StatusNXDomain:
+			err = w.store.ClearHost(w.org, ip)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range w.prefixes {
+		if err := w.store.TouchPrefix(w.org, p, 0, now); err != nil {
+			return err
+		}
+	}
+	if err := w.store.TouchOrg(w.org, now); err != nil {
+		return err
+	}
+	if err := w.store.Save(); err != nil {
+		return err
+	}
+
+	if len(baseline) == 0 {
+		fmt.Printf(Green+"[+] Baseline established with %d hosts\n"+Reset, len(current))
+		return nil
+	}
+	w.report(events)
+	return nil
+}
+
+func (w *watcher) report(events []ChangeEvent) {
+	fmt.Printf(Green+"\n[+] %d changes since the last cycle\n"+Reset, len(events))
+	for _, ev := range events {
+		switch ev.Type {
+		case "new":
+			fmt.Printf(Green+"[new] %s -> %s\n"+Reset, ev.IP, strings.Join(ev.Hostnames, ", "))
+		case "changed":
+			fmt.Printf(Blue+"[changed] %s -> %s (was %s)\n"+Reset, ev.IP, strings.Join(ev.Hostnames, ", "), strings.Join(ev.Previous, ", "))
+		case "gone":
+			fmt.Printf(Red+"[gone] %s (was %s)\n"+Reset, ev.IP, strings.Join(ev.Previous, ", "))
+		}
+		if w.events != nil {
+			if err := w.events.Encode(ev); err != nil {
+				fmt.Println(Red+"[!] Failed to write change event:", err, Reset)
+			}
+		}
+	}
+
+	if w.webhook != "" && len(events) > 0 {
+		if err := postWebhook(w.sc.context(), w.webhook, map[string]interface{}{"org": w.org, "events": events}, w.timeout); err != nil {
+			fmt.Println(Red+"[!] Webhook delivery failed:", err, Reset)
+		}
+	}
+}
+
+const defaultIRRServer = "whois.radb.net:43"
+
+const (
+	// defaultWhoisServer is where WHOIS queries start; IANA refers them on
+	// to the registry holding the resource.
+	defaultWhoisServer = "whois.iana.org:43"
+	whoisTimeout       = 10 * time.Second
+	whoisMaxReferrals  = 3
+	whoisMaxResponse   = 1 << 20
+)
+
+// whoisQuery sends one query to a WHOIS server (RFC 3912) and returns the
+// whole response.
+func whoisQuery(ctx context.Context, server, query string) (string, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "43")
+	}
+	d := net.Dialer{Timeout: whoisTimeout}
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(whoisTimeout))
+	if _, err := io.WriteString(conn, query+"\r\n"); err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(io.LimitReader(conn, whoisMaxResponse))
+	return string(data), err
+}
+
+// whoisValues returns the values of the "key: value" lines for any of keys,
+// compared case-insensitively, in the order they appear.
+func whoisValues(resp string, keys ...string) []string {
+	var out []string
+	for _, line := range strings.Split(resp, "\n") {
+		k, v, ok := strings.Cut(line, ":")
+		if !ok || strings.HasPrefix(strings.TrimSpace(line), "%") || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		for _, key := range keys {
+			if strings.EqualFold(k, key) && v != "" {
+				out = append(out, v)
+			}
+		}
+	}
+	return out
+}
+
+// whoisReferral finds where a response sends the query next: IANA's refer,
+// ARIN's ReferralServer or a registry's registrar server.
+func whoisReferral(resp string) string {
+	for _, v := range whoisValues(resp, "refer", "ReferralServer", "Registrar WHOIS Server", "whois") {
+		v = strings.TrimPrefix(strings.TrimPrefix(v, "whois://"), "rwhois://")
+		if v != "" && !strings.Contains(v, "/") && !strings.Contains(v, " ") {
+			return v
+		}
+	}
+	return ""
+}
+
+// whoisFollow queries start and follows referrals up to whoisMaxReferrals,
+// returning the last (most specific) response and the server that gave it.
+// ARIN only returns the network when asked with "n +".
+func whoisFollow(ctx context.Context, start, query string) (resp, server string, err error) {
+	server = start
+	for hop := 0; ; hop++ {
+		q := query
+		if strings.HasPrefix(server, "whois.arin.net") && net.ParseIP(query) != nil {
+			q = "n + " + query
+		}
+		resp, err = whoisQuery(ctx, server, q)
+		if err != nil {
+			return "", server, err
+		}
+		next := whoisReferral(resp)
+		if next == "" || hop == whoisMaxReferrals || strings.EqualFold(next, server) || strings.EqualFold(net.JoinHostPort(next, "43"), server) {
+			return resp, server, nil
+		}
+		server = next
+	}
+}
+
+// WhoisLead is an origin AS that WHOIS ties to a domain's web address,
+// kept with the raw lines it was read from so its strength can be judged.
+type WhoisLead struct {
+	Host     string
+	IP       string
+	Server   string
+	ASNs     []int
+	NetName  string
+	Org      string
+	Country  string
+	Evidence []string
+	Provenance
+}
+
+var whoisASN = regexp.MustCompile(`(?i)\bAS(\d+)\b`)
+
+// whoisDiscover resolves domain and www.domain and asks WHOIS which
+// network and origin AS each address belongs to. It is a heuristic: a site
+// hosted by a CDN leads to the CDN's AS, not the organization's.
+func whoisDiscover(ctx context.Context, server, domain string) ([]WhoisLead, error) {
+	if whois, _, err := whoisFollow(ctx, server, domain); err == nil {
+		if org := whoisValues(whois, "Registrant Organization", "org", "Registrant"); len(org) > 0 {
+			fmt.Printf(Purple+"[~] WHOIS for %s: registrant %s\n"+Reset, domain, org[0])
+		}
+	}
+
+	var leads []WhoisLead
+	seen := map[string]bool{}
+	var lastErr error
+	for _, host := range []string{domain, "www." + domain} {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, ip := range addrs {
+			if seen[ip] {
+				continue
+			}
+			seen[ip] = true
+			resp, from, err := whoisFollow(ctx, server, ip)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			lead := WhoisLead{Host: host, IP: ip, Server: from, Provenance: retrievedFrom(sourceWhois)}
+			keys := []string{"OriginAS", "origin", "aut-num", "NetName", "netname", "OrgName", "org-name", "owner", "descr", "Country", "country", "NetRange", "inetnum", "inet6num", "CIDR", "route", "route6"}
+			for _, line := range strings.Split(resp, "\n") {
+				k, _, ok := strings.Cut(line, ":")
+				if ok && slices.ContainsFunc(keys, func(key string) bool { return strings.EqualFold(strings.TrimSpace(k), key) }) {
+					lead.Evidence = append(lead.Evidence, strings.TrimSpace(line))
+				}
+			}
+			for _, v := range whoisValues(resp, "OriginAS", "origin", "aut-num") {
+				for _, m := range whoisASN.FindAllStringSubmatch(v, -1) {
+					if n, err := strconv.Atoi(m[1]); err == nil && !slices.Contains(lead.ASNs, n) {
+						lead.ASNs = append(lead.ASNs, n)
+					}
+				}
+			}
+			lead.NetName = cmp.Or(append(whoisValues(resp, "NetName", "netname"), "")...)
+			lead.Org = cmp.Or(append(whoisValues(resp, "OrgName", "org-name", "owner", "descr"), "")...)
+			lead.Country = strings.ToUpper(cmp.Or(append(whoisValues(resp, "Country"), "")...))
+			leads = append(leads, lead)
+		}
+	}
+	if len(leads) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return leads, nil
+}
+
+// whoisASNs prints the evidence of each lead and turns the origin ASes
+// found into search results.
+func whoisASNs(leads []WhoisLead) []ASN {
+	var asns []ASN
+	seen := map[int]bool{}
+	for _, lead := range leads {
+		fmt.Printf(Purple+"\n[~] %s (%s), answered by %s:\n"+Reset, lead.Host, lead.IP, lead.Server)
+		for _, line := range lead.Evidence {
+			fmt.Println("    " + line)
+		}
+		if len(lead.ASNs) == 0 {
+			fmt.Println(Red + "    [!] No origin AS in the WHOIS record" + Reset)
+		}
+		for _, n := range lead.ASNs {
+			if seen[n] {
+				continue
+			}
+			seen[n] = true
+			asns = append(asns, ASN{Number: n, Name: cmp.Or(lead.NetName, lead.Org), Description: lead.Org, CountryCode: lead.Country,
+				Whois: fmt.Sprintf("%s of %s", lead.IP, lead.Host), Provenance: lead.Provenance})
+		}
+	}
+	return asns
+}
+
+// whoisSource configures WHOIS discovery: domain is the organization's
+// main domain, only skips the bgpview search altogether and offline turns
+// discovery off.
+type whoisSource struct {
+	server  string
+	domain  string
+	only    bool
+	offline bool
+}
+
+var errIRRNotFound = errors.New("object not found")
+
+// readIRRResponse reads one IRRd "!" command response: "A<len>" followed by
+// that many bytes and "C", a bare "C" (no data), "D" (not found), or an
+// error line starting with E or F.
+func readIRRResponse(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case strings.HasPrefix(line, "A"):
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("malformed IRR response %q", line)
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		end, err := r.ReadString('\n')
+		for err == nil && strings.TrimSpace(end) == "" {
+			end, err = r.ReadString('\n')
+		}
+		if err != nil {
+			return "", err
+		}
+		if strings.TrimSpace(end) != "C" {
+			return "", fmt.Errorf("malformed IRR response trailer %q", end)
+		}
+		return string(buf), nil
+	case line == "C":
+		return "", nil
+	case line == "D":
+		return "", errIRRNotFound
+	case strings.HasPrefix(line, "E"), strings.HasPrefix(line, "F"):
+		return "", fmt.Errorf("IRR error: %s", strings.TrimSpace(line[1:]))
+	}
+	return "", fmt.Errorf("unexpected IRR response %q", line)
+}
+
+type irrClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialIRR opens a persistent IRRd session ("!!" keeps it open for several
+// queries).
+func dialIRR(ctx context.Context, addr string) (*irrClient, error) {
+	d := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte("!!\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &irrClient{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *irrClient) Query(q string) (string, error) {
+	c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := c.conn.Write([]byte(q + "\n")); err != nil {
+		return "", err
+	}
+	return readIRRResponse(c.r)
+}
+
+func (c *irrClient) Close() error {
+	c.conn.Write([]byte("!q\n"))
+	return c.conn.Close()
+}
+
+// expandASSet resolves an AS-SET to its member ASNs, following nested sets
+// itself (each set queried once, so membership loops terminate) up to
+// maxDepth levels and maxASNs members.
+func expandASSet(query func(string) (string, error), name string, maxDepth, maxASNs int) ([]int, error) {
+	seenSets := map[string]bool{}
+	asns := map[int]bool{}
+	var truncated bool
+
+	var expand func(set string, depth int) error
+	expand = func(set string, depth int) error {
+		key := strings.ToUpper(set)
+		if seenSets[key] {
+			return nil
+		}
+		seenSets[key] = true
+		if depth > maxDepth {
+			fmt.Printf(Red+"[!] Not expanding %s: deeper than %d levels\n"+Reset, set, maxDepth)
+			truncated = true
+			return nil
+		}
+
+		resp, err := query("!i" + set)
+		if err != nil {
+			if depth > 0 && errors.Is(err, errIRRNotFound) {
+				fmt.Printf(Red+"[!] Nested set %s not found in IRR\n"+Reset, set)
+				return nil
+			}
+			return fmt.Errorf("%s: %w", set, err)
+		}
+		for _, member := range strings.Fields(resp) {
+			upper := strings.ToUpper(member)
+			if n, err := strconv.Atoi(strings.TrimPrefix(upper, "AS")); err == nil && strings.HasPrefix(upper, "AS") {
+				if len(asns) >= maxASNs {
+					truncated = true
+					return nil
+				}
+				asns[n] = true
+				continue
+			}
+			if err := expand(member, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := expand(name, 0); err != nil {
+		return nil, err
+	}
+	if truncated {
+		fmt.Printf(Red+"[!] %s expansion was capped, the member list is incomplete\n"+Reset, name)
+	}
+
+	out := make([]int, 0, len(asns))
+	for n := range asns {
+		out = append(out, n)
+	}
+	sort.Ints(out)
+	return out, nil
+}
+
+// apiFetchers bounds how many ASN prefix lists are requested at once; the
+// requests still pass through the client's rate limiter.
+const apiFetchers = 4
+
+// rangesForASNs fetches the prefixes of several ASNs concurrently and
+// aggregates them, remembering which ASN announced each one and the name,
+// description and country bgpview lists for it. A failed ASN is reported and
+// skipped rather than aborting the others.
+func rangesForASNs(ctx context.Context, api *Client, asns []int) ([]string, map[string]int, map[string]Prefix) {
+	results := make([][]Prefix, len(asns))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, apiFetchers)
+	for i, asn := range asns {
+		wg.Add(1)
+		go func(i, asn int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			prefixes, err := api.ASNPrefixes(ctx, asn)
+			if err != nil {
+				fmt.Printf(Red+"[!] Error fetching IP ranges for AS%d: %v\n"+Reset, asn, err)
+				return
+			}
+			fmt.Printf(Green+"[+] AS%d announces %d prefixes\n"+Reset, asn, len(prefixes))
+			results[i] = prefixes
+		}(i, asn)
+	}
+	wg.Wait()
+
+	var ranges []string
+	origin, meta := map[string]int{}, map[string]Prefix{}
+	for i, prefixes := range results {
+		for _, p := range prefixes {
+			if _, dup := origin[p.CIDR]; !dup {
+				origin[p.CIDR], meta[p.CIDR] = asns[i], p
+				ranges = append(ranges, p.CIDR)
+			}
+		}
+	}
+	return aggregatePrefixes(ranges), origin, meta
+}
+
+// OrgResult is what ResolveOrgs found for one organization. Err is set when
+// its search or one of its prefix lookups failed; whatever was found before
+// that is kept.
+type OrgResult struct {
+	ASNs     []ASN
+	Prefixes []Prefix
+	// Origin maps each prefix to the ASN announcing it.
+	Origin map[string]int
+	Err    error
+}
+
+// Options tunes ResolveOrgs; the zero value is usable.
+type Options struct {
+	// Client makes the API calls, and every organization shares its rate
+	// limit. Nil means NewClient().
+	Client *Client
+	// Parallel bounds how many organizations are resolved at once
+	// (default apiFetchers).
+	Parallel int
+	// Retries is how often a call answered with HTTP 429 is repeated before
+	// its organization fails (default 3, negative for none). The first wait
+	// is Backoff (default 2s), doubled each time, and the whole batch
+	// pauses for it: the limit is the API's, not one organization's.
+	Retries int
+	Backoff time.Duration
+	// Progress, if set, is called as each organization finishes, with how
+	// many of total are done. Calls never overlap.
+	Progress func(org string, res OrgResult, done, total int)
+}
+
+// batchBackoff is the pause all workers of a batch honour after a rate
+// limit answer.
+type batchBackoff struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+func (b *batchBackoff) wait(ctx context.Context) error {
+	b.mu.Lock()
+	d := time.Until(b.until)
+	b.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *batchBackoff) extend(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until := time.Now().Add(d); until.After(b.until) {
+		b.until = until
+	}
+}
+
+// ResolveOrgs searches each organization's ASNs and fetches their
+// prefixes, resolving up to opts.Parallel organizations at a time. A failed
+// organization does not stop the others; its error is in its OrgResult.
+// The error returned is ctx's, when the batch was cut short, and the
+// organizations finished by then are still in the map.
+func ResolveOrgs(ctx context.Context, orgs []string, opts Options) (map[string]OrgResult, error) {
+	api := opts.Client
+	if api == nil {
+		api = NewClient()
+	}
+	parallel := max(cmp.Or(opts.Parallel, apiFetchers), 1)
+	retries := max(cmp.Or(opts.Retries, 3), 0)
+	backoff := cmp.Or(opts.Backoff, 2*time.Second)
+
+	var bo batchBackoff
+	call := func(f func() error) error {
+		delay := backoff
+		for attempt := 0; ; attempt++ {
+			if err := bo.wait(ctx); err != nil {
+				return err
+			}
+			err := f()
+			var status *statusError
+			if !errors.As(err, &status) || status.code != http.StatusTooManyRequests || attempt == retries {
+				return err
+			}
+			bo.extend(delay)
+			delay *= 2
+		}
+	}
+	resolve := func(org string) OrgResult {
+		res := OrgResult{Origin: map[string]int{}}
+		if res.Err = call(func() (err error) { res.ASNs, err = api.SearchASNs(ctx, org); return err }); res.Err != nil {
+			return res
+		}
+		for _, asn := range res.ASNs {
+			var prefixes []Prefix
+			if err := call(func() (err error) { prefixes, err = api.ASNPrefixes(ctx, asn.Number); return err }); err != nil {
+				res.Err = fmt.Errorf("AS%d prefixes: %w", asn.Number, err)
+				return res
+			}
+			for _, p := range prefixes {
+				if _, dup := res.Origin[p.CIDR]; !dup {
+					res.Origin[p.CIDR] = asn.Number
+					res.Prefixes = append(res.Prefixes, p)
+				}
+			}
+		}
+		return res
+	}
+
+	var unique []string
+	for _, org := range orgs {
+		if !slices.Contains(unique, org) {
+			unique = append(unique, org)
+		}
+	}
+	results := make(map[string]OrgResult, len(unique))
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, parallel)
+	)
+	for _, org := range unique {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(org string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res := resolve(org)
+			if ctx.Err() != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results[org] = res
+			if opts.Progress != nil {
+				opts.Progress(org, res, len(results), len(unique))
+			}
+		}(org)
+	}
+	wg.Wait()
+	return results, ctx.Err()
+}
+
+// readOrgFile reads -org-file: one organization per line, blank lines and
+// # comments ignored, repeats dropped.
+func readOrgFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var orgs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") && !slices.Contains(orgs, line) {
+			orgs = append(orgs, line)
+		}
+	}
+	return orgs, nil
+}
+
+// validateOrigins looks up the RPKI status of every prefix with a known
+// origin ASN. A failing validation source never blocks the scan: affected
+// prefixes are reported as unknown.
+func validateOrigins(ctx context.Context, validate func(context.Context, int, string) (string, error), prefixes []string, origin map[string]int) map[string]string {
+	statuses := make([]string, len(prefixes))
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		failed  int
+		lastErr error
+	)
+	sem := make(chan struct{}, apiFetchers)
+	for i, p := range prefixes {
+		if origin[p] == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			status, err := validate(ctx, origin[p], p)
+			if err != nil {
+				mu.Lock()
+				failed, lastErr = failed+1, err
+				mu.Unlock()
+				status = rpkiUnknown
+			}
+			statuses[i] = status
+		}(i, p)
+	}
+	wg.Wait()
+	if failed > 0 {
+		fmt.Printf(Red+"[!] RPKI validation failed for %d prefixes, reporting them as unknown: %v\n"+Reset, failed, lastErr)
+	}
+
+	out := map[string]string{}
+	fmt.Println(Green + "\n[+] RPKI origin validation" + Reset)
+	for i, p := range prefixes {
+		if statuses[i] == "" {
+			continue
+		}
+		out[p] = statuses[i]
+		color := Purple
+		switch statuses[i] {
+		case rpkiValid:
+			color = Green
+		case rpkiInvalid:
+			color = Red
+		}
+		fmt.Printf("%s AS%d: "+color+"%s"+Reset+"\n", p, origin[p], statuses[i])
+	}
+	return out
+}
+
+// prefixHistory looks up the announcement history of at most max prefixes,
+// so a large ASN does not turn into thousands of RIPEstat queries. Failed
+// lookups are reported and left without history.
+func prefixHistory(ctx context.Context, ripe *Client, prefixes []string, origin map[string]int, max int) map[string]*History {
+	if len(prefixes) > max {
+		fmt.Printf(Purple+"[~] Looking up the history of the first %d of %d prefixes (-history-max)\n"+Reset, max, len(prefixes))
+		prefixes = prefixes[:max]
+	}
+	results := make([]*History, len(prefixes))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, apiFetchers)
+	for i, p := range prefixes {
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			h, err := ripe.RoutingHistory(ctx, p, origin[p])
+			if err != nil {
+				fmt.Printf(Red+"[!] Routing history for %s failed: %v\n"+Reset, p, err)
+				return
+			}
+			results[i] = h
+		}(i, p)
+	}
+	wg.Wait()
+
+	out := map[string]*History{}
+	fmt.Println(Green + "\n[+] Announcement history" + Reset)
+	for i, p := range prefixes {
+		if h := results[i]; h != nil {
+			out[p] = h
+			fmt.Printf("%s: %s\n", p, h)
+		}
+	}
+	return out
+}
+
+// verifyOwnership looks up the RDAP registrant of every prefix and compares
+// it with the names of the ASN announcing it and the target organization.
+// A prefix without registry data or without names to compare against is
+// marked unknown rather than mismatched.
+func verifyOwnership(ctx context.Context, rdap *Client, prefixes []string, origin map[string]int, asns []ASN, orgs []string) map[string]*Ownership {
+	names := map[int][]string{}
+	for _, asn := range asns {
+		names[asn.Number] = []string{asn.Name, asn.Description, asn.PeeringDBOrg}
+	}
+	results := make([]*Ownership, len(prefixes))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, apiFetchers)
+	for i, p := range prefixes {
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			o := &Ownership{Status: ownershipUnknown}
+			results[i] = o
+			network, err := rdap.RDAPLookup(ctx, p)
+			if err != nil {
+				fmt.Printf(Red+"[!] RDAP lookup for %s failed: %v\n"+Reset, p, err)
+				return
+			}
+			o.Netname, o.Org = network.Name, network.Org
+			expected := append(append([]string{}, names[origin[p]]...), orgs...)
+			registry := []string{network.Name, network.Org}
+			switch {
+			case network.Name == "" && network.Org == "", len(strings.Join(expected, "")) == 0:
+			case sameOrg(registry, expected):
+				o.Status = ownershipMatch
+			default:
+				o.Status = ownershipMismatch
+			}
+		}(i, p)
+	}
+	wg.Wait()
+
+	out := map[string]*Ownership{}
+	mismatches := 0
+	fmt.Println(Green + "\n[+] Registry ownership" + Reset)
+	for i, p := range prefixes {
+		o := results[i]
+		out[p] = o
+		color := ""
+		if o.Status == ownershipMismatch {
+			color = Red
+			mismatches++
+		}
+		fmt.Printf("%s AS%d: "+color+"%s"+Reset+"\n", p, origin[p], o)
+	}
+	if mismatches > 0 {
+		fmt.Printf(Red+"[!] %d prefixes are registered to someone other than the announcing organization; check before scanning them\n"+Reset, mismatches)
+	}
+	return out
+}
+
+// checkVisibility runs a looking-glass query for every prefix. Prefixes
+// whose query fails are reported and left without visibility data.
+func checkVisibility(ctx context.Context, ripe *Client, prefixes []string) map[string]*Visibility {
+	results := make([]*Visibility, len(prefixes))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, apiFetchers)
+	for i, p := range prefixes {
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			v, err := ripe.LookingGlass(ctx, p)
+			if err != nil {
+				fmt.Printf(Red+"[!] Looking-glass query for %s failed: %v\n"+Reset, p, err)
+				return
+			}
+			results[i] = v
+		}(i, p)
+	}
+	wg.Wait()
+
+	out := map[string]*Visibility{}
+	fmt.Println(Green + "\n[+] Looking glass" + Reset)
+	for i, p := range prefixes {
+		v := results[i]
+		if v == nil {
+			continue
+		}
+		out[p] = v
+		peers := make([]string, 0, 5)
+		for _, n := range v.PeerASNs {
+			if len(peers) == cap(peers) {
+				peers = append(peers, fmt.Sprintf("+%d more", len(v.PeerASNs)-cap(peers)))
+				break
+			}
+			peers = append(peers, fmt.Sprintf("AS%d", n))
+		}
+		color := Green
+		if v.SeenBy == 0 {
+			color = Red
+		}
+		fmt.Printf("%s: "+color+"%s"+Reset+" on %d collectors", p, v, v.Collectors)
+		if len(peers) > 0 {
+			fmt.Printf(" (%s)", strings.Join(peers, ", "))
+		}
+		fmt.Println()
+	}
+	return out
+}
+
+// AbuseContact is one abuse mailbox and the ASNs and prefixes it covers.
+type AbuseContact struct {
+	Email     string   `json:"email"`
+	Resources []string `json:"resources"`
+}
+
+// findAbuseContacts looks up the abuse contacts of every ASN and announced
+// prefix once and returns the mailboxes per resource plus the deduplicated
+// contact list. Failed lookups are reported and skipped.
+func findAbuseContacts(ctx context.Context, ripe *Client, asns []int, prefixes []string) (map[string][]string, []AbuseContact) {
+	var resources []string
+	seen := map[string]bool{}
+	for _, n := range asns {
+		if r := fmt.Sprintf("AS%d", n); !seen[r] {
+			seen[r] = true
+			resources = append(resources, r)
+		}
+	}
+	resources = append(resources, prefixes...)
+
+	results := make([][]string, len(resources))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, apiFetchers)
+	for i, r := range resources {
+		wg.Add(1)
+		go func(i int, r string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			emails, err := ripe.AbuseContacts(ctx, r)
+			if err != nil {
+				fmt.Printf(Red+"[!] Abuse contact lookup for %s failed: %v\n"+Reset, r, err)
+				return
+			}
+			results[i] = emails
+		}(i, r)
+	}
+	wg.Wait()
+
+	byResource := map[string][]string{}
+	index := map[string]int{}
+	var contacts []AbuseContact
+	for i, r := range resources {
+		for _, email := range results[i] {
+			email = strings.ToLower(strings.TrimSpace(email))
+			if email == "" {
+				continue
+			}
+			byResource[r] = append(byResource[r], email)
+			j, ok := index[email]
+			if !ok {
+				j = len(contacts)
+				index[email] = j
+				contacts = append(contacts, AbuseContact{Email: email})
+			}
+			contacts[j].Resources = append(contacts[j].Resources, r)
+		}
+	}
+	return byResource, contacts
+}
+
+func printAbuseContacts(contacts []AbuseContact) {
+	fmt.Println(Green + "\n[+] Abuse contacts" + Reset)
+	if len(contacts) == 0 {
+		fmt.Println("none found")
+	}
+	for _, c := range contacts {
+		fmt.Printf(Blue+"%s"+Reset+" for %s\n", c.Email, strings.Join(c.Resources, ", "))
+	}
+}
+
+// announcedPrefix returns the announced prefix that prefix is, or was carved
+// out of by -deaggregate or reserved-range trimming.
+func announcedPrefix(prefix string, announced []*net.IPNet) string {
+	ip, _, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return ""
+	}
+	return containingPrefix(ip, announced)
+}
+
+// aggregatePrefixes drops duplicates and prefixes already covered by a
+// broader one in the list, so overlapping announcements are scanned once.
+func aggregatePrefixes(prefixes []string) []string {
+	type entry struct {
+		prefix string
+		net    *net.IPNet
+		ones   int
+	}
+	var entries []entry
+	seen := map[string]bool{}
+	for _, p := range prefixes {
+		_, n, err := net.ParseCIDR(p)
+		if err != nil || seen[p] {
+			continue
+		}
+		seen[p] = true
+		ones, _ := n.Mask.Size()
+		entries = append(entries, entry{p, n, ones})
+	}
+
+	byLen := append([]entry(nil), entries...)
+	sort.SliceStable(byLen, func(i, j int) bool { return byLen[i].ones < byLen[j].ones })
+	covered := map[string]bool{}
+	var kept []*net.IPNet
+	for _, e := range byLen {
+		for _, k := range kept {
+			if k.Contains(e.net.IP) && len(k.IP) == len(e.net.IP) {
+				covered[e.prefix] = true
+				break
+			}
+		}
+		if !covered[e.prefix] {
+			kept = append(kept, e.net)
+		}
+	}
+
+	out := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !covered[e.prefix] {
+			out = append(out, e.prefix)
+		}
+	}
+	return out
+}
+
+// reservedRanges are the IANA special-purpose IPv4 and IPv6 blocks (plus
+// multicast and the old class E space) that have no business in a public
+// sweep. Globally routed special-purpose blocks such as AS112 are left out.
+var reservedRanges = []struct{ cidr, purpose string }{
+	{"0.0.0.0/8", `"this network", RFC 791`},
+	{"10.0.0.0/8", "private use, RFC 1918"},
+	{"100.64.0.0/10", "shared address space (CGNAT), RFC 6598"},
+	{"127.0.0.0/8", "loopback, RFC 1122"},
+	{"169.254.0.0/16", "link local, RFC 3927"},
+	{"172.16.0.0/12", "private use, RFC 1918"},
+	{"192.0.0.0/24", "IETF protocol assignments, RFC 6890"},
+	{"192.0.2.0/24", "documentation (TEST-NET-1), RFC 5737"},
+	{"192.88.99.0/24", "deprecated 6to4 relay anycast, RFC 7526"},
+	{"192.168.0.0/16", "private use, RFC 1918"},
+	{"198.18.0.0/15", "benchmarking, RFC 2544"},
+	{"198.51.100.0/24", "documentation (TEST-NET-2), RFC 5737"},
+	{"203.0.113.0/24", "documentation (TEST-NET-3), RFC 5737"},
+	{"224.0.0.0/4", "multicast, RFC 5771"},
+	{"240.0.0.0/4", "reserved, RFC 1112"},
+	{"::/128", "unspecified address, RFC 4291"},
+	{"::1/128", "loopback, RFC 4291"},
+	{"::ffff:0:0/96", "IPv4-mapped addresses, RFC 4291"},
+	{"64:ff9b:1::/48", "local-use IPv4/IPv6 translation, RFC 8215"},
+	{"100::/64", "discard only, RFC 6666"},
+	{"2001:db8::/32", "documentation, RFC 3849"},
+	{"3fff::/20", "documentation, RFC 9637"},
+	{"fc00::/7", "unique local, RFC 4193"},
+	{"fe80::/10", "link local, RFC 4291"},
+	{"ff00::/8", "multicast, RFC 4291"},
+}
+
+// Exclusion records reserved space cut out of a scanned prefix. Skipped is
+// set when nothing of the prefix was left to scan.
+type Exclusion struct {
+	Prefix   string `json:"prefix"`
+	Reserved string `json:"reserved"`
+	Purpose  string `json:"purpose"`
+	Skipped  bool   `json:"skipped,omitempty"`
+}
+
+func netsOverlap(a, b *net.IPNet) bool {
+	return len(a.IP) == len(b.IP) && (a.Contains(b.IP) || b.Contains(a.IP))
+}
+
+// subtractNets returns the parts of n outside every hole as CIDRs, halving n
+// until each half either misses all holes or lies entirely inside one.
+func subtractNets(n *net.IPNet, holes []*net.IPNet) []*net.IPNet {
+	ones, bits := n.Mask.Size()
+	overlaps := false
+	for _, h := range holes {
+		if !netsOverlap(n, h) {
+			continue
+		}
+		if hOnes, _ := h.Mask.Size(); hOnes <= ones {
+			return nil
+		}
+		overlaps = true
+	}
+	if !overlaps {
+		return []*net.IPNet{n}
+	}
+	mask := net.CIDRMask(ones+1, bits)
+	hi := append(net.IP(nil), n.IP...)
+	hi[ones/8] |= 0x80 >> uint(ones%8)
+	return append(subtractNets(&net.IPNet{IP: n.IP, Mask: mask}, holes),
+		subtractNets(&net.IPNet{IP: hi, Mask: mask}, holes)...)
+}
+
+// excludeReserved trims reserved space out of prefixes, dropping prefixes
+// that lie entirely inside it, and reports every cut.
+func excludeReserved(prefixes []string) ([]string, []Exclusion) {
+	var kept []string
+	var excluded []Exclusion
+	for _, p := range prefixes {
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			kept = append(kept, p)
+			continue
+		}
+		var holes []*net.IPNet
+		var cuts []Exclusion
+		for _, r := range reservedRanges {
+			_, h, _ := net.ParseCIDR(r.cidr)
+			if !netsOverlap(n, h) {
+				continue
+			}
+			holes = append(holes, h)
+			// The overlap of two CIDRs is the more specific of them.
+			overlap := h
+			nOnes, _ := n.Mask.Size()
+			if hOnes, _ := h.Mask.Size(); nOnes > hOnes {
+				overlap = n
+			}
+			cuts = append(cuts, Exclusion{Prefix: p, Reserved: overlap.String(), Purpose: r.purpose})
+		}
+		if len(holes) == 0 {
+			kept = append(kept, p)
+			continue
+		}
+		rest := subtractNets(n, holes)
+		for _, r := range rest {
+			kept = append(kept, r.String())
+		}
+		for i := range cuts {
+			cuts[i].Skipped = len(rest) == 0
+		}
+		excluded = append(excluded, cuts...)
+	}
+	return kept, excluded
+}
+
+// ScanRequest is the body of POST /scans. Exactly one of Org, ASN or CIDRs
+// selects the targets; an org search scans every ASN it returns, narrowed by
+// the asn_name_filter option.
+type ScanRequest struct {
+	Org     string      `json:"org,omitempty"`
+	ASN     int         `json:"asn,omitempty"`
+	CIDRs   []string    `json:"cidrs,omitempty"`
+	Options ScanOptions `json:"options"`
+}
+
+type ScanOptions struct {
+	Sample        int     `json:"sample,omitempty"`
+	Workers       int     `json:"workers,omitempty"`
+	QPS           float64 `json:"qps,omitempty"`
+	ASNNameFilter string  `json:"asn_name_filter,omitempty"`
+	AllowReserved bool    `json:"allow_reserved,omitempty"`
+}
+
+func (r ScanRequest) validate() error {
+	set := 0
+	for _, ok := range []bool{r.Org != "", r.ASN != 0, len(r.CIDRs) > 0} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("exactly one of org, asn or cidrs is required")
+	}
+	if len(r.CIDRs) > 0 {
+		if _, ok := parseTargets(strings.Join(r.CIDRs, ",")); !ok {
+			return errors.New("cidrs must be IP addresses or CIDRs")
+		}
+	}
+	if r.Options.Sample < 0 || r.Options.Workers < 0 || r.Options.QPS < 0 {
+		return errors.New("options must not be negative")
+	}
+	return nil
+}
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// ScanJob is a scan submitted to the server, as stored in the scans bucket.
+// Findings are only part of /results: the store keeps them in an
+// append-only JSONL file per job, written as they are found. Stores from
+// before that still carry them in the record.
+type ScanJob struct {
+	ID         string       `json:"id"`
+	Status     string       `json:"status"`
+	Request    ScanRequest  `json:"request"`
+	Error      string       `json:"error,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+	StartedAt  *time.Time   `json:"started_at,omitempty"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	Prefixes   []string     `json:"prefixes,omitempty"`
+	Planned    int64        `json:"planned"`
+	Done       int64        `json:"done"`
+	Found      int          `json:"found"`
+	Findings   []FindingRow `json:"findings,omitempty"`
+}
+
+func (j *ScanJob) finished() bool {
+	return j.Status == jobDone || j.Status == jobFailed || j.Status == jobCancelled
+}
+
+type scanJob struct {
+	mu sync.Mutex
+	ScanJob
+	cancel context.CancelFunc
+	sc     *scanner
+	done   chan struct{}
+	// log is the job's findings file while it runs.
+	log       *os.File
+	logFailed bool
+}
+
+// snapshot returns the job without its findings, with live progress.
+func (j *scanJob) snapshot() ScanJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := j.ScanJob
+	if j.sc != nil && j.Status == jobRunning {
+		s.Done = j.sc.done.Load()
+	}
+	s.Found, s.Findings = len(j.Findings), nil
+	return s
+}
+
+// server runs submitted scans in the background, at most len(slots) at a
+// time, and keeps every job in the store and its findings in findingsDir.
+type server struct {
+	ctx         context.Context
+	token       string
+	api         *Client
+	resolver    string
+	workers     int
+	slots       chan struct{}
+	running     sync.WaitGroup
+	metrics     *metrics
+	findingsDir string
+
+	storeMu sync.Mutex
+	store   *Store
+
+	mu   sync.Mutex
+	jobs map[string]*scanJob
+}
+
+// queued counts the addresses the running scans have yet to hand a worker.
+func (srv *server) queued() int64 {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var n int64
+	for _, j := range srv.jobs {
+		j.mu.Lock()
+		if j.sc != nil && j.Status == jobRunning {
+			n += j.sc.queued.Load()
+		}
+		j.mu.Unlock()
+	}
+	return n
+}
+
+// newJobID returns a random job ID. Job IDs are the only handle on a
+// scan's results, so they come from crypto/rand.
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := crand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// loadJobs restores jobs from the store and their findings files. Jobs that
+// were still queued or running when the server stopped are marked failed.
+func (srv *server) loadJobs() {
+	srv.storeMu.Lock()
+	defer srv.storeMu.Unlock()
+	srv.store.ForEach(bucketScans, "", func(id string, raw json.RawMessage) error {
+		j := &scanJob{done: make(chan struct{})}
+		if err := json.Unmarshal(raw, &j.ScanJob); err != nil {
+			return nil
+		}
+		switch {
+		case len(j.Findings) > 0:
+			// Written before findings had their own files: move them out.
+			if err := writeFindingsLog(srv.findingsPath(id), j.Findings); err != nil {
+				fmt.Println(Red+"[!] Failed to write findings of scan", id+":", err, Reset)
+			} else if err := srv.store.Put(bucketScans, id, j.record()); err != nil {
+				fmt.Println(Red+"[!] Failed to store scan", id+":", err, Reset)
+			}
+		default:
+			findings, err := readFindingsLog(srv.findingsPath(id))
+			if err != nil && !os.IsNotExist(err) {
+				fmt.Println(Red+"[!] Failed to read findings of scan", id+":", err, Reset)
+			}
+			j.Findings = findings
+		}
+		if !j.finished() {
+			j.Status, j.Error = jobFailed, "server restarted before the scan finished"
+			j.Found = len(j.Findings)
+			if err := srv.store.Put(bucketScans, id, j.record()); err != nil {
+				fmt.Println(Red+"[!] Failed to store scan", id+":", err, Reset)
+			}
+		}
+		close(j.done)
+		srv.jobs[id] = j
+		return nil
+	})
+}
+
+func (srv *server) findingsPath(id string) string {
+	return filepath.Join(srv.findingsDir, id+".jsonl")
+}
+
+// readFindingsLog reads a job's findings file. A torn last line, from a
+// server killed mid-write, is ignored.
+func readFindingsLog(path string) ([]FindingRow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rows []FindingRow
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var row FindingRow
+		if json.Unmarshal(sc.Bytes(), &row) == nil {
+			rows = append(rows, row)
+		}
+	}
+	return rows, sc.Err()
+}
+
+// record is the job as stored in the scans bucket, without its findings.
+// j.mu must be held.
+func (j *scanJob) record() ScanJob {
+	rec := j.ScanJob
+	rec.Found, rec.Findings = len(j.Findings), nil
+	return rec
+}
+
+// addFinding keeps a finding for /results and appends it to the job's
+// findings file. A failing file is reported once and then left alone.
+func (j *scanJob) addFinding(row FindingRow) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Findings = append(j.Findings, row)
+	if j.log == nil || j.logFailed {
+		return
+	}
+	line, err := json.Marshal(row)
+	if err == nil {
+		_, err = j.log.Write(append(line, '\n'))
+	}
+	if err != nil {
+		j.logFailed = true
+		fmt.Println(Red+"[!] Failed to write findings of scan", j.ID+":", err, Reset)
+	}
+}
+
+// saveJob stores the job's metadata. Its findings are already on disk.
+func (srv *server) saveJob(j *scanJob) {
+	j.mu.Lock()
+	rec := j.record()
+	j.mu.Unlock()
+
+	srv.storeMu.Lock()
+	defer srv.storeMu.Unlock()
+	if err := srv.store.Put(bucketScans, rec.ID, rec); err != nil {
+		fmt.Println(Red+"[!] Failed to store scan", rec.ID+":", err, Reset)
+		return
+	}
+	if err := srv.store.Save(); err != nil {
+		fmt.Println(Red+"[!] Failed to save store:", err, Reset)
+	}
+}
+
+func (srv *server) submit(req ScanRequest) *scanJob {
+	ctx, cancel := context.WithCancel(srv.ctx)
+	j := &scanJob{cancel: cancel, done: make(chan struct{})}
+	j.ID, j.Status, j.Request, j.CreatedAt = newJobID(), jobQueued, req, time.Now()
+	srv.mu.Lock()
+	srv.jobs[j.ID] = j
+	srv.mu.Unlock()
+	srv.saveJob(j)
+
+	srv.running.Add(1)
+	go srv.run(ctx, j)
+	return j
+}
+
+func (srv *server) finish(j *scanJob, status, errMsg string) {
+	j.mu.Lock()
+	now := time.Now()
+	j.Status, j.Error, j.FinishedAt = status, errMsg, &now
+	if j.sc != nil {
+		j.Done = j.sc.done.Load()
+	}
+	if j.log != nil {
+		if err := j.log.Close(); err != nil && !j.logFailed {
+			fmt.Println(Red+"[!] Failed to write findings of scan", j.ID+":", err, Reset)
+		}
+		j.log = nil
+	}
+	j.mu.Unlock()
+	srv.saveJob(j)
+	close(j.done)
+	fmt.Printf(Green+"[+] Scan %s %s\n"+Reset, j.ID, status)
+}
+
+// targets resolves a request into the prefixes to scan, their origin ASNs
+// and the organization name results are stored under.
+func (srv *server) targets(ctx context.Context, j *scanJob) ([]string, map[string]int, string, error) {
+	req := j.Request
+	var (
+		prefixes []string
+		origin   = map[string]int{}
+		org      = req.Org
+	)
+	switch {
+	case len(req.CIDRs) > 0:
+		prefixes, _ = parseTargets(strings.Join(req.CIDRs, ","))
+		org = "scan " + j.ID
+	case req.ASN != 0:
+		prefixes, origin, _ = rangesForASNs(ctx, srv.api, []int{req.ASN})
+		org = fmt.Sprintf("AS%d", req.ASN)
+	default:
+		asns, err := srv.api.SearchASNs(ctx, req.Org)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("searching ASNs: %v", err)
+		}
+		if req.Options.ASNNameFilter != "" {
+			asns = filterASNs(asns, req.Options.ASNNameFilter, nil)
+		}
+		var nums []int
+		for _, asn := range asns {
+			nums = append(nums, asn.Number)
+		}
+		if len(nums) == 0 {
+			return nil, nil, "", fmt.Errorf("no ASN found for %s", req.Org)
+		}
+		prefixes, origin, _ = rangesForASNs(ctx, srv.api, nums)
+	}
+	if len(req.CIDRs) == 0 {
+		prefixes, _ = filterFamilies(prefixes, true, false)
+	}
+	if !req.Options.AllowReserved {
+		prefixes, _ = excludeReserved(prefixes)
+	}
+	if len(prefixes) == 0 {
+		return nil, nil, "", errors.New("no prefixes to scan")
+	}
+	return prefixes, origin, org, nil
+}
+
+func writeFindingsLog(path string, rows []FindingRow) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+func openFindingsLog(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+}
+
+// run waits for a free slot and scans the job with the CLI's scanner.
+func (srv *server) run(ctx context.Context, j *scanJob) {
+	defer flushOnPanic()
+	defer srv.running.Done()
+	defer j.cancel()
+
+	select {
+	case srv.slots <- struct{}{}:
+		defer func() { <-srv.slots }()
+	case <-ctx.Done():
+		srv.finish(j, jobCancelled, "")
+		return
+	}
+
+	log, err := openFindingsLog(srv.findingsPath(j.ID))
+	if err != nil {
+		srv.finish(j, jobFailed, "opening findings file: "+err.Error())
+		return
+	}
+	j.mu.Lock()
+	now := time.Now()
+	j.Status, j.StartedAt, j.log = jobRunning, &now, log
+	j.mu.Unlock()
+	srv.saveJob(j)
+
+	prefixes, origin, org, err := srv.targets(ctx, j)
+	if err != nil {
+		if ctx.Err() != nil {
+			srv.finish(j, jobCancelled, "")
+		} else {
+			srv.finish(j, jobFailed, err.Error())
+		}
+		return
+	}
+
+	opts := j.Request.Options
+	workers := srv.workers
+	if opts.Workers > 0 {
+		workers = opts.Workers
+	}
+	sc := &scanner{ctx: ctx, countries: map[string]int{}, sample: opts.Sample, rng: rand.New(rand.NewSource(time.Now().UnixNano())),
+		workers: workers, hostnames: map[string]bool{}, delay: 100 * time.Millisecond, metrics: srv.metrics}
+	if opts.QPS > 0 {
+		sc.qps = newTokenBucket(opts.QPS, opts.QPS/10)
+	}
+	if srv.resolver != "" {
+		r := customResolver(resolverAddress(srv.resolver), transportAuto)
+		sc.resolver, sc.ptr = r, r
+	}
+	sc.onResult = func(prefix string, res LookupResult) {
+		if res.Status != StatusFound {
+			return
+		}
+		j.addFinding(FindingRow{IP: res.IP, Prefix: prefix, Hostnames: res.Names, Retried: res.Retried, Provenance: res.Provenance})
+		srv.storeMu.Lock()
+		err := srv.store.TouchHost(org, prefix, res, time.Now())
+		srv.storeMu.Unlock()
+		if err != nil {
+			fmt.Println(Red+"[!] Failed to store", res.IP+":", err, Reset)
+		}
+	}
+	sc.onPrefixDone = func(ps *PrefixStats) {
+		srv.storeMu.Lock()
+		err := srv.store.TouchPrefix(org, ps.Prefix, origin[ps.Prefix], time.Now())
+		if err == nil && !ps.Sampled {
+			err = srv.store.MarkScanned(org, ps.Prefix, time.Now())
+		}
+		srv.storeMu.Unlock()
+		if err != nil {
+			fmt.Println(Red+"[!] Failed to store", ps.Prefix+":", err, Reset)
+		}
+		srv.saveJob(j)
+	}
+
+	srv.storeMu.Lock()
+	err = srv.store.TouchOrg(org, time.Now())
+	srv.storeMu.Unlock()
+	if err != nil {
+		fmt.Println(Red+"[!] Failed to store", org+":", err, Reset)
+	}
+
+	sc.started, sc.planned = time.Now(), plannedLookups(prefixes, sc.sample)
+	j.mu.Lock()
+	j.sc, j.Prefixes, j.Planned = sc, prefixes, sc.planned
+	j.mu.Unlock()
+
+	sc.scan(prefixes)
+	if ctx.Err() != nil {
+		srv.finish(j, jobCancelled, "")
+		return
+	}
+	srv.finish(j, jobDone, "")
+}
+
+func writeJSONResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, status int, msg string) {
+	writeJSONResponse(w, status, map[string]string{"error": msg})
+}
+
+func (srv *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(srv.token)) != 1 {
+		httpError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "scans" || len(parts) > 3 || (len(parts) == 3 && parts[2] != "results") {
+		httpError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodPost:
+			srv.createScan(w, r)
+		case http.MethodGet:
+			srv.listScans(w)
+		default:
+			httpError(w, http.StatusMethodNotAllowed, "use GET or POST")
+		}
+		return
+	}
+
+	srv.mu.Lock()
+	j := srv.jobs[parts[1]]
+	srv.mu.Unlock()
+	if j == nil {
+		httpError(w, http.StatusNotFound, "no such scan")
+		return
+	}
+	switch {
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		srv.scanResults(w, r, j)
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		writeJSONResponse(w, http.StatusOK, j.snapshot())
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		if j.cancel != nil {
+			j.cancel()
+		}
+		writeJSONResponse(w, http.StatusAccepted, j.snapshot())
+	default:
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (srv *server) createScan(w http.ResponseWriter, r *http.Request) {
+	var req ScanRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if err := req.validate(); err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	j := srv.submit(req)
+	w.Header().Set("Location", "/scans/"+j.ID)
+	writeJSONResponse(w, http.StatusCreated, j.snapshot())
+}
+
+func (srv *server) listScans(w http.ResponseWriter) {
+	srv.mu.Lock()
+	list := make([]ScanJob, 0, len(srv.jobs))
+	for _, j := range srv.jobs {
+		list = append(list, j.snapshot())
+	}
+	srv.mu.Unlock()
+	sort.Slice(list, func(a, b int) bool { return list[a].CreatedAt.Before(list[b].CreatedAt) })
+	writeJSONResponse(w, http.StatusOK, list)
+}
+
+// scanResults returns the findings so far as one JSON document or, with
+// ?format=ndjson or an NDJSON Accept header, streams them one per line
+// until the scan finishes.
+func (srv *server) scanResults(w http.ResponseWriter, r *http.Request, j *scanJob) {
+	ndjson := r.URL.Query().Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+	if !ndjson {
+		j.mu.Lock()
+		body := struct {
+			ID       string       `json:"id"`
+			Status   string       `json:"status"`
+			Findings []FindingRow `json:"findings"`
+		}{j.ID, j.Status, append([]FindingRow{}, j.Findings...)}
+		j.mu.Unlock()
+		writeJSONResponse(w, http.StatusOK, body)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	sent := 0
+	for {
+		j.mu.Lock()
+		batch := append([]FindingRow(nil), j.Findings[sent:]...)
+		finished := j.finished()
+		j.mu.Unlock()
+		for _, f := range batch {
+			if err := enc.Encode(f); err != nil {
+				return
+			}
+		}
+		sent += len(batch)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if finished {
+			return
+		}
+		select {
+		case <-j.done:
+		case <-r.Context().Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// serveTokenEnv names the environment variable holding the API token.
+const serveTokenEnv = "RECON_API_TOKEN"
+
+// agentTokenEnv names the environment variable holding the token shared by
+// a controller and its agents.
+const agentTokenEnv = "RECON_AGENT_TOKEN"
+
+// loopbackHost reports whether host, a name or an address, stays on this
+// machine, where sending the token in the clear is harmless.
+func loopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+const (
+	chunkPending = "pending"
+	chunkLeased  = "leased"
+	chunkDone    = "done"
+	// agentPoll is how long an agent waits before asking again while every
+	// remaining chunk is leased, or while the controller is unreachable.
+	agentPoll = 5 * time.Second
+)
+
+// WorkChunk is block Index of Prefix, chunkSize addresses counted from its
+// first host address as with -shard, queued on the controller.
+type WorkChunk struct {
+	ID       int        `json:"id"`
+	Prefix   string     `json:"prefix"`
+	Index    uint64     `json:"index"`
+	Status   string     `json:"status"`
+	Agent    string     `json:"agent,omitempty"`
+	Lease    string     `json:"lease,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Attempts int        `json:"attempts,omitempty"`
+}
+
+// ChunkLease hands a chunk to an agent until Expires, unless it is renewed.
+// Seconds is the lease length, so agents need not share the controller's
+// clock.
+type ChunkLease struct {
+	Lease   string    `json:"lease"`
+	Chunk   WorkChunk `json:"chunk"`
+	Expires time.Time `json:"expires"`
+	Seconds int       `json:"lease_seconds"`
+}
+
+// ChunkResult is an agent's report of a finished chunk.
+type ChunkResult struct {
+	Lease    string       `json:"lease"`
+	Agent    string       `json:"agent"`
+	Stats    PrefixStats  `json:"stats"`
+	Findings []FindingRow `json:"findings"`
+}
+
+// ControllerState is the work queue and the results merged so far. It is
+// saved whenever a chunk is leased or done, so a restarted controller
+// resumes from it; lease renewals are not saved (see controller.load). The
+// findings are not part of the saved state: each is appended once to the
+// findings log next to it (controllerFindingsPath). State files that still
+// embed them are migrated when loaded.
+type ControllerState struct {
+	Prefixes  []string                `json:"prefixes"`
+	Chunks    []*WorkChunk            `json:"chunks"`
+	Stats     map[string]*PrefixStats `json:"stats"`
+	Findings  map[string]FindingRow   `json:"findings,omitempty"`
+	StartedAt time.Time               `json:"started_at"`
+}
+
+// controllerFindingsPath is the findings log of the controller state at
+// path.
+func controllerFindingsPath(path string) string {
+	return path + ".findings.jsonl"
+}
+
+func newControllerState(prefixes []string) *ControllerState {
+	st := &ControllerState{Stats: map[string]*PrefixStats{}, Findings: map[string]FindingRow{}, StartedAt: time.Now()}
+	for _, p := range prefixes {
+		_, first, last, err := hostRange(p)
+		if err != nil {
+			fmt.Printf(Red+"[!] Skipping %s: %v\n"+Reset, p, err)
+			continue
+		}
+		st.Prefixes = append(st.Prefixes, p)
+		for i := uint64(0); i <= (last-first)/chunkSize; i++ {
+			st.Chunks = append(st.Chunks, &WorkChunk{ID: len(st.Chunks), Prefix: p, Index: i, Status: chunkPending})
+		}
+	}
+	return st
+}
+
+// controller leases chunks to agents and merges what they send back.
+type controller struct {
+	mu       sync.Mutex
+	path     string
+	token    string
+	lease    time.Duration
+	state    *ControllerState
+	log      *os.File
+	finished chan struct{}
+}
+
+// load reads the state at c.path and its findings log, moving findings a
+// state file still embeds into the log, and opens the log for appending.
+// Renewals are not saved, so every chunk still leased gets a full lease
+// from now: its agent may well be alive and renewing.
+func (c *controller) load(data []byte) error {
+	c.state = &ControllerState{}
+	if err := json.Unmarshal(data, c.state); err != nil {
+		return fmt.Errorf("corrupt controller state: %v", err)
+	}
+	expires := time.Now().Add(c.lease)
+	for _, ch := range c.state.Chunks {
+		if ch.Status == chunkLeased {
+			ch.Expires = &expires
+		}
+	}
+	logPath := controllerFindingsPath(c.path)
+	if len(c.state.Findings) > 0 {
+		rows := make([]FindingRow, 0, len(c.state.Findings))
+		for _, f := range c.state.Findings {
+			rows = append(rows, f)
+		}
+		sortFindings(rows, sortIP)
+		if err := writeFindingsLog(logPath, rows); err != nil {
+			return err
+		}
+		c.save()
+	}
+	rows, err := readFindingsLog(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	c.state.Findings = make(map[string]FindingRow, len(rows))
+	for _, f := range rows {
+		if _, dup := c.state.Findings[f.IP]; !dup {
+			c.state.Findings[f.IP] = f
+		}
+	}
+	c.log, err = openFindingsLog(logPath)
+	return err
+}
+
+// save writes the queue and stats; the findings are already in the log.
+func (c *controller) save() {
+	st := *c.state
+	st.Findings = nil
+	data, err := json.Marshal(&st)
+	if err == nil {
+		err = writeFileAtomic(c.path, data)
+	}
+	if err != nil {
+		fmt.Println(Red+"[!] Failed to save controller state:", err, Reset)
+	}
+}
+
+func (c *controller) pending() (done, total int) {
+	for _, ch := range c.state.Chunks {
+		if ch.Status == chunkDone {
+			done++
+		}
+	}
+	return done, len(c.state.Chunks)
+}
+
+func (c *controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) != 1 {
+		httpError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "status" && r.Method == http.MethodGet:
+		c.mu.Lock()
+		done, total := c.pending()
+		c.mu.Unlock()
+		writeJSONResponse(w, http.StatusOK, map[string]int{"done": done, "chunks": total})
+	case len(parts) == 1 && parts[0] == "lease" && r.Method == http.MethodPost:
+		c.leaseChunk(w, r)
+	case len(parts) == 3 && parts[0] == "chunks" && r.Method == http.MethodPost && (parts[2] == "renew" || parts[2] == "result"):
+		id, err := strconv.Atoi(parts[1])
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err != nil || id < 0 || id >= len(c.state.Chunks) {
+			httpError(w, http.StatusNotFound, "no such chunk")
+			return
+		}
+		if parts[2] == "renew" {
+			c.renew(w, r, c.state.Chunks[id])
+		} else {
+			c.result(w, r, c.state.Chunks[id])
+		}
+	default:
+		httpError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// leaseChunk hands out the first pending chunk, or one whose lease ran out
+// because its agent died or lost contact. It answers 204 while every
+// remaining chunk is leased and 410 once all are done.
+func (c *controller) leaseChunk(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Agent string `json:"agent"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	var next *WorkChunk
+	for _, ch := range c.state.Chunks {
+		if ch.Status == chunkPending || ch.Status == chunkLeased && ch.Expires.Before(now) {
+			next = ch
+			break
+		}
+	}
+	if next == nil {
+		if done, total := c.pending(); done == total {
+			httpError(w, http.StatusGone, "all chunks are done")
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+	if next.Status == chunkLeased {
+		fmt.Printf(Purple+"[~] Lease of chunk %d (%s) held by %s expired, leasing it again\n"+Reset, next.ID, next.Prefix, next.Agent)
+	}
+	expires := now.Add(c.lease)
+	next.Status, next.Agent, next.Lease, next.Expires = chunkLeased, req.Agent, newJobID(), &expires
+	next.Attempts++
+	c.save()
+	writeJSONResponse(w, http.StatusOK, ChunkLease{Lease: next.Lease, Chunk: *next, Expires: expires, Seconds: int(c.lease.Seconds())})
+}
+
+// renew extends a lease that is still held, answering 409 if the chunk was
+// leased to another agent in the meantime. The new expiry is only kept in
+// memory, since agents renew far more often than chunks change hands.
+func (c *controller) renew(w http.ResponseWriter, r *http.Request, ch *WorkChunk) {
+	var req struct {
+		Lease string `json:"lease"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if ch.Status != chunkLeased || ch.Lease != req.Lease {
+		httpError(w, http.StatusConflict, "lease lost")
+		return
+	}
+	expires := time.Now().Add(c.lease)
+	ch.Expires = &expires
+	writeJSONResponse(w, http.StatusOK, ChunkLease{Lease: ch.Lease, Chunk: *ch, Expires: expires, Seconds: int(c.lease.Seconds())})
+}
+
+// result merges a finished chunk. Only the agent holding the current lease
+// may report it, even after the lease expired as long as nobody leased the
+// chunk again; a result for a done chunk is acknowledged and dropped, so
+// nothing is counted twice. Findings are deduplicated by IP and appended to
+// the findings log before the chunk is marked done, so a crash in between
+// costs a rescan of the chunk, not its findings.
+func (c *controller) result(w http.ResponseWriter, r *http.Request, ch *WorkChunk) {
+	var res ChunkResult
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<20)).Decode(&res); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if res.Stats.Prefix != ch.Prefix {
+		httpError(w, http.StatusBadRequest, "result is for a different prefix")
+		return
+	}
+	if ch.Status == chunkDone {
+		writeJSONResponse(w, http.StatusOK, map[string]string{"status": "duplicate"})
+		return
+	}
+	if ch.Status != chunkLeased || ch.Lease != res.Lease {
+		httpError(w, http.StatusConflict, "lease lost")
+		return
+	}
+
+	var fresh []FindingRow
+	seen := make(map[string]bool, len(res.Findings))
+	for _, f := range res.Findings {
+		if _, ok := c.state.Findings[f.IP]; !ok && !seen[f.IP] {
+			seen[f.IP] = true
+			fresh = append(fresh, f)
+		}
+	}
+	if c.log != nil && len(fresh) > 0 {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, f := range fresh {
+			enc.Encode(f)
+		}
+		if _, err := c.log.Write(buf.Bytes()); err != nil {
+			fmt.Println(Red+"[!] Failed to save findings:", err, Reset)
+			httpError(w, http.StatusInternalServerError, "failed to save findings")
+			return
+		}
+	}
+
+	ps := c.state.Stats[ch.Prefix]
+	if ps == nil {
+		ps = newPrefixStats(ch.Prefix, false)
+		c.state.Stats[ch.Prefix] = ps
+	}
+	ps.Total += res.Stats.Total
+	for i, n := range res.Stats.Counts {
+		ps.Counts[i] += n
+	}
+	if ps.Apexes == nil {
+		ps.Apexes = map[string]bool{}
+	}
+	for apex := range res.Stats.Apexes {
+		ps.Apexes[apex] = true
+	}
+	for _, f := range fresh {
+		c.state.Findings[f.IP] = f
+	}
+	ch.Status, ch.Agent, ch.Lease, ch.Expires = chunkDone, res.Agent, "", nil
+	c.save()
+
+	done, total := c.pending()
+	fmt.Printf(Green+"[+] Chunk %d of %s done by %s: %d findings (%d/%d chunks)\n"+Reset, ch.ID, ch.Prefix, res.Agent, len(fresh), done, total)
+	if done == total {
+		close(c.finished)
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]string{"status": "merged"})
+}
+
+// writeOutputs writes the merged findings as a JSON report and as JSON
+// lines, like a local scan's -o and -jsonl.
+func (c *controller) writeOutputs(jsonOut, jsonlPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var stats []*PrefixStats
+	for _, p := range c.state.Prefixes {
+		if ps := c.state.Stats[p]; ps != nil {
+			stats = append(stats, ps)
+		}
+	}
+	findings := make([]FindingRow, 0, len(c.state.Findings))
+	for _, f := range c.state.Findings {
+		findings = append(findings, f)
+	}
+	sortFindings(findings, sortIP)
+
+	if jsonOut != "" {
+		rep := &Report{StartedAt: c.state.StartedAt, FinishedAt: time.Now(), Prefixes: statsTable(stats), Findings: findings}
+		if err := writeJSONReport(jsonOut, rep); err != nil {
+			fmt.Println(Red+"[!] Failed to write JSON report:", err, Reset)
+		}
+	}
+	if jsonlPath != "" {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, f := range findings {
+			enc.Encode(resultRecord(f.Prefix, false, LookupResult{IP: f.IP, Names: f.Hostnames, Status: StatusFound, Retried: f.Retried, Provenance: f.Provenance}))
+		}
+		if err := writeFileAtomic(jsonlPath, buf.Bytes()); err != nil {
+			fmt.Println(Red+"[!] Failed to write JSONL output:", err, Reset)
+		}
+	}
+	printSummary(stats)
+	fmt.Printf(Green+"[+] %d unique findings from %d prefixes\n"+Reset, len(findings), len(stats))
+}
+
+func runController(args []string) {
+	fs := flag.NewFlagSet("controller", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8090", "address agents connect to")
+	statePath := fs.String("state", "", "file holding the work queue and merged results; an existing one is resumed")
+	var ipFlags stringList
+	fs.Var(&ipFlags, "ip", "IPv4/IPv6 address or CIDR to scan (repeatable)")
+	var asnFlags stringList
+	fs.Var(&asnFlags, "asn", "ASN whose announced IPv4 prefixes to scan (repeatable or comma-separated)")
+	allowReserved := fs.Bool("allow-reserved", false, "keep reserved ranges (loopback, RFC 1918, documentation blocks, ...)")
+	leaseFor := fs.Duration("lease", 2*time.Minute, "how long an agent holds a chunk without renewing it before it is leased again")
+	apiURL := addAPIURLFlag(fs)
+	apiKey := fs.String("api-key", "", "bgpview API key for the higher rate limit (default $"+apiKeyEnv+")")
+	jsonOut := fs.String("o", "", "write a JSON report of the merged results to this file")
+	jsonlPath := fs.String("jsonl", "", "write the merged findings as JSON lines to this file")
+	tlsOpts := addTLSFlags(fs)
+	fs.Parse(args)
+
+	if err := tlsOpts.apply(); err != nil {
+		fmt.Println(Red+"Error:", err, Reset)
+		os.Exit(1)
+	}
+	if err := checkAPIURL(*apiURL); err != nil {
+		fmt.Println(Red+"Error:", err, Reset)
+		os.Exit(1)
+	}
+
+	token := os.Getenv(agentTokenEnv)
+	if token == "" {
+		fmt.Println(Red + "Error: set " + agentTokenEnv + " to the token agents must send." + Reset)
+		os.Exit(1)
+	}
+	if *statePath == "" || *leaseFor <= 0 {
+		fmt.Println(Red + "Error: controller requires -state and a positive -lease." + Reset)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if host, _, err := net.SplitHostPort(*listen); err != nil || !loopbackHost(host) {
+		fmt.Println(Red + "[!] Agents reach the controller over plain HTTP: the token and the findings cross the network unencrypted" + Reset)
+	}
+
+	c := &controller{path: *statePath, token: token, lease: *leaseFor, finished: make(chan struct{})}
+	data, err := os.ReadFile(*statePath)
+	switch {
+	case err == nil:
+		if err := c.load(data); err != nil {
+			fmt.Println(Red+"Error:", err, Reset)
+			os.Exit(1)
+		}
+		done, total := c.pending()
+		fmt.Printf(Purple+"[~] Resuming controller state: %d of %d chunks done\n"+Reset, done, total)
+		if len(ipFlags) > 0 || len(asnFlags) > 0 {
+			fmt.Println(Purple + "[~] Ignoring -ip and -asn, the saved queue is used" + Reset)
+		}
+	case os.IsNotExist(err):
+		var prefixes []string
+		if len(ipFlags) > 0 {
+			targets, ok := parseTargets(ipFlags.String())
+			if !ok {
+				fmt.Println(Red + "Error: -ip expects IP addresses or CIDRs." + Reset)
+				os.Exit(1)
+			}
+			prefixes = targets
+		}
+		if len(asnFlags) > 0 {
+			var asns []int
+			for _, s := range splitOrgTerms(asnFlags) {
+				n, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(s), "AS"))
+				if err != nil {
+					fmt.Printf(Red+"Error: invalid ASN %q\n"+Reset, s)
+					os.Exit(1)
+				}
+				asns = append(asns, n)
+			}
+			api := NewClient()
+			api.BaseURL = *apiURL
+			api.SetAPIKey(cmp.Or(*apiKey, os.Getenv(apiKeyEnv)))
+			ranges, _, _ := rangesForASNs(ctx, api, asns)
+			ranges, _ = filterFamilies(ranges, true, false)
+			prefixes = append(prefixes, ranges...)
+		}
+		if !*allowReserved {
+			prefixes, _ = excludeReserved(prefixes)
+		}
+		prefixes = aggregatePrefixes(prefixes)
+		if len(prefixes) == 0 {
+			fmt.Println(Red + "Error: controller needs -ip or -asn with something left to scan." + Reset)
+			os.Exit(1)
+		}
+		c.state = newControllerState(prefixes)
+		c.save()
+		os.Remove(controllerFindingsPath(*statePath))
+		if c.log, err = openFindingsLog(controllerFindingsPath(*statePath)); err != nil {
+			fmt.Println(Red+"Error:", err, Reset)
+			os.Exit(1)
+		}
+		fmt.Printf(Green+"[+] Queued %d chunks of %d prefixes\n"+Reset, len(c.state.Chunks), len(c.state.Prefixes))
+	default:
+		fmt.Println(Red+"Error reading controller state:", err, Reset)
+		os.Exit(1)
+	}
+	if done, total := c.pending(); done == total {
+		close(c.finished)
+	}
+
+	httpSrv := &http.Server{Addr: *listen, Handler: c, BaseContext: func(net.Listener) context.Context { return ctx }}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-c.finished:
+			// Keep answering 410 for a while so polling agents learn the
+			// scan is over instead of finding the port closed.
+			select {
+			case <-ctx.Done():
+			case <-time.After(2 * agentPoll):
+			}
+		}
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpSrv.Shutdown(shutdown)
+	}()
+
+	fmt.Printf(Green+"[+] Controller listening on %s\n"+Reset, *listen)
+	if err := httpSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Println(Red+"Error serving agents:", err, Reset)
+		os.Exit(1)
+	}
+	select {
+	case <-c.finished:
+		c.writeOutputs(*jsonOut, *jsonlPath)
+	default:
+		fmt.Printf(Red+"\n[!] Interrupted, the queue is saved in %s; run again with the same -state to resume\n"+Reset, *statePath)
+		os.Exit(130)
+	}
+}
+
+// agent leases chunks from a controller, scans them with its own resolver
+// and reports back.
+type agent struct {
+	url         string
+	token       string
+	name        string
+	client      *http.Client
+	sc          *scanner
+	retryPasses int
+}
+
+// call POSTs in as JSON to the controller and decodes a 200 answer into out.
+func (a *agent) call(ctx context.Context, path string, in, out interface{}) (int, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && out != nil {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode, nil
+}
+
+// work scans one leased chunk, renewing the lease while it runs. It returns
+// nil without reporting if the lease was lost or ctx ended.
+func (a *agent) work(ctx context.Context, l ChunkLease) *ChunkResult {
+	base, first, last, err := hostRange(l.Chunk.Prefix)
+	if err != nil {
+		return nil
+	}
+	from := first + l.Chunk.Index*chunkSize
+	to := min(from+chunkSize-1, last)
+
+	scanCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		renewal := time.NewTicker(max(time.Duration(l.Seconds)*time.Second/3, time.Second))
+		defer renewal.Stop()
+		for {
+			select {
+			case <-scanCtx.Done():
+				return
+			case <-renewal.C:
+			}
+			status, err := a.call(scanCtx, fmt.Sprintf("/chunks/%d/renew", l.Chunk.ID), map[string]string{"lease": l.Lease}, nil)
+			if status == http.StatusConflict {
+				fmt.Printf(Red+"[!] Lost the lease of chunk %d, giving it up\n"+Reset, l.Chunk.ID)
+				cancel()
+				return
+			}
+			if err != nil && a.sc.verbose {
+				fmt.Println("[-] Renewing lease failed:", err)
+			}
+		}
+	}()
+
+	res := &ChunkResult{Lease: l.Lease, Agent: a.name, Findings: []FindingRow{}}
+	a.sc.ctx, a.sc.failed = scanCtx, nil
+	a.sc.onResult = func(prefix string, lr LookupResult) {
+		if lr.Status == StatusFound {
+			res.Findings = append(res.Findings, FindingRow{IP: lr.IP, Prefix: prefix, Hostnames: lr.Names, Retried: lr.Retried, Provenance: lr.Provenance})
+		}
+	}
+	ps := newPrefixStats(l.Chunk.Prefix, false)
+	fmt.Printf(Green+"\n[+] Scanning chunk %d: %d IPs of %s\n"+Reset, l.Chunk.ID, to-from+1, l.Chunk.Prefix)
+	if !a.sc.scanChunk(ps, ipsInRange(base, from, to), nil) {
+		return nil
+	}
+	// The chunk is reported once, so its failed lookups get their retry
+	// passes here rather than at the end of a run.
+	if a.retryPasses > 0 && len(a.sc.failed) > 0 {
+		recovered, total := a.sc.retryFailed(a.retryPasses)
+		fmt.Printf(Green+"[+] Retry passes recovered %d of %d failed lookups\n"+Reset, recovered, total)
+		if scanCtx.Err() != nil {
+			return nil
+		}
+	}
+	res.Stats = *ps
+	return res
+}
+
+func runAgent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	controllerURL := fs.String("controller", "", "base URL of the controller (e.g. http://10.0.0.1:8090)")
+	hostname, _ := os.Hostname()
+	name := fs.String("name", hostname, "name the controller knows this agent by")
+	workers := fs.Int("workers", 4, "number of concurrent lookups")
+	qps := fs.Float64("qps", 0, "cap lookups per second (0 for no limit)")
+	resolverFlag := fs.String("resolver", "", "DNS resolver host[:port] to use instead of the system configuration")
+	dnsTransport := fs.String("dns-transport", transportAuto, "how lookups reach the resolver: udp, tcp, or auto")
+	retryPasses := fs.Int("retry-passes", 1, "passes over each chunk's lookups that timed out or hit SERVFAIL before it is reported (0 disables)")
+	verbose := fs.Bool("v", false, "print every lookup outcome, not only found hostnames")
+	tlsOpts := addTLSFlags(fs)
+	fs.Parse(args)
+
+	if err := tlsOpts.apply(); err != nil {
+		fmt.Println(Red+"Error:", err, Reset)
+		os.Exit(1)
+	}
+	token := os.Getenv(agentTokenEnv)
+	if token == "" || *controllerURL == "" {
+		fmt.Println(Red + "Error: agent requires -controller and the " + agentTokenEnv + " token." + Reset)
+		os.Exit(1)
+	}
+	if *workers < 1 {
+		fmt.Println(Red + "Error: -workers must be at least 1." + Reset)
+		os.Exit(1)
+	}
+	if *dnsTransport == transportUDP && *resolverFlag == "" {
+		fmt.Println(Red + "Error: -dns-transport udp requires -resolver." + Reset)
+		os.Exit(1)
+	}
+	if u, err := url.Parse(*controllerURL); err == nil && u.Scheme == "http" && !loopbackHost(u.Hostname()) {
+		fmt.Println(Red + "[!] The controller URL is plain http: the token and the findings cross the network unencrypted" + Reset)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sc := &scanner{ctx: ctx, verbose: *verbose, countries: map[string]int{}, rng: rand.New(rand.NewSource(time.Now().UnixNano())),
+		workers: *workers, hostnames: map[string]bool{}, delay: 100 * time.Millisecond}
+	if *qps > 0 {
+		sc.qps = newTokenBucket(*qps, *qps/10)
+	}
+	if *resolverFlag != "" || *dnsTransport != transportAuto {
+		addr := ""
+		if *resolverFlag != "" {
+			addr = resolverAddress(*resolverFlag)
+		}
+		sc.ptr, sc.resolver, _ = newLookuper(addr, "standard", *dnsTransport, defaultEDNSSize, 0)
+	}
+	a := &agent{url: strings.TrimRight(*controllerURL, "/"), token: token, name: *name, client: newHTTPClient(30 * time.Second), sc: sc,
+		retryPasses: *retryPasses}
+
+	fmt.Printf(Green+"[+] Agent %s working for %s\n"+Reset, a.name, a.url)
+	chunks := 0
+	for ctx.Err() == nil {
+		var l ChunkLease
+		status, err := a.call(ctx, "/lease", map[string]string{"agent": a.name}, &l)
+		switch {
+		case err != nil:
+			if ctx.Err() == nil {
+				fmt.Println(Red+"[!] Controller unreachable:", err, Reset)
+			}
+		case status == http.StatusGone:
+			fmt.Printf(Green+"\n[+] All chunks are done, %d scanned by this agent\n"+Reset, chunks)
+			return
+		case status == http.StatusUnauthorized:
+			fmt.Println(Red + "Error: the controller rejected the token." + Reset)
+			os.Exit(1)
+		case status == http.StatusOK:
+			res := a.work(ctx, l)
+			if res == nil {
+				continue
+			}
+			// A lost result is not fatal: the lease expires and the chunk
+			// is scanned again.
+			for attempt := 0; attempt < 3 && ctx.Err() == nil; attempt++ {
+				status, err = a.call(ctx, fmt.Sprintf("/chunks/%d/result", l.Chunk.ID), res, nil)
+				if err == nil && status == http.StatusOK {
+					chunks++
+					break
+				}
+				if status == http.StatusConflict {
+					fmt.Printf(Red+"[!] Chunk %d was leased again before its result arrived, dropping it\n"+Reset, l.Chunk.ID)
+					break
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(agentPoll):
+				}
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(agentPoll):
+		}
+	}
+	fmt.Println(Red + "\n[!] Interrupted; the current chunk is leased again once its lease expires" + Reset)
+	os.Exit(130)
+}
+
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8080", "address to serve the HTTP API on")
+	dbPath := fs.String("db", "", "results store holding every scan and its findings")
+	jobs := fs.Int("jobs", 2, "number of scans run at the same time; further scans wait in the queue")
+	workers := fs.Int("workers", 1, "default number of concurrent lookups per scan")
+	resolverFlag := fs.String("resolver", "", "DNS resolver host[:port] to use instead of the system configuration")
+	apiURL := addAPIURLFlag(fs)
+	apiKey := fs.String("api-key", "", "bgpview API key for the higher rate limit (default $"+apiKeyEnv+")")
+	cacheDir := fs.String("cache-dir", "", "cache bgpview API responses in this directory")
+	metricsAddr := fs.String("metrics-addr", "", "serve Prometheus metrics on this address (e.g. :9090) at /metrics")
+	tlsOpts := addTLSFlags(fs)
+	fs.Parse(args)
+
+	if err := tlsOpts.apply(); err != nil {
+		fmt.Println(Red+"Error:", err, Reset)
+		os.Exit(1)
+	}
+	if err := checkAPIURL(*apiURL); err != nil {
+		fmt.Println(Red+"Error:", err, Reset)
+		os.Exit(1)
+	}
+	token := os.Getenv(serveTokenEnv)
+	if token == "" {
+		fmt.Println(Red + "Error: set " + serveTokenEnv + " to the token clients must send as \"Authorization: Bearer <token>\"." + Reset)
+		os.Exit(1)
+	}
+	if *dbPath == "" || *jobs < 1 {
+		fmt.Println(Red + "Error: serve requires -db and a positive -jobs." + Reset)
+		os.Exit(1)
+	}
+	store, err := openStore(*dbPath)
+	if err != nil {
+		fmt.Println(Red+"Error opening store:", err, Reset)
+		os.Exit(1)
+	}
+
+	api := NewClient()
+	api.BaseURL = *apiURL
+	api.SetAPIKey(cmp.Or(*apiKey, os.Getenv(apiKeyEnv)))
+	if *cacheDir != "" {
+		api.Cache = &apiCache{dir: *cacheDir, ttl: 24 * time.Hour}
+	}
+	srv := &server{token: token, api: api, resolver: *resolverFlag, workers: *workers, slots: make(chan struct{}, *jobs),
+		store: store, jobs: map[string]*scanJob{}, findingsDir: *dbPath + ".scans"}
+	srv.loadJobs()
+	if *metricsAddr != "" {
+		srv.metrics = newMetrics()
+		srv.metrics.queueDepth = srv.queued
+		api.metrics = srv.metrics
+		if err := serveMetrics(*metricsAddr, srv.metrics); err != nil {
+			fmt.Println(Red+"Error serving metrics:", err, Reset)
+			os.Exit(1)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srv.ctx = ctx
+	httpSrv := &http.Server{Addr: *listen, Handler: srv, BaseContext: func(net.Listener) context.Context { return ctx }}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpSrv.Shutdown(shutdown)
+	}()
+
+	fmt.Printf(Green+"[+] Serving the scan API on %s (%d concurrent scans)\n"+Reset, *listen, *jobs)
+	if err := httpSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Println(Red+"Error serving API:", err, Reset)
+		os.Exit(1)
+	}
+	srv.running.Wait()
+}
+
+// BenchStep is one rate a resolver was driven at by the bench subcommand.
+type BenchStep struct {
+	Rate     float64 `json:"target_qps"`
+	Sent     int     `json:"queries"`
+	QPS      float64 `json:"achieved_qps"`
+	P50      float64 `json:"p50_ms"`
+	P95      float64 `json:"p95_ms"`
+	P99      float64 `json:"p99_ms"`
+	Found    int     `json:"found"`
+	Empty    int     `json:"nxdomain"`
+	Errors   int     `json:"errors"`
+	ErrorPct float64 `json:"error_pct"`
+}
+
+// BenchResult sums up a resolver: the best rate it kept up with inside the
+// error budget, and the first rate where errors went over it (0 if none).
+type BenchResult struct {
+	Resolver    string      `json:"resolver"`
+	Steps       []BenchStep `json:"steps"`
+	Sustainable float64     `json:"sustainable_qps"`
+	Knee        float64     `json:"error_knee_qps,omitempty"`
+	Saturated   bool        `json:"saturated,omitempty"`
+}
+
+// benchKeepUp is the share of the target rate a step must achieve to count
+// as sustained.
+const benchKeepUp = 0.9
+
+// benchEmptyNets hold the documentation ranges, which have no PTR records,
+// so their queries are answered NXDOMAIN. Picking addresses at random keeps
+// most of them out of the resolver's cache.
+var benchEmptyNets = []string{"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24"}
+
+// benchStep sends n PTR queries through ptr paced at rate, alternating
+// between found addresses and random empty ones, and measures the answers.
+func benchStep(ctx context.Context, ptr PTRLookuper, rate float64, n, workers int, found []string, rng *rand.Rand) BenchStep {
+	ips := make([]string, n)
+	for i := range ips {
+		if i%2 == 0 && len(found) > 0 {
+			ips[i] = found[i/2%len(found)]
+			continue
+		}
+		_, ipnet, _ := net.ParseCIDR(benchEmptyNets[rng.Intn(len(benchEmptyNets))])
+		ip := slices.Clone(ipnet.IP.To4())
+		ip[3] = byte(1 + rng.Intn(254))
+		ips[i] = ip.String()
+	}
+
+	// Paced like a scan with -qps.
+	bucket := newTokenBucket(rate, rate/10)
+	jobs := make(chan string)
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		step      = BenchStep{Rate: rate}
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range jobs {
+				t := time.Now()
+				res := lookupWith(ctx, ptr, ip)
+				took := time.Since(t)
+				if ctx.Err() != nil {
+					continue
+				}
+				mu.Lock()
+				latencies = append(latencies, took)
+				step.Sent++
+				switch res.Status {
+				case StatusFound:
+					step.Found++
+				case StatusNXDomain:
+					step.Empty++
+				default:
+					step.Errors++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, ip := range ips {
+		if bucket.Wait(ctx) != nil {
+			break
+		}
+		jobs <- ip
+	}
+	close(jobs)
+	wg.Wait()
+
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		step.QPS = float64(step.Sent) / elapsed
+	}
+	if step.Sent > 0 {
+		step.ErrorPct = 100 * float64(step.Errors) / float64(step.Sent)
+		slices.Sort(latencies)
+		pct := func(p float64) float64 {
+			i := int(math.Ceil(p*float64(len(latencies)))) - 1
+			return float64(latencies[max(i, 0)]) / float64(time.Millisecond)
+		}
+		step.P50, step.P95, step.P99 = pct(0.50), pct(0.95), pct(0.99)
+	}
+	return step
+}
+
+// printConflicts lists the addresses claimed by more than one ASN.
+func printConflicts(conflicts []Conflict) {
+	if len(conflicts) == 0 {
+		return
+	}
+	fmt.Printf(Red+"\n[!] %d addresses fall in overlapping prefixes of different ASNs:\n"+Reset, len(conflicts))
+	for _, c := range conflicts {
+		fmt.Printf("%s in %s (%s), kept %s\n", c.IP, strings.Join(c.Prefixes, ", "), asnList(c.ASNs), c.Prefix)
+	}
+}
+
+// printRecordConflicts lists where merged reports disagreed.
+func printRecordConflicts(conflicts []RecordConflict) {
+	if len(conflicts) == 0 {
+		return
+	}
+	fmt.Printf(Purple+"\n[~] %d records differ between the reports, kept the fresher:\n"+Reset, len(conflicts))
+	for _, c := range conflicts {
+		fmt.Printf("%s: %q as of %s over %q as of %s\n", c.Record, c.Kept, asOfLabel(c.KeptAsOf), c.Dropped, asOfLabel(c.DroppedAsOf))
+	}
+}
+
+// runMerge combines the JSON reports (-o) of several runs into one report,
+// with hostnames, prefixes and ASNs deduplicated as in a single run.
+func runMerge(args []string) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	jsonOut := fs.String("o", "", "write the merged JSON report to this file")
+	reportMD := fs.String("report", "", "write a markdown report of the merged results to this file")
+	reportHTML := fs.String("report-html", "", "write a self-contained HTML report of the merged results to this file")
+	jsonlPath := fs.String("jsonl", "", "write the merged findings as JSON lines to this file")
+	sortBy := fs.String("sort", sortIP, "order of the merged findings: ip or hostname")
+	fs.Parse(args)
+
+	if fs.NArg() < 2 || *jsonOut == "" && *reportMD == "" && *reportHTML == "" && *jsonlPath == "" {
+		fmt.Println(Red + "Usage: go run asn-lookup.go merge [-o merged.json] [-report merged.md] [-report-html merged.html] [-jsonl merged.jsonl] report.json report.json..." + Reset)
+		os.Exit(1)
+	}
+	var reps []*Report
+	for _, path := range fs.Args() {
+		rep, err := readReport(path)
+		if err != nil {
+			fmt.Println(Red+"Error reading report:", err, Reset)
+			os.Exit(1)
+		}
+		reps = append(reps, rep)
+	}
+	if *sortBy != sortIP && *sortBy != sortHostname {
+		fmt.Println(Red + "Error: -sort must be ip or hostname." + Reset)
+		os.Exit(1)
+	}
+	merged := mergeReports(reps)
+	sortReport(merged, *sortBy)
+
+	if *jsonOut != "" {
+		if err := writeJSONReport(*jsonOut, merged); err != nil {
+			fmt.Println(Red+"[!] Failed to write JSON report:", err, Reset)
+		}
+	}
+	if *reportMD != "" {
+		if err := writeMarkdownReport(*reportMD, merged); err != nil {
+			fmt.Println(Red+"[!] Failed to write markdown report:", err, Reset)
+		}
+	}
+	if *reportHTML != "" {
+		if err := writeHTMLReport(*reportHTML, merged); err != nil {
+			fmt.Println(Red+"[!] Failed to write HTML report:", err, Reset)
+		}
+	}
+	if *jsonlPath != "" {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, f := range merged.Findings {
+			rec := resultRecord(f.Prefix, false, LookupResult{IP: f.IP, Names: f.Hostnames, Status: StatusFound, Retried: f.Retried, Confidence: f.Confidence, Provenance: f.Provenance})
+			rec.Country, rec.City = f.Country, f.City
+			enc.Encode(rec)
+		}
+		if err := writeFileAtomic(*jsonlPath, buf.Bytes()); err != nil {
+			fmt.Println(Red+"[!] Failed to write JSONL output:", err, Reset)
+		}
+	}
+	printConflicts(merged.Conflicts)
+	printRecordConflicts(merged.RecordConflicts)
+	fmt.Printf(Green+"[+] Merged %d reports: %d prefixes, %d unique findings"+Reset, len(reps), len(merged.Prefixes), len(merged.Findings))
+	if len(merged.Hosts) > 0 {
+		fmt.Printf(Green+", %d hostnames across %d ASNs"+Reset, len(merged.Hosts), len(merged.ByASN))
+	}
+	fmt.Println()
+}
+
+// runBench ramps each resolver through the -rates steps until it stops
+// keeping up or goes over the error budget. Queries take the same lookup
+// path as a scan in the chosen -dns-mode.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	var resolvers stringList
+	fs.Var(&resolvers, "resolver", "resolver host[:port] to benchmark (repeatable or comma-separated)")
+	ratesFlag := fs.String("rates", "50,100,200,400,800,1600", "comma-separated queries per second to try, in order")
+	queries := fs.Int("queries", 500, "queries sent at each rate")
+	workers := fs.Int("workers", 100, "concurrent queries in flight at most")
+	maxErrors := fs.Float64("max-errors", 1, "error percentage a rate may reach and still count as sustained")
+	foundFlag := fs.String("found", healthPTR+",8.8.8.8,9.9.9.9", "comma-separated addresses known to have PTR records; the other half of the queries go to documentation ranges without any")
+	dnsMode := fs.String("dns-mode", "standard", "PTR lookup path: standard, pipelined or raw")
+	dnsTransport := fs.String("dns-transport", transportAuto, "how lookups reach the resolver: udp, tcp, or auto")
+	ednsSize := fs.Int("edns-size", defaultEDNSSize, "UDP payload size advertised with EDNS0 in -dns-mode raw")
+	dnsConns := fs.Int("dns-conns", 2, "TCP connections to open in pipelined mode")
+	jsonPath := fs.String("json", "", "also write the results as JSON to this file")
+	dnsProxy := fs.String("dns-proxy", "", "send the queries through this SOCKS5 proxy, socks5://[user:password@]host:port")
+	fs.Parse(args)
+
+	var servers []string
+	for _, v := range resolvers {
+		for _, server := range strings.Split(v, ",") {
+			if server = strings.TrimSpace(server); server != "" {
+				servers = append(servers, resolverAddress(server))
+			}
+		}
+	}
+	var rates []float64
+	for _, v := range strings.Split(*ratesFlag, ",") {
+		rate, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || rate <= 0 {
+			fmt.Printf(Red+"Error: -rates: %q is not a positive rate.\n"+Reset, v)
+			os.Exit(1)
+		}
+		rates = append(rates, rate)
+	}
+	var found []string
+	for _, v := range strings.Split(*foundFlag, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			found = append(found, v)
+		}
+	}
+	if len(servers) == 0 || *queries < 1 || *workers < 1 {
+		fmt.Println(Red + "Error: bench requires -resolver, and positive -queries and -workers." + Reset)
+		os.Exit(1)
+	}
+	if *dnsProxy != "" {
+		transport, err := useDNSProxy(context.Background(), *dnsProxy, *dnsTransport)
+		if err != nil {
+			fmt.Println(Red+"Error: -dns-proxy:", err, Reset)
+			os.Exit(1)
+		}
+		*dnsTransport = transport
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var results []BenchResult
+	for _, server := range servers {
+		ptr, _, err := newLookuper(server, *dnsMode, *dnsTransport, *ednsSize, *dnsConns)
+		if err != nil {
+			fmt.Printf(Red+"[!] Skipping %s: %v\n"+Reset, server, err)
+			continue
+		}
+		res := BenchResult{Resolver: server}
+		fmt.Printf(Purple+"\n[~] Benchmarking %s\n"+Reset, server)
+		for _, rate := range rates {
+			step := benchStep(ctx, ptr, rate, *queries, *workers, found, rng)
+			if ctx.Err() != nil {
+				break
+			}
+			res.Steps = append(res.Steps, step)
+			fmt.Printf("[~] %g q/s: %.1f achieved, p50 %.1fms, p99 %.1fms, %.1f%% errors\n", rate, step.QPS, step.P50, step.P99, step.ErrorPct)
+			if step.ErrorPct > *maxErrors {
+				res.Knee = rate
+				break
+			}
+			if step.QPS < rate*benchKeepUp {
+				res.Saturated = true
+				break
+			}
+			res.Sustainable = max(res.Sustainable, step.QPS)
+		}
+		results = append(results, res)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	printBench(results)
+	if *jsonPath != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err == nil {
+			err = writeFileAtomic(*jsonPath, append(data, '\n'))
+		}
+		if err != nil {
+			fmt.Println(Red+"[!] Failed to write JSON results:", err, Reset)
+		}
+	}
+	if ctx.Err() != nil {
+		fmt.Println(Red + "\n[!] Interrupted" + Reset)
+		os.Exit(130)
+	}
+}
+
+func printBench(results []BenchResult) {
+	if len(results) == 0 {
+		return
+	}
+	fmt.Println(Green + "\n[+] Resolver benchmark" + Reset)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESOLVER\tTARGET Q/S\tACHIEVED\tP50 MS\tP95 MS\tP99 MS\tERRORS")
+	for _, r := range results {
+		for _, st := range r.Steps {
+			fmt.Fprintf(tw, "%s\t%g\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f%%\n", r.Resolver, st.Rate, st.QPS, st.P50, st.P95, st.P99, st.ErrorPct)
+		}
+	}
+	tw.Flush()
+
+	fmt.Println(Green + "\n[+] Sustainable rates" + Reset)
+	for _, r := range results {
+		line := fmt.Sprintf("%s: %.0f q/s sustained", r.Resolver, r.Sustainable)
+		switch {
+		case r.Knee > 0:
+			line += fmt.Sprintf(", errors over budget at %g q/s", r.Knee)
+		case r.Saturated:
+			line += ", stopped keeping up before errors rose"
+		default:
+			line += ", no limit reached at the rates tried"
+		}
+		fmt.Println(line)
+	}
+}
+
+const (
+	// exitDeadline is the exit status of a run cut short by -max-runtime.
+	exitDeadline = 3
+	// exitNoSelection is the exit status when -asn-filter selects nothing.
+	exitNoSelection = 4
+)
+
+// exitIfStopped ends a run whose context is done with the matching status;
+// note describes what was left unfinished.
+func exitIfStopped(ctx context.Context, note string) {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		fmt.Println(Red + "\n[!] Deadline reached" + note + Reset)
+		flushOutputs()
+		finishManifest(runDeadline)
+		os.Exit(exitDeadline)
+	case ctx.Err() != nil:
+		fmt.Println(Red + "\n[!] Interrupted" + note + Reset)
+		flushOutputs()
+		finishManifest(runInterrupted)
+		os.Exit(130)
+	}
+}
+
+func main() {
+	defer flushOnPanic()
+
+	if len(os.Args) > 1 && os.Args[1] == "db" {
+		runDB(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		runServe(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "controller" {
+		runController(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		runAgent(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "merge" {
+		runMerge(os.Args[2:])
+		return
+	}
+
+	verbose := flag.Bool("v", false, "print every lookup outcome, not only found hostnames")
+	jsonlPath := flag.String("jsonl", "", "write one JSON record per looked-up IP to this file (same as -output jsonl:FILE)")
+	outputFormat := flag.String("output-format", "", "write records to stdout in this format, e.g. dnsx or dnsx-json (same as -output FORMAT:-)")
+	socketPath := flag.String("socket", "", "stream each finding as a JSON line to the collector on this unix socket")
+	socketListen := flag.Bool("socket-listen", false, "with -socket, listen on the socket for a collector instead of connecting to one")
+	var outputSpecs stringList
+	flag.Var(&outputSpecs, "output", "write records as format:path, format jsonl, csv, txt, dnsx, dnsx-json or cef, path - for stdout (repeatable)")
+	var ipFlags stringList
+	flag.Var(&ipFlags, "ip", "IPv4/IPv6 address or CIDR to reverse-resolve instead of searching an organization (repeatable)")
+	var orgFlags stringList
+	flag.Var(&orgFlags, "org", "organization to search for, or the name to store -ip results under (repeatable or comma-separated to search several brand names at once)")
+	orgFile := flag.String("org-file", "", "resolve the organizations in this file (one per line) concurrently and scan the prefixes of all their ASNs, without prompting")
+	dbPath := flag.String("db", "", "persist results per organization in this store file")
+	var skipWithin ageFlag
+	flag.Var(&skipWithin, "skip-scanned-within", "with -db, skip prefixes fully scanned within this long (e.g. 7d, 36h)")
+	force := flag.Bool("force", false, "scan every prefix, overriding -skip-scanned-within")
+	watch := flag.Bool("watch", false, "keep re-scanning the selected prefixes and report changes (requires -db)")
+	interval := flag.Duration("interval", 12*time.Hour, "time between watch cycles, jittered by ±10%")
+	eventsPath := flag.String("events", "", "append watch change events as JSON lines to this file")
+	webhook := flag.String("webhook", "", "POST watch change events as JSON to this URL")
+	syslogTarget := flag.String("syslog", "", "send scan events and findings as RFC 5424 messages to udp://host[:port], tcp://host[:port] or unix:///path")
+	syslogFacility := flag.String("syslog-facility", "user", "syslog facility, e.g. user, daemon or local0-local7")
+	syslogRate := flag.Int("syslog-rate", 100, "most syslog messages sent per second, the rest are dropped (0 for no cap)")
+	geoDBPath := flag.String("geoip-db", "", "annotate findings with country and city from this GeoLite2 mmdb file")
+	sample := flag.Int("sample", 0, "only look up this many randomly chosen addresses per prefix")
+	seed := flag.Int64("seed", 0, "random seed for -sample and -shuffle-prefixes (default: time based)")
+	fullScanTop := flag.Int("full-scan-top", 0, "after sampling, scan the N prefixes with the best hit rate exhaustively")
+	resolverFlag := flag.String("resolver", "", "DNS resolver host[:port] to use instead of the system configuration")
+	var fallbackFlags stringList
+	flag.Var(&fallbackFlags, "fallback-resolver", "resolvers to shift lookups to, in order, while the primary keeps failing (repeatable or comma-separated)")
+	skipHealthcheck := flag.Bool("skip-healthcheck", false, "do not check the resolvers with known-good queries before scanning (e.g. air-gapped networks)")
+	dnsTransport := flag.String("dns-transport", transportAuto, "how lookups reach the resolver: udp, tcp, or auto (UDP, retried over TCP when truncated)")
+	dnsMode := flag.String("dns-mode", "standard", "PTR lookup path: standard, pipelined (persistent TCP to -resolver) or raw (own UDP queries to -resolver, with EDNS0)")
+	dnsProxy := flag.String("dns-proxy", "", "send all DNS traffic through this SOCKS5 proxy, socks5://[user:password@]host:port (requires -resolver; TCP only if the proxy does not relay UDP)")
+	ednsSize := flag.Int("edns-size", defaultEDNSSize, "UDP payload size advertised with EDNS0 in -dns-mode raw (0 sends no OPT record)")
+	dnsConns := flag.Int("dns-conns", 2, "TCP connections to open in pipelined mode")
+	workers := flag.Int("workers", 1, "number of concurrent lookups")
+	cacheSize := flag.Int("dns-cache", 100000, "keep up to this many PTR results in memory so repeated addresses are not queried again (0 disables)")
+	negativeTTL := flag.Duration("negative-ttl", time.Hour, "keep NXDOMAIN answers this long, across runs with -cache-dir (0 disables)")
+	noCache := flag.Bool("no-cache", false, "query every address, ignoring cached and negative-cached PTR results")
+	shardFlag := flag.String("shard", "", "scan only share K/N of the address space (e.g. 2/5), so N machines each running one shard cover it exactly once")
+	shufflePrefixes := flag.Bool("shuffle-prefixes", false, "scan prefixes in random order so partial runs cover a representative slice")
+	checkpointPath := flag.String("checkpoint", "", "record progress in this file and resume from it if it exists")
+	var hostnameRegexes stringList
+	flag.Var(&hostnameRegexes, "hostname-regex", "only show findings whose hostname matches this pattern (repeatable, OR-ed)")
+	invertRegex := flag.Bool("hostname-regex-invert", false, "hide findings matching -hostname-regex instead of showing only them")
+	var hostnameSuffixes stringList
+	flag.Var(&hostnameSuffixes, "hostname-suffix", "only show findings with a hostname at or under this domain (repeatable)")
+	hideGeneric := flag.Bool("hide-generic", false, "hide findings whose hostnames all look provider-generated (e.g. 203-0-113-7.dsl.example.net)")
+	hidePools := flag.Bool("hide-pools", false, "hide findings tagged access-pool by the pool ruleset")
+	poolRulesPath := flag.String("pool-rules", "", "file of access-pool rules added to the built-in ones, one \"kind pattern\" per line (kind substring, prefix, suffix or regex, !kind to allowlist)")
+	exportSubs := flag.String("export-subs", "", "write the deduplicated hostname list (subfinder/amass format) to this file")
+	importSubs := flag.String("import-subs", "", "merge a subfinder/amass hostname list into the findings")
+	bannerSpec := flag.String("banners", "", "grab the banners TCP services on these ports (e.g. 21,22,25,110) send to hosts with findings")
+	bannerBytes := flag.Int("banner-bytes", 256, "read at most this many bytes of each banner")
+	probeSMTPFlag := flag.Bool("probe-smtp", false, "read the EHLO reply of hosts whose PTR looks like a mail server (mx, mail, smtp), then QUIT")
+	probeSMTPAll := flag.Bool("probe-smtp-all", false, "like -probe-smtp, for every host with a finding")
+	pivotFlag := flag.Bool("pivot", false, "trace discovered apex domains back to ASNs outside the scan and list them as related organizations (never scanned)")
+	pivotMin := flag.Int("pivot-min", 3, "with -pivot, only pivot on apex domains with at least this many hostnames")
+	resolveAll := flag.Bool("resolve-all", false, "forward-resolve every discovered hostname and report addresses the sweep did not find")
+	enrichDNS := flag.Bool("enrich-dns", false, "look up MX and NS records of every discovered apex domain")
+	enrichSPF := flag.Bool("enrich-spf", false, "with -enrich-dns, also follow SPF include: and ip4:/ip6: entries")
+	jsonOut := flag.String("o", "", "write a JSON report with per-prefix statistics and findings to this file")
+	reportMD := flag.String("report", "", "write a markdown report to this file")
+	reportHTML := flag.String("report-html", "", "write a self-contained HTML report to this file")
+	exportDOT := flag.String("export-dot", "", "write the org/ASN/prefix/hostname graph to this Graphviz DOT file")
+	sortBy := flag.String("sort", sortIP, "order of the findings in reports written at the end of the run: ip or hostname (streamed output keeps discovery order)")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics on this address (e.g. :9090) at /metrics, for long -watch runs")
+	statusFile := flag.String("status-file", "", "append the progress snapshots taken on SIGUSR1 (or -snapshot-trigger) to this file")
+	snapshotTrigger := flag.String("snapshot-trigger", "", "take a progress snapshot whenever this file is created, then remove it (for platforms without SIGUSR1)")
+	manifestPath := flag.String("manifest", "", "write the run's flags, scope, resolvers, times and output checksums to this JSON file")
+	dotApex := flag.Bool("dot-collapse-apex", false, "with -export-dot, draw one node per apex domain instead of per hostname")
+	dotMaxHosts := flag.Int("dot-max-hosts", 50, "with -export-dot, maximum hostname nodes per prefix (0 for no limit)")
+	exportBurp := flag.String("export-burp", "", "write a Burp Suite target scope (JSON) of the discovered hostnames and scanned prefixes to this file")
+	exportZAP := flag.String("export-zap", "", "write an OWASP ZAP context (XML) of the discovered hostnames and scanned IPv4 prefixes to this file")
+	exportHTTP := flag.String("export-http", "", "write host:port targets for httpx or aquatone to this file: each hostname with the -banners ports open on its address, or bare hostnames without -banners")
+	scopeWildcard := flag.Int("scope-wildcard", 0, "with -export-burp or -export-zap, replace the hostnames of an apex domain with one wildcard entry once it has this many (0 never does)")
+	quiet := flag.Bool("quiet", false, "do not print the live status line or the per-prefix statistics table")
+	deaggregate := flag.Int("deaggregate", 0, "split IPv4 prefixes larger than this length (e.g. 20) into chunks and choose which to scan")
+	chunkLen := flag.Int("chunk-len", 24, "prefix length of the chunks produced by -deaggregate")
+	chunkSample := flag.Int("chunk-sample", 0, "with -deaggregate, sample this many addresses per chunk before choosing")
+	chunksSpec := flag.String("chunks", "", "with -deaggregate, select chunks non-interactively (e.g. 10-20,45 or all)")
+	ripestatURL := flag.String("ripestat-url", defaultRIPEstatURL, "base URL of the RIPEstat data API")
+	abuse := flag.Bool("abuse", false, "look up abuse contacts (RIPEstat) for the selected ASNs and announced prefixes")
+	source := flag.String("source", "auto", "where routing data comes from: auto (bgpview, failing over to RIPEstat when it errors), bgpview, ripestat, or whois (organizations looked up in WHOIS only); searches that find nothing fall back to WHOIS")
+	whoisDomain := flag.String("whois-domain", "", "the organization's main domain, for WHOIS discovery (default: the search term when it is a domain)")
+	whoisServer := flag.String("whois-server", defaultWhoisServer, "WHOIS server discovery starts from")
+	peeringDB := flag.Bool("peeringdb", false, "also offer the ASNs of matching PeeringDB organizations, marked as such")
+	peeringDBURL := flag.String("peeringdb-url", defaultPeeringDBURL, "base URL of the PeeringDB API")
+	lookingGlass := flag.Bool("lg", false, "ask the RIPEstat looking glass how many RIS peers currently see each announced prefix")
+	verifyOwner := flag.Bool("verify-ownership", false, "compare each prefix's RDAP registrant with the announcing ASN's organization and flag mismatches")
+	routingHistory := flag.Bool("history", false, "look up when each announced prefix was first announced by its origin and by whom before (RIPEstat)")
+	historyMax := flag.Int("history-max", 100, "with -history, query at most this many prefixes")
+	rpkiCheck := flag.Bool("rpki", false, "look up the RPKI origin validation status of each announced prefix (RIPEstat)")
+	rpkiValidator := flag.String("rpki-validator", "", "with -rpki, ask this Routinator HTTP API (e.g. http://localhost:8323) instead of RIPEstat")
+	scanV4 := flag.Bool("4", false, "scan IPv4 prefixes (the default for ASN lookups; combine with -6 for both)")
+	scanV6 := flag.Bool("6", false, "scan IPv6 prefixes; large ones are only probed with -sample")
+	allowReserved := flag.Bool("allow-reserved", false, "scan private, CGNAT, documentation and other reserved ranges instead of excluding them (lab use)")
+	zoneInfo := flag.Bool("zone-info", false, "look up the NS and SOA of the reverse zones covering each scanned prefix")
+	probeZones := flag.Bool("probe-zones", true, "ask for the SOA of each /24 (IPv6 /120) reverse zone before sweeping it and skip its addresses if the zone does not exist; disable for PTRs published without a proper delegation")
+	tryAXFR := flag.Bool("try-axfr", false, "try a zone transfer of each reverse zone before sweeping it address by address")
+	score := flag.Bool("score", false, "score each finding 0-100 from forward confirmation, org domain match, wildcard zones and generic-PTR heuristics")
+	minConfidence := flag.Int("min-confidence", 0, "hide findings scoring below this (implies -score)")
+	qps := flag.Float64("qps", 0, "cap the global DNS query rate at this many queries per second across all workers (replaces the per-lookup delay)")
+	retryPasses := flag.Int("retry-passes", 1, "end-of-run passes over lookups that timed out or hit SERVFAIL (0 disables)")
+	apiURL := addAPIURLFlag(flag.CommandLine)
+	apiKey := flag.String("api-key", "", "bgpview API key for the higher rate limit (default $"+apiKeyEnv+")")
+	apiTimeout := flag.Duration("api-timeout", 30*time.Second, "timeout for each API request and watch webhook delivery")
+	tlsOpts := addTLSFlags(flag.CommandLine)
+	cacheDir := flag.String("cache-dir", "", "cache bgpview API responses in this directory and revalidate them with conditional requests")
+	cacheTTL := flag.Duration("cache-ttl", 24*time.Hour, "with -cache-dir, use cached responses younger than this without revalidating")
+	offline := flag.Bool("offline", false, "serve every API request from -cache-dir, whatever its age, and never contact the data sources")
+	prefixTimeout := flag.Duration("prefix-timeout", 0, "abandon a prefix that takes longer than this (e.g. 30m) and move on; a later run with -checkpoint scans it again")
+	maxRuntime := flag.Duration("max-runtime", 0, "stop cleanly once the run has taken this long (e.g. 4h), exiting with status 3")
+	asnNameFilter := flag.String("asn-name-filter", "", "only offer search results whose name or description contains this text")
+	var asnCountries, prefixCountryFlags stringList
+	flag.Var(&asnCountries, "country", "only keep search results of ASNs registered in this country code (repeatable)")
+	flag.Var(&prefixCountryFlags, "prefix-country", "only scan prefixes located in this country code, per -geoip-db or else RDAP (repeatable)")
+	countryPrecedence := flag.String("country-precedence", "prefix", "when an ASN matches -country but its prefix is located elsewhere: prefix drops the prefix, asn keeps it")
+	rdapURL := flag.String("rdap-url", defaultRDAPURL, "base URL of the RDAP service used by -prefix-country")
+	asnFilter := flag.String("asn-filter", "", "select every search result whose name or description contains this text, without prompting")
+	asnFilterRegex := flag.String("asn-filter-regex", "", "select every search result whose name or description matches this case-insensitive regexp, without prompting")
+	prefixFilter := flag.String("prefix-filter", "", "only scan announced prefixes whose name or description contains this text")
+	prefixFilterRegex := flag.String("prefix-filter-regex", "", "only scan announced prefixes whose name or description matches this case-insensitive regexp")
+	prefixesSpec := flag.String("prefixes", "", "scan only these announced prefixes, by their number in the listing (e.g. 1,4-9 or all), without the menu")
+	var prefixPicks stringList
+	flag.Var(&prefixPicks, "prefix", "scan only this announced prefix, or part of one (repeatable)")
+	prefixExclude := flag.String("prefix-exclude", "", "leave out announced prefixes whose name or description contains this text (e.g. customer)")
+	asSet := flag.String("as-set", "", "expand this IRR AS-SET (e.g. AS-EXAMPLE) and scan all member ASNs")
+	irrServer := flag.String("irr-server", defaultIRRServer, "IRR whois server used for -as-set")
+	asSetDepth := flag.Int("as-set-depth", 5, "maximum nesting depth followed when expanding -as-set")
+	asSetMax := flag.Int("as-set-max", 500, "maximum number of member ASNs taken from -as-set")
+	includeDownstreams := flag.Bool("include-downstreams", false, "offer the downstream customer ASNs of the selected ones, with their total size, and add them on confirmation")
+	downstreamMax := flag.Int("downstream-depth", 1, "with -include-downstreams, how many levels of downstreams to follow")
+	flag.Parse()
+
+	filter, err := newHostnameFilter(hostnameRegexes, *invertRegex)
+	if err != nil {
+		fmt.Println(Red+"Error:", err, Reset)
+		os.Exit(1)
+	}
+	if err := tlsOpts.apply(); err != nil {
+		fmt.Println(Red+"Error:", err, Reset)
+		os.Exit(1)
+	}
+	if err := checkAPIURL(*apiURL); err != nil {
+		fmt.Println(Red+"Error:", err, Reset)
+		os.Exit(1)
+	}
+
+	if *sortBy != sortIP && *sortBy != sortHostname {
+		fmt.Println(Red + "Error: -sort must be ip or hostname." + Reset)
+		os.Exit(1)
+	}
+	if *orgFile != "" && (len(orgFlags) > 0 || len(ipFlags) > 0 || *asSet != "") {
+		fmt.Println(Red + "Error: -org-file cannot be combined with -org, -ip or -as-set." + Reset)
+		os.Exit(1)
+	}
+	if *includeDownstreams && (*orgFile != "" || len(ipFlags) > 0 || *asSet != "") {
+		fmt.Println(Red + "Error: -include-downstreams works with an organization search only, not with -org-file, -ip or -as-set." + Reset)
+		os.Exit(1)
+	}
+	pools, err := loadPoolRules(*poolRulesPath)
+	if err != nil {
+		fmt.Println(Red+"Error: -pool-rules:", err, Reset)
+		os.Exit(1)
+	}
+	if *dnsMode != "standard" && *dnsMode != "pipelined" && *dnsMode != "raw" {
+		fmt.Println(Red + "Error: -dns-mode must be standard, pipelined or raw." + Reset)
+		os.Exit(1)
+	}
+	switch *dnsTransport {
+	case transportAuto, transportUDP, transportTCP:
+	default:
+		fmt.Println(Red + "Error: -dns-transport must be udp, tcp or auto." + Reset)
+		os.Exit(1)
+	}
+	if *dnsMode != "standard" && *resolverFlag == "" {
+		fmt.Printf(Red+"Error: -dns-mode %s requires -resolver.\n"+Reset, *dnsMode)
+		os.Exit(1)
+	}
+	if *dnsTransport == transportUDP && *resolverFlag == "" {
+		fmt.Println(Red + "Error: -dns-transport udp requires -resolver." + Reset)
+		os.Exit(1)
+	}
+	if *dnsProxy != "" {
+		if *resolverFlag == "" {
+			fmt.Println(Red + "Error: -dns-proxy requires -resolver." + Reset)
+			os.Exit(1)
+		}
+		transport, err := useDNSProxy(context.Background(), *dnsProxy, *dnsTransport)
+		if err != nil {
+			fmt.Println(Red+"Error: -dns-proxy:", err, Reset)
+			os.Exit(1)
+		}
+		// Lookups outside the scan (WHOIS leads, API host names) must not
+		// leave through the local resolver either.
+		*dnsTransport = transport
+		net.DefaultResolver = customResolver(resolverAddress(*resolverFlag), transport)
+	}
+	var fallbacks []string
+	for _, v := range fallbackFlags {
+		for _, server := range strings.Split(v, ",") {
+			if server = strings.TrimSpace(server); server != "" {
+				fallbacks = append(fallbacks, server)
+			}
+		}
+	}
+	for _, server := range append([]string{*resolverFlag}, fallbacks...) {
+		if server == "" {
+			continue
+		}
+		_, port, err := net.SplitHostPort(resolverAddress(server))
+		if n, perr := strconv.Atoi(port); err != nil || perr != nil || n < 1 || n > 65535 {
+			fmt.Println(Red+"Error: resolvers must be host or host:port, got", server, Reset)
+			os.Exit(1)
+		}
+	}
+	var bannerPorts []int
+	if *bannerSpec != "" {
+		var err error
+		if bannerPorts, err = parsePorts(*bannerSpec); err != nil {
+			fmt.Println(Red+"Error: -banners:", err, Reset)
+			os.Exit(1)
+		}
+	}
+	if *bannerBytes < 1 {
+		fmt.Println(Red + "Error: -banner-bytes must be positive." + Reset)
+		os.Exit(1)
+	}
+	if *ednsSize < 0 || *ednsSize > 65535 {
+		fmt.Println(Red + "Error: -edns-size must be between 0 and 65535." + Reset)
+		os.Exit(1)
+	}
+
+	if *watch && *dbPath == "" {
+		fmt.Println(Red + "Error: -watch requires -db to keep its baseline in." + Reset)
+		os.Exit(1)
+	}
+	if *source != "auto" && *source != "bgpview" && *source != "ripestat" && *source != "whois" {
+		fmt.Println(Red + "Error: -source must be auto, bgpview, ripestat or whois." + Reset)
+		os.Exit(1)
+	}
+	downstreamDepth := 0
+	if *includeDownstreams {
+		if *downstreamMax < 1 {
+			fmt.Println(Red + "Error: -downstream-depth must be at least 1." + Reset)
+			os.Exit(1)
+		}
+		downstreamDepth = *downstreamMax
+	}
+	if *offline {
+		switch {
+		case *cacheDir == "":
+			fmt.Println(Red + "Error: -offline needs the -cache-dir of an earlier online run." + Reset)
+			os.Exit(1)
+		case *source == "whois" || *asSet != "":
+			fmt.Println(Red + "Error: -offline cannot be combined with -source whois or -as-set, which query WHOIS and IRR servers live." + Reset)
+			os.Exit(1)
+		}
+	}
+	var shard shardSpec
+	if *shardFlag != "" {
+		var err error
+		if shard, err = parseShard(*shardFlag); err != nil {
+			fmt.Println(Red+"Error:", err, Reset)
+			os.Exit(1)
+		}
+	}
+	var sysw *syslogWriter
+	if *syslogTarget != "" {
+		var err error
+		if sysw, err = newSyslogWriter(*syslogTarget, *syslogFacility, *syslogRate); err != nil {
+			fmt.Println(Red+"Error: -syslog:", err, Reset)
+			os.Exit(1)
+		}
+	}
+	if *countryPrecedence != "prefix" && *countryPrecedence != "asn" {
+		fmt.Println(Red + "Error: -country-precedence must be prefix or asn." + Reset)
+		os.Exit(1)
+	}
+	var pick *asnPicker
+	if *asnFilter != "" || *asnFilterRegex != "" {
+		pick = &asnPicker{substr: *asnFilter}
+		if *asnFilterRegex != "" {
+			if pick.re, err = regexp.Compile("(?i)" + *asnFilterRegex); err != nil {
+				fmt.Println(Red+"Error: invalid -asn-filter-regex:", err, Reset)
+				os.Exit(1)
+			}
+		}
+	}
+	var prefixPick *prefixPicker
+	if *prefixFilter != "" || *prefixFilterRegex != "" || *prefixExclude != "" {
+		prefixPick = &prefixPicker{substr: *prefixFilter, exclude: *prefixExclude}
+		if *prefixFilterRegex != "" {
+			if prefixPick.re, err = regexp.Compile("(?i)" + *prefixFilterRegex); err != nil {
+				fmt.Println(Red+"Error: invalid -prefix-filter-regex:", err, Reset)
+				os.Exit(1)
+			}
+		}
+	}
+	api := NewClient()
+	api.BaseURL, api.HTTPClient.Timeout = *apiURL, *apiTimeout
+	api.SetAPIKey(cmp.Or(*apiKey, os.Getenv(apiKeyEnv)))
+	if *cacheDir != "" {
+		api.Cache = &apiCache{dir: *cacheDir, ttl: *cacheTTL, offline: *offline}
+	}
+	var reg *metrics
+	if *metricsAddr != "" {
+		reg = newMetrics()
+		api.metrics = reg
+	}
+	ripestat := newRIPEstatClient(api, *ripestatURL)
+	ripestat.metrics = reg
+	switch *source {
+	case "ripestat":
+		api.SetProviders(*verbose, ripestat.ripestatProvider())
+	case "auto", "whois":
+		api.SetProviders(*verbose, api.bgpviewProvider(), ripestat.ripestatProvider())
+	}
+	var pdb *Client
+	if *peeringDB {
+		pdb = newRIPEstatClient(api, *peeringDBURL)
+	}
+
+	// Ctrl-C or SIGTERM cancels the run: no new lookups are started, and
+	// outputs and the summary are still written. A second signal kills it.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	if *maxRuntime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *maxRuntime)
+		defer cancel()
+	}
+
+	printBanner()
+	if !*skipHealthcheck {
+		servers := []string{*resolverFlag}
+		if *resolverFlag == "" {
+			servers = systemResolvers()
+		}
+		healthy := servers
+		if servers[0] != "system" {
+			healthy = healthyResolvers(ctx, servers, *dnsTransport)
+		}
+		if len(fallbacks) > 0 {
+			fallbacks = healthyResolvers(ctx, fallbacks, *dnsTransport)
+		}
+		switch {
+		case len(healthy) == 0 && len(fallbacks) == 0:
+			fmt.Println(Red + "Error: no working DNS resolver, every lookup would fail (use -skip-healthcheck if this is expected)." + Reset)
+			os.Exit(1)
+		case len(healthy) == 0:
+			*resolverFlag, fallbacks = fallbacks[0], fallbacks[1:]
+			fmt.Printf(Purple+"[~] Dropping unhealthy resolvers, using %s\n"+Reset, resolverAddress(*resolverFlag))
+		case len(healthy) < len(servers):
+			// Pin the scan to a resolver that answered instead of letting
+			// the system configuration keep trying the broken ones.
+			*resolverFlag = healthy[0]
+			fmt.Printf(Purple+"[~] Dropping unhealthy resolvers, using %s\n"+Reset, resolverAddress(healthy[0]))
+		}
+	}
+
+	var out *fanout
+	if *jsonlPath != "" {
+		outputSpecs = append(outputSpecs, "jsonl:"+*jsonlPath)
+	}
+	if *outputFormat != "" {
+		outputSpecs = append(outputSpecs, *outputFormat+":-")
+	}
+	if *socketPath != "" {
+		format := "socket"
+		if *socketListen {
+			format = "socket-listen"
+		}
+		outputSpecs = append(outputSpecs, format+":"+*socketPath)
+	}
+	if len(outputSpecs) > 0 {
+		var err error
+		if out, err = openOutputs(outputSpecs); err != nil {
+			fmt.Println(Red+"Error creating output:", err, Reset)
+			os.Exit(1)
+		}
+		defer out.Close()
+	}
+
+	if *manifestPath != "" {
+		m := newManifest(*manifestPath, flag.CommandLine)
+		m.DataSource = []string{api.BaseURL}
+		switch *source {
+		case "ripestat":
+			m.DataSource = []string{*ripestatURL}
+		case "auto", "whois":
+			m.DataSource = append(m.DataSource, *ripestatURL)
+		}
+		if *asSet != "" {
+			m.DataSource = append(m.DataSource, "irr "+*irrServer)
+		}
+		m.Resolvers = systemResolvers()
+		if *resolverFlag != "" {
+			m.Resolvers = []string{resolverAddress(*resolverFlag)}
+		}
+		for _, spec := range outputSpecs {
+			if format, path, _ := strings.Cut(spec, ":"); path != "-" && !strings.HasPrefix(format, "socket") {
+				m.outputPaths = append(m.outputPaths, path)
+			}
+		}
+		for _, path := range []string{*jsonOut, *reportMD, *reportHTML, *exportDOT, *exportSubs, *eventsPath, *checkpointPath} {
+			if path != "" {
+				m.outputPaths = append(m.outputPaths, path)
+			}
+		}
+		startManifest(m)
+	}
+
+	var (
+		ipRanges  []string
+		orgTerms  = splitOrgTerms(orgFlags)
+		orgName   string
+		selected  []ASN
+		prefixASN = map[string]int{}
+		// prefixMeta holds bgpview's name, description and country of
+		// each announced prefix.
+		prefixMeta = map[string]Prefix{}
+		explicit   bool
+	)
+	out.SetASNs(func(prefix string) int { return prefixASN[prefix] })
+	// scopePaths holds the path of each ASN -include-downstreams added.
+	scopePaths := map[int][]int{}
+	out.SetScope(func(prefix string) []int { return scopePaths[prefixASN[prefix]] })
+	if len(orgTerms) > 0 {
+		orgName = orgTerms[0]
+	}
+	if len(ipFlags) > 0 {
+		targets, ok := parseTargets(ipFlags.String())
+		if !ok {
+			fmt.Println(Red + "Error: -ip expects IP addresses or CIDRs." + Reset)
+			os.Exit(1)
+		}
+		ipRanges, explicit = targets, true
+	} else if *asSet != "" {
+		irr, err := dialIRR(ctx, *irrServer)
+		if err != nil {
+			fmt.Println(Red+"Error connecting to IRR server:", err, Reset)
+			os.Exit(1)
+		}
+		members, err := expandASSet(irr.Query, *asSet, *asSetDepth, *asSetMax)
+		expanded := retrievedFrom(sourceIRR)
+		irr.Close()
+		if err != nil {
+			fmt.Println(Red+"Error expanding AS-SET:", err, Reset)
+			os.Exit(1)
+		}
+		if len(members) == 0 {
+			fmt.Printf(Red+"No member ASNs found in %s\n"+Reset, *asSet)
+			os.Exit(0)
+		}
+
+		fmt.Printf(Green+"\n[+] %s expands to %d ASNs\n"+Reset, *asSet, len(members))
+		for _, n := range members {
+			selected = append(selected, ASN{Number: n, Provenance: expanded})
+		}
+		ipRanges, prefixASN, prefixMeta = rangesForASNs(ctx, api, members)
+		if orgName == "" {
+			orgName = *asSet
+		}
+	} else if *orgFile != "" {
+		orgs, err := readOrgFile(*orgFile)
+		if err != nil {
+			fmt.Println(Red+"Error: -org-file:", err, Reset)
+			os.Exit(1)
+		}
+		if len(orgs) == 0 {
+			fmt.Printf(Red+"Error: no organizations in %s\n"+Reset, *orgFile)
+			os.Exit(1)
+		}
+		fmt.Printf(Green+"\n[+] Resolving %d organizations\n"+Reset, len(orgs))
+		results, err := ResolveOrgs(ctx, orgs, Options{Client: api, Progress: func(org string, res OrgResult, done, total int) {
+			if res.Err != nil {
+				fmt.Printf(Red+"[!] (%d/%d) %s: %v\n"+Reset, done, total, org, res.Err)
+				return
+			}
+			fmt.Printf(Green+"[+] (%d/%d) %s: %d ASNs, %d prefixes\n"+Reset, done, total, org, len(res.ASNs), len(res.Prefixes))
+		}})
+		if err != nil {
+			fmt.Println(Red+"Error:", err, Reset)
+			os.Exit(1)
+		}
+		for _, org := range orgs {
+			// A failed organization may have found some of its ASNs
+			// already; scanning only those would pass for a full result.
+			res := results[org]
+			if res.Err != nil {
+				continue
+			}
+			for _, asn := range res.ASNs {
+				if !slices.ContainsFunc(selected, func(a ASN) bool { return a.Number == asn.Number }) {
+					selected = append(selected, asn)
+				}
+			}
+			for _, p := range res.Prefixes {
+				if _, dup := prefixASN[p.CIDR]; !dup {
+					prefixASN[p.CIDR], prefixMeta[p.CIDR] = res.Origin[p.CIDR], p
+					ipRanges = append(ipRanges, p.CIDR)
+				}
+			}
+		}
+		ipRanges = aggregatePrefixes(ipRanges)
+		if len(ipRanges) == 0 {
+			fmt.Println(Red + "No prefixes found for any organization in -org-file." + Reset)
+			os.Exit(0)
+		}
+		orgTerms, orgName = orgs, strings.Join(orgs, ", ")
+	} else {
+		input := strings.Join(orgFlags, ",")
+		if input == "" {
+			input = mustPrompt(Blue + "Enter domain, company name(s), IP or CIDR: " + Reset)
+			orgTerms = splitOrgTerms([]string{input})
+		}
+
+		if len(orgTerms) == 0 {
+			fmt.Println(Red + "Error: Please enter a valid organization name." + Reset)
+			os.Exit(1)
+		}
+
+		if targets, ok := parseTargets(input); ok {
+			if downstreamDepth > 0 {
+				fmt.Println(Red + "Error: -include-downstreams works with an organization search only, not with addresses." + Reset)
+				os.Exit(1)
+			}
+			ipRanges, explicit = targets, true
+			orgName = ""
+		} else {
+			orgName = orgTerms[0]
+			whois := whoisSource{server: *whoisServer, domain: *whoisDomain, only: *source == "whois", offline: *offline}
+			if whois.domain == "" && strings.Contains(orgName, ".") && !strings.ContainsAny(orgName, " /") {
+				whois.domain = strings.ToLower(orgName)
+			}
+			if whois.only && whois.domain == "" {
+				fmt.Println(Red + "Error: -source whois needs the organization's domain, as the search term or with -whois-domain." + Reset)
+				os.Exit(1)
+			}
+			selected, ipRanges, prefixASN, prefixMeta = selectASNRanges(ctx, api, orgTerms, *asnNameFilter, countrySet(asnCountries), pick, pdb, whois, downstreamDepth)
+			for _, asn := range selected {
+				if asn.ScopePath != nil {
+					scopePaths[asn.Number] = asn.ScopePath
+				}
+			}
+		}
+	}
+
+	// Without -4 or -6 only the IPv4 side of an ASN is scanned; addresses
+	// given on the command line are taken as they are.
+	if *scanV4 || *scanV6 || !explicit {
+		var dropped map[string]int
+		ipRanges, dropped = filterFamilies(ipRanges, *scanV4 || !*scanV6, *scanV6)
+		for _, f := range []string{"ipv4", "ipv6"} {
+			if n := dropped[f]; n > 0 {
+				fmt.Printf(Purple+"[~] Leaving out %s (use -%c to scan them)\n"+Reset, familyCount(n, f), f[3])
+			}
+		}
+		if len(ipRanges) == 0 {
+			fmt.Println(Red + "Nothing left to scan in the selected address families." + Reset)
+			os.Exit(0)
+		}
+	}
+
+	if prefixPick != nil {
+		var kept []string
+		var removed uint64
+		for _, p := range ipRanges {
+			if prefixPick.match(prefixMeta[p]) {
+				kept = append(kept, p)
+				continue
+			}
+			size, _ := prefixSize(p)
+			removed += size
+			if *verbose {
+				fmt.Printf(Purple+"[~] Leaving out %s (%s)\n"+Reset, p, cmp.Or(prefixMeta[p].About(), "no description"))
+			}
+		}
+		fmt.Printf(Purple+"[~] Prefix filters removed %d of %d prefixes (%d addresses)\n"+Reset, len(ipRanges)-len(kept), len(ipRanges), removed)
+		ipRanges = kept
+		if len(ipRanges) == 0 {
+			fmt.Println(Red + "Nothing left to scan after the prefix filters." + Reset)
+			os.Exit(0)
+		}
+	}
+
+	// The prefix menu follows an interactive ASN choice. A checkpoint that
+	// recorded a selection of these prefixes is resumed with it instead.
+	var (
+		selection string
+		chosen    []string
+	)
+	if !explicit {
+		var saved []string
+		if cp, err := loadCheckpoint(*checkpointPath); *checkpointPath != "" && err == nil && len(cp.Selection) > 0 && len(prefixPicks) == 0 && *prefixesSpec == "" {
+			nets := parseNets(ipRanges)
+			saved = cp.Selection
+			for _, p := range saved {
+				if ip, _, err := net.ParseCIDR(p); err != nil || containingPrefix(ip, nets) == "" {
+					saved = nil
+					break
+				}
+			}
+		}
+		if saved != nil {
+			fmt.Printf(Purple+"\n[~] Using the selection of %d prefixes recorded in the checkpoint\n"+Reset, len(saved))
+			ipRanges, selection = saved, strings.Join(saved, ",")
+		} else {
+			picked, spec, err := selectPrefixes(ipRanges, prefixMeta, *prefixesSpec, prefixPicks, pick == nil && *asSet == "" && len(ipRanges) > 1)
+			if err != nil {
+				fmt.Println(Red+"Error: invalid prefix selection:", err, Reset)
+				os.Exit(1)
+			}
+			ipRanges, selection = picked, spec
+		}
+		if selection != "" {
+			chosen = ipRanges
+		}
+	}
+
+	var geo *geoIP
+	if *geoDBPath != "" {
+		var err error
+		if geo, err = newGeoIP(*geoDBPath); err != nil {
+			fmt.Println(Red+"[!] GeoIP database unavailable, continuing without it:", err, Reset)
+		}
+	}
+
+	if want := countrySet(prefixCountryFlags); len(want) > 0 {
+		byASN := countrySet(asnCountries)
+		inCountryASN := map[int]bool{}
+		for _, asn := range selected {
+			inCountryASN[asn.Number] = byASN[strings.ToUpper(asn.CountryCode)]
+		}
+		located := prefixCountries(ctx, geo, newRIPEstatClient(api, *rdapURL), ipRanges)
+		var kept []string
+		var excludedN, unknown, overridden int
+		for _, p := range ipRanges {
+			cc := located[p]
+			switch {
+			case cc == "":
+				unknown++
+			case want[cc]:
+			case *countryPrecedence == "asn" && inCountryASN[prefixASN[p]]:
+				overridden++
+			default:
+				excludedN++
+				if *verbose {
+					fmt.Printf(Purple+"[~] Leaving out %s: located in %s\n"+Reset, p, cc)
+				}
+				continue
+			}
+			kept = append(kept, p)
+		}
+		note := fmt.Sprintf("-prefix-country kept %d of %d prefixes, excluded %d", len(kept), len(ipRanges), excludedN)
+		if unknown > 0 {
+			note += fmt.Sprintf(", kept %d of unknown location", unknown)
+		}
+		if overridden > 0 {
+			note += fmt.Sprintf(", kept %d located elsewhere as their ASN matches -country", overridden)
+		}
+		fmt.Println(Purple + "[~] " + note + Reset)
+		ipRanges = kept
+		if len(ipRanges) == 0 {
+			fmt.Println(Red + "Nothing left to scan in the selected countries." + Reset)
+			os.Exit(0)
+		}
+	}
+
+	// RPKI and looking-glass data describe the announced prefixes, before
+	// they are trimmed or deaggregated.
+	announced := parseNets(ipRanges)
+	var rpki map[string]string
+	if *rpkiCheck || *rpkiValidator != "" {
+		validate := newRIPEstatClient(api, *ripestatURL).RIPEstatRPKI
+		if *rpkiValidator != "" {
+			validate = newRIPEstatClient(api, *rpkiValidator).RoutinatorRPKI
+		}
+		rpki = validateOrigins(ctx, validate, ipRanges, prefixASN)
+	}
+	var visibility map[string]*Visibility
+	if *lookingGlass {
+		visibility = checkVisibility(ctx, newRIPEstatClient(api, *ripestatURL), ipRanges)
+	}
+	var ownership map[string]*Ownership
+	if *verifyOwner {
+		ownership = verifyOwnership(ctx, newRIPEstatClient(api, *rdapURL), ipRanges, prefixASN, selected, orgTerms)
+	}
+	var history map[string]*History
+	if *routingHistory {
+		history = prefixHistory(ctx, newRIPEstatClient(api, *ripestatURL), ipRanges, prefixASN, *historyMax)
+	}
+	var (
+		abuseBy  map[string][]string
+		contacts []AbuseContact
+	)
+	if *abuse {
+		var asns []int
+		for _, p := range ipRanges {
+			if n := prefixASN[p]; n != 0 {
+				asns = append(asns, n)
+			}
+		}
+		abuseBy, contacts = findAbuseContacts(ctx, newRIPEstatClient(api, *ripestatURL), asns, ipRanges)
+		if contacts == nil {
+			contacts = []AbuseContact{}
+		}
+	}
+
+	var excluded []Exclusion
+	if !*allowReserved {
+		parents := parseNets(ipRanges)
+		ipRanges, excluded = excludeReserved(ipRanges)
+		for _, ex := range excluded {
+			if ex.Skipped {
+				fmt.Printf(Red+"[!] Skipping %s: %s is reserved (%s)\n"+Reset, ex.Prefix, ex.Reserved, ex.Purpose)
+			} else {
+				fmt.Printf(Red+"[!] Excluding %s from %s: reserved (%s)\n"+Reset, ex.Reserved, ex.Prefix, ex.Purpose)
+			}
+		}
+		for _, p := range ipRanges {
+			if _, ok := prefixASN[p]; !ok {
+				ip, _, _ := net.ParseCIDR(p)
+				prefixASN[p] = prefixASN[containingPrefix(ip, parents)]
+			}
+		}
+		if len(ipRanges) == 0 {
+			fmt.Println(Red + "Nothing left to scan: every prefix is reserved space (use -allow-reserved for lab networks)." + Reset)
+			os.Exit(0)
+		}
+	}
+
+	var (
+		store      *Store
+		asnNums    []int
+		asnRecords []ASNRow
+		scanTime   = time.Now()
+	)
+	for _, asn := range selected {
+		asnNums = append(asnNums, asn.Number)
+		asnRecords = append(asnRecords, ASNRow{ASN: asn.Number, Name: asn.Name, CountryCode: asn.CountryCode, Provenance: asn.Provenance})
+	}
+	if *dbPath != "" && orgName != "" {
+		var err error
+		if store, err = openStore(*dbPath); err != nil {
+			fmt.Println(Red+"Error opening store:", err, Reset)
+			os.Exit(1)
+		}
+		err = store.TouchOrg(orgName, scanTime)
+		for _, asn := range selected {
+			if err == nil {
+				err = store.TouchASN(orgName, asn.Number, asn.Name, scanTime)
+			}
+		}
+		if err != nil {
+			fmt.Println(Red+"Error updating store:", err, Reset)
+			os.Exit(1)
+		}
+	}
+	if skipWithin > 0 && store == nil {
+		fmt.Println(Red + "Error: -skip-scanned-within needs -db and an organization name." + Reset)
+		os.Exit(1)
+	}
+	if *watch && store == nil {
+		fmt.Println(Red + "Error: -watch needs an organization name to keep its baseline under (use -org with -ip)." + Reset)
+		os.Exit(1)
+	}
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	sc := &scanner{ctx: ctx, verbose: *verbose, out: out, countries: map[string]int{}, sample: *sample, rng: rand.New(rand.NewSource(*seed)), workers: *workers, filter: filter,
+		hostnames: map[string]bool{}, patterns: newPatternCounter(), shard: shard, prefixTimeout: *prefixTimeout, delay: 100 * time.Millisecond, metrics: reg}
+	if *qps > 0 {
+		sc.qps = newTokenBucket(*qps, *qps/10)
+	}
+	if *resolveAll {
+		sc.looked = map[string]LookupStatus{}
+	}
+	if reg != nil {
+		reg.queueDepth = sc.queued.Load
+		if err := serveMetrics(*metricsAddr, reg); err != nil {
+			fmt.Println(Red+"Error serving metrics:", err, Reset)
+			os.Exit(1)
+		}
+	}
+	sc.tryAXFR = *tryAXFR
+	sc.lookupZones = *zoneInfo
+	if *probeZones {
+		server := *resolverFlag
+		if server == "" {
+			server = systemResolvers()[0]
+		}
+		if server != "system" {
+			sc.zoneProbe = &rawResolver{addr: resolverAddress(server), transport: *dnsTransport, timeout: 5 * time.Second}
+		}
+	}
+	var negativePath string
+	if *cacheSize > 0 && !*noCache {
+		sc.cache = newResultCache(*cacheSize, *negativeTTL)
+		if *cacheDir != "" && *negativeTTL > 0 {
+			negativePath = filepath.Join(*cacheDir, negativeCacheFile)
+			if err := sc.cache.LoadNegative(negativePath); err != nil {
+				fmt.Println(Red+"[!] Ignoring unreadable negative cache:", err, Reset)
+			}
+		}
+	}
+	if *resolverFlag != "" || *dnsTransport != transportAuto {
+		addr := ""
+		if *resolverFlag != "" {
+			addr = resolverAddress(*resolverFlag)
+		}
+		ptr, r, err := newLookuper(addr, *dnsMode, *dnsTransport, *ednsSize, *dnsConns)
+		if err != nil {
+			fmt.Println(Red+"[!] Pipelined DNS unavailable, falling back to standard lookups:", err, Reset)
+		}
+		sc.resolver, sc.ptr = r, ptr
+	}
+	var chain *resolverChain
+	if len(fallbacks) > 0 {
+		chain = newResolverChain()
+		name, ptr := "system resolver", sc.ptr
+		if *resolverFlag != "" {
+			name = resolverAddress(*resolverFlag)
+		}
+		if ptr == nil {
+			ptr = net.DefaultResolver
+		}
+		chain.Add(name, ptr)
+		for _, server := range fallbacks {
+			addr := resolverAddress(server)
+			var ptr PTRLookuper = customResolver(addr, *dnsTransport)
+			if *dnsMode == "raw" || *dnsTransport == transportUDP {
+				ptr = &rawResolver{addr: addr, transport: *dnsTransport, ednsSize: uint16(*ednsSize), timeout: 5 * time.Second}
+			}
+			chain.Add(addr, ptr)
+		}
+		sc.ptr = chain
+	}
+	if len(hostnameSuffixes) > 0 {
+		sc.processors = append(sc.processors, suffixProcessor(hostnameSuffixes))
+	}
+	if *hideGeneric {
+		sc.processors = append(sc.processors, genericPTRProcessor())
+	}
+	sc.processors = append(sc.processors, poolTagger{pools})
+	if *hidePools {
+		sc.processors = append(sc.processors, poolProcessor())
+	}
+	if filter != nil {
+		sc.processors = append(sc.processors, regexProcessor(filter))
+	}
+	if *score || *minConfidence > 0 {
+		if *minConfidence > 0 {
+			sc.processors = append(sc.processors, confidenceProcessor(*minConfidence))
+		}
+		sc.scorer = newScorer(sc.dnsResolver(), orgName, sc.throttle)
+	}
+	sc.geo = geo
+
+	if *deaggregate > 0 {
+		parents := parseNets(ipRanges)
+		ipRanges = sc.selectChunks(ipRanges, *deaggregate, *chunkLen, *chunkSample, *chunksSpec)
+		for _, chunk := range ipRanges {
+			if _, ok := prefixASN[chunk]; !ok {
+				ip, _, _ := net.ParseCIDR(chunk)
+				prefixASN[chunk] = prefixASN[containingPrefix(ip, parents)]
+			}
+		}
+	}
+
+	updateManifest(func(m *Manifest) {
+		m.Org, m.ASNs, m.Prefixes, m.Shard, m.Selection = orgName, asnNums, ipRanges, sc.shard.String(), selection
+	})
+
+	if *watch {
+		w := &watcher{sc: sc, store: store, org: orgName, prefixes: ipRanges, interval: *interval, webhook: *webhook, timeout: *apiTimeout}
+		if *eventsPath != "" {
+			f, err := openOutput(*eventsPath, true)
+			if err != nil {
+				fmt.Println(Red+"Error opening events file:", err, Reset)
+				os.Exit(1)
+			}
+			defer f.Close()
+			w.events = json.NewEncoder(f)
+		}
+		w.run()
+		flushOutputs()
+		exitIfStopped(ctx, "")
+		finishManifest(runCompleted)
+		return
+	}
+
+	var doneHooks []func(ps *PrefixStats)
+	sc.onPrefixDone = func(ps *PrefixStats) {
+		for _, h := range doneHooks {
+			h(ps)
+		}
+	}
+
+	if sysw != nil {
+		// Addresses given with -ip have no known ASN.
+		prefixParams := func(prefix string) []string {
+			if asn := prefixASN[prefix]; asn != 0 {
+				return []string{"asn", strconv.Itoa(asn), "prefix", prefix}
+			}
+			return []string{"prefix", prefix}
+		}
+		doneHooks = append(doneHooks, func(ps *PrefixStats) {
+			sysw.Send(syslogInfo, "prefix-done", fmt.Sprintf("%s scanned: %d IPs, %d found", ps.Prefix, ps.Total, ps.Counts[StatusFound]), prefixParams(ps.Prefix)...)
+		})
+		sc.onDeliver = func(f Finding) {
+			params := append(prefixParams(f.Prefix), "ip", f.IP)
+			for _, name := range f.Hostnames {
+				params = append(params, "hostname", name)
+			}
+			sysw.Send(syslogNotice, "finding", fmt.Sprintf("%s -> %s", f.IP, strings.Join(f.Hostnames, ", ")), params...)
+		}
+	}
+
+	if store != nil {
+		sc.onResult = func(prefix string, res LookupResult) {
+			if res.Status != StatusFound {
+				return
+			}
+			if err := store.TouchHost(orgName, prefix, res, time.Now()); err != nil {
+				fmt.Println(Red+"[!] Failed to store", res.IP+":", err, Reset)
+			}
+		}
+		doneHooks = append(doneHooks, func(ps *PrefixStats) {
+			err := store.TouchPrefix(orgName, ps.Prefix, prefixASN[ps.Prefix], time.Now())
+			if err == nil && !ps.Sampled && sc.shard.Count <= 1 {
+				err = store.MarkScanned(orgName, ps.Prefix, time.Now())
+			}
+			if err != nil {
+				fmt.Println(Red+"[!] Failed to store", ps.Prefix+":", err, Reset)
+			}
+			if err := store.Save(); err != nil {
+				fmt.Println(Red+"[!] Failed to save store:", err, Reset)
+			}
+		})
+	}
+
+	var cp *Checkpoint
+	if *checkpointPath != "" {
+		var err error
+		cp, err = loadCheckpoint(*checkpointPath)
+		switch {
+		case err == nil && cp.covers(ipRanges):
+			ipRanges, sc.resume = cp.Remaining(), cp.Current
+			fmt.Printf(Purple+"\n[~] Resuming from checkpoint: %d of %d prefixes left\n"+Reset, len(ipRanges), len(cp.Prefixes))
+			sc.requeue(cp)
+		case err == nil:
+			fmt.Println(Red + "[!] Checkpoint was written for a different prefix set, starting over." + Reset)
+			cp = nil
+		case !os.IsNotExist(err):
+			fmt.Println(Red+"[!] Ignoring unreadable checkpoint:", err, Reset)
+		}
+	}
+	if cp == nil && *shufflePrefixes {
+		rand.New(rand.NewSource(*seed)).Shuffle(len(ipRanges), func(i, j int) {
+			ipRanges[i], ipRanges[j] = ipRanges[j], ipRanges[i]
+		})
+		fmt.Printf(Purple+"\n[~] Prefix order shuffled (seed %d)\n"+Reset, *seed)
+	}
+	if cp == nil && *checkpointPath != "" {
+		cp = &Checkpoint{path: *checkpointPath, Prefixes: ipRanges, Completed: []string{}, Shuffled: *shufflePrefixes, Selection: chosen}
+		if *shufflePrefixes {
+			cp.Seed = *seed
+		}
+		if err := cp.Save(); err != nil {
+			fmt.Println(Red+"[!] Failed to write checkpoint:", err, Reset)
+		}
+	}
+	if cp != nil {
+		doneHooks = append(doneHooks, func(ps *PrefixStats) {
+			if ps.Sampled {
+				return
+			}
+			cp.MarkDone(ps)
+			cp.Failed = sc.failedLookups()
+			if err := cp.Save(); err != nil {
+				fmt.Println(Red+"[!] Failed to write checkpoint:", err, Reset)
+			}
+		})
+		sc.onChunkDone = func(ps *PrefixStats, done uint64) {
+			cp.MarkChunk(ps, done)
+			cp.Failed = sc.failedLookups()
+			if err := cp.Save(); err != nil {
+				fmt.Println(Red+"[!] Failed to write checkpoint:", err, Reset)
+			}
+		}
+	}
+
+	var skipped []string
+	if skipWithin > 0 && !*force {
+		var fresh []string
+		for _, p := range ipRanges {
+			at, err := store.LastScanned(orgName, p)
+			if err == nil && at != nil && time.Since(*at) < time.Duration(skipWithin) {
+				skipped = append(skipped, fmt.Sprintf("%s: last fully scanned %s (%s ago)", p, at.Format(time.RFC3339), time.Since(*at).Round(time.Second)))
+				continue
+			}
+			fresh = append(fresh, p)
+		}
+		if len(skipped) > 0 {
+			fmt.Printf(Purple+"\n[~] Skipping %d of %d prefixes fully scanned within %s (-force to rescan)\n"+Reset, len(skipped), len(ipRanges), &skipWithin)
+		}
+		ipRanges = fresh
+	}
+
+	if sc.sample > 0 {
+		fmt.Printf(Purple+"\n[~] Sampling %d addresses per prefix (seed %d)...\n"+Reset, sc.sample, *seed)
+	} else {
+		fmt.Printf(Purple + "\n[~] Starting reverse DNS lookups for all IPs in found ranges...\n" + Reset)
+	}
+	fmt.Printf(Purple+"[~] %s\n"+Reset, familySummary(ipRanges, sc.sample))
+	time.Sleep(1 * time.Second)
+
+	sc.started, sc.planned = time.Now(), sc.shard.planned(ipRanges, sc.sample)
+	if sc.resume != nil {
+		sc.planned -= int64(sc.resume.Done)
+	}
+	restoreTerminal := sc.watchKeyboard()
+	defer restoreTerminal()
+	stopSnapshots := sc.watchSnapshots(*statusFile, *snapshotTrigger)
+	defer stopSnapshots()
+	// Records written to stdout would be cut into by the status line.
+	stopStatus := func() {}
+	if !*quiet && !slices.ContainsFunc(outputSpecs, func(spec string) bool { return strings.HasSuffix(spec, ":-") }) {
+		stopStatus = sc.startStatus()
+	}
+	defer stopStatus()
+
+	var stats []*PrefixStats
+	if cp != nil {
+		stats = cp.CompletedStats()
+	}
+	if sysw != nil {
+		msg := fmt.Sprintf("Scan of %d prefixes started", len(ipRanges))
+		if orgName != "" {
+			msg += " for " + orgName
+		}
+		sysw.Send(syslogInfo, "scan-start", msg)
+	}
+	findings, errs := sc.Run(ctx, ipRanges)
+	for f := range findings {
+		sc.findings = append(sc.findings, f)
+	}
+	for err := range errs {
+		if ctx.Err() == nil || !errors.Is(err, ctx.Err()) {
+			fmt.Println(Red+"[!]", err, Reset)
+		}
+	}
+	stats = append(stats, sc.Stats()...)
+	ranked := rankBySampledHitRate(stats)
+	if *fullScanTop > 0 && len(ranked) > 0 && !sc.stopped() {
+		var top []string
+		for _, ps := range ranked {
+			if len(top) == *fullScanTop || ps.Counts[StatusFound] == 0 {
+				break
+			}
+			top = append(top, ps.Prefix)
+		}
+		fmt.Printf(Purple+"\n[~] Scanning the top %d sampled prefixes exhaustively...\n"+Reset, len(top))
+		sc.sample = 0
+		stats = append(stats, sc.scan(top)...)
+	}
+
+	if *retryPasses > 0 && len(sc.failed) > 0 {
+		recovered, total := sc.retryFailed(*retryPasses)
+		fmt.Printf(Green+"[+] Retry passes recovered %d of %d failed lookups\n"+Reset, recovered, total)
+		if cp != nil {
+			cp.Failed = sc.failedLookups()
+			if err := cp.Save(); err != nil {
+				fmt.Println(Red+"[!] Failed to write checkpoint:", err, Reset)
+			}
+		}
+	}
+	stopStatus()
+	if negativePath != "" {
+		if err := sc.cache.SaveNegative(negativePath); err != nil {
+			fmt.Println(Red+"[!] Failed to save negative cache:", err, Reset)
+		}
+	}
+
+	if len(bannerPorts) > 0 && len(sc.findings) > 0 && !sc.stopped() {
+		sc.grabBanners(bannerPorts, *bannerBytes)
+	}
+	if (*probeSMTPFlag || *probeSMTPAll) && len(sc.findings) > 0 && !sc.stopped() {
+		sc.probeMailHosts(*probeSMTPAll)
+	}
+	if *resolveAll {
+		sc.resolveAll(api, ipRanges)
+	}
+	var pivots []PivotLead
+	if *pivotFlag && !sc.stopped() {
+		scanned := map[int]bool{}
+		for _, n := range asnNums {
+			scanned[n] = true
+		}
+		for _, n := range prefixASN {
+			scanned[n] = true
+		}
+		pivots = sc.pivot(api, scanned, ipRanges, *pivotMin)
+	}
+	if *importSubs != "" {
+		hosts, err := readSubs(*importSubs)
+		if err != nil {
+			fmt.Println(Red+"[!] Failed to read imported hostnames:", err, Reset)
+		} else {
+			sc.mergeImported(hosts, ipRanges)
+		}
+	}
+	var dnsInfra []DNSInfraRow
+	if *enrichDNS {
+		dnsInfra = sc.enrichDNS(apexDomains(sc.hostnames), ipRanges, *enrichSPF)
+	}
+	if *exportSubs != "" {
+		if err := writeSubs(*exportSubs, sc.hostnames); err != nil {
+			fmt.Println(Red+"[!] Failed to write hostname list:", err, Reset)
+		} else {
+			fmt.Printf(Green+"\n[+] Wrote %d hostnames to %s\n"+Reset, len(sc.hostnames), *exportSubs)
+		}
+	}
+
+	rows := statsTable(stats)
+	for i := range rows {
+		rows[i].ASN = prefixASN[rows[i].Prefix]
+		parent := announcedPrefix(rows[i].Prefix, announced)
+		rows[i].RPKI, rows[i].Visibility, rows[i].Abuse = rpki[parent], visibility[parent], abuseBy[parent]
+		rows[i].History, rows[i].Ownership = history[parent], ownership[parent]
+		meta := prefixMeta[parent]
+		rows[i].Name, rows[i].Description, rows[i].CountryCode = meta.Name, meta.Description, meta.CountryCode
+		rows[i].Provenance = meta.Provenance
+	}
+	patterns := sc.patterns.Top(patternTop)
+	for i := range sc.findings {
+		sc.findings[i].ScopePath = scopePaths[prefixASN[sc.findings[i].Prefix]]
+	}
+	rep := &Report{Org: orgName, ASNs: asnNums, ASNRecords: asnRecords, StartedAt: scanTime, FinishedAt: time.Now(), Prefixes: rows, Findings: sc.findings, Excluded: excluded, Contacts: contacts,
+		ResolverEvents: chain.Events(), Patterns: patterns, Pivots: pivots, DNSInfra: dnsInfra}
+	consolidate(rep)
+	sortReport(rep, *sortBy)
+	printConflicts(rep.Conflicts)
+	if *jsonOut != "" {
+		if err := writeJSONReport(*jsonOut, rep); err != nil {
+			fmt.Println(Red+"[!] Failed to write JSON report:", err, Reset)
+		}
+	}
+	if *reportMD != "" {
+		if err := writeMarkdownReport(*reportMD, rep); err != nil {
+			fmt.Println(Red+"[!] Failed to write markdown report:", err, Reset)
+		}
+	}
+	if *reportHTML != "" {
+		if err := writeHTMLReport(*reportHTML, rep); err != nil {
+			fmt.Println(Red+"[!] Failed to write HTML report:", err, Reset)
+		}
+	}
+	if *exportDOT != "" {
+		if err := writeDOT(*exportDOT, rep, *dotApex, *dotMaxHosts); err != nil {
+			fmt.Println(Red+"[!] Failed to write DOT graph:", err, Reset)
+		}
+	}
+	if *exportBurp != "" || *exportZAP != "" {
+		exportProxyScope(rep, *exportBurp, *exportZAP, *scopeWildcard)
+	}
+	if *exportHTTP != "" {
+		// A finding passes the hostname filters when one of its names
+		// does; the others are checked here one by one.
+		keep := func(ip, name string) bool {
+			return (len(hostnameSuffixes) == 0 || underDomain(name, hostnameSuffixes)) && filter.Match([]string{name}) &&
+				!(*hideGeneric && isGenericPTR(ip, name)) && !(*hidePools && pools.IsPool(name))
+		}
+		targets := httpTargets(rep.Findings, len(bannerPorts) > 0, keep)
+		if err := writeHTTPTargets(*exportHTTP, targets); err != nil {
+			fmt.Println(Red+"[!] Failed to write HTTP targets:", err, Reset)
+		} else {
+			fmt.Printf(Green+"[+] Wrote %d HTTP targets to %s\n"+Reset, len(targets), *exportHTTP)
+		}
+	}
+
+	printSummary(stats)
+	if n := len(slices.DeleteFunc(slices.Clone(stats), func(ps *PrefixStats) bool { return !ps.TimedOut })); n > 0 {
+		fmt.Printf(Red+"[!] %d prefixes abandoned after -prefix-timeout %s (a -checkpoint keeps them pending for a later run)\n"+Reset, n, *prefixTimeout)
+	}
+	if len(skipped) > 0 {
+		fmt.Printf(Purple+"\n[~] %d prefixes skipped, fully scanned within %s:\n"+Reset, len(skipped), &skipWithin)
+		for _, line := range skipped {
+			fmt.Println(line)
+		}
+	}
+	if !*quiet {
+		printStatsTable(rows)
+	}
+	if contacts != nil {
+		printAbuseContacts(contacts)
+	}
+	for _, p := range sc.processors {
+		if d, ok := p.(*dropFilter); ok && d.dropped > 0 {
+			fmt.Printf(Purple+"[~] %d findings %s\n"+Reset, d.dropped, d.why)
+		}
+	}
+	if sc.processErrors > 0 {
+		fmt.Printf(Red+"[!] %d findings could not be processed\n"+Reset, sc.processErrors)
+	}
+	switch n := truncations.Load(); {
+	case n > 0 && *dnsTransport == transportUDP:
+		fmt.Printf(Red+"[!] %d truncated DNS answers were kept incomplete or failed, use -dns-transport auto\n"+Reset, n)
+	case n > 0:
+		fmt.Printf(Purple+"[~] %d truncated DNS answers retried over TCP\n"+Reset, n)
+	}
+	if hits, negative := sc.cache.Hits(); hits > 0 {
+		fmt.Printf(Purple+"[~] Result cache: %d hits, %d queries skipped on negative cache hits\n"+Reset, hits, negative)
+	}
+	if events := chain.Events(); len(events) > 0 {
+		fmt.Println(Green + "\n[+] Resolver health" + Reset)
+		for _, ev := range events {
+			state := "unhealthy"
+			if ev.Healthy {
+				state = "recovered"
+			}
+			fmt.Printf("%s %s %s\n", ev.Time.Format(time.TimeOnly), ev.Resolver, state)
+		}
+	}
+	printSampleRanking(ranked)
+	printCountryBreakdown(sc.countries)
+	printPatterns(patterns)
+	printPivots(pivots)
+
+	if sysw != nil {
+		status, severity := runCompleted, syslogInfo
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			status, severity = runDeadline, syslogWarning
+		} else if ctx.Err() != nil {
+			status, severity = runInterrupted, syslogWarning
+		}
+		sysw.Send(severity, "scan-stop", fmt.Sprintf("Scan %s: %d findings, %d prefixes incomplete", status, len(sc.findings), sc.incomplete))
+		sysw.Close()
 	}
+	flushOutputs()
+	exitIfStopped(ctx, fmt.Sprintf(", %d prefixes incomplete", sc.incomplete))
+	finishManifest(runCompleted)
 }
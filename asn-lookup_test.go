@@ -0,0 +1,2686 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIPsInCIDRTopOfIPv4(t *testing.T) {
+	tests := []struct {
+		cidr        string
+		first, last string
+		n           int
+	}{
+		{"255.255.255.0/24", "255.255.255.1", "255.255.255.254", 254},
+		{"255.255.255.252/30", "255.255.255.253", "255.255.255.254", 2},
+		{"255.255.255.254/31", "255.255.255.254", "255.255.255.255", 2},
+		{"255.255.255.255/32", "255.255.255.255", "255.255.255.255", 1},
+		{"255.255.0.0/16", "255.255.0.1", "255.255.255.254", 65534},
+	}
+	for _, tt := range tests {
+		ips, err := ipsInCIDR(tt.cidr)
+		if err != nil {
+			t.Errorf("ipsInCIDR(%s): %v", tt.cidr, err)
+			continue
+		}
+		if len(ips) != tt.n {
+			t.Errorf("ipsInCIDR(%s) returned %d addresses, want %d", tt.cidr, len(ips), tt.n)
+			continue
+		}
+		if ips[0] != tt.first || ips[len(ips)-1] != tt.last {
+			t.Errorf("ipsInCIDR(%s) = %s..%s, want %s..%s", tt.cidr, ips[0], ips[len(ips)-1], tt.first, tt.last)
+		}
+	}
+}
+
+func TestHostRangeWholeIPv4(t *testing.T) {
+	_, first, last, err := hostRange("0.0.0.0/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 1 || last != 1<<32-2 {
+		t.Errorf("hostRange(0.0.0.0/0) = [%d, %d], want [1, %d]", first, last, uint64(1<<32-2))
+	}
+}
+
+func TestIPsInCIDRRefusesHugePrefixes(t *testing.T) {
+	for _, cidr := range []string{"0.0.0.0/0", "10.0.0.0/7"} {
+		if _, err := ipsInCIDR(cidr); err == nil || !strings.Contains(err.Error(), "more than") {
+			t.Errorf("ipsInCIDR(%s) error = %v, want a size error", cidr, err)
+		}
+	}
+}
+
+func TestIPsInCIDRSmallPrefixes(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want []string
+	}{
+		{"192.0.2.7/32", []string{"192.0.2.7"}},
+		{"192.0.2.6/31", []string{"192.0.2.6", "192.0.2.7"}},
+		{"192.0.2.4/30", []string{"192.0.2.5", "192.0.2.6"}},
+		{"192.0.2.0/29", []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5", "192.0.2.6"}},
+		{"2001:db8::1/128", []string{"2001:db8::1"}},
+		{"2001:db8::/127", []string{"2001:db8::", "2001:db8::1"}},
+		{"2001:db8::/126", []string{"2001:db8::", "2001:db8::1", "2001:db8::2", "2001:db8::3"}},
+	}
+	for _, tt := range tests {
+		got, err := ipsInCIDR(tt.cidr)
+		if err != nil {
+			t.Errorf("ipsInCIDR(%s): %v", tt.cidr, err)
+			continue
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("ipsInCIDR(%s) = %v, want %v", tt.cidr, got, tt.want)
+		}
+		size, err := prefixSize(tt.cidr)
+		if err != nil || size != uint64(len(tt.want)) {
+			t.Errorf("prefixSize(%s) = %d, %v, want %d", tt.cidr, size, err, len(tt.want))
+		}
+	}
+}
+
+func TestPTRNameIP(t *testing.T) {
+	tests := map[string]string{
+		"7.2.0.192.in-addr.arpa.":  "192.0.2.7",
+		"7.2.0.192.IN-ADDR.ARPA.":  "192.0.2.7",
+		"7.2.0.192.In-Addr.Arpa":   "192.0.2.7",
+		"2.0.192.in-addr.arpa.":    "",
+		"7.2.0.192.example.com.":   "",
+		"300.2.0.192.in-addr.arpa": "",
+	}
+	for name, want := range tests {
+		if got := ptrNameIP(name); got != want {
+			t.Errorf("ptrNameIP(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// blockingWriter holds every write until release is closed.
+type blockingWriter struct{ release chan struct{} }
+
+func (w blockingWriter) WriteRecord(jsonlRecord) error {
+	<-w.release
+	return nil
+}
+
+func TestFanoutEmitDoesNotBlockOnSlowSink(t *testing.T) {
+	slow := &outputSink{spec: "slow", w: blockingWriter{make(chan struct{})}, ch: make(chan jsonlRecord, 2)}
+	f := &fanout{sinks: []*outputSink{slow}}
+	f.wg.Add(1)
+	go slow.run(&f.wg)
+
+	for i := 0; i < 10; i++ {
+		f.Emit(jsonlRecord{IP: "192.0.2.1"})
+	}
+	// One record is being written and two are queued; the rest are dropped.
+	if slow.dropped < 7 {
+		t.Errorf("dropped = %d, want at least 7", slow.dropped)
+	}
+	close(slow.w.(blockingWriter).release)
+	f.Close()
+}
+
+func TestOpenOutputsClosesEarlierSinksOnError(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "findings.sock")
+	_, err := openOutputs([]string{"socket-listen:" + sock, "jsonl:" + filepath.Join(dir, "run.jsonl"), "bogus:" + filepath.Join(dir, "x")})
+	if err == nil || !strings.Contains(err.Error(), "unknown output format") {
+		t.Fatalf("openOutputs error = %v, want unknown output format", err)
+	}
+	if conn, err := net.Dial("unix", sock); err == nil {
+		conn.Close()
+		t.Error("socket listener still accepts connections after openOutputs failed")
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket %s was left behind: %v", sock, err)
+	}
+}
+
+// testRR is one answer record of a testDNS response. Data is the raw rdata,
+// or a name for PTR records.
+type testRR struct {
+	Type uint16
+	TTL  uint32
+	Name string
+	Data []byte
+}
+
+// testDNS is a small UDP and TCP DNS server on the loopback interface. The
+// handler answers each question, after the delay set with setDelay. UDP
+// answers over maxUDP bytes (512 unless set) go out truncated, with the TC
+// bit and no records. Queries pipelined on one TCP connection are answered
+// as they complete, in any order.
+type testDNS struct {
+	addr    string
+	handler func(name string, qtype uint16) (rcode int, answers []testRR)
+	maxUDP  int
+	delay   time.Duration
+
+	mu      sync.Mutex
+	queries map[string]int
+	tcp     int
+}
+
+func startTestDNS(t testing.TB, handler func(name string, qtype uint16) (int, []testRR)) *testDNS {
+	t.Helper()
+	d := &testDNS{handler: handler, maxUDP: 512, queries: map[string]int{}}
+	var pc net.PacketConn
+	var l net.Listener
+	for tries := 0; ; tries++ {
+		var err error
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if l, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+		if tries == 10 {
+			t.Fatal(err)
+		}
+	}
+	d.addr = pc.LocalAddr().String()
+	t.Cleanup(func() {
+		pc.Close()
+		l.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := append([]byte(nil), buf[:n]...)
+			go func() {
+				resp := d.respond(q)
+				d.mu.Lock()
+				max := d.maxUDP
+				d.mu.Unlock()
+				if len(resp) > max {
+					resp = truncateResponse(resp)
+				}
+				pc.WriteTo(resp, from)
+			}()
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			d.mu.Lock()
+			d.tcp++
+			d.mu.Unlock()
+			go d.serveTCP(conn)
+		}
+	}()
+	return d
+}
+
+func (d *testDNS) serveTCP(conn net.Conn) {
+	defer conn.Close()
+	var mu sync.Mutex
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		q := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, q); err != nil {
+			return
+		}
+		go func() {
+			resp := d.respond(q)
+			frame := binary.BigEndian.AppendUint16(nil, uint16(len(resp)))
+			mu.Lock()
+			conn.Write(append(frame, resp...))
+			mu.Unlock()
+		}()
+	}
+}
+
+// tcpConns reports how many TCP connections the server accepted.
+func (d *testDNS) tcpConns() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.tcp
+}
+
+// setDelay makes the server wait this long before each answer.
+func (d *testDNS) setDelay(delay time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.delay = delay
+}
+
+// count reports how many questions for name the server was asked.
+func (d *testDNS) count(name string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.queries[strings.ToLower(name)]
+}
+
+func (d *testDNS) respond(q []byte) []byte {
+	name, next, err := readName(q, 12)
+	if err != nil || next+4 > len(q) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(q[next:])
+	d.mu.Lock()
+	d.queries[strings.ToLower(name)]++
+	delay := d.delay
+	d.mu.Unlock()
+	time.Sleep(delay)
+	rcode, answers := d.handler(strings.ToLower(name), qtype)
+
+	resp := make([]byte, 12, 512)
+	copy(resp, q[:2])
+	binary.BigEndian.PutUint16(resp[2:], 0x8580|uint16(rcode)) // QR, AA, RD, RA
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	resp = append(resp, q[12:next+4]...)
+	for _, rr := range answers {
+		resp = append(resp, 0xc0, 12)
+		resp = binary.BigEndian.AppendUint16(resp, rr.Type)
+		resp = binary.BigEndian.AppendUint16(resp, dnsClassIN)
+		resp = binary.BigEndian.AppendUint32(resp, rr.TTL)
+		data := rr.Data
+		if rr.Name != "" {
+			data, _ = appendName(nil, rr.Name)
+		}
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(data)))
+		resp = append(resp, data...)
+	}
+	return resp
+}
+
+// truncateResponse keeps the header and question of resp, sets TC and drops
+// the answers, as a server does when they do not fit.
+func truncateResponse(resp []byte) []byte {
+	_, next, _ := readName(resp, 12)
+	out := append([]byte(nil), resp[:next+4]...)
+	binary.BigEndian.PutUint16(out[2:], binary.BigEndian.Uint16(out[2:])|0x0200)
+	binary.BigEndian.PutUint16(out[6:], 0)
+	return out
+}
+
+// ptrZone answers PTR questions from names, keyed by address. The names
+// above those records exist without data, as delegated reverse zones do, and
+// everything else is NXDOMAIN.
+func ptrZone(names map[string][]string) func(string, uint16) (int, []testRR) {
+	byName, parents := map[string][]string{}, map[string]bool{}
+	for ip, hosts := range names {
+		name := reverseName(net.ParseIP(ip))
+		byName[name] = hosts
+		for _, rest, ok := strings.Cut(name, "."); ok && rest != ""; _, rest, ok = strings.Cut(rest, ".") {
+			parents[rest] = true
+		}
+	}
+	return func(name string, qtype uint16) (int, []testRR) {
+		hosts, ok := byName[name]
+		switch {
+		case !ok && parents[name], ok && qtype != dnsTypePTR:
+			return rcodeNoError, nil
+		case !ok:
+			return rcodeNXDomain, nil
+		}
+		var rrs []testRR
+		for _, h := range hosts {
+			rrs = append(rrs, testRR{Type: dnsTypePTR, TTL: 300, Name: h})
+		}
+		return rcodeNoError, rrs
+	}
+}
+
+// captureStdout returns what f prints.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	defer func() { os.Stdout = saved }()
+	f()
+	w.Close()
+	return <-out
+}
+
+func TestResolveAllTellsMissingPTRFromUnscanned(t *testing.T) {
+	const typeA = 1
+	dns := startTestDNS(t, func(name string, qtype uint16) (int, []testRR) {
+		if name != "multi.example." || qtype != typeA {
+			return rcodeNoError, nil
+		}
+		var rrs []testRR
+		for _, last := range []byte{1, 2, 3, 4} {
+			rrs = append(rrs, testRR{Type: typeA, TTL: 60, Data: []byte{192, 0, 2, last}})
+		}
+		return rcodeNoError, rrs
+	})
+	sc := &scanner{ctx: context.Background(), resolver: customResolver(dns.addr, transportAuto),
+		hostnames: map[string]bool{"multi.example": true},
+		findings:  []FindingRow{{IP: "192.0.2.1", Prefix: "192.0.2.0/24", Hostnames: []string{"multi.example."}}},
+		looked:    map[string]LookupStatus{"192.0.2.1": StatusFound, "192.0.2.2": StatusNXDomain, "192.0.2.3": StatusTimeout}}
+
+	out := captureStdout(t, func() { sc.resolveAll(NewClient(), []string{"192.0.2.0/24"}) })
+	for _, want := range []string{
+		"192.0.2.2" + Reset + " (in 192.0.2.0/24, no PTR record)",
+		"192.0.2.3" + Reset + " (in 192.0.2.0/24, PTR lookup failed: timeout)",
+		"192.0.2.4" + Reset + " (in 192.0.2.0/24, not looked up in this run)",
+		"3 more addresses inside the scanned prefixes, 0 elsewhere",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "192.0.2.1"+Reset) {
+		t.Errorf("the address the sweep found is reported again:\n%s", out)
+	}
+}
+
+// enrichZone serves the MX, NS and SPF records of example.com. Asking for
+// an address of onAddr calls it first.
+func enrichZone(onAddr map[string]func()) func(string, uint16) (int, []testRR) {
+	const typeA, typeMX, typeTXT = 1, 15, 16
+	mx := func(pref byte, host string) testRR {
+		name, _ := appendName(nil, host)
+		return testRR{Type: typeMX, TTL: 60, Data: append([]byte{0, pref}, name...)}
+	}
+	return func(name string, qtype uint16) (int, []testRR) {
+		if f := onAddr[name]; f != nil {
+			f()
+		}
+		switch {
+		case name == "example.com." && qtype == typeMX:
+			return rcodeNoError, []testRR{mx(10, "mail.example.com."), mx(20, "gone.example.com."), mx(30, "broken.example.com.")}
+		case name == "example.com." && qtype == dnsTypeNS:
+			return rcodeNoError, []testRR{{Type: dnsTypeNS, TTL: 60, Name: "ns.example.net."}}
+		case name == "example.com." && qtype == typeTXT:
+			spf := "v=spf1 ip4:192.0.2.0/25 include:_spf.example.net -all"
+			return rcodeNoError, []testRR{{Type: typeTXT, TTL: 60, Data: append([]byte{byte(len(spf))}, spf...)}}
+		case name == "mail.example.com." && qtype == typeA:
+			return rcodeNoError, []testRR{{Type: typeA, TTL: 60, Data: []byte{192, 0, 2, 25}}}
+		case name == "ns.example.net." && qtype == typeA:
+			return rcodeNoError, []testRR{{Type: typeA, TTL: 60, Data: []byte{198, 51, 100, 53}}}
+		case name == "broken.example.com.":
+			return rcodeServFail, nil
+		case name == "example.com.", name == "mail.example.com.", name == "ns.example.net.":
+			return rcodeNoError, nil
+		}
+		return rcodeNXDomain, nil
+	}
+}
+
+func TestEnrichDNSReportsEachRecord(t *testing.T) {
+	dns := startTestDNS(t, enrichZone(nil))
+	sc := &scanner{ctx: context.Background(), resolver: customResolver(dns.addr, transportAuto)}
+
+	var rows []DNSInfraRow
+	out := captureStdout(t, func() { rows = sc.enrichDNS([]string{"example.com"}, []string{"192.0.2.0/24"}, true) })
+	var got []string
+	for _, r := range rows {
+		got = append(got, strings.Join([]string{r.Record, r.Value, r.IP, r.Prefix, r.Status}, " "))
+	}
+	want := []string{
+		"SPF _spf.example.net   found",
+		"MX mail.example.com 192.0.2.25 192.0.2.0/24 found",
+		"MX gone.example.com   unresolved",
+		"MX broken.example.com   servfail",
+		"NS ns.example.net 198.51.100.53  found",
+		"SPF 192.0.2.0/25 192.0.2.0/25 192.0.2.0/24 found",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("rows:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	for _, line := range []string{"gone.example.com (does not resolve)", "broken.example.com (lookup failed: servfail)"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("output lacks %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestEnrichDNSStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The scan is cancelled while the first MX host is looked up.
+	dns := startTestDNS(t, enrichZone(map[string]func(){"mail.example.com.": cancel}))
+	sc := &scanner{ctx: ctx, resolver: customResolver(dns.addr, transportAuto)}
+
+	var rows []DNSInfraRow
+	out := captureStdout(t, func() { rows = sc.enrichDNS([]string{"example.com", "example.org"}, []string{"192.0.2.0/24"}, false) })
+	if len(rows) != 0 || strings.Contains(out, "does not resolve") {
+		t.Errorf("a cancelled run reported %+v:\n%s", rows, out)
+	}
+	if n := dns.count("example.org."); n != 0 {
+		t.Errorf("example.org was still looked up %d times after the cancellation", n)
+	}
+}
+
+func TestTruncatedUDPAnswers(t *testing.T) {
+	var names []string
+	for i := 0; i < 40; i++ {
+		names = append(names, fmt.Sprintf("host-%02d.a-rather-long-domain-name.example.", i))
+	}
+	dns := startTestDNS(t, ptrZone(map[string][]string{"192.0.2.1": names}))
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		mode, transport string
+	}{
+		{"standard", transportAuto},
+		{"raw", transportAuto},
+	} {
+		ptr, _, err := newLookuper(dns.addr, tc.mode, tc.transport, 0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := dns.tcpConns()
+		if res := lookupWith(ctx, ptr, "192.0.2.1"); res.Status != StatusFound || len(res.Names) != len(names) {
+			t.Errorf("%s over %s: %s with %d names, want all %d", tc.mode, tc.transport, res.Status, len(res.Names), len(names))
+		}
+		if dns.tcpConns() == before {
+			t.Errorf("%s over %s: the truncated answer was not retried over TCP", tc.mode, tc.transport)
+		}
+	}
+
+	// Over udp nothing is retried. An answer truncated before its first
+	// record tells nothing, which must not pass for NXDOMAIN.
+	ptr, _, err := newLookuper(dns.addr, "standard", transportUDP, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := dns.tcpConns()
+	if res := lookupWith(ctx, ptr, "192.0.2.1"); res.Status != StatusError {
+		t.Errorf("standard over udp: %s (%v), want an error", res.Status, res.Err)
+	}
+	if dns.tcpConns() != before {
+		t.Error("standard over udp fell back to TCP")
+	}
+}
+
+func TestMarkChunkCopiesStats(t *testing.T) {
+	ps := newPrefixStats("192.0.2.0/24", false)
+	ps.Add(LookupResult{IP: "192.0.2.1", Status: StatusFound, Names: []string{"a.example.com."}})
+	ps.UndelegatedZones = make([]string, 1, 4)
+	ps.UndelegatedZones[0] = "1.2.0.192.in-addr.arpa."
+	ps.Zones = []*ReverseZone{{Zone: "2.0.192.in-addr.arpa.", Nameservers: []string{"ns1.example.com."}}}
+	cp := &Checkpoint{}
+	cp.MarkChunk(ps, 1)
+
+	ps.Add(LookupResult{IP: "192.0.2.2", Status: StatusFound, Names: []string{"b.example.org."}})
+	ps.UndelegatedZones = append(ps.UndelegatedZones, "3.2.0.192.in-addr.arpa.")
+	ps.UndelegatedZones[0] = "changed"
+	ps.Zones[0].Nameservers[0] = "changed"
+
+	snap := cp.Current.Stats
+	if snap.Total != 1 || len(snap.Apexes) != 1 || fmt.Sprint(snap.UndelegatedZones) != "[1.2.0.192.in-addr.arpa.]" ||
+		snap.Zones[0].Nameservers[0] != "ns1.example.com." {
+		t.Errorf("the checkpoint followed later changes: %+v", snap)
+	}
+}
+
+func TestCheckpointKeepsRetryQueue(t *testing.T) {
+	done, current := newPrefixStats("192.0.2.0/24", false), newPrefixStats("198.51.100.0/24", false)
+	failed := &scanner{}
+	for _, item := range []retryItem{
+		{ip: "192.0.2.7", status: StatusTimeout, stats: done},
+		{ip: "198.51.100.9", status: StatusServFail, stats: current},
+	} {
+		item.stats.Add(LookupResult{IP: item.ip, Status: item.status})
+		failed.failed = append(failed.failed, item)
+	}
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp := &Checkpoint{path: path, Prefixes: []string{"192.0.2.0/24", "198.51.100.0/24"}}
+	cp.MarkDone(done)
+	cp.MarkChunk(current, 16)
+	cp.Failed = failed.failedLookups()
+	if err := cp.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &scanner{ctx: context.Background(), workers: 1, countries: map[string]int{},
+		ptr: staticPTR{"192.0.2.7": {"late.example.com."}}}
+	sc.requeue(cp)
+	if len(sc.failed) != 2 || sc.failed[0].stats != cp.Stats["192.0.2.0/24"] || sc.failed[1].stats != cp.Current.Stats {
+		t.Fatalf("requeued %+v", sc.failed)
+	}
+	captureStdout(t, func() {
+		if recovered, total := sc.retryFailed(1); recovered != 2 || total != 2 {
+			t.Errorf("retry passes recovered %d of %d, want 2 of 2", recovered, total)
+		}
+	})
+	if ps := cp.Stats["192.0.2.0/24"]; ps.Counts[StatusFound] != 1 || ps.Counts[StatusTimeout] != 0 {
+		t.Errorf("completed prefix counts after retry: %v", ps.Counts)
+	}
+	if ps := cp.Current.Stats; ps.Counts[StatusNXDomain] != 1 || ps.Counts[StatusServFail] != 0 {
+		t.Errorf("current prefix counts after retry: %v", ps.Counts)
+	}
+}
+
+func TestScoreHostname(t *testing.T) {
+	tokens := orgTokens("Example Networks, Inc.")
+	for _, tc := range []struct {
+		name, ip, host      string
+		confirmed, wildcard bool
+		want                int
+	}{
+		{"confirmed org host", "192.0.2.1", "mail.example.com", true, false,
+			confidenceBase + weightForwardConfirmed + weightOrgDomain},
+		{"confirmed unrelated host", "192.0.2.1", "mail.other.net", true, false,
+			confidenceBase + weightForwardConfirmed},
+		{"unconfirmed org host", "192.0.2.1", "mail.example.com", false, false,
+			confidenceBase + weightNotConfirmed + weightOrgDomain},
+		{"wildcard replaces confirmation", "192.0.2.1", "mail.example.com", true, true,
+			confidenceBase + weightWildcard + weightOrgDomain},
+		{"embedded address", "192.0.2.1", "192-0-2-1.dsl.example.com", true, false,
+			confidenceBase + weightForwardConfirmed + weightOrgDomain + weightGenericPTR},
+		{"reversed address", "192.0.2.1", "1.2.0.192.in.other.net", false, false,
+			confidenceBase + weightNotConfirmed + weightGenericPTR},
+		{"pool keyword", "192.0.2.1", "pool7.other.net", false, false,
+			confidenceBase + weightNotConfirmed + weightGenericPTR},
+		{"generic wildcard", "192.0.2.1", "dhcp-4.other.net", false, true,
+			confidenceBase + weightWildcard + weightGenericPTR},
+	} {
+		if got := scoreHostname(tc.ip, tc.host, tokens, tc.confirmed, tc.wildcard); got != tc.want {
+			t.Errorf("%s: score = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestOrgTokens(t *testing.T) {
+	for org, want := range map[string]string{
+		"Example Networks, Inc.":     "[example]",
+		"AS-EXAMPLE":                 "[example]",
+		"The Acme Group GmbH":        "[acme]",
+		"Big Data Communications Co": "[big data]",
+		"Inc":                        "[]",
+		"Example Hosting Pty Ltd":    "[example hosting]",
+		"Example Incorporated":       "[example]",
+	} {
+		if got := fmt.Sprint(orgTokens(org)); got != want {
+			t.Errorf("orgTokens(%q) = %s, want %s", org, got, want)
+		}
+	}
+}
+
+func TestSearchVariants(t *testing.T) {
+	for _, tc := range []struct {
+		name, term string
+		want       []string
+	}{
+		{"legal suffix", "Example GmbH", []string{"Example"}},
+		{"legal suffix with punctuation", "Example, Inc.", []string{"Example"}},
+		{"stacked suffixes", "Example Holdings Co. Ltd", []string{"Example Holdings", "Example"}},
+		{"punctuation", "Example-Net", []string{"Example Net", "Example"}},
+		{"first word", "Example Net Services", []string{"Example"}},
+		{"domain label", "example.co.uk", []string{"example", "example co uk"}},
+		{"extra spaces", "  Acme   Corp  ", []string{"Acme"}},
+		{"suffix alone is kept", "Inc", nil},
+		{"too short", "X Inc", nil},
+		{"nothing to rewrite", "example", nil},
+		{"blank", " ", nil},
+		{"unicode", "Müller-Lüdenscheid GmbH", []string{"Müller-Lüdenscheid", "Müller Lüdenscheid", "Müller"}},
+		// Every rewrite applies, which is as many as the cap allows.
+		{"at the cap", "Ex-Am.co.uk.", []string{"ex-am", "Ex-Am.co.uk", "Ex Am co uk", "Ex"}},
+	} {
+		got := searchVariants(tc.term)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: searchVariants(%q) = %q, want %q", tc.name, tc.term, got, tc.want)
+		}
+		if len(got) > maxSearchVariants {
+			t.Errorf("%s: %d variants, more than the cap of %d", tc.name, len(got), maxSearchVariants)
+		}
+		for _, v := range got {
+			if strings.EqualFold(v, strings.TrimSpace(tc.term)) {
+				t.Errorf("%s: the term itself is among the variants %q", tc.name, got)
+			}
+		}
+	}
+}
+
+func TestGroupASNs(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		asns []ASN
+		want [][]int
+	}{
+		{"legal suffix variants", []ASN{
+			{Number: 1, Name: "Example GmbH"}, {Number: 2, Name: "EXAMPLE-AS"},
+			{Number: 3, Name: "Example Pty Ltd"}, {Number: 4, Name: "Example Networks, Inc."},
+		}, [][]int{{1, 2, 3, 4}}},
+		{"different organizations sharing a word", []ASN{
+			{Number: 1, Name: "ACME-TELECOM"}, {Number: 2, Name: "ACME-STEEL"}, {Number: 3, Name: "Acme Telecom Ltd"},
+		}, [][]int{{1, 3}, {2}}},
+		{"one letter apart", []ASN{
+			{Number: 1, Name: "EXAMPLE-NET"}, {Number: 2, Name: "EXAMPLES-NET"},
+		}, [][]int{{1}, {2}}},
+		{"falls back to the description", []ASN{
+			{Number: 1, Name: "AS-1", Description: "Example Hosting"},
+			{Number: 2, Name: "EXAMPLE-HOSTING"},
+		}, [][]int{{1, 2}}},
+		// Names with nothing left to compare never merge.
+		{"no tokens", []ASN{{Number: 1, Name: "AS-1"}, {Number: 2, Name: "AS-2"}}, [][]int{{1}, {2}}},
+		// Only a group's first member is compared, so a chain of overlaps
+		// does not pull the ends together.
+		{"no chaining", []ASN{
+			{Number: 1, Name: "Alpha Beta"}, {Number: 2, Name: "Beta Gamma"}, {Number: 3, Name: "Alpha Beta Gamma"},
+		}, [][]int{{1, 3}, {2}}},
+	} {
+		groups, flat := groupASNs(tc.asns)
+		var got [][]int
+		for _, g := range groups {
+			var numbers []int
+			for j, asn := range g.members {
+				numbers = append(numbers, asn.Number)
+				if flat[g.first+j].Number != asn.Number {
+					t.Errorf("%s: AS%d is not at position %d of the listing", tc.name, asn.Number, g.first+j)
+				}
+			}
+			got = append(got, numbers)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: groups = %v, want %v", tc.name, got, tc.want)
+		}
+		if len(flat) != len(tc.asns) {
+			t.Errorf("%s: listing has %d entries, want %d", tc.name, len(flat), len(tc.asns))
+		}
+	}
+}
+
+func TestExpandGroupSelection(t *testing.T) {
+	groups, flat := groupASNs([]ASN{
+		{Number: 10, Name: "ACME-TELECOM"}, {Number: 20, Name: "Example GmbH"},
+		{Number: 30, Name: "Acme Telecom Inc"}, {Number: 40, Name: "EXAMPLE-AS"}, {Number: 50, Name: "Other"},
+	})
+	for _, tc := range []struct {
+		spec, want string
+		asns       []int
+	}{
+		{"g1", "1-2", []int{10, 30}},
+		{"g2", "3-4", []int{20, 40}},
+		{" G3 ", "5-5", []int{50}},
+		{"g2,1", "3-4,1", []int{20, 40, 10}},
+	} {
+		got, err := expandGroupSelection(tc.spec, groups)
+		if err != nil {
+			t.Errorf("expandGroupSelection(%q): %v", tc.spec, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("expandGroupSelection(%q) = %q, want %q", tc.spec, got, tc.want)
+		}
+		picked, err := parseSelection(got, len(flat))
+		if err != nil {
+			t.Errorf("parseSelection(%q): %v", got, err)
+			continue
+		}
+		var numbers []int
+		for _, i := range picked {
+			numbers = append(numbers, flat[i-1].Number)
+		}
+		if !slices.Equal(numbers, tc.asns) {
+			t.Errorf("%q selects %v, want %v", tc.spec, numbers, tc.asns)
+		}
+	}
+	for _, spec := range []string{"g0", "g4", "gx", "g"} {
+		if _, err := expandGroupSelection(spec, groups); err == nil {
+			t.Errorf("expandGroupSelection(%q) accepted an invalid group", spec)
+		}
+	}
+}
+
+func TestSuggestSearchesStopsAtTheCap(t *testing.T) {
+	var mu sync.Mutex
+	var asked []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		asked = append(asked, r.URL.Query().Get("query_term"))
+		mu.Unlock()
+		io.WriteString(w, `{"status":"ok","data":{"asns":[]}}`)
+	}))
+	defer ts.Close()
+	api := NewClient()
+	api.BaseURL = ts.URL
+
+	// Three terms with six variants between them.
+	captureStdout(t, func() {
+		suggestSearches(context.Background(), api, []string{"Example GmbH", "Example-Net Telecom Ltd", "Other Net Services"})
+	})
+	want := []string{"Example", "Example-Net Telecom", "Example Net Telecom", "Example"}
+	if !slices.Equal(asked, want) {
+		t.Errorf("searched %q, want the first %d variants %q", asked, maxSearchVariants, want)
+	}
+}
+
+func TestPoolRules(t *testing.T) {
+	p := &poolRules{}
+	rules := `# one rule of each kind
+substring -dyn-
+prefix cpe
+suffix Pools.Example.NET.
+regex ^DSL\d+\.
+!suffix static.pools.example.net
+!substring -server-
+`
+	if err := p.parse(strings.NewReader(rules), "rules"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		host string
+		want bool
+	}{
+		{"host-dyn-12.example.com.", true},
+		{"CPE-1-2-3-4.example.com", true},
+		{"mycpe.example.com", false},
+		{"a.pools.example.net.", true},
+		{"pools.example.net", true},
+		{"notpools.example.net", false},
+		{"dsl42.example.org", true},
+		{"DSL42.example.org", true},
+		{"adsl42.example.org", false},
+		{"x.static.pools.example.net", false},
+		{"cpe-server-1.example.com", false},
+		{"www.example.com", false},
+	} {
+		if got := p.IsPool(tc.host); got != tc.want {
+			t.Errorf("IsPool(%q) = %v, want %v", tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestPoolRulesParseErrors(t *testing.T) {
+	for _, tc := range []struct{ rules, want string }{
+		{"substring -dyn-\nprefix\n", `rules:2: want "kind pattern"`},
+		{"regex ^dsl(\n", "rules:1: error parsing regexp"},
+		{"glob *.dyn.example\n", `rules:1: unknown rule kind "glob"`},
+	} {
+		err := (&poolRules{}).parse(strings.NewReader(tc.rules), "rules")
+		if err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+			t.Errorf("parse(%q) = %v, want an error starting %q", tc.rules, err, tc.want)
+		}
+	}
+	if _, err := loadPoolRules(""); err != nil {
+		t.Errorf("the built-in rules do not parse: %v", err)
+	}
+}
+
+// orgAPI answers searches for Good, Broken and Limited. Broken's ASN has
+// no prefix list, and the first limited calls are answered with 429. Good's
+// search is slow, so its next call comes after the first 429.
+type orgAPI struct {
+	api      *Client
+	rejected atomic.Int32
+
+	mu       sync.Mutex
+	limitAt  time.Time // first 429
+	goodNext time.Time // Good's prefix call
+}
+
+func newOrgAPI(t *testing.T, limited int) *orgAPI {
+	o := &orgAPI{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path + "?" + r.URL.Query().Get("query_term") {
+		case "/search?Good":
+			time.Sleep(10 * time.Millisecond)
+			io.WriteString(w, `{"status":"ok","data":{"asns":[{"asn":64500,"name":"GOOD"}]}}`)
+		case "/search?Broken":
+			io.WriteString(w, `{"status":"ok","data":{"asns":[{"asn":64501,"name":"BROKEN"}]}}`)
+		case "/search?Limited":
+			if n := int(o.rejected.Add(1)); n <= limited {
+				if n == 1 {
+					o.mu.Lock()
+					o.limitAt = time.Now()
+					o.mu.Unlock()
+				}
+				http.Error(w, "slow down", http.StatusTooManyRequests)
+				return
+			}
+			io.WriteString(w, `{"status":"ok","data":{"asns":[{"asn":64502,"name":"LIMITED"}]}}`)
+		case "/asn/64500/prefixes?":
+			o.mu.Lock()
+			o.goodNext = time.Now()
+			o.mu.Unlock()
+			fallthrough
+		case "/asn/64502/prefixes?":
+			io.WriteString(w, `{"status":"ok","data":{"ipv4_prefixes":[{"prefix":"198.51.100.0/24"}],"ipv6_prefixes":[]}}`)
+		default:
+			http.Error(w, "unexpected "+r.URL.String(), http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	o.api = NewClient()
+	o.api.BaseURL = ts.URL
+	o.api.limiter = newTokenBucket(1000, 100)
+	return o
+}
+
+func TestResolveOrgsKeepsGoingPastFailures(t *testing.T) {
+	o := newOrgAPI(t, 2)
+	start := time.Now()
+	results, err := ResolveOrgs(context.Background(), []string{"Limited", "Good", "Broken", "Good"}, Options{Client: o.api, Backoff: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("%d results, want one per distinct organization", len(results))
+	}
+	if res := results["Good"]; res.Err != nil || len(res.Prefixes) != 1 || res.Origin["198.51.100.0/24"] != 64500 {
+		t.Errorf("Good: %+v", res)
+	}
+	if res := results["Broken"]; res.Err == nil || !strings.Contains(res.Err.Error(), "AS64501 prefixes") {
+		t.Errorf("Broken: error %v, want the failed prefix lookup", res.Err)
+	}
+	if res := results["Limited"]; res.Err != nil || len(res.ASNs) != 1 {
+		t.Errorf("Limited: %+v, want it resolved after the rate limit passed", res)
+	}
+	// Two 429s wait 50ms and then 100ms.
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("the batch finished after %v, before the backoff ran out", elapsed)
+	}
+	// Limited's 429 holds Good back too.
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if wait := o.goodNext.Sub(o.limitAt); wait < 50*time.Millisecond {
+		t.Errorf("Good went on %v after the 429, inside the batch's backoff", wait)
+	}
+}
+
+func TestResolveOrgsRetries(t *testing.T) {
+	for _, tc := range []struct {
+		retries      int
+		wantRejected int32
+	}{
+		{0, 4},  // the default of 3 retries
+		{1, 2},  // one retry
+		{-1, 1}, // none
+	} {
+		o := newOrgAPI(t, 100)
+		results, err := ResolveOrgs(context.Background(), []string{"Limited"}, Options{Client: o.api, Retries: tc.retries, Backoff: time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status *statusError
+		if res := results["Limited"]; !errors.As(res.Err, &status) || status.code != http.StatusTooManyRequests {
+			t.Errorf("Retries %d: error %v, want the 429", tc.retries, res.Err)
+		}
+		if got := o.rejected.Load(); got != tc.wantRejected {
+			t.Errorf("Retries %d: %d calls, want %d", tc.retries, got, tc.wantRejected)
+		}
+	}
+}
+
+func TestOrgFileSkipsFailedOrganizations(t *testing.T) {
+	o := newOrgAPI(t, 0)
+	dir := t.TempDir()
+	orgs, report := filepath.Join(dir, "orgs.txt"), filepath.Join(dir, "report.json")
+	os.WriteFile(orgs, []byte("Good\nBroken\n"), 0o644)
+	dns := startTestDNS(t, ptrZone(map[string][]string{"198.51.100.1": {"good.example."}}))
+
+	out, err := runMain(t, "", "-api-url", o.api.BaseURL, "-org-file", orgs, "-resolver", dns.addr, "-allow-reserved", "-quiet", "-skip-healthcheck",
+		"-workers", "32", "-qps", "10000", "-o", report)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep Report
+	json.Unmarshal(data, &rep)
+	if !slices.Equal(rep.ASNs, []int{64500}) {
+		t.Errorf("report covers ASNs %v, want only the resolved organization's", rep.ASNs)
+	}
+}
+
+func TestNewJobID(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := newJobID()
+		if len(id) != 16 || seen[id] {
+			t.Fatalf("newJobID() = %q after %d IDs", id, i)
+		}
+		seen[id] = true
+	}
+}
+
+func newTestServer(t *testing.T, dir, resolver string) (*server, *httptest.Server) {
+	t.Helper()
+	store, err := openStore(filepath.Join(dir, "recon.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{ctx: context.Background(), token: "secret", api: NewClient(), resolver: resolver, workers: 2, slots: make(chan struct{}, 1),
+		store: store, jobs: map[string]*scanJob{}, findingsDir: filepath.Join(dir, "recon.db.scans")}
+	srv.loadJobs()
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	return srv, ts
+}
+
+func TestServerStoresFindingsOutsideTheJobRecord(t *testing.T) {
+	dns := startTestDNS(t, ptrZone(map[string][]string{
+		"192.0.2.1": {"a.example."},
+		"192.0.2.2": {"b.example.", "c.example."},
+	}))
+	dir := t.TempDir()
+	srv, ts := newTestServer(t, dir, dns.addr)
+
+	body := strings.NewReader(`{"cidrs": ["192.0.2.0/30"], "options": {"allow_reserved": true}}`)
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/scans", body)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created ScanJob
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /scans: %s", resp.Status)
+	}
+
+	srv.mu.Lock()
+	j := srv.jobs[created.ID]
+	srv.mu.Unlock()
+	select {
+	case <-j.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("scan did not finish")
+	}
+	if j.Status != jobDone {
+		t.Fatalf("job status %s (%s), want done", j.Status, j.Error)
+	}
+
+	var stored ScanJob
+	if ok, err := srv.store.Get(bucketScans, created.ID, &stored); !ok || err != nil {
+		t.Fatalf("job not in store: %v", err)
+	}
+	if len(stored.Findings) != 0 || stored.Found != 2 {
+		t.Errorf("stored record has %d findings and found=%d, want 0 and 2", len(stored.Findings), stored.Found)
+	}
+	rows, err := readFindingsLog(srv.findingsPath(created.ID))
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("findings file has %d rows, %v; want 2", len(rows), err)
+	}
+
+	// A restarted server serves the findings from the file.
+	srv.store.Save()
+	again, _ := newTestServer(t, dir, dns.addr)
+	if got := again.jobs[created.ID]; got == nil || len(got.Findings) != 2 {
+		t.Fatalf("restored job = %+v, want 2 findings", got)
+	}
+}
+
+func TestDiffHosts(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	baseline := map[string]HostRecord{
+		"192.0.2.1": {IP: "192.0.2.1", Hostnames: []string{"a.example.", "b.example."}},
+		"192.0.2.2": {IP: "192.0.2.2", Hostnames: []string{"old.example."}},
+		"192.0.2.3": {IP: "192.0.2.3", Hostnames: []string{"gone.example."}},
+		"192.0.2.4": {IP: "192.0.2.4", Hostnames: []string{"flaky.example."}},
+	}
+	for _, tc := range []struct {
+		name string
+		res  LookupResult
+		want string
+	}{
+		{"same names in another order", LookupResult{IP: "192.0.2.1", Status: StatusFound, Names: []string{"b.example.", "a.example."}}, ""},
+		{"renamed", LookupResult{IP: "192.0.2.2", Status: StatusFound, Names: []string{"new.example."}}, "changed [new.example.] was [old.example.]"},
+		{"removed", LookupResult{IP: "192.0.2.3", Status: StatusNXDomain}, "gone [] was [gone.example.]"},
+		{"failed lookup of a known host", LookupResult{IP: "192.0.2.4", Status: StatusTimeout}, ""},
+		{"added", LookupResult{IP: "192.0.2.5", Status: StatusFound, Names: []string{"added.example."}}, "new [added.example.] was []"},
+		{"unknown address without a PTR", LookupResult{IP: "192.0.2.6", Status: StatusNXDomain}, ""},
+	} {
+		current := map[string]LookupResult{tc.res.IP: tc.res}
+		events := diffHosts("Example", baseline, current, map[string]string{tc.res.IP: "192.0.2.0/29"}, now)
+		var got string
+		if len(events) > 1 {
+			t.Errorf("%s: %d events, want at most one", tc.name, len(events))
+		}
+		for _, ev := range events {
+			got = fmt.Sprintf("%s %v was %v", ev.Type, ev.Hostnames, ev.Previous)
+			if ev.IP != tc.res.IP || ev.Prefix != "192.0.2.0/29" || ev.Org != "Example" || !ev.Time.Equal(now) {
+				t.Errorf("%s: event %+v does not carry the address, prefix, org and time", tc.name, ev)
+			}
+		}
+		if got != tc.want {
+			t.Errorf("%s: event %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func newTestWatcher(t *testing.T, ptr PTRLookuper, webhook string) *watcher {
+	t.Helper()
+	store, err := openStore(filepath.Join(t.TempDir(), "recon.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &scanner{ctx: context.Background(), ptr: ptr, workers: 2, countries: map[string]int{}, silent: true}
+	return &watcher{sc: sc, store: store, org: "Example", prefixes: []string{"192.0.2.0/29"}, webhook: webhook, timeout: time.Second}
+}
+
+func TestWatchCycleReportsChangesAgainstBaseline(t *testing.T) {
+	type payload struct {
+		Org    string        `json:"org"`
+		Events []ChangeEvent `json:"events"`
+	}
+	var payloads []payload
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		payloads = append(payloads, p)
+	}))
+	defer hook.Close()
+	ptr := staticPTR{"192.0.2.1": {"a.example."}, "192.0.2.2": {"b.example."}}
+	w := newTestWatcher(t, ptr, hook.URL)
+
+	out := captureStdout(t, func() {
+		if err := w.cycle(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !strings.Contains(out, "Baseline established with 6 hosts") || len(payloads) != 0 {
+		t.Fatalf("first cycle sent %d webhooks:\n%s", len(payloads), out)
+	}
+
+	ptr["192.0.2.2"] = []string{"renamed.example."}
+	ptr["192.0.2.3"] = []string{"added.example."}
+	delete(ptr, "192.0.2.1")
+	captureStdout(t, func() {
+		if err := w.cycle(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if len(payloads) != 1 {
+		t.Fatalf("%d webhooks after the second cycle, want 1", len(payloads))
+	}
+	if payloads[0].Org != "Example" {
+		t.Errorf("webhook org %q", payloads[0].Org)
+	}
+	var got []string
+	for _, ev := range payloads[0].Events {
+		got = append(got, ev.Type+" "+ev.IP)
+	}
+	if fmt.Sprint(got) != "[gone 192.0.2.1 changed 192.0.2.2 new 192.0.2.3]" {
+		t.Errorf("webhook events %v", got)
+	}
+
+	// The next cycle diffs against the updated baseline.
+	captureStdout(t, func() {
+		if err := w.cycle(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if len(payloads) != 1 {
+		t.Errorf("an unchanged cycle sent a webhook: %+v", payloads[1:])
+	}
+}
+
+func TestWatchCycleKeepsBaselineWhenLookupsFail(t *testing.T) {
+	names := staticPTR{"192.0.2.1": {"a.example."}}
+	w := newTestWatcher(t, names, "")
+	captureStdout(t, func() {
+		if err := w.cycle(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Every lookup times out: the cycle must not read that as the host
+	// having gone away.
+	w.sc.ptr = &flakyPTR{seen: map[string]bool{}, names: names}
+	var err error
+	captureStdout(t, func() { err = w.cycle() })
+	if err == nil || !strings.Contains(err.Error(), "lookups failed") {
+		t.Fatalf("cycle with failing lookups = %v, want an error", err)
+	}
+	hosts, err := w.store.baselineHosts("Example", w.prefixes)
+	if err != nil || len(hosts["192.0.2.1"].Hostnames) != 1 {
+		t.Errorf("baseline after the failed cycle = %+v, %v; want a.example. kept", hosts, err)
+	}
+}
+
+func TestWatchWebhookTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hook.Close()
+	defer close(release)
+	w := newTestWatcher(t, staticPTR{}, hook.URL)
+	w.timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	out := captureStdout(t, func() {
+		w.report([]ChangeEvent{{Type: "new", IP: "192.0.2.1", Hostnames: []string{"a.example."}}})
+	})
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("webhook delivery took %s against a %s timeout", took, w.timeout)
+	}
+	if !strings.Contains(out, "Webhook delivery failed") {
+		t.Errorf("a timed-out webhook was not reported:\n%s", out)
+	}
+}
+
+func TestStoreKeepsOtherWritersRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recon.db")
+	a, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := a.TouchOrg("Example A", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.TouchOrg("Example B", now); err != nil {
+		t.Fatal(err)
+	}
+	// The second Save must not write back the first one's view.
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, org := range []string{"Example A", "Example B"} {
+		var rec OrgRecord
+		if found, err := again.Get(bucketOrgs, orgKey(org), &rec); !found || err != nil {
+			t.Errorf("%s lost from the store: %v", org, err)
+		}
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+}
+
+func TestStoreReadsOldSnapshotAndTornLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recon.db")
+	old := `{
+  "buckets": {
+    "orgs": {
+      "example": {"name": "Example"}
+    }
+  }
+}
+{"bucket":"orgs","key":"other","value":{"name":"Other"}}
+{"bucket":"orgs","key":"torn","val`
+	if err := os.WriteFile(path, []byte(old), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TouchOrg("Appended", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	again.ForEach(bucketOrgs, "", func(key string, _ json.RawMessage) error {
+		got = append(got, key)
+		return nil
+	})
+	if fmt.Sprint(got) != "[appended example other]" {
+		t.Errorf("orgs = %v, want the snapshot, the appended lines and the new record", got)
+	}
+}
+
+func TestStoreCompactsLongLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recon.db")
+	s, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < storeCompactMin; i++ {
+		if err := s.Put(bucketScans, "job", i); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 1 {
+		t.Fatalf("log has %d lines after compaction, want 1", lines)
+	}
+	again, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last int
+	if found, err := again.Get(bucketScans, "job", &last); !found || err != nil || last != storeCompactMin-1 {
+		t.Errorf("job = %d (found %v, %v), want the last value put", last, found, err)
+	}
+}
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite the testdata/*.golden files from the current output")
+
+// checkGolden compares got with testdata/name, or rewrites the file with
+// -update-golden.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update-golden to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file (go test -update-golden rewrites it)\n--- got\n%s\n--- want\n%s", name, got, want)
+	}
+}
+
+// fixtureClock pins recordClock for the formats that carry a timestamp.
+func fixtureClock(t *testing.T) time.Time {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	saved := recordClock
+	recordClock = func() time.Time { return now }
+	t.Cleanup(func() { recordClock = saved })
+	return now
+}
+
+// fixtureResults is a scan of one IPv4 and one IPv6 prefix with the cases
+// the output formats have to get right: several PTRs for one address,
+// non-ASCII names, failures, and findings with as little set as possible.
+func fixtureResults() []struct {
+	prefix string
+	res    LookupResult
+} {
+	at := time.Date(2024, 5, 1, 11, 59, 30, 0, time.UTC)
+	conf := 80
+	type row = struct {
+		prefix string
+		res    LookupResult
+	}
+	return []row{
+		{"192.0.2.0/24", LookupResult{IP: "192.0.2.1", Names: []string{"web.example.com.", "mail.example.com."}, Status: StatusFound,
+			Geo: GeoInfo{Country: "DE", City: "Berlin"}, Answer: &PTRAnswer{TTL: 300, Rcode: rcodeNoError, Authoritative: true, Server: "198.51.100.53:53"},
+			Confidence: &conf, Provenance: Provenance{Source: sourceDNS, RetrievedAt: &at}}},
+		{"192.0.2.0/24", LookupResult{IP: "192.0.2.2", Names: []string{"bücher.example.", "xn--bcher-kva.example."}, Status: StatusFound,
+			Provenance: Provenance{Source: sourceDNS, RetrievedAt: &at}}},
+		{"192.0.2.0/24", LookupResult{IP: "192.0.2.3", Status: StatusNXDomain}},
+		{"192.0.2.0/24", LookupResult{IP: "192.0.2.4", Status: StatusTimeout, Err: &net.DNSError{Err: "i/o timeout", Name: "192.0.2.4", IsTimeout: true}}},
+		{"192.0.2.0/24", LookupResult{IP: "192.0.2.5", Names: []string{"Pool-5.Example.NET."}, Status: StatusFound, Retried: true, Category: "access-pool"}},
+		{"2001:db8::/120", LookupResult{IP: "2001:db8::1", Names: []string{"v6.example.net."}, Status: StatusFound,
+			Provenance: Provenance{Source: sourceCache, RetrievedAt: &at, FetchedAt: &at}}},
+		{"2001:db8::/120", LookupResult{IP: "2001:db8::2", Status: StatusServFail, Err: errors.New("server misbehaving")}},
+	}
+}
+
+// fixtureReport turns fixtureResults into the report of a finished scan of
+// AS64500, with an organization name and a hostname that markup would
+// choke on.
+func fixtureReport() *Report {
+	stats := map[string]*PrefixStats{}
+	rep := &Report{
+		Org:        `Example <Corp> & "Co"`,
+		ASNs:       []int{64500},
+		StartedAt:  time.Date(2024, 5, 1, 11, 58, 0, 0, time.UTC),
+		FinishedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Findings:   []FindingRow{},
+	}
+	var order []*PrefixStats
+	for _, r := range fixtureResults() {
+		ps := stats[r.prefix]
+		if ps == nil {
+			ps = newPrefixStats(r.prefix, r.prefix == "2001:db8::/120")
+			stats[r.prefix] = ps
+			order = append(order, ps)
+		}
+		ps.Add(r.res)
+		if r.res.Status == StatusFound {
+			rep.Findings = append(rep.Findings, FindingRow{IP: r.res.IP, Prefix: r.prefix, Hostnames: r.res.Names, Country: r.res.Geo.Country,
+				City: r.res.Geo.City, Retried: r.res.Retried, Confidence: r.res.Confidence, ASN: 64500, Category: r.res.Category, Provenance: r.res.Provenance})
+		}
+	}
+	rep.Findings = append(rep.Findings, FindingRow{IP: "192.0.2.6", Prefix: "192.0.2.0/24", Hostnames: []string{`<a href="x">click</a>.example.`}, ASN: 64500})
+	rep.Prefixes = statsTable(order)
+	for i := range rep.Prefixes {
+		rep.Prefixes[i].ASN = 64500
+	}
+	rep.Prefixes[0].Name, rep.Prefixes[0].Description, rep.Prefixes[0].CountryCode = "EXAMPLE-NET", "Example | Berlin", "DE"
+	rep.DNSInfra = []DNSInfraRow{
+		{Domain: "example.com", Record: "MX", Value: "mail.example.com", IP: "192.0.2.25", Prefix: "192.0.2.0/24", Status: "found"},
+		{Domain: "example.com", Record: "NS", Value: "ns1.example.net", Status: "timeout"},
+		{Domain: "example.com", Record: "SPF", Value: "198.51.100.0/24", IP: "198.51.100.0/24", Status: "found"},
+		{Domain: "example.com", Record: "SPF", Value: "_spf.<example>|mail", Status: "found"},
+	}
+	return rep
+}
+
+func TestHTMLReportGolden(t *testing.T) {
+	got, err := renderHTMLReport(fixtureReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "report.html.golden", got)
+	for _, raw := range []string{"<Corp>", `<a href="x">`} {
+		if bytes.Contains(got, []byte(raw)) {
+			t.Errorf("%s is not escaped", raw)
+		}
+	}
+}
+
+// renderRecords writes the fixture through w and returns what it wrote.
+func renderRecords(t *testing.T, newWriter func(io.Writer) recordWriter) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := newWriter(&buf)
+	for _, r := range fixtureResults() {
+		if err := w.WriteRecord(resultRecord(r.prefix, false, r.res)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestDNSXGolden(t *testing.T) {
+	fixtureClock(t)
+	checkGolden(t, "dnsx.golden", renderRecords(t, func(w io.Writer) recordWriter { return dnsxWriter{w: w} }))
+	checkGolden(t, "dnsx-json.golden", renderRecords(t, func(w io.Writer) recordWriter { return dnsxWriter{w: w, asJSON: true} }))
+}
+
+func TestRecordFormatsGolden(t *testing.T) {
+	fixtureClock(t)
+	checkGolden(t, "findings.txt.golden", renderRecords(t, func(w io.Writer) recordWriter { return txtWriter{w} }))
+	checkGolden(t, "findings.jsonl.golden", renderRecords(t, func(w io.Writer) recordWriter { return jsonlWriter{json.NewEncoder(w)} }))
+	checkGolden(t, "findings.csv.golden", renderRecords(t, func(w io.Writer) recordWriter { return &csvWriter{w: csv.NewWriter(w)} }))
+}
+
+func TestReportFormatsGolden(t *testing.T) {
+	got, err := renderJSONReport(fixtureReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "report.json.golden", got)
+	checkGolden(t, "report.md.golden", renderMarkdownReport(fixtureReport()))
+}
+
+func TestCEFGolden(t *testing.T) {
+	fixtureClock(t)
+	got := renderRecords(t, func(w io.Writer) recordWriter {
+		return &cefWriter{w: w, asnOf: func(string) int { return 64500 }}
+	})
+	// Characters CEF gives a meaning to, in both the header and the
+	// extension.
+	w := &cefWriter{w: bytes.NewBuffer(got)}
+	conf := 40
+	nasty := jsonlRecord{IP: "192.0.2.7", Prefix: "192.0.2.0/24", Status: StatusFound.String(), ASN: 64501, Country: "D=E",
+		Hostnames: []string{`pipe|equals=back\slash.example.`, "münchen.example.", "line\nbreak\r.example."}, Confidence: &conf}
+	if err := w.WriteRecord(nasty); err != nil {
+		t.Fatal(err)
+	}
+	got = w.w.(*bytes.Buffer).Bytes()
+	// The header carries the build's version, which differs between
+	// builds.
+	got = bytes.ReplaceAll(got, []byte("|"+cefHeader.Replace(toolVersion())+"|"), []byte("|VERSION|"))
+	checkGolden(t, "cef.golden", got)
+
+	lines := strings.Split(strings.TrimSuffix(string(got), "\n"), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("%d lines, want one per finding:\n%s", len(lines), got)
+	}
+	last := lines[len(lines)-1]
+	for _, want := range []string{`shost=pipe|equals\=back\\slash.example`, `cs4=D\=E`, `line\nbreak\r.example`, "cs1=64501"} {
+		if !strings.Contains(last, want) {
+			t.Errorf("%q does not contain %q", last, want)
+		}
+	}
+}
+
+func TestClientSendsAndRedactsAPIKey(t *testing.T) {
+	const key = "k-123-secret"
+	var auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		// A server echoing the credentials back in its error page.
+		http.Error(w, "upstream rejected "+r.Header.Get("Authorization"), http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	c := NewClient()
+	c.BaseURL = ts.URL
+	c.SetAPIKey(key)
+	_, err := c.SearchASNs(context.Background(), "example")
+	if auth != "Bearer "+key {
+		t.Errorf("Authorization header = %q, want the bearer key", auth)
+	}
+	if err == nil {
+		t.Fatal("SearchASNs succeeded against a 503")
+	}
+	if strings.Contains(err.Error(), key) || fmt.Sprintf("%+v", err) != err.Error() {
+		t.Errorf("error leaks the key: %v", err)
+	}
+	if !strings.Contains(err.Error(), "[redacted]") {
+		t.Errorf("error %q does not show the redaction", err)
+	}
+	var status *statusError
+	if !errors.As(err, &status) || status.code != http.StatusServiceUnavailable || !hardFailure(err) {
+		t.Errorf("redacted error lost its HTTP status: %#v", err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("api-key", "", "")
+	fs.Parse([]string{"-api-key", key})
+	m := newManifest(filepath.Join(t.TempDir(), "manifest.json"), fs)
+	if got := m.Flags["api-key"]; got != "[redacted]" {
+		t.Errorf("manifest records -api-key as %q", got)
+	}
+}
+
+// serveFile answers every request with testdata/path and HTTP 200, the way
+// bgpview sends its error envelopes.
+func serveFile(t *testing.T, path string) *httptest.Server {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestBGPViewErrorEnvelopes(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"bgpview/error_query_term.json", "API error: The query_term must be at least 3 characters."},
+		{"bgpview/error_maintenance.json", "API error: The API is currently under maintenance, please try again shortly."},
+		{"bgpview/error_malformed_input.json", "API error: Malformed input"},
+		{"bgpview/error_no_message.json", `API error: status "error"`},
+	}
+	for _, tt := range tests {
+		c := NewClient()
+		c.BaseURL = serveFile(t, tt.file).URL
+		c.limiter = nil
+		ctx := context.Background()
+
+		if asns, err := c.SearchASNs(ctx, "ex"); err == nil || err.Error() != tt.want {
+			t.Errorf("%s: SearchASNs = %v, %v; want error %q", tt.file, asns, err, tt.want)
+		}
+		if prefixes, err := c.ASNPrefixes(ctx, 64500); err == nil || err.Error() != tt.want {
+			t.Errorf("%s: ASNPrefixes = %v, %v; want error %q", tt.file, prefixes, err, tt.want)
+		}
+		if asn, _, err := c.IPOrigin(ctx, "192.0.2.1"); err == nil || err.Error() != tt.want {
+			t.Errorf("%s: IPOrigin = %v, %v; want error %q", tt.file, asn, err, tt.want)
+		}
+	}
+}
+
+func TestBGPViewErrorEnvelopeIsNotCached(t *testing.T) {
+	c := NewClient()
+	c.BaseURL = serveFile(t, "bgpview/error_maintenance.json").URL
+	c.Cache = &apiCache{dir: t.TempDir(), ttl: time.Hour}
+	if _, err := c.SearchASNs(context.Background(), "example"); err == nil {
+		t.Fatal("SearchASNs succeeded on an error envelope")
+	}
+	if e := c.Cache.load(c.endpoint("/search?query_term=example")); e != nil {
+		t.Errorf("error envelope was cached: %s", e.Body)
+	}
+}
+
+func TestSearchASNsDecodesCapturedResponse(t *testing.T) {
+	c := NewClient()
+	c.BaseURL = serveFile(t, "bgpview/search_ok.json").URL
+	asns, err := c.SearchASNs(context.Background(), "cloudflare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ASN{
+		{Number: 13335, Name: "CLOUDFLARENET", Description: "Cloudflare, Inc.", CountryCode: "US"},
+		{Number: 209242, Name: "CLOUDFLARESPECTRUM", Description: "Cloudflare London, LLC", CountryCode: "GB"},
+		{Number: 394536, Name: "CLOUDFLARE-MAGIC-TRANSIT"},
+	}
+	if len(asns) != len(want) {
+		t.Fatalf("got %d ASNs, want %d", len(asns), len(want))
+	}
+	for i, w := range want {
+		got := asns[i]
+		if got.Number != w.Number || got.Name != w.Name || got.Description != w.Description || got.CountryCode != w.CountryCode {
+			t.Errorf("ASN %d = %+v, want %+v", i, got, w)
+		}
+		if got.Source != sourceBGPView || got.RetrievedAt == nil {
+			t.Errorf("ASN %d provenance = %+v, want bgpview with a retrieval time", i, got.Provenance)
+		}
+	}
+}
+
+func TestSearchResponseRejectsChangedShape(t *testing.T) {
+	var resp SearchResponse
+	err := decodeBody([]byte(`{"status":"ok","data":{"asns":[{"asn":"13335","name":"X"}]}}`), &resp)
+	if err == nil {
+		t.Errorf("decoding an ASN number given as a string succeeded: %+v", resp)
+	}
+}
+
+func TestASNPrefixesDecodesMetadata(t *testing.T) {
+	c := NewClient()
+	c.BaseURL = serveFile(t, "bgpview/prefixes_ok.json").URL
+	prefixes, err := c.ASNPrefixes(context.Background(), 13335)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		p     Prefix
+		about string
+	}{
+		{Prefix{CIDR: "1.0.0.0/24", Name: "APNIC-LABS", Description: "APNIC and Cloudflare DNS Resolver project", CountryCode: "AU"}, "APNIC and Cloudflare DNS Resolver project [AU]"},
+		{Prefix{CIDR: "104.16.0.0/13", Name: "CLOUDFLARENET", Description: "Cloudflare, Inc.", CountryCode: "US"}, "Cloudflare, Inc. [US]"},
+		{Prefix{CIDR: "198.41.214.0/23"}, ""},
+		{Prefix{CIDR: "2606:4700::/32", Name: "CLOUDFLARENET", Description: "Cloudflare, Inc.", CountryCode: "US"}, "Cloudflare, Inc. [US]"},
+	}
+	if len(prefixes) != len(want) {
+		t.Fatalf("got %d prefixes, want %d", len(prefixes), len(want))
+	}
+	for i, w := range want {
+		got := prefixes[i]
+		got.Provenance = Provenance{}
+		if got != w.p {
+			t.Errorf("prefix %d = %+v, want %+v", i, got, w.p)
+		}
+		if about := got.About(); about != w.about {
+			t.Errorf("prefix %d About() = %q, want %q", i, about, w.about)
+		}
+	}
+	if prefixes[0].Source != sourceBGPView {
+		t.Errorf("prefix source = %q, want bgpview", prefixes[0].Source)
+	}
+}
+
+func TestPrefixAboutFallsBackToName(t *testing.T) {
+	if got := (Prefix{Name: "EXAMPLE-NET", Description: "  "}).About(); got != "EXAMPLE-NET" {
+		t.Errorf("About() = %q, want the name", got)
+	}
+}
+
+// testMMDB builds a reader over a one-node IPv4 tree whose two records are
+// left and right, followed by data.
+func testMMDB(left, right uint, data []byte) *mmdbReader {
+	buf := []byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)}
+	buf = append(buf, make([]byte, 16)...)
+	return &mmdbReader{buf: append(buf, data...), dataStart: len(buf), nodeCount: 1, recordSize: 24, ipVersion: 4}
+}
+
+func TestMMDBRejectsCorruptData(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		right uint
+		data  []byte
+	}{
+		// Records from node count+1 to node count+15 would point before
+		// the data section.
+		{"record into the separator", 1 + 5, []byte{0x42, 'D', 'E'}},
+		{"record past the data", 1 + 16 + 3, []byte{0x42, 'D', 'E'}},
+		{"pointer to itself", 1 + 16, []byte{0x20, 0x00}},
+		{"map larger than the file", 1 + 16, []byte{0xff, 0xff, 0xff, 0xff}},
+		{"array larger than the file", 1 + 16, []byte{0x1f, 0x04, 0xff, 0xff, 0xff}},
+	} {
+		r := testMMDB(1+16, tc.right, tc.data)
+		if v, err := r.lookup(net.ParseIP("192.0.2.1")); err == nil {
+			t.Errorf("%s: looked up %v, want an error", tc.name, v)
+		}
+	}
+
+	r := testMMDB(1+16, 1, []byte{0x42, 'D', 'E'})
+	if v, err := r.lookup(net.ParseIP("10.0.0.1")); v != "DE" || err != nil {
+		t.Errorf("valid record = %v, %v; want DE", v, err)
+	}
+	if v, err := r.lookup(net.ParseIP("192.0.2.1")); v != nil || err != nil {
+		t.Errorf("empty record = %v, %v; want nothing", v, err)
+	}
+}
+
+func TestReadIRRResponse(t *testing.T) {
+	for _, tc := range []struct {
+		file, want, err string
+	}{
+		{file: "as-example.txt", want: "AS64500 AS64501 AS-EXAMPLE-CUSTOMERS as64502\n"},
+		{file: "empty.txt"},
+		{file: "as-missing.txt", err: "object not found"},
+		{file: "error.txt", err: "IRR error: Unrecognized command"},
+		{file: "bad-trailer.txt", err: "malformed IRR response trailer"},
+		{file: "short.txt", err: "unexpected EOF"},
+	} {
+		f, err := os.Open(filepath.Join("testdata", "irr", tc.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readIRRResponse(bufio.NewReader(f))
+		f.Close()
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: error = %v, want %q", tc.file, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %q, %v, want %q", tc.file, got, err, tc.want)
+		}
+	}
+}
+
+// irrFixtures answers "!iSET" queries from testdata/irr/<set>.txt.
+func irrFixtures(t *testing.T) func(q string) (string, error) {
+	return func(q string) (string, error) {
+		set, ok := strings.CutPrefix(q, "!i")
+		if !ok {
+			t.Fatalf("unexpected IRR query %q", q)
+		}
+		f, err := os.Open(filepath.Join("testdata", "irr", strings.ToLower(set)+".txt"))
+		if err != nil {
+			return "", errIRRNotFound
+		}
+		defer f.Close()
+		return readIRRResponse(bufio.NewReader(f))
+	}
+}
+
+func TestExpandASSet(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		set               string
+		maxDepth, maxASNs int
+		want              []int
+	}{
+		// AS-EXAMPLE-CUSTOMERS lists AS-EXAMPLE again and a set that does
+		// not exist; both are skipped.
+		{name: "nested", set: "AS-EXAMPLE", maxDepth: 5, maxASNs: 100, want: []int{64500, 64501, 64502, 64503}},
+		{name: "lower case", set: "as-example", maxDepth: 5, maxASNs: 100, want: []int{64500, 64501, 64502, 64503}},
+		{name: "depth cap", set: "AS-EXAMPLE", maxDepth: 0, maxASNs: 100, want: []int{64500, 64501, 64502}},
+		{name: "size cap", set: "AS-EXAMPLE", maxDepth: 5, maxASNs: 2, want: []int{64500, 64501}},
+	} {
+		got, err := expandASSet(irrFixtures(t), tc.set, tc.maxDepth, tc.maxASNs)
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: got %v, %v, want %v", tc.name, got, err, tc.want)
+		}
+	}
+	if _, err := expandASSet(irrFixtures(t), "AS-MISSING", 5, 100); !errors.Is(err, errIRRNotFound) {
+		t.Errorf("missing top-level set: error = %v, want not found", err)
+	}
+}
+
+func TestClientUsesBaseURLAndHTTPClient(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.RequestURI())
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/mirror/search"):
+			io.WriteString(w, `{"status":"ok","data":{"asns":[{"asn":64500,"name":"EXAMPLE"}]}}`)
+		case strings.HasPrefix(r.URL.Path, "/mirror/asn/64500/prefixes"):
+			io.WriteString(w, `{"status":"ok","data":{"ipv4_prefixes":[{"prefix":"192.0.2.0/24"}],"ipv6_prefixes":[{"prefix":"2001:db8::/32"}]}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	var used bool
+	c := NewClient()
+	c.BaseURL = ts.URL + "/mirror/"
+	c.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		used = true
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	c.limiter = nil
+
+	ctx := context.Background()
+	asns, err := c.SearchASNs(ctx, "Example & Co")
+	if err != nil || len(asns) != 1 || asns[0].Number != 64500 {
+		t.Fatalf("SearchASNs = %+v, %v", asns, err)
+	}
+	prefixes, err := c.ASNPrefixes(ctx, 64500)
+	if err != nil || len(prefixes) != 2 || prefixes[0].CIDR != "192.0.2.0/24" || prefixes[1].CIDR != "2001:db8::/32" {
+		t.Fatalf("ASNPrefixes = %+v, %v", prefixes, err)
+	}
+	if !used {
+		t.Error("the injected HTTPClient was not used")
+	}
+	want := []string{"/mirror/search?query_term=Example+%26+Co", "/mirror/asn/64500/prefixes"}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("requested %v, want %v", paths, want)
+	}
+
+	_, err = c.ASNPrefixes(ctx, 64501)
+	var status *statusError
+	if !errors.As(err, &status) || status.code != http.StatusNotFound || hardFailure(err) {
+		t.Errorf("404 error = %v, want a statusError that is not a hard failure", err)
+	}
+}
+
+// TestAPICacheRevalidatesWithETag checks that a fresh entry is served
+// without a request, that a stale one is revalidated with If-None-Match and
+// kept on a 304, and that a changed response replaces it.
+func TestAPICacheRevalidatesWithETag(t *testing.T) {
+	version, asn := "v1", 64500
+	requests, conditional := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		etag := `"` + version + `"`
+		if r.Header.Get("If-None-Match") != "" {
+			conditional++
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, `{"status":"ok","data":{"asn":%d}}`, asn)
+	}))
+	defer ts.Close()
+	c := NewClient()
+	c.limiter = nil
+	c.Cache = &apiCache{dir: t.TempDir(), ttl: time.Hour}
+	ctx := context.Background()
+	get := func() int {
+		t.Helper()
+		var v struct {
+			Data struct {
+				ASN int `json:"asn"`
+			} `json:"data"`
+		}
+		if err := c.getJSON(ctx, ts.URL+"/asn", &v); err != nil {
+			t.Fatal(err)
+		}
+		return v.Data.ASN
+	}
+
+	if got := get(); got != 64500 || requests != 1 {
+		t.Fatalf("first lookup = AS%d after %d requests, want AS64500 after 1", got, requests)
+	}
+	if got := get(); got != 64500 || requests != 1 {
+		t.Errorf("fresh entry = AS%d after %d requests, want it served from the cache", got, requests)
+	}
+	c.Cache.ttl = 0
+	if got := get(); got != 64500 || requests != 2 || conditional != 1 {
+		t.Errorf("stale entry = AS%d after %d requests, %d conditional; want a 304 revalidation", got, requests, conditional)
+	}
+	version, asn = "v2", 64501
+	if got := get(); got != 64501 || requests != 3 {
+		t.Errorf("changed response = AS%d after %d requests, want AS64501", got, requests)
+	}
+	if got := get(); got != 64501 || conditional != 3 {
+		t.Errorf("after the change = AS%d with %d conditional requests, want the new ETag sent", got, conditional)
+	}
+}
+
+// TestAPICacheWithoutValidators checks that a response with neither an ETag
+// nor a Last-Modified date is fetched again in full once it is stale.
+func TestAPICacheWithoutValidators(t *testing.T) {
+	requests, conditional := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+			conditional++
+		}
+		fmt.Fprintf(w, `{"status":"ok","data":{"asn":%d}}`, 64499+requests)
+	}))
+	defer ts.Close()
+	c := NewClient()
+	c.limiter = nil
+	c.Cache = &apiCache{dir: t.TempDir(), ttl: time.Hour}
+	ctx := context.Background()
+	c.Cache.ttl = 0
+	for want := 64500; want < 64502; want++ {
+		var v struct {
+			Data struct {
+				ASN int `json:"asn"`
+			} `json:"data"`
+		}
+		if err := c.getJSON(ctx, ts.URL+"/asn", &v); err != nil || v.Data.ASN != want {
+			t.Errorf("lookup = AS%d, %v; want AS%d", v.Data.ASN, err, want)
+		}
+	}
+	if requests != 2 || conditional != 0 {
+		t.Errorf("%d requests, %d conditional; want 2 plain ones", requests, conditional)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// countingPTR answers NXDOMAIN after delay and records when each lookup
+// started. With cancelAfter set, it calls cancel once that many lookups ran.
+type countingPTR struct {
+	delay       time.Duration
+	cancelAfter int
+	cancel      context.CancelFunc
+
+	mu       sync.Mutex
+	started  []time.Time
+	cancelAt time.Time
+}
+
+func (p *countingPTR) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	p.mu.Lock()
+	p.started = append(p.started, time.Now())
+	if len(p.started) == p.cancelAfter {
+		p.cancelAt = time.Now()
+		p.cancel()
+	}
+	p.mu.Unlock()
+	select {
+	case <-time.After(p.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestCancelStopsNewLookups(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ptr := &countingPTR{delay: time.Millisecond, cancelAfter: 200, cancel: cancel}
+	sc := &scanner{ctx: ctx, ptr: ptr, workers: 8, countries: map[string]int{}}
+
+	done := make(chan struct{})
+	go func() {
+		sc.scan([]string{"10.0.0.0/16"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan kept running after its context was cancelled")
+	}
+
+	ptr.mu.Lock()
+	defer ptr.mu.Unlock()
+	if ptr.cancelAt.IsZero() {
+		t.Fatal("the scan never reached the cancellation point")
+	}
+	if since := time.Since(ptr.cancelAt); since > time.Second {
+		t.Errorf("scan returned %s after cancellation", since)
+	}
+	// A worker that had already checked the context may still be on its
+	// way into a lookup, but no more than one per worker.
+	late := 0
+	for _, at := range ptr.started {
+		if at.After(ptr.cancelAt) {
+			late++
+		}
+	}
+	if late > sc.workers {
+		t.Errorf("%d lookups started after the context was cancelled, want at most %d", late, sc.workers)
+	}
+}
+
+func TestDeadlineLetsInFlightLookupsFinish(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ptr := &countingPTR{delay: 300 * time.Millisecond}
+	sc := &scanner{ctx: ctx, ptr: ptr, workers: 4, countries: map[string]int{}}
+	var ips []string
+	for i := 1; i <= 20; i++ {
+		ips = append(ips, fmt.Sprintf("10.0.0.%d", i))
+	}
+
+	var got []LookupResult
+	for res := range sc.lookupAll(ips) {
+		got = append(got, res)
+	}
+	if len(got) != sc.workers {
+		t.Fatalf("got %d results, want the %d lookups under way at the deadline", len(got), sc.workers)
+	}
+	for _, res := range got {
+		if res.Status != StatusNXDomain {
+			t.Errorf("%s: status %s, want %s", res.IP, res.Status, StatusNXDomain)
+		}
+	}
+	ptr.mu.Lock()
+	defer ptr.mu.Unlock()
+	if len(ptr.started) != sc.workers {
+		t.Errorf("%d lookups started, want %d", len(ptr.started), sc.workers)
+	}
+}
+
+// recordingPTR answers NXDOMAIN and remembers every address asked about.
+type recordingPTR struct {
+	mu    sync.Mutex
+	asked map[string]int
+}
+
+func (p *recordingPTR) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	p.mu.Lock()
+	p.asked[addr]++
+	p.mu.Unlock()
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestShardsCoverEveryAddressOnce(t *testing.T) {
+	prefixes := []string{"10.0.0.0/16", "10.1.0.0/22", "10.2.0.0/30"}
+	var want uint64
+	for _, p := range prefixes {
+		_, first, last, err := hostRange(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want += last - first + 1
+	}
+
+	for _, count := range []int{1, 3, 5} {
+		owner := map[string]int{}
+		for index := 1; index <= count; index++ {
+			shard := shardSpec{Index: index, Count: count}
+			ptr := &recordingPTR{asked: map[string]int{}}
+			sc := &scanner{ctx: context.Background(), ptr: ptr, workers: 4, countries: map[string]int{}, shard: shard, silent: true}
+			captureStdout(t, func() { sc.scan(prefixes) })
+			if planned := shard.planned(prefixes, 0); planned != int64(len(ptr.asked)) {
+				t.Errorf("shard %s planned %d lookups but made %d", shard, planned, len(ptr.asked))
+			}
+			for ip, n := range ptr.asked {
+				if n > 1 {
+					t.Errorf("shard %s looked up %s %d times", shard, ip, n)
+				}
+				if other, dup := owner[ip]; dup {
+					t.Fatalf("%s was looked up by shards %d and %d of %d", ip, other, index, count)
+				}
+				owner[ip] = index
+			}
+		}
+		if uint64(len(owner)) != want {
+			t.Errorf("%d shards looked up %d addresses, want %d", count, len(owner), want)
+		}
+	}
+}
+
+// reverseZones answers for a delegated, an undelegated and a lame /24 and
+// for the single addresses of a sampled sweep: 192.0.2.0/24 has a PTR
+// record, 198.51.100.0/24 does not exist, and the nameservers of
+// 203.0.113.0/24 answer SERVFAIL for everything.
+func reverseZones(name string, qtype uint16) (int, []testRR) {
+	switch {
+	case strings.HasSuffix(name, "113.0.203.in-addr.arpa."):
+		return rcodeServFail, nil
+	case strings.HasSuffix(name, "100.51.198.in-addr.arpa."):
+		return rcodeNXDomain, nil
+	case name == "1.2.0.192.in-addr.arpa." && qtype == dnsTypePTR:
+		return rcodeNoError, []testRR{{Type: dnsTypePTR, TTL: 300, Name: "delegated.example."}}
+	case name == "2.0.192.in-addr.arpa." && qtype == dnsTypeSOA:
+		return rcodeNoError, nil
+	}
+	return rcodeNXDomain, nil
+}
+
+func TestSkipUndelegatedZones(t *testing.T) {
+	dns := startTestDNS(t, reverseZones)
+	raw := &rawResolver{addr: dns.addr, transport: transportAuto, timeout: time.Second}
+	sc := &scanner{ctx: context.Background(), ptr: raw, zoneProbe: raw, workers: 8, countries: map[string]int{}, silent: true}
+	var stats []*PrefixStats
+	captureStdout(t, func() { stats = sc.scan([]string{"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24"}) })
+
+	for _, tc := range []struct {
+		prefix, zone                      string
+		lookups, undeleg, found, servfail int
+	}{
+		{"192.0.2.0/24", "2.0.192.in-addr.arpa.", 254, 0, 1, 0},
+		{"198.51.100.0/24", "100.51.198.in-addr.arpa.", 0, 254, 0, 0},
+		{"203.0.113.0/24", "113.0.203.in-addr.arpa.", 254, 0, 0, 254},
+	} {
+		i := slices.IndexFunc(stats, func(s *PrefixStats) bool { return s.Prefix == tc.prefix })
+		if i < 0 {
+			t.Fatalf("no stats for %s", tc.prefix)
+		}
+		ps := stats[i]
+		if ps.Total != tc.lookups || ps.NotDelegated != tc.undeleg || ps.Counts[StatusFound] != tc.found || ps.Counts[StatusServFail] != tc.servfail {
+			t.Errorf("%s: %d lookups, %d not delegated, %d found, %d servfail; want %d, %d, %d, %d", ps.Prefix,
+				ps.Total, ps.NotDelegated, ps.Counts[StatusFound], ps.Counts[StatusServFail], tc.lookups, tc.undeleg, tc.found, tc.servfail)
+		}
+		if tc.undeleg > 0 && fmt.Sprint(ps.UndelegatedZones) != "["+tc.zone+"]" {
+			t.Errorf("%s: undelegated zones %v, want %s", ps.Prefix, ps.UndelegatedZones, tc.zone)
+		}
+		if n := dns.count(tc.zone); n != 1 {
+			t.Errorf("%s was probed %d times, want once", tc.zone, n)
+		}
+	}
+}
+
+func TestSkipUndelegatedProbesConcurrently(t *testing.T) {
+	dns := startTestDNS(t, ptrZone(nil))
+	dns.setDelay(50 * time.Millisecond)
+	raw := &rawResolver{addr: dns.addr, transport: transportAuto, timeout: time.Second}
+	sc := &scanner{ctx: context.Background(), ptr: raw, zoneProbe: raw, workers: 16, countries: map[string]int{}, silent: true}
+	ips, err := ipsInCIDR("10.0.0.0/20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := newPrefixStats("10.0.0.0/20", false)
+	start := time.Now()
+	pending := sc.skipUndelegated(ps, ips)
+	// One probe at a time would take 16 x 50ms.
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("probing 16 zones took %v", elapsed)
+	}
+	if len(pending) != 0 || len(ps.UndelegatedZones) != 16 {
+		t.Errorf("kept %d addresses and found %d undelegated zones, want 0 and 16", len(pending), len(ps.UndelegatedZones))
+	}
+}
+
+func TestSkipUndelegatedLeavesSampledZonesAlone(t *testing.T) {
+	dns := startTestDNS(t, reverseZones)
+	raw := &rawResolver{addr: dns.addr, transport: transportAuto, timeout: time.Second}
+	sc := &scanner{ctx: context.Background(), ptr: raw, zoneProbe: raw, workers: 8, countries: map[string]int{}, silent: true}
+	// A sampled sweep: a couple of addresses in each zone.
+	ps := newPrefixStats("198.51.100.0/24", true)
+	pending := sc.skipUndelegated(ps, []string{"198.51.100.7", "198.51.100.200", "2001:db8::1"})
+	if len(pending) != 3 || ps.NotDelegated != 0 {
+		t.Errorf("kept %v and skipped %d, want every address swept", pending, ps.NotDelegated)
+	}
+	if n := dns.count("100.51.198.in-addr.arpa."); n != 0 {
+		t.Errorf("a zone with two pending addresses was probed %d times", n)
+	}
+}
+
+func TestParseShard(t *testing.T) {
+	if s, err := parseShard("2/5"); err != nil || s != (shardSpec{Index: 2, Count: 5}) {
+		t.Errorf("parseShard(2/5) = %v, %v", s, err)
+	}
+	for _, bad := range []string{"", "2", "0/3", "4/3", "1/0", "a/b", "-1/2"} {
+		if _, err := parseShard(bad); err == nil {
+			t.Errorf("parseShard(%q) succeeded", bad)
+		}
+	}
+}
+
+// newTestController serves a fresh queue for prefixes with its state in
+// dir.
+func newTestController(t *testing.T, dir string, prefixes ...string) (*controller, *httptest.Server) {
+	t.Helper()
+	c := &controller{path: filepath.Join(dir, "queue.json"), token: "secret", lease: time.Minute,
+		state: newControllerState(prefixes), finished: make(chan struct{})}
+	var err error
+	if c.log, err = openFindingsLog(controllerFindingsPath(c.path)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.log.Close() })
+	srv := httptest.NewServer(c)
+	t.Cleanup(srv.Close)
+	return c, srv
+}
+
+// controllerCall POSTs in to the controller as agent name would.
+func controllerCall(t *testing.T, srv *httptest.Server, path string, in, out any) int {
+	t.Helper()
+	a := &agent{url: srv.URL, token: "secret", client: srv.Client()}
+	status, err := a.call(context.Background(), path, in, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestControllerRejectsResultsOfLostLeases(t *testing.T) {
+	c, srv := newTestController(t, t.TempDir(), "192.0.2.0/30")
+	var first, second ChunkLease
+	if status := controllerCall(t, srv, "/lease", map[string]string{"agent": "a"}, &first); status != http.StatusOK {
+		t.Fatalf("lease: HTTP %d", status)
+	}
+	// Agent a goes quiet, its lease runs out and b takes the chunk over.
+	c.mu.Lock()
+	expired := time.Now().Add(-time.Second)
+	c.state.Chunks[0].Expires = &expired
+	c.mu.Unlock()
+	if status := controllerCall(t, srv, "/lease", map[string]string{"agent": "b"}, &second); status != http.StatusOK || second.Chunk.ID != first.Chunk.ID {
+		t.Fatalf("second lease: HTTP %d for chunk %d", status, second.Chunk.ID)
+	}
+
+	result := func(l ChunkLease, agent, host string) int {
+		return controllerCall(t, srv, fmt.Sprintf("/chunks/%d/result", l.Chunk.ID), ChunkResult{Lease: l.Lease, Agent: agent,
+			Stats:    PrefixStats{Prefix: "192.0.2.0/30", Total: 2, Counts: [len(statusNames)]int{StatusFound: 1, StatusNXDomain: 1}},
+			Findings: []FindingRow{{IP: "192.0.2.1", Prefix: "192.0.2.0/30", Hostnames: []string{host}}}}, nil)
+	}
+	if status := result(first, "a", "stale.example."); status != http.StatusConflict {
+		t.Errorf("result under the expired lease: HTTP %d, want 409", status)
+	}
+	if status := result(second, "b", "fresh.example."); status != http.StatusOK {
+		t.Errorf("result under the current lease: HTTP %d", status)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f := c.state.Findings["192.0.2.1"]; fmt.Sprint(f.Hostnames) != "[fresh.example.]" {
+		t.Errorf("merged finding %+v, want the one of the current lease", f)
+	}
+	if ps := c.state.Stats["192.0.2.0/30"]; ps.Total != 2 {
+		t.Errorf("merged %d lookups, want 2", ps.Total)
+	}
+}
+
+func TestControllerAppendsFindingsToItsLog(t *testing.T) {
+	dir := t.TempDir()
+	c, srv := newTestController(t, dir, "192.0.2.0/30")
+	var l ChunkLease
+	controllerCall(t, srv, "/lease", map[string]string{"agent": "a"}, &l)
+	controllerCall(t, srv, fmt.Sprintf("/chunks/%d/result", l.Chunk.ID), ChunkResult{Lease: l.Lease, Agent: "a",
+		Stats: PrefixStats{Prefix: "192.0.2.0/30", Total: 2, Counts: [len(statusNames)]int{StatusFound: 2}},
+		Findings: []FindingRow{
+			{IP: "192.0.2.1", Prefix: "192.0.2.0/30", Hostnames: []string{"one.example."}},
+			{IP: "192.0.2.2", Prefix: "192.0.2.0/30", Hostnames: []string{"two.example."}},
+			{IP: "192.0.2.1", Prefix: "192.0.2.0/30", Hostnames: []string{"one.example."}},
+		}}, nil)
+
+	state, err := os.ReadFile(c.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(state, []byte("one.example.")) {
+		t.Errorf("the state file holds the findings:\n%s", state)
+	}
+	rows, err := readFindingsLog(controllerFindingsPath(c.path))
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("findings log: %v, %v", rows, err)
+	}
+
+	restarted := &controller{path: c.path}
+	if err := restarted.load(state); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.log.Close()
+	if len(restarted.state.Findings) != 2 || restarted.state.Chunks[0].Status != chunkDone {
+		t.Errorf("restarted with %d findings and chunk %s", len(restarted.state.Findings), restarted.state.Chunks[0].Status)
+	}
+}
+
+func TestControllerSavesOnlyStatusChanges(t *testing.T) {
+	c, srv := newTestController(t, t.TempDir(), "192.0.2.0/30")
+	var l ChunkLease
+	if status := controllerCall(t, srv, "/lease", map[string]string{"agent": "a"}, &l); status != http.StatusOK {
+		t.Fatalf("lease: HTTP %d", status)
+	}
+	leased, err := os.ReadFile(c.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if status := controllerCall(t, srv, fmt.Sprintf("/chunks/%d/renew", l.Chunk.ID), map[string]string{"lease": l.Lease}, nil); status != http.StatusOK {
+		t.Fatalf("renew: HTTP %d", status)
+	}
+	if state, _ := os.ReadFile(c.path); !bytes.Equal(state, leased) {
+		t.Errorf("the renewal rewrote the state file:\n%s\nwas\n%s", state, leased)
+	}
+
+	// A restarted controller gives the chunk a full lease, so its agent can
+	// keep renewing and report it.
+	restarted := &controller{path: c.path, lease: time.Minute}
+	if err := restarted.load(leased); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.log.Close()
+	ch := restarted.state.Chunks[l.Chunk.ID]
+	if ch.Status != chunkLeased || ch.Lease != l.Lease {
+		t.Fatalf("restarted with chunk %s under lease %q, want it leased under %q", ch.Status, ch.Lease, l.Lease)
+	}
+	if left := time.Until(*ch.Expires); left < 50*time.Second {
+		t.Errorf("restarted lease runs out in %s, want a full minute", left)
+	}
+}
+
+func TestControllerMigratesEmbeddedFindings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	st := newControllerState([]string{"192.0.2.0/30"})
+	st.Findings["192.0.2.1"] = FindingRow{IP: "192.0.2.1", Prefix: "192.0.2.0/30", Hostnames: []string{"old.example."}}
+	data, err := json.Marshal(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &controller{path: path}
+	if err := c.load(data); err != nil {
+		t.Fatal(err)
+	}
+	defer c.log.Close()
+	if _, ok := c.state.Findings["192.0.2.1"]; !ok {
+		t.Error("the embedded finding was lost")
+	}
+	if rows, err := readFindingsLog(controllerFindingsPath(path)); err != nil || len(rows) != 1 {
+		t.Errorf("findings log after migration: %v, %v", rows, err)
+	}
+	if state, _ := os.ReadFile(path); bytes.Contains(state, []byte("old.example.")) {
+		t.Error("the migrated state file still embeds the findings")
+	}
+}
+
+// flakyPTR times out the first lookup of every address and answers the
+// next from names.
+type flakyPTR struct {
+	mu    sync.Mutex
+	seen  map[string]bool
+	names staticPTR
+}
+
+func (p *flakyPTR) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	p.mu.Lock()
+	again := p.seen[addr]
+	p.seen[addr] = true
+	p.mu.Unlock()
+	if !again {
+		return nil, &net.DNSError{Err: "i/o timeout", Name: addr, IsTimeout: true}
+	}
+	return p.names.LookupAddr(ctx, addr)
+}
+
+func TestAgentRetriesFailedLookupsBeforeReporting(t *testing.T) {
+	ptr := &flakyPTR{seen: map[string]bool{}, names: staticPTR{"192.0.2.1": {"late.example."}}}
+	a := &agent{retryPasses: 1, sc: &scanner{ctx: context.Background(), ptr: ptr, workers: 2, countries: map[string]int{}, silent: true}}
+	var res *ChunkResult
+	captureStdout(t, func() {
+		res = a.work(context.Background(), ChunkLease{Lease: "l", Chunk: WorkChunk{Prefix: "192.0.2.0/30"}, Seconds: 60})
+	})
+	if res == nil {
+		t.Fatal("the chunk was not reported")
+	}
+	if res.Stats.Counts[StatusTimeout] != 0 || res.Stats.Counts[StatusFound] != 1 || res.Stats.Counts[StatusNXDomain] != 1 {
+		t.Errorf("reported counts %v, want the retried outcomes", res.Stats.Counts)
+	}
+	if len(res.Findings) != 1 || res.Findings[0].IP != "192.0.2.1" || !res.Findings[0].Retried {
+		t.Errorf("reported findings %+v", res.Findings)
+	}
+}
+
+func TestPromptReadsPipedLines(t *testing.T) {
+	saved := stdin
+	defer func() { stdin = saved }()
+	stdin = bufio.NewReader(strings.NewReader("  Example Corp \n\n2,3\nlast"))
+
+	for _, want := range []string{"Example Corp", "", "2,3", "last"} {
+		got, err := prompt("")
+		if err != nil || got != want {
+			t.Fatalf("prompt() = %q, %v; want %q", got, err, want)
+		}
+	}
+	if got, err := prompt(""); err != io.EOF {
+		t.Errorf("prompt() at end of input = %q, %v; want io.EOF", got, err)
+	}
+}
+
+// TestMainProcess runs main with the arguments in RECON_TEST_ARGS when
+// started by runMain, and is skipped otherwise.
+func TestMainProcess(t *testing.T) {
+	args := os.Getenv("RECON_TEST_ARGS")
+	if args == "" {
+		t.Skip("only run as a subprocess of runMain")
+	}
+	os.Args = append([]string{"asn-lookup"}, strings.Split(args, "\n")...)
+	main()
+	os.Exit(0)
+}
+
+// runMain runs the program in a subprocess with input piped to its
+// standard input and returns everything it printed.
+func runMain(t *testing.T, input string, args ...string) (string, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainProcess$")
+	cmd.Env = append(os.Environ(), "RECON_TEST_ARGS="+strings.Join(args, "\n"))
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestPipedInteractiveSession(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/search"):
+			io.WriteString(w, `{"status":"ok","data":{"asns":[{"asn":64500,"name":"EXAMPLE-A"},{"asn":64501,"name":"EXAMPLE-B"}]}}`)
+		case r.URL.Path == "/asn/64501/prefixes":
+			io.WriteString(w, `{"status":"ok","data":{"ipv4_prefixes":[{"prefix":"192.0.2.0/30","description":"Example B"}],"ipv6_prefixes":[]}}`)
+		default:
+			http.Error(w, "unexpected "+r.URL.Path, http.StatusNotFound)
+		}
+	}))
+	defer api.Close()
+	dns := startTestDNS(t, ptrZone(map[string][]string{"192.0.2.2": {"piped.example."}}))
+
+	out, err := runMain(t, "Example\n2\n\n", "-api-url", api.URL, "-resolver", dns.addr, "-allow-reserved", "-quiet", "-skip-healthcheck")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	for _, want := range []string{"EXAMPLE-B", "192.0.2.2 -> piped.example."} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "192.0.2.0/24") {
+		t.Errorf("the ASN selection was not read from the piped input:\n%s", out)
+	}
+}
+
+func TestDownstreamsKeepSelectedPrefixes(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/search"):
+			io.WriteString(w, `{"status":"ok","data":{"asns":[{"asn":64500,"name":"EXAMPLE-A"},{"asn":64501,"name":"EXAMPLE-B"}]}}`)
+		case r.URL.Path == "/asn/64500/prefixes":
+			io.WriteString(w, `{"status":"ok","data":{"ipv4_prefixes":[{"prefix":"192.0.2.0/30"}],"ipv6_prefixes":[]}}`)
+		case r.URL.Path == "/asn/64500/downstreams":
+			io.WriteString(w, `{"status":"ok","data":{"ipv4_downstreams":[{"asn":64510,"name":"EXAMPLE-CUSTOMER"}],"ipv6_downstreams":[]}}`)
+		case r.URL.Path == "/asn/64510/prefixes":
+			// A covering announcement of the selected prefix.
+			io.WriteString(w, `{"status":"ok","data":{"ipv4_prefixes":[{"prefix":"192.0.2.0/29"}],"ipv6_prefixes":[]}}`)
+		default:
+			http.Error(w, "unexpected "+r.URL.Path, http.StatusNotFound)
+		}
+	}))
+	defer api.Close()
+	dns := startTestDNS(t, ptrZone(map[string][]string{"192.0.2.1": {"selected.example."}, "192.0.2.5": {"customer.example."}}))
+	report := filepath.Join(t.TempDir(), "report.json")
+
+	out, err := runMain(t, "Example\n1\ny\n\n", "-api-url", api.URL, "-resolver", dns.addr, "-allow-reserved", "-quiet", "-skip-healthcheck",
+		"-include-downstreams", "-o", report)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep Report
+	if err := json.Unmarshal(data, &rep); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]FindingRow{}
+	for _, f := range rep.Findings {
+		got[f.IP] = f
+	}
+	if f := got["192.0.2.1"]; f.Prefix != "192.0.2.0/30" || f.ASN != 64500 || f.ScopePath != nil {
+		t.Errorf("selected finding %+v, want it under 192.0.2.0/30 of AS64500 without a scope path", f)
+	}
+	if f := got["192.0.2.5"]; f.Prefix != "192.0.2.4/30" || f.ASN != 64510 || fmt.Sprint(f.ScopePath) != "[64500 64510]" {
+		t.Errorf("downstream finding %+v, want it under 192.0.2.4/30 of AS64510 by way of AS64500", f)
+	}
+}
+
+func TestDownstreamsNeedAnOrganizationSearch(t *testing.T) {
+	for _, args := range [][]string{
+		{"-include-downstreams", "-ip", "192.0.2.1"},
+		{"-include-downstreams", "-as-set", "AS-EXAMPLE"},
+		{"-include-downstreams", "-org-file", "orgs.txt"},
+	} {
+		out, err := runMain(t, "", append(args, "-skip-healthcheck")...)
+		if err == nil || !strings.Contains(out, "-include-downstreams works with an organization search only") {
+			t.Errorf("%v: %v\n%s", args, err, out)
+		}
+	}
+	out, err := runMain(t, "192.0.2.0/30\n", "-include-downstreams", "-skip-healthcheck")
+	if err == nil || !strings.Contains(out, "not with addresses") {
+		t.Errorf("typed addresses: %v\n%s", err, out)
+	}
+}
+
+func TestPipedInputEndingEarly(t *testing.T) {
+	out, err := runMain(t, "", "-api-url", "http://127.0.0.1:1", "-skip-healthcheck")
+	if err == nil || !strings.Contains(out, "input ended before an answer was given") {
+		t.Errorf("empty input: %v\n%s", err, out)
+	}
+}
+
+func TestKilledScanKeepsReportedResults(t *testing.T) {
+	dns := startTestDNS(t, func(name string, qtype uint16) (int, []testRR) {
+		return rcodeNoError, []testRR{{Type: dnsTypePTR, TTL: 60, Name: "host.example."}}
+	})
+	dns.setDelay(20 * time.Millisecond)
+	jsonl := filepath.Join(t.TempDir(), "results.jsonl")
+
+	args := []string{"-ip", "192.0.2.0/24", "-resolver", dns.addr, "-jsonl", jsonl,
+		"-allow-reserved", "-quiet", "-skip-healthcheck", "-probe-zones=false"}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainProcess$")
+	cmd.Env = append(os.Environ(), "RECON_TEST_ARGS="+strings.Join(args, "\n"))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var reported []string
+	lines := bufio.NewScanner(stdout)
+	for len(reported) < 10 && lines.Scan() {
+		_, found, _ := strings.Cut(lines.Text(), Blue+"[+] ")
+		if ip, _, ok := strings.Cut(found, " -> "); ok {
+			reported = append(reported, ip)
+		}
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	if len(reported) < 10 {
+		t.Fatalf("the scan reported %d results before it ended", len(reported))
+	}
+
+	data, err := os.ReadFile(jsonl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec struct{ IP string }
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		written[rec.IP] = true
+	}
+	for _, ip := range reported {
+		if !written[ip] {
+			t.Errorf("%s was reported before the kill but is not in %s", ip, jsonl)
+		}
+	}
+}
+
+// benchmarkLookups resolves b.N addresses of 10.0.0.0/8 through ptr, 64 at a
+// time, against a server answering after a millisecond.
+func benchmarkLookups(b *testing.B, newPTR func(addr string) PTRLookuper) {
+	dns := startTestDNS(b, func(name string, qtype uint16) (int, []testRR) {
+		return rcodeNoError, []testRR{{Type: dnsTypePTR, TTL: 60, Name: "host.example."}}
+	})
+	dns.setDelay(time.Millisecond)
+	ptr := newPTR(dns.addr)
+	ctx := context.Background()
+
+	var next atomic.Uint32
+	b.SetParallelism(64 / runtime.GOMAXPROCS(0))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		ip := make(net.IP, 4)
+		for pb.Next() {
+			binary.BigEndian.PutUint32(ip, 10<<24|next.Add(1)&0xffffff)
+			if res := lookupWith(ctx, ptr, ip.String()); res.Status != StatusFound {
+				b.Errorf("%s: %v", ip, res.Err)
+			}
+		}
+	})
+}
+
+func BenchmarkLookupStandard(b *testing.B) {
+	benchmarkLookups(b, func(addr string) PTRLookuper { return customResolver(addr, transportAuto) })
+}
+
+func BenchmarkLookupPipelined(b *testing.B) {
+	benchmarkLookups(b, func(addr string) PTRLookuper {
+		p, err := newPipelinedResolver(addr, 2, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return p
+	})
+}
+
+func FuzzIpsInCIDR(f *testing.F) {
+	f.Add("192.0.2.0/24")
+	f.Fuzz(func(t *testing.T, cidr string) {
+		// Big prefixes are legal but too slow to list on every input.
+		if size, err := prefixSize(cidr); err != nil || size > 1<<16 {
+			return
+		}
+		ips, err := ipsInCIDR(cidr)
+		if err != nil {
+			return
+		}
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		size, _ := prefixSize(cidr)
+		if uint64(len(ips)) != size {
+			t.Fatalf("%s: %d addresses, want %d", cidr, len(ips), size)
+		}
+		var prev net.IP
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			if ip == nil || !ipnet.Contains(ip) {
+				t.Fatalf("%s: %q is outside the prefix", cidr, s)
+			}
+			if prev != nil && bytes.Compare(prev.To16(), ip.To16()) >= 0 {
+				t.Fatalf("%s: %s does not follow %s", cidr, ip, prev)
+			}
+			prev = ip
+		}
+	})
+}
+
+// FuzzHostRange stands in for the old incIP walk: hostRange is what turns
+// a prefix into the interval the scan steps through.
+func FuzzHostRange(f *testing.F) {
+	f.Add("192.0.2.0/24")
+	f.Fuzz(func(t *testing.T, cidr string) {
+		base, first, last, err := hostRange(cidr)
+		if err != nil {
+			return
+		}
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		size, _ := prefixSize(cidr)
+		if first > last || last > math.MaxUint32 || last-first+1 != size {
+			t.Fatalf("%s: range [%d, %d], want %d addresses within 32 bits", cidr, first, last, size)
+		}
+		for _, n := range []uint64{first, last} {
+			ips := ipsInRange(base, n, n)
+			if ip := net.ParseIP(ips[0]); ip == nil || !ipnet.Contains(ip) {
+				t.Fatalf("%s: bound %s is outside the prefix", cidr, ips[0])
+			}
+		}
+		// The edges stay put when the prefix is given in canonical form.
+		// An IPv4-mapped prefix such as ::ffff:192.0.2.0/120 prints as a
+		// /24, which is an IPv4 prefix with its edges cut off.
+		canonical := ipnet.String()
+		if _, again, _ := net.ParseCIDR(canonical); len(again.Mask) != len(ipnet.Mask) {
+			return
+		}
+		base2, first2, last2, err := hostRange(canonical)
+		if err != nil || !base.Equal(base2) || first2 != first || last2 != last {
+			t.Fatalf("%s and %s walk different ranges", cidr, ipnet)
+		}
+	})
+}
+
+func FuzzParseTargets(f *testing.F) {
+	for _, seed := range []string{"192.0.2.1", "192.0.2.0/24, 2001:db8::/120", "example corp", "10.0.0.1\t::1", ",,"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		prefixes, ok := parseTargets(input)
+		if !ok {
+			return
+		}
+		for _, p := range prefixes {
+			if _, ipnet, err := net.ParseCIDR(p); err != nil || ipnet.String() != p {
+				t.Fatalf("%q: target %q is not a canonical prefix", input, p)
+			}
+		}
+		again, ok := parseTargets(strings.Join(prefixes, ","))
+		if !ok || !slices.Equal(again, prefixes) {
+			t.Fatalf("%q: %v reparses as %v", input, prefixes, again)
+		}
+	})
+}
+
+func FuzzSelectionRange(f *testing.F) {
+	for _, seed := range []struct {
+		spec string
+		max  int
+	}{{"1", 1}, {"10-20,45", 50}, {"3-1", 5}, {" 2 , 2-4 ", 4}, {"0", 3}, {"-", 3}} {
+		f.Add(seed.spec, seed.max)
+	}
+	f.Fuzz(func(t *testing.T, spec string, max int) {
+		// Bound the list so a huge range stays quick to expand.
+		max = int(uint(max) % 1000)
+		picked, err := parseSelection(spec, max)
+		if err != nil {
+			return
+		}
+		seen := map[int]bool{}
+		parts := make([]string, len(picked))
+		for i, n := range picked {
+			if n < 1 || n > max || seen[n] {
+				t.Fatalf("%q against %d: picked %v", spec, max, picked)
+			}
+			seen[n] = true
+			parts[i] = strconv.Itoa(n)
+		}
+		again, err := parseSelection(strings.Join(parts, ","), max)
+		if err != nil || !slices.Equal(again, picked) {
+			t.Fatalf("%q against %d: %v reparses as %v, %v", spec, max, picked, again, err)
+		}
+	})
+}
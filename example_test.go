@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+)
+
+// A consumer that keeps only the hostnames under one domain. Findings
+// arrive while the sweep runs; the error channel is read once they are
+// drained.
+func Example_run() {
+	sc := &scanner{
+		ptr: staticPTR{
+			"192.0.2.1": {"web.example.com."},
+			"192.0.2.2": {"pool-2.isp.example.net."},
+			"192.0.2.3": {"mail.example.com."},
+		},
+		workers:   2,
+		countries: map[string]int{},
+		silent:    true,
+	}
+	stored := map[string]string{}
+	findings, errs := sc.Run(context.Background(), []string{"192.0.2.0/29", "not-a-prefix"})
+	for f := range findings {
+		if strings.HasSuffix(f.Hostnames[0], ".example.com.") {
+			stored[f.IP] = f.Hostnames[0]
+		}
+	}
+	for err := range errs {
+		fmt.Println("error:", err)
+	}
+	ips := make([]string, 0, len(stored))
+	for ip := range stored {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		fmt.Println(ip, stored[ip])
+	}
+	// Output:
+	// error: failed to parse CIDR not-a-prefix: invalid CIDR address: not-a-prefix
+	// 192.0.2.1 web.example.com.
+	// 192.0.2.3 mail.example.com.
+}
+
+// exampleAPI stands in for the bgpview API.
+func exampleAPI() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/search":
+			io.WriteString(w, `{"status":"ok","data":{"asns":[{"asn":64500,"name":"EXAMPLE-NET","description":"Example Corp","country_code":"DE"}]}}`)
+		case "/asn/64500/prefixes":
+			io.WriteString(w, `{"status":"ok","data":{"ipv4_prefixes":[{"prefix":"198.51.100.0/24","name":"EXAMPLE-1"}],"ipv6_prefixes":[]}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func ExampleClient_SearchASNs() {
+	srv := exampleAPI()
+	defer srv.Close()
+
+	api := NewClient()
+	api.BaseURL = srv.URL
+	asns, err := api.SearchASNs(context.Background(), "Example")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, a := range asns {
+		fmt.Printf("AS%d %s (%s)\n", a.Number, a.Name, a.CountryCode)
+	}
+	// Output:
+	// AS64500 EXAMPLE-NET (DE)
+}
+
+func ExampleResolveOrgs() {
+	srv := exampleAPI()
+	defer srv.Close()
+
+	api := NewClient()
+	api.BaseURL = srv.URL
+	results, err := ResolveOrgs(context.Background(), []string{"Example"}, Options{Client: api})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	res := results["Example"]
+	for _, p := range res.Prefixes {
+		fmt.Printf("%s announced by AS%d\n", p.CIDR, res.Origin[p.CIDR])
+	}
+	// Output:
+	// 198.51.100.0/24 announced by AS64500
+}